@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Env var with the identity file for decrypting .age configs, if the
+// -age-identity flag is not given.
+const ageIdentityEnv = "BACKUP_HELPER_AGE_IDENTITY"
+
+// Set from the -age-identity flag
+var ageIdentity string
+
+// Decrypts the file with the age CLI, keeping the plaintext in memory. Without
+// an identity file, age prompts for the passphrase on the terminal.
+func decryptAge(path string) ([]byte, error) {
+	identity := ageIdentity
+	if identity == "" {
+		identity = os.Getenv(ageIdentityEnv)
+	}
+	args := []string{"-d"}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	args = append(args, path)
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, &stdout, os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt with age: %w", err)
+	}
+	logger.Debug("config decrypted", "file", path, "identity", identity)
+	return stdout.Bytes(), nil
+}
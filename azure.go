@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// For out folders given as azure://container/prefix, as block blobs.
+type azureConfig struct {
+	// Default $AZURE_STORAGE_ACCOUNT
+	Account string
+	// Shared Key auth with the account key (default $AZURE_STORAGE_KEY), or
+	// else a SAS token (default $AZURE_STORAGE_SAS_TOKEN). The key may be a
+	// secret reference, or given as a command or OS keyring entry instead (as
+	// for MailPass).
+	AccountKey        string
+	AccountKeyCommand []string
+	AccountKeyKeyring *keyringRef
+	SASToken          string
+
+	// Default https://<Account>.blob.core.windows.net - e.g.
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	Endpoint string
+	// Files bigger than this are uploaded in blocks of this size (default 64,
+	// at most 4000).
+	BlockSizeMB int
+	// Hot, Cool or Cold. Default the account's.
+	AccessTier string
+}
+
+const azureScheme = "azure://"
+
+const azureVersion = "2021-12-02"
+
+func validateAzure(c *config) error {
+	if c.Azure.BlockSizeMB < 0 || c.Azure.BlockSizeMB > 4000 {
+		return fmt.Errorf("Azure BlockSizeMB must be between 1 and 4000, not %d", c.Azure.BlockSizeMB)
+	}
+	switch c.Azure.AccessTier {
+	case "", "Hot", "Cool", "Cold":
+	case "Archive":
+		return errors.New("Azure AccessTier can't be Archive, since the index (and test object) must be readable")
+	default:
+		return fmt.Errorf("Azure AccessTier must be Hot, Cool or Cold, not %q", c.Azure.AccessTier)
+	}
+	return nil
+}
+
+type azureStore struct {
+	container string
+	prefix    string // Ends with / (or is blank)
+
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	sas       url.Values
+	blockSize int64
+
+	// From the container's properties, on first use
+	checked          bool
+	versionImmutable bool
+}
+
+// The store for out, if it is an azure:// URL.
+func azureDestination(out string) (*azureStore, bool, error) {
+	rest, ok := strings.CutPrefix(out, azureScheme)
+	if !ok {
+		return nil, false, nil
+	}
+	container, prefix, _ := strings.Cut(rest, "/")
+	if container == "" {
+		return nil, true, fmt.Errorf("no container in %s", out)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s := &azureStore{
+		container: container,
+		prefix:    prefix,
+		account:   firstNonEmpty(cfg.Azure.Account, os.Getenv("AZURE_STORAGE_ACCOUNT")),
+		blockSize: int64(cfg.Azure.BlockSizeMB) << 20,
+	}
+	if s.blockSize == 0 {
+		s.blockSize = 64 << 20
+	}
+	if s.account == "" {
+		return nil, true, errors.New("no Azure storage account: set the Azure Account config, or the AZURE_STORAGE_ACCOUNT env var")
+	}
+	if key := firstNonEmpty(cfg.Azure.AccountKey, os.Getenv("AZURE_STORAGE_KEY")); key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid Azure AccountKey (not base64): %w", err)
+		}
+		s.key = b
+	} else if sas := firstNonEmpty(cfg.Azure.SASToken, os.Getenv("AZURE_STORAGE_SAS_TOKEN")); sas != "" {
+		q, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid Azure SASToken: %w", err)
+		}
+		s.sas = q
+	} else {
+		return nil, true, errors.New("no Azure credentials: set the Azure AccountKey or SASToken config, or the AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN env vars")
+	}
+	endpoint := firstNonEmpty(cfg.Azure.Endpoint, fmt.Sprintf("https://%s.blob.core.windows.net", s.account))
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, true, fmt.Errorf("invalid Azure Endpoint %q", endpoint)
+	}
+	s.endpoint = u
+	return s, true, nil
+}
+
+func (s *azureStore) String() string {
+	return azureScheme + s.container + "/" + s.prefix
+}
+
+type azureError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, strings.TrimSpace(strings.SplitN(e.Message, "\n", 2)[0]))
+}
+
+// Sends the signed request for the key (under the prefix - or for the
+// container itself, if blank), failing on a non-2xx status.
+func (s *azureStore) do(method string, key string, query url.Values, headers map[string]string, body io.ReaderAt, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.container
+	if key != "" {
+		u.Path += "/" + s.prefix + key
+	}
+	u.RawPath = ""
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	var rd io.Reader
+	if body != nil {
+		rd = io.NewSectionReader(body, 0, size)
+	}
+	req, err := http.NewRequestWithContext(runCtx, method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	if s.key != nil {
+		s.sign(req, query)
+	}
+
+	logger.Debug("azure request", "method", method, "url", strings.SplitN(u.String(), "?", 2)[0])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &azureError{Status: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code")}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(b, e)
+		if e.Code == "" {
+			e.Code, e.Message = "error", resp.Status
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, u.Path, e)
+	}
+	return resp, nil
+}
+
+// Signs the request with the account key, as per Shared Key authorization.
+func (s *azureStore) sign(req *http.Request, query url.Values) {
+	h := req.Header
+	length := ""
+	if req.ContentLength > 0 {
+		length = fmt.Sprint(req.ContentLength)
+	}
+	var msHeaders []string
+	for k := range h {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk+":"+strings.TrimSpace(h.Get(k)))
+		}
+	}
+	sort.Strings(msHeaders)
+	resource := "/" + s.account + req.URL.EscapedPath()
+	var params []string
+	for k, v := range query {
+		vals := append([]string{}, v...)
+		sort.Strings(vals)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(vals, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+	toSign := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date, since x-ms-date is set
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(toSign))
+	h.Set("Authorization", "SharedKey "+s.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// Checks the container's immutability on first use. With a legal hold or
+// container-level policy, nothing (including the index) could be overwritten,
+// so it can't be mirrored to. With version-level immutability, only blobs
+// under a policy are kept.
+func (s *azureStore) checkContainer() error {
+	if s.checked {
+		return nil
+	}
+	resp, err := s.do(http.MethodGet, "", url.Values{"restype": {"container"}}, nil, nil, 0)
+	if err != nil {
+		return fmt.Errorf("could not get container properties: %w", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("x-ms-has-legal-hold") == "true" {
+		return fmt.Errorf("container %s has a legal hold, so its blobs can't be overwritten (use another container)", s.container)
+	}
+	if resp.Header.Get("x-ms-has-immutability-policy") == "true" {
+		return fmt.Errorf("container %s has an immutability policy, so its blobs can't be overwritten (use another container, or version-level immutability)", s.container)
+	}
+	s.versionImmutable = resp.Header.Get("x-ms-immutable-storage-with-versioning-enabled") == "true"
+	s.checked = true
+	logger.Debug("azure container checked", "container", s.container, "versionImmutable", s.versionImmutable)
+	return nil
+}
+
+// For the report.
+func (s *azureStore) notes() []string {
+	if !s.versionImmutable {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: version-level immutability is enabled, so blobs under a retention policy (or legal hold) are kept, rather than deleted", s)}
+}
+
+type azureList struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string
+			Properties struct {
+				ContentLength int64 `xml:"Content-Length"`
+			}
+		}
+	}
+	NextMarker string
+}
+
+func (s *azureStore) list() (map[string]storedObject, error) {
+	err := s.checkContainer()
+	if err != nil {
+		return nil, err
+	}
+	objs := map[string]storedObject{}
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := s.do(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var res azureList
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse blob list: %w", err)
+		}
+		for _, b := range res.Blobs.Blob {
+			objs[strings.TrimPrefix(b.Name, s.prefix)] = storedObject{Size: b.Properties.ContentLength}
+		}
+		if res.NextMarker == "" {
+			return objs, nil
+		}
+		marker = res.NextMarker
+	}
+}
+
+// As a block blob, with Azure checking the MD5 of the whole blob (or of each
+// block, for big files - with the whole blob's MD5 then stored too).
+func (s *azureStore) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	err := s.checkContainer()
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	_, err = io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return fmt.Errorf("could not hash: %w", err)
+	}
+	md5Sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	headers := map[string]string{"x-ms-meta-sha256": hex.EncodeToString(sum)}
+	if cfg.Azure.AccessTier != "" {
+		headers["x-ms-access-tier"] = cfg.Azure.AccessTier
+	}
+	if size > s.blockSize {
+		err = s.putBlocks(key, r, size, md5Sum, headers)
+	} else {
+		headers["x-ms-blob-type"] = "BlockBlob"
+		headers["Content-MD5"] = md5Sum
+		var resp *http.Response
+		resp, err = s.do(http.MethodPut, key, nil, headers, r, size)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if isAzureImmutable(err) {
+		return fmt.Errorf("can't be overwritten, since it is under a retention policy or legal hold: %w", err)
+	}
+	return err
+}
+
+func (s *azureStore) putBlocks(key string, r io.ReaderAt, size int64, md5Sum string, headers map[string]string) error {
+	var ids []string
+	for off, n := int64(0), 0; off < size; off, n = off+s.blockSize, n+1 {
+		blockLen := min(s.blockSize, size-off)
+		h := md5.New()
+		_, err := io.Copy(h, io.NewSectionReader(r, off, blockLen))
+		if err != nil {
+			return fmt.Errorf("could not hash block %d: %w", n, err)
+		}
+		// Block IDs must all be the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+		resp, err := s.do(http.MethodPut, key, url.Values{"comp": {"block"}, "blockid": {id}},
+			map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(h.Sum(nil))},
+			io.NewSectionReader(r, off, blockLen), blockLen)
+		if err != nil {
+			return fmt.Errorf("could not upload block %d: %w", n, err)
+		}
+		resp.Body.Close()
+		ids = append(ids, id)
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids})
+	if err != nil {
+		return fmt.Errorf("could not marshal block list: %w", err)
+	}
+	headers["x-ms-blob-content-md5"] = md5Sum
+	headers["Content-Type"] = "application/xml"
+	resp, err := s.do(http.MethodPut, key, url.Values{"comp": {"blocklist"}}, headers, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return fmt.Errorf("could not commit block list: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *azureStore) get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Blobs under a retention policy or legal hold are kept, rather than failing
+// the sync.
+func (s *azureStore) delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, map[string]string{"x-ms-delete-snapshots": "include"}, nil, 0)
+	if isAzureImmutable(err) {
+		return fmt.Errorf("%w: it is under a retention policy or legal hold", errObjectKept)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Whether the request failed since the blob is under an immutability policy
+// or legal hold.
+func isAzureImmutable(err error) bool {
+	var aErr *azureError
+	return errors.As(err, &aErr) && strings.HasPrefix(aErr.Code, "BlobImmutable")
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// For out folders given as b2://bucket/prefix, via the native B2 API.
+type b2Config struct {
+	// Default $B2_APPLICATION_KEY_ID and $B2_APPLICATION_KEY. The key may be a
+	// secret reference, or given as a command or OS keyring entry instead (as
+	// for MailPass).
+	KeyID                 string
+	ApplicationKey        string
+	ApplicationKeyCommand []string
+	ApplicationKeyKeyring *keyringRef
+
+	// Files bigger than this are uploaded as large files, in parts of this
+	// size (default B2's recommended size, at least 5).
+	PartSizeMB int
+
+	// Default https://api.backblazeb2.com/b2api/v2/b2_authorize_account
+	AuthURL string
+}
+
+const b2Scheme = "b2://"
+
+func validateB2(c *config) error {
+	if c.B2.PartSizeMB != 0 && (c.B2.PartSizeMB < 5 || c.B2.PartSizeMB > 5120) {
+		return fmt.Errorf("B2 PartSizeMB must be between 5 and 5120, not %d", c.B2.PartSizeMB)
+	}
+	return nil
+}
+
+type b2Store struct {
+	bucket string
+	prefix string // Ends with / (or is blank)
+	keyID  string
+	key    string
+
+	// Set once authorized
+	apiURL      string
+	downloadURL string
+	token       string
+	bucketID    string
+	partSize    int64
+	upload      *b2UploadURL // Reused until it fails
+	// A lifecycle rule deletes hidden versions under the prefix, so a
+	// delete only hides (and old versions are left to the rule)
+	keepVersions bool
+	fileIDs      map[string]string // From the last list
+}
+
+type b2UploadURL struct {
+	UploadURL          string
+	AuthorizationToken string
+}
+
+// The store for out, if it is a b2:// URL.
+func b2Destination(out string) (*b2Store, bool, error) {
+	rest, ok := strings.CutPrefix(out, b2Scheme)
+	if !ok {
+		return nil, false, nil
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, true, fmt.Errorf("no bucket in %s", out)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &b2Store{
+		bucket: bucket,
+		prefix: prefix,
+		keyID:  firstNonEmpty(cfg.B2.KeyID, os.Getenv("B2_APPLICATION_KEY_ID")),
+		key:    firstNonEmpty(cfg.B2.ApplicationKey, os.Getenv("B2_APPLICATION_KEY")),
+	}
+	if s.keyID == "" || s.key == "" {
+		return nil, true, errors.New("no B2 credentials: set the B2 KeyID and ApplicationKey config, or the B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY env vars")
+	}
+	return s, true, nil
+}
+
+func (s *b2Store) String() string {
+	return b2Scheme + s.bucket + "/" + s.prefix
+}
+
+type b2Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Sends the request, decoding the JSON response into out (if not nil) and
+// failing on a non-2xx status.
+func b2Do(req *http.Request, out any) error {
+	logger.Debug("b2 request", "method", req.Method, "url", req.URL.Redacted())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e := &b2Error{Status: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, e) != nil || e.Code == "" {
+			e.Code, e.Message = "error", resp.Status
+		}
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, e)
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("could not parse %s response: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// Calls the b2_<name> API with the JSON body.
+func (s *b2Store) call(name string, body any, out any) error {
+	err := s.authorize()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodPost, s.apiURL+"/b2api/v2/b2_"+name, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", s.token)
+	return b2Do(req, out)
+}
+
+// Authorizes the account and finds the bucket (and its lifecycle rules), on
+// first use.
+func (s *b2Store) authorize() error {
+	if s.token != "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet, cfg.B2.AuthURL, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.keyID, s.key)
+	var auth struct {
+		AccountID           string
+		AuthorizationToken  string
+		APIURL              string `json:"apiUrl"`
+		DownloadURL         string `json:"downloadUrl"`
+		RecommendedPartSize int64
+	}
+	err = b2Do(req, &auth)
+	if err != nil {
+		return fmt.Errorf("could not authorize with B2: %w", err)
+	}
+	s.apiURL, s.downloadURL, s.token = auth.APIURL, auth.DownloadURL, auth.AuthorizationToken
+	s.partSize = int64(cfg.B2.PartSizeMB) << 20
+	if s.partSize == 0 {
+		s.partSize = max(auth.RecommendedPartSize, 5<<20)
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID       string `json:"bucketId"`
+			LifecycleRules []struct {
+				DaysFromHidingToDeleting *int
+				FileNamePrefix           string
+			}
+		}
+	}
+	err = s.call("list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": s.bucket}, &buckets)
+	if err != nil {
+		s.token = ""
+		return fmt.Errorf("could not find bucket %s: %w", s.bucket, err)
+	}
+	if len(buckets.Buckets) == 0 {
+		s.token = ""
+		return fmt.Errorf("no bucket %s (or the key can't access it)", s.bucket)
+	}
+	s.bucketID = buckets.Buckets[0].BucketID
+	for _, rule := range buckets.Buckets[0].LifecycleRules {
+		if rule.DaysFromHidingToDeleting != nil && strings.HasPrefix(s.prefix, rule.FileNamePrefix) {
+			s.keepVersions = true
+		}
+	}
+	logger.Debug("authorized with B2", "bucket", s.bucket, "lifecycle_rule", s.keepVersions)
+	return nil
+}
+
+type b2File struct {
+	FileID        string `json:"fileId"`
+	FileName      string
+	ContentLength int64
+	ContentSha1   string
+	Action        string
+}
+
+func (s *b2Store) list() (map[string]storedObject, error) {
+	objs := map[string]storedObject{}
+	s.fileIDs = map[string]string{}
+	start := ""
+	for {
+		var res struct {
+			Files        []b2File
+			NextFileName *string
+		}
+		err := s.call("list_file_names", map[string]any{
+			"bucketId": s.bucketID, "prefix": s.prefix, "startFileName": start, "maxFileCount": 1000,
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range res.Files {
+			if f.Action != "upload" {
+				continue
+			}
+			key := strings.TrimPrefix(f.FileName, s.prefix)
+			objs[key] = storedObject{Size: f.ContentLength}
+			s.fileIDs[key] = f.FileID
+		}
+		if res.NextFileName == nil {
+			return objs, nil
+		}
+		start = *res.NextFileName
+	}
+}
+
+// B2 checks the content against the SHA-1 (of each part, for large files).
+// Without a lifecycle rule, the old version of an overwritten file is then
+// deleted, so that versions don't pile up.
+func (s *b2Store) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	err := s.authorize()
+	if err != nil {
+		return err
+	}
+	if size > s.partSize {
+		err = s.putLarge(key, r, size, sum)
+	} else {
+		err = s.putSmall(key, r, size, sum)
+	}
+	if err != nil {
+		return err
+	}
+	if oldID, ok := s.fileIDs[key]; ok && !s.keepVersions {
+		err = s.call("delete_file_version", map[string]string{"fileName": s.prefix + key, "fileId": oldID}, nil)
+		if err != nil {
+			return fmt.Errorf("uploaded, but could not delete the old version: %w", err)
+		}
+	}
+	delete(s.fileIDs, key)
+	return nil
+}
+
+func sha1Hex(r io.ReaderAt, off int64, n int64) (string, error) {
+	h := sha1.New()
+	_, err := io.Copy(h, io.NewSectionReader(r, off, n))
+	if err != nil {
+		return "", fmt.Errorf("could not hash: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Posts the content to the upload URL, getting a new URL (once) if it fails,
+// as B2 asks.
+func (s *b2Store) postUpload(getURL func() (*b2UploadURL, error), cached **b2UploadURL, headers map[string]string, r io.ReaderAt, off int64, n int64, out any) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if *cached == nil {
+			*cached, err = getURL()
+			if err != nil {
+				return err
+			}
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(runCtx, http.MethodPost, (*cached).UploadURL, io.NewSectionReader(r, off, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Authorization", (*cached).AuthorizationToken)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		err = b2Do(req, out)
+		var bErr *b2Error
+		if err == nil || !errors.As(err, &bErr) || (bErr.Status != 401 && bErr.Status/100 != 5 && bErr.Status != 408) {
+			return err
+		}
+		*cached = nil
+	}
+	return err
+}
+
+func (s *b2Store) putSmall(key string, r io.ReaderAt, size int64, sum []byte) error {
+	sha, err := sha1Hex(r, 0, size)
+	if err != nil {
+		return err
+	}
+	getURL := func() (*b2UploadURL, error) {
+		var u b2UploadURL
+		err := s.call("get_upload_url", map[string]string{"bucketId": s.bucketID}, &u)
+		return &u, err
+	}
+	var uploaded b2File
+	err = s.postUpload(getURL, &s.upload, map[string]string{
+		"X-Bz-File-Name":    b2Escape(s.prefix + key),
+		"Content-Type":      "b2/x-auto",
+		"X-Bz-Content-Sha1": sha,
+		"X-Bz-Info-sha256":  hex.EncodeToString(sum),
+	}, r, 0, size, &uploaded)
+	if err != nil {
+		return err
+	}
+	if uploaded.ContentSha1 != sha {
+		return fmt.Errorf("upload check failed: B2 has SHA-1 %s, not %s", uploaded.ContentSha1, sha)
+	}
+	return nil
+}
+
+// Uploads as a large file, in parts of partSize - cancelling it if a part
+// fails, so that the parts are not kept.
+func (s *b2Store) putLarge(key string, r io.ReaderAt, size int64, sum []byte) (err error) {
+	sha, err := sha1Hex(r, 0, size)
+	if err != nil {
+		return err
+	}
+	var started b2File
+	err = s.call("start_large_file", map[string]any{
+		"bucketId": s.bucketID, "fileName": s.prefix + key, "contentType": "b2/x-auto",
+		"fileInfo": map[string]string{"large_file_sha1": sha, "sha256": hex.EncodeToString(sum)},
+	}, &started)
+	if err != nil {
+		return fmt.Errorf("could not start large file: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		cErr := s.call("cancel_large_file", map[string]string{"fileId": started.FileID}, nil)
+		if cErr != nil {
+			logger.Warn("could not cancel large file", "key", key, "err", cErr.Error())
+		}
+	}()
+
+	getURL := func() (*b2UploadURL, error) {
+		var u b2UploadURL
+		err := s.call("get_upload_part_url", map[string]string{"fileId": started.FileID}, &u)
+		return &u, err
+	}
+	var partURL *b2UploadURL
+	var shas []string
+	for off, n := int64(0), 1; off < size; off, n = off+s.partSize, n+1 {
+		partLen := min(s.partSize, size-off)
+		partSha, err := sha1Hex(r, off, partLen)
+		if err != nil {
+			return err
+		}
+		var part struct{ ContentSha1 string }
+		err = s.postUpload(getURL, &partURL, map[string]string{
+			"X-Bz-Part-Number":  strconv.Itoa(n),
+			"X-Bz-Content-Sha1": partSha,
+		}, r, off, partLen, &part)
+		if err != nil {
+			return fmt.Errorf("could not upload part %d: %w", n, err)
+		}
+		if part.ContentSha1 != partSha {
+			return fmt.Errorf("upload check failed: B2 has SHA-1 %s for part %d, not %s", part.ContentSha1, n, partSha)
+		}
+		shas = append(shas, partSha)
+	}
+	err = s.call("finish_large_file", map[string]any{"fileId": started.FileID, "partSha1Array": shas}, nil)
+	if err != nil {
+		return fmt.Errorf("could not finish large file: %w", err)
+	}
+	return nil
+}
+
+func (s *b2Store) get(key string) ([]byte, error) {
+	err := s.authorize()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet,
+		s.downloadURL+"/file/"+url.PathEscape(s.bucket)+"/"+b2Escape(s.prefix+key), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", s.token)
+	logger.Debug("b2 request", "method", req.Method, "url", req.URL.Redacted())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// With a lifecycle rule, hides the file (leaving its versions to the rule).
+// Otherwise deletes every version, as rsync --delete would delete the file.
+func (s *b2Store) delete(key string) error {
+	name := s.prefix + key
+	if s.keepVersions {
+		return s.call("hide_file", map[string]string{"bucketId": s.bucketID, "fileName": name}, nil)
+	}
+	start, startID := name, ""
+	for {
+		var res struct {
+			Files        []b2File
+			NextFileName *string
+			NextFileID   *string `json:"nextFileId"`
+		}
+		body := map[string]any{"bucketId": s.bucketID, "startFileName": start, "prefix": name, "maxFileCount": 100}
+		if startID != "" {
+			body["startFileId"] = startID
+		}
+		err := s.call("list_file_versions", body, &res)
+		if err != nil {
+			return err
+		}
+		for _, f := range res.Files {
+			if f.FileName != name {
+				continue
+			}
+			err = s.call("delete_file_version", map[string]string{"fileName": name, "fileId": f.FileID}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		if res.NextFileName == nil || *res.NextFileName != name || res.NextFileID == nil {
+			break
+		}
+		start, startID = *res.NextFileName, *res.NextFileID
+	}
+	delete(s.fileIDs, key)
+	return nil
+}
+
+// As B2 wants file names: percent-encoded, but with / kept.
+func b2Escape(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
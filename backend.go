@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A kind of destination (e.g. a restic repository, or an S3 bucket), backed up
+// to by backupFolder in the same steps, whatever it is: Prepare, Verify, then
+// (unless verifying only) Sync, and always Cleanup. One is opened per pair, as
+// chosen by its out folder's scheme (see backendKinds).
+type backend interface {
+	// Checks the destination, and that the in folder suits it, adding the
+	// "Folders checked" section. May return the pair with another In to back
+	// up from (e.g. a snapshot it took), with Live set to the in folder.
+	Prepare(r *report, p folderPair) (folderPair, error)
+	// Checks the in folder (and the destination, if it can) for bitrot with
+	// cshatag, before anything is synced. All that a verify only run does.
+	Verify(r *report, rec *historyRecord, p folderPair) error
+	// Syncs the in folder to the destination, then checks and prunes it as
+	// configured.
+	Sync(r *report, rec *historyRecord, p folderPair) error
+	// Undoes what the other steps left to undo (e.g. a snapshot which was
+	// not sent), whether they failed or not.
+	Cleanup(r *report) error
+}
+
+type backendKind struct {
+	schemes []string
+	// Whether the in folder may be backed up from a snapshot (as per the ZFS
+	// and LVM Snapshot config). zfs: and btrfs: outputs take their own.
+	snapshots bool
+	// Opens the backend for the out folder. Errors are config errors.
+	open func(out string, st *state) (backend, error)
+}
+
+// The destinations given by a scheme, in the order they are tried.
+var backendKinds = []backendKind{
+	{[]string{zfsScheme}, false, openZFS},
+	{[]string{btrfsScheme}, false, openBtrfs},
+	{[]string{resticScheme}, true, openRestic},
+	{[]string{borgScheme}, true, openBorg},
+	{[]string{tarScheme}, true, openTar},
+	{[]string{s3Scheme, b2Scheme, azureScheme, gdriveScheme, sftpScheme, davScheme, davsScheme}, true, openObjects},
+	{[]string{rcloneScheme}, true, openRclone},
+}
+
+// Out folders without a scheme: a folder on this host, or on another one over
+// ssh.
+var folderKind = backendKind{snapshots: true, open: openFolder}
+
+func outKind(out string) backendKind {
+	kind, ok := schemeKind(out)
+	if !ok {
+		return folderKind
+	}
+	return kind
+}
+
+// The kind of the out folder's scheme, if it has one.
+func schemeKind(out string) (backendKind, bool) {
+	for _, k := range backendKinds {
+		for _, s := range k.schemes {
+			if strings.HasPrefix(out, s) {
+				return k, true
+			}
+		}
+	}
+	return backendKind{}, false
+}
+
+// Checks, verifies, and syncs the pair's in folder to its out folder.
+func backupFolder(r *report, rec *historyRecord, st *state, p folderPair, verifyOnly bool) (err error) {
+	// Never store checksums in a verify only run
+	p.VerifyOnly = verifyOnly
+	// Check folders
+	err = withRunTimeout("folder check", func() error { return checkFolder(p.In) })
+	if err != nil {
+		return withExitCode(exitFolderCheck, fmt.Errorf("in folder: %w", err))
+	}
+	kind := outKind(p.Out)
+	b, err := kind.open(p.Out, st)
+	if err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("out: %w", err))
+	}
+
+	// Back up from a snapshot of the in folder, if configured (and not already
+	// taken, for all of a Parallel job's destinations)
+	if kind.snapshots && p.Live == "" {
+		var release func() error
+		p, release, err = snapshotSource(r, p)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, release())
+		}()
+	}
+	defer func() {
+		err = errors.Join(err, b.Cleanup(r))
+	}()
+
+	p, err = b.Prepare(r, p)
+	if err != nil {
+		return err
+	}
+	err = b.Verify(r, rec, p)
+	if err != nil {
+		return err
+	}
+	if verifyOnly {
+		logger.Info("verify only, so skipping the sync")
+		r.Sections = append(r.Sections, section{
+			Title:  "Sync skipped",
+			Detail: "This was a verify only run, so nothing was synced.",
+		})
+		return nil
+	}
+	return b.Sync(r, rec, p)
+}
+
+// Checks the in folder for bitrot with cshatag (unless skipped), so that it
+// is never backed up. How it would be backed up is for the report.
+func verifyInput(r *report, rec *historyRecord, p folderPair, how string) error {
+	if cfg.skipVerify {
+		logger.Info("skipping cshatag verification")
+		r.Sections = append(r.Sections, section{
+			Title:  "Verification skipped",
+			Detail: fmt.Sprintf("This run was started with -skip-verify, so cshatag was not run. Bitrot in the input folder would not be noticed - and could be %s.", how),
+		})
+		return nil
+	}
+	return verifyFolders(r, rec, p.In, "", p.hash(), p.VerifyOnly)
+}
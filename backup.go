@@ -0,0 +1,693 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Out folders on this host, or on another one for rsync over ssh.
+type folderBackend struct {
+	out       string
+	host, dir string // If remote
+	remote    bool
+}
+
+func openFolder(out string, st *state) (backend, error) {
+	host, dir, remote := remoteOut(out)
+	return &folderBackend{out: out, host: host, dir: dir, remote: remote}, nil
+}
+
+func (b *folderBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	var err error
+	if b.remote {
+		err = withRunTimeout("folder check", func() error { return checkRemote(b.host, b.dir) })
+	} else {
+		err = withRunTimeout("folder check", func() error { return checkFolder(b.out) })
+	}
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out folder: %w", err))
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Folders checked",
+		Detail: `This test tries to write, read, and delete a temporary file
+		in both the input and output folders. It also checks for the existence
+		of .backup-helper-check files.`,
+		LogLines: []string{
+			fmt.Sprintf("%s: OK", p.live()),
+			fmt.Sprintf("%s: OK", b.out),
+		},
+	})
+
+	// Check the output keeps what is being preserved
+	if cfg.CheckFeatures && !b.remote {
+		checkFeatures(r, b.out)
+	}
+
+	// Check there is room for the sync
+	if cfg.CheckFreeSpace && !b.remote {
+		err = checkFreeSpace(r, p.In, b.out)
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Both folders are checked for bitrot, or only the in folder if the out
+// folder is remote.
+func (b *folderBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	if cfg.skipVerify {
+		logger.Info("skipping cshatag verification")
+		r.Sections = append(r.Sections, section{
+			Title:  "Verification skipped",
+			Detail: "This run was started with -skip-verify, so cshatag was not run. Bitrot in either folder would not be noticed - and could be synced to the output folder.",
+		})
+		return nil
+	}
+	if b.remote {
+		// cshatag can only be run on local folders
+		r.Sections = append(r.Sections, section{
+			Title:  "Output not verified",
+			Detail: fmt.Sprintf("The output folder is on %s, so cshatag was only run on the input folder.", b.host),
+		})
+		return verifyFolders(r, rec, p.In, "", p.hash(), p.VerifyOnly)
+	}
+	return verifyFolders(r, rec, p.In, b.out, p.hash(), p.VerifyOnly)
+}
+
+func (b *folderBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	var err error
+	engine := syncEngine(p)
+	switch engine {
+	case copyEngineNative:
+		err = nativeSync(r, rec, p)
+	case copyEngineRobocopy:
+		err = robocopySync(r, rec, p)
+	default:
+		err = rsyncFolder(r, rec, p)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Confirm the content matches, regardless of size/time
+	if cfg.DoubleCheckChecksum && !cfg.dryRun {
+		if engine == copyEngineRsync {
+			err = checksumDoubleCheck(r, p)
+		} else {
+			err = nativeChecksumDoubleCheck(r, p)
+		}
+		if err != nil {
+			return withExitCode(exitRsync, err)
+		}
+	}
+
+	var manifest map[string]string
+	if cfg.WriteManifest && !cfg.dryRun && b.remote {
+		r.Sections = append(r.Sections, section{
+			Title:  "Manifest skipped",
+			Detail: fmt.Sprintf("The output folder is on %s, so no manifest was written.", b.host),
+		})
+	} else if cfg.WriteManifest && !cfg.dryRun {
+		manifest, err = writeManifest(r, b.out, p.hash())
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.VerifyDestination && !cfg.dryRun && b.remote {
+		r.Sections = append(r.Sections, section{
+			Title:  "Destination verification skipped",
+			Detail: fmt.Sprintf("The output folder is on %s, so its files could not be checked against the input folder's checksums.", b.host),
+		})
+	} else if cfg.VerifyDestination && !cfg.dryRun {
+		err = verifyDestination(r, p, manifest)
+		if err != nil {
+			return withExitCode(exitRsync, err)
+		}
+	}
+
+	logger.Info("folder backed up", "in", p.In, "out", b.out)
+	return nil
+}
+
+func (b *folderBackend) Cleanup(r *report) error {
+	return nil
+}
+
+// Syncs the pair's in folder to its out folder with rsync.
+func rsyncFolder(r *report, rec *historyRecord, p folderPair) error {
+	// -> Need a slash at the end of the in folder to indicate to rsync to sync the contents into out
+	rsyncArgs := syncArgs(p)
+	rsyncDesc := "rsync from input to output folder"
+	if !p.delete() {
+		rsyncDesc += " (deletions disabled)"
+	}
+	if p.delete() && cfg.MaxDeletes > 0 && !cfg.dryRun && !cfg.force {
+		err := confirmDeletes(r, p)
+		if err != nil {
+			return err
+		}
+	}
+	rsyncStart := time.Now()
+	rsyncLines, err := execCommand("rsync:"+p.Out, cfg.RsyncPath, rsyncArgs...)
+	rsyncDuration := time.Since(rsyncStart)
+	addExecSection(r, rsyncDesc, rsyncLines,
+		cfg.RsyncPath, rsyncArgs...)
+	rsyncSection := &r.Sections[len(r.Sections)-1]
+	rsyncSection.Detail += " " + throughput(rsyncTransferredBytes(rsyncLines), rsyncDuration)
+	if cfg.RsyncLogFile {
+		rsyncSection.Detail += fmt.Sprintf(" rsync's own log is at %s.", p.rsyncLogPath())
+	}
+	if perms := permissionArgs(); len(perms) > 0 {
+		rsyncSection.Detail += fmt.Sprintf(" Permissions forced with %s.", strings.Join(perms, " "))
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("rsync failed: %w", err))
+	}
+	created, updated, deleted := rsyncChanges(rsyncLines)
+	rec.BytesSent += rsyncSentBytes(rsyncLines)
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	rec.FilesDeleted += len(deleted)
+	if cfg.dryRun {
+		// Nothing was changed, so list everything which would be
+		addChangeSection(r, "Files that would be created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be updated", updated, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be deleted", deleted, cfg.ChangeListMax)
+	} else {
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files deleted", deleted, cfg.ChangeListMax)
+	}
+	return nil
+}
+
+type folderPair struct {
+	In  string
+	Out string
+	Sub bool // Out is a subfolder (for a source) of the out folder
+	// Set if In is a snapshot being backed up from: the in folder itself
+	Live string
+	// Set for verify only runs, whose checksums are checked read only
+	VerifyOnly bool
+
+	// Set for jobs
+	Name     string
+	Excludes []string
+	Delete   *bool  // Overrides cfg.Delete
+	Hash     string // Overrides cfg.HashAlgorithm
+	Parallel bool   // Backed up at once with the job's other destinations
+	Offsite  bool   // The job's Offsite, only backed up to when due
+	jobMail
+}
+
+// Whether out is a restic or borg repository, rather than a folder.
+func isRepo(out string) bool {
+	_, restic := resticRepo(out)
+	_, borg := borgRepo(out)
+	return restic || borg
+}
+
+// Need a slash at the end of the in folder to indicate to rsync to sync the
+// contents into out.
+func (p folderPair) inWithSlash() string {
+	return p.In + string(filepath.Separator)
+}
+
+// The in folder itself, even if In is a snapshot of it.
+func (p folderPair) live() string {
+	return firstNonEmpty(p.Live, p.In)
+}
+
+func (p folderPair) delete() bool {
+	if p.Delete != nil {
+		return *p.Delete
+	}
+	return cfg.Delete
+}
+
+func (p folderPair) hash() string {
+	return firstNonEmpty(p.Hash, cfg.HashAlgorithm)
+}
+
+// The pairs to back up: either the jobs (for run), the in and out folders
+// given, or each source (from -sources-from or SourcesFile) into a subfolder
+// of the out folder.
+func folderPairs(opts options) ([]folderPair, error) {
+	if opts.RunJobs {
+		return jobPairs(opts.JobNames)
+	}
+	sourcesFile := opts.SourcesFrom
+	if sourcesFile == "" {
+		sourcesFile = cfg.SourcesFile
+	}
+	if len(opts.Pairs) > 0 {
+		if sourcesFile != "" {
+			return nil, errors.New("give either folder pairs or a sources file, not both")
+		}
+		return opts.Pairs, nil
+	}
+	if sourcesFile == "" {
+		if opts.In == "" {
+			return nil, errors.New("no input folder given")
+		}
+		return []folderPair{{In: opts.In, Out: opts.Out}}, nil
+	}
+	if opts.In != "" {
+		return nil, errors.New("give either an input folder or a sources file, not both")
+	}
+
+	sources, err := readSourcesFile(sourcesFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources in %s", sourcesFile)
+	}
+	var pairs []folderPair
+	seen := map[string]string{}
+	for _, src := range sources {
+		// Every source goes into the one repository, as its own path
+		if isRepo(opts.Out) {
+			pairs = append(pairs, folderPair{In: src, Out: opts.Out})
+			continue
+		}
+		sub := filepath.Base(filepath.Clean(src))
+		if prev, ok := seen[sub]; ok {
+			return nil, fmt.Errorf("sources %s and %s would both back up into %s", prev, src, sub)
+		}
+		seen[sub] = src
+		// Each source is archived as sub-<date>.tar into the archive dir (or
+		// sent as its own snapshots, into the btrfs dir)
+		if isArchive(opts.Out) || isBtrfs(opts.Out) {
+			pairs = append(pairs, folderPair{In: src, Out: opts.Out})
+			continue
+		}
+		if isObjectStore(opts.Out) || isZFS(opts.Out) || isRclone(opts.Out) {
+			pairs = append(pairs, folderPair{In: src, Out: strings.TrimSuffix(opts.Out, "/") + "/" + sub})
+			continue
+		}
+		if isRemote(opts.Out) {
+			pairs = append(pairs, folderPair{In: src, Out: remoteJoin(opts.Out, sub), Sub: true})
+			continue
+		}
+		pairs = append(pairs, folderPair{In: src, Out: filepath.Join(opts.Out, sub), Sub: true})
+	}
+	return pairs, nil
+}
+
+// Newline separated paths, ignoring blank lines and # comments.
+func readSourcesFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sources file: %w", err)
+	}
+	var sources []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		sources = append(sources, l)
+	}
+	return sources, nil
+}
+
+// The subfolders get their own smoke files, once the out folder's smoke file
+// shows it is mounted.
+func prepareSubfolders(outFolder string, pairs []folderPair) error {
+	if len(pairs) == 0 || !pairs[0].Sub {
+		return nil
+	}
+	if host, dir, ok := remoteOut(outFolder); ok {
+		return prepareRemoteSubfolders(host, dir, pairs)
+	}
+	_, err := os.Stat(filepath.Join(outFolder, smokeFilename))
+	if err != nil {
+		return fmt.Errorf("out folder: smoke file check err (maybe not mounted?): %w", err)
+	}
+	for _, p := range pairs {
+		err = os.MkdirAll(p.Out, 0755)
+		if err != nil {
+			return fmt.Errorf("could not create out subfolder: %w", err)
+		}
+		smoke := filepath.Join(p.Out, smokeFilename)
+		_, err = os.Stat(smoke)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.WriteFile(smoke, nil, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("could not create smoke file in out subfolder: %w", err)
+		}
+	}
+	return nil
+}
+
+// Describes what a backup of the pairs would do, without doing it.
+func explainPairs(pairs []folderPair) report {
+	r := report{
+		Title:  "Backup Helper paths",
+		Detail: "What a run would sync. Nothing has been run or changed.",
+	}
+	for _, p := range pairs {
+		if repo, ok := resticRepo(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{
+				fmt.Sprintf("in: %s", in),
+				fmt.Sprintf("restic repository: %s", repo),
+				fmt.Sprintf("restic command: %s %s", cfg.Restic.Path, strings.Join(resticBackupArgs(p, repo), " ")),
+			}
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if d, ok, err := zfsTarget(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{fmt.Sprintf("in: %s", in)}
+			dataset, _, dErr := zfsDataset(p.In)
+			switch {
+			case err != nil:
+				lines = append(lines, fmt.Sprintf("invalid destination: %s", err))
+			case dErr != nil:
+				lines = append(lines, fmt.Sprintf("in dataset: unknown (%s)", dErr))
+			default:
+				send, recv := zfsSendArgs(dataset, d.snapPrefix()+"<date>", "", d)
+				name, argv := zfsCommand(d, recv)
+				lines = append(lines,
+					fmt.Sprintf("in dataset: %s", dataset),
+					fmt.Sprintf("out dataset: %s", d),
+					fmt.Sprintf("zfs command: %s %s | %s %s", cfg.ZFS.Path, strings.Join(send, " "), name, strings.Join(argv, " ")))
+			}
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if d, ok, err := btrfsTarget(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{fmt.Sprintf("in: %s", in)}
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("invalid destination: %s", err))
+			} else {
+				name, argv := btrfsCommand(d.host, d.port, append(append([]string{"receive"}, cfg.Btrfs.ReceiveArgs...), d.dir))
+				snap := filepath.Join(cfg.Btrfs.SnapshotDir, btrfsSnapPrefix(p)+"<date>")
+				lines = append(lines,
+					fmt.Sprintf("out folder: %s", d),
+					fmt.Sprintf("snapshot: %s", snap),
+					fmt.Sprintf("btrfs command: %s %s | %s %s", cfg.Btrfs.Path, strings.Join(append(append([]string{"send"}, cfg.Btrfs.SendArgs...), "[-p <parent>]", snap), " "), name, strings.Join(argv, " ")))
+			}
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if isArchive(p.Out) {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{fmt.Sprintf("in: %s", in)}
+			t, err := resolveTarTarget(p, time.Now())
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("invalid destination: %s", err))
+			} else {
+				lines = append(lines,
+					fmt.Sprintf("archive: %s (compressed with %s)", t.path, t.compression),
+					fmt.Sprintf("index: %s", t.index),
+					fmt.Sprintf("checksum: %s", t.sum))
+				if t.stream {
+					lines = append(lines, streamLines(t)...)
+				}
+			}
+			if encrypting() {
+				lines = append(lines, encryptionLine())
+			}
+			files, bytes, _, err := tarFiles(p)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("usage of %s: unknown (%s)", p.In, err))
+			} else {
+				lines = append(lines, fmt.Sprintf("usage of %s: %s in %d file(s)", p.In, humanBytes(float64(bytes)), files))
+			}
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if dest, ok := rcloneTarget(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			typ, err := rcloneRemoteType(dest)
+			if err != nil {
+				typ = fmt.Sprintf("unknown (%s)", err)
+			}
+			lines := []string{
+				fmt.Sprintf("in: %s", in),
+				fmt.Sprintf("rclone remote: %s (type %s)", dest, typ),
+				fmt.Sprintf("rclone command: %s %s", cfg.Rclone.Path, strings.Join(rcloneSyncArgs(p, dest), " ")),
+			}
+			if cfg.Rclone.Check {
+				lines = append(lines, fmt.Sprintf("rclone check: %s %s", cfg.Rclone.Path, strings.Join(rcloneCheckArgs(p, dest, typ == "crypt"), " ")))
+			}
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if isObjectStore(p.Out) {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{fmt.Sprintf("in: %s", in), fmt.Sprintf("out: %s", p.Out)}
+			store, _, err := objectDestination(p.Out)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("invalid destination: %s", err))
+			} else if s3, ok := store.(*s3Store); ok {
+				lines = append(lines, fmt.Sprintf("endpoint: %s (profile %s, region %s, path style %t, %d part(s) at once)",
+					s3.endpoint, firstNonEmpty(cfg.S3.Profile, s3ProfileAWS), s3.region, s3.pathStyle, s3.concurrency))
+			} else if b2, ok := store.(*b2Store); ok {
+				lines = append(lines, fmt.Sprintf("b2 key: %s (auth %s)", b2.keyID, cfg.B2.AuthURL))
+			} else if az, ok := store.(*azureStore); ok {
+				auth := "shared key"
+				if az.key == nil {
+					auth = "SAS token"
+				}
+				lines = append(lines, fmt.Sprintf("endpoint: %s (account %s, auth %s)", az.endpoint, az.account, auth))
+			} else if _, ok := store.(*gdriveStore); ok {
+				lines = append(lines, fmt.Sprintf("google drive: client %s (token %s)", cfg.GDrive.ClientID, cfg.GDrive.TokenFile))
+			} else if dav, ok := store.(*webdavStore); ok {
+				lines = append(lines, fmt.Sprintf("url: %s (user %q)", dav.base.Redacted(), dav.user))
+			} else if sftp, ok := store.(*sftpStore); ok {
+				lines = append(lines, fmt.Sprintf("ssh: %s", strings.Join(append([]string{cfg.SSH.Path}, sftp.sshArgs()...), " ")))
+			}
+			if encrypting() {
+				lines = append(lines, encryptionLine())
+			}
+			bytes, entries, err := treeUsage(p.In)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("usage of %s: unknown (%s)", p.In, err))
+			} else {
+				lines = append(lines, fmt.Sprintf("usage of %s: %s in %d entries", p.In, humanBytes(float64(bytes)), entries))
+			}
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if repo, ok := borgRepo(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{
+				fmt.Sprintf("in: %s", in),
+				fmt.Sprintf("borg repository: %s", repo),
+				fmt.Sprintf("borg command: %s %s", cfg.Borg.Path, strings.Join(borgCreateArgs(p, repo, time.Now()), " ")),
+			}
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		if host, _, ok := remoteOut(p.Out); ok {
+			in, _ := filepath.Abs(p.In)
+			lines := []string{fmt.Sprintf("in: %s", in), fmt.Sprintf("out: %s (on %s)", p.Out, host)}
+			bytes, entries, err := treeUsage(p.In)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("usage of %s: unknown (%s)", p.In, err))
+			} else {
+				lines = append(lines, fmt.Sprintf("usage of %s: %s in %d entries", p.In, humanBytes(float64(bytes)), entries))
+			}
+			lines = append(lines, fmt.Sprintf("rsync command: %s %s", cfg.RsyncPath, strings.Join(syncArgs(p), " ")))
+			lines = append(lines, snapshotLines(p)...)
+			r.Sections = append(r.Sections, section{Title: p.title(), LogLines: lines})
+			continue
+		}
+		var lines []string
+		in, inErr := filepath.Abs(p.In)
+		out, outErr := filepath.Abs(p.Out)
+		lines = append(lines,
+			fmt.Sprintf("in: %s", in),
+			fmt.Sprintf("out: %s", out))
+		if err := errors.Join(inErr, outErr); err != nil {
+			lines = append(lines, fmt.Sprintf("could not resolve paths: %s", err))
+		}
+
+		same, err := sameFilesystem(p.In, p.Out)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("same filesystem: unknown (%s)", err))
+		} else {
+			lines = append(lines, fmt.Sprintf("same filesystem: %t", same))
+		}
+		for _, dir := range []string{p.In, p.Out} {
+			bytes, entries, err := treeUsage(dir)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("usage of %s: unknown (%s)", dir, err))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("usage of %s: %s in %d entries", dir, humanBytes(float64(bytes)), entries))
+		}
+		freeBytes, freeInodes, err := fsFree(p.Out)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("free on output: unknown (%s)", err))
+		} else {
+			lines = append(lines, fmt.Sprintf("free on output: %s, %d inodes", humanBytes(float64(freeBytes)), freeInodes))
+		}
+		switch syncEngine(p) {
+		case copyEngineNative:
+			lines = append(lines, fmt.Sprintf("copy engine: native (CopyEngine %s)", cfg.CopyEngine))
+		case copyEngineRobocopy:
+			args, err := robocopyArgs(p)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("robocopy command: invalid (%s)", err))
+			} else {
+				lines = append(lines, fmt.Sprintf("robocopy command: %s %s", cfg.RobocopyPath, strings.Join(args, " ")))
+			}
+		default:
+			args := syncArgs(p)
+			lines = append(lines, fmt.Sprintf("rsync command: %s %s", cfg.RsyncPath, strings.Join(args, " ")))
+		}
+
+		lines = append(lines, snapshotLines(p)...)
+		r.Sections = append(r.Sections, section{
+			Title:    p.title(),
+			LogLines: lines,
+		})
+	}
+	return r
+}
+
+// Runs cshatag on both folders (concurrently), reporting any corruption. If
+// there is no out folder (e.g. for a restic repository), only the in folder is
+// checked. Checksums are with the hash algorithm, and read only in both folders
+// if readOnly (e.g. for a verify only run).
+func verifyFolders(r *report, rec *historyRecord, inFolder string, outFolder string, algo string, readOnly bool) (err error) {
+	logger.Debug("running cshatag on input and output folders (concurrently)")
+	var wg sync.WaitGroup
+	var cshaInErr, cshaOutErr error
+	var cshaIn, cshaOut checksumRun
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cshaIn, cshaInErr = runChecksums("cshatag:input", inFolder, readOnly || cfg.CshatagReadOnlyInput || isSnapshotDir(inFolder), algo)
+		logger.Info("cshatag on input finished",
+			"dir", inFolder,
+			"files", len(cshaIn.files))
+	}()
+	if outFolder != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cshaOut, cshaOutErr = runChecksums("cshatag:output:"+outFolder, outFolder, readOnly, algo)
+			logger.Info("cshatag on output finished",
+				"dir", outFolder,
+				"files", len(cshaOut.files))
+		}()
+	}
+	wg.Wait()
+	addChecksumSection(r, "cshatag on input folder", cshaIn)
+	if outFolder != "" {
+		addChecksumSection(r, "cshatag on output folder", cshaOut)
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    "Checksum storage",
+		LogLines: checksumStorageLines(inFolder, outFolder, algo, readOnly),
+	})
+	corrupt := append(corruptFiles(cshaIn.files), corruptFiles(cshaOut.files)...)
+	rec.CorruptFiles += len(corrupt)
+	if len(corrupt) > 0 {
+		handleCorruption(r, corrupt)
+	}
+	if cshaInErr != nil {
+		err = errors.Join(err, fmt.Errorf("cshatag on input folder failed: %w", cshaInErr))
+	}
+	if cshaOutErr != nil {
+		err = errors.Join(err, fmt.Errorf("cshatag on output folder failed: %w", cshaOutErr))
+	}
+	if err != nil && len(corrupt) > 0 {
+		return withExitCode(exitCorruption, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The run's output, with a count of what it found.
+func addChecksumSection(r *report, desc string, run checksumRun) {
+	addExecSection(r, desc, run.lines, run.argv[0], run.argv[1:]...)
+	sec := &r.Sections[len(r.Sections)-1]
+	sec.Detail += " " + checksumSummary(run.files)
+}
+
+// For verify given folders instead of job names: the folders. Then each is
+// just scrubbed with cshatag, with no output folder.
+func verifyDirs(opts options) ([]string, error) {
+	if opts.Command != "verify" || !opts.RunJobs || len(opts.JobNames) == 0 {
+		return nil, nil
+	}
+	var dirs []string
+	for _, n := range opts.JobNames {
+		jobs, err := matchJobs(n)
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) == 0 {
+			dirs = append(dirs, n)
+		}
+	}
+	if len(dirs) > 0 && len(dirs) < len(opts.JobNames) {
+		return nil, fmt.Errorf("verify takes either job names or folders, not both - %s are not jobs", strings.Join(dirs, ", "))
+	}
+	return dirs, nil
+}
+
+// Checks and runs cshatag on each dir, failing if any corruption is found.
+func scrubFolders(r *report, rec *historyRecord, dirs []string) (err error) {
+	rec.In = strings.Join(dirs, ",")
+	for _, dir := range dirs {
+		dErr := scrubFolder(r, rec, dir)
+		if dErr != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", dir, dErr))
+		}
+	}
+	return err
+}
+
+// Read only, like any verify run: stored checksums are checked, but none are
+// stored or updated.
+func scrubFolder(r *report, rec *historyRecord, dir string) error {
+	err := withRunTimeout("folder check", func() error { return checkFolder(dir) })
+	if err != nil {
+		return withExitCode(exitFolderCheck, err)
+	}
+
+	run, err := runChecksums("cshatag", dir, true, cfg.HashAlgorithm)
+	addChecksumSection(r, "cshatag on "+dir, run)
+	corrupt := corruptFiles(run.files)
+	rec.CorruptFiles += len(corrupt)
+	if len(corrupt) > 0 {
+		handleCorruption(r, corrupt)
+	}
+	if err != nil {
+		err = fmt.Errorf("cshatag failed: %w", err)
+	} else if len(corrupt) > 0 {
+		err = fmt.Errorf("%d corrupt file(s) found", len(corrupt))
+	}
+	if err != nil && len(corrupt) > 0 {
+		return withExitCode(exitCorruption, err)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("folder verified", "dir", dir)
+	return nil
+}
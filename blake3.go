@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// BLAKE3 (unkeyed, with a 32 byte output), as per the spec and its reference
+// implementation. Files bigger than a few segments are hashed in parallel,
+// each segment being a whole subtree of the hash.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+
+	// Chunks per segment hashed in parallel (4 MiB), a power of two
+	blake3SegmentChunks = 1 << 12
+	blake3SegmentLen    = blake3SegmentChunks * blake3ChunkLen
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+// The message words used by each round: the spec's permutation, applied once
+// per round.
+var blake3Schedule = [7][16]uint8{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8},
+	{3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1},
+	{10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6},
+	{12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4},
+	{9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7},
+	{11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13},
+}
+
+func blake3G(a, b, c, d, mx, my uint32) (uint32, uint32, uint32, uint32) {
+	a += b + mx
+	d = bits.RotateLeft32(d^a, -16)
+	c += d
+	b = bits.RotateLeft32(b^c, -12)
+	a += b + my
+	d = bits.RotateLeft32(d^a, -8)
+	c += d
+	b = bits.RotateLeft32(b^c, -7)
+	return a, b, c, d
+}
+
+func blake3Compress(cv *[8]uint32, m [16]uint32, counter uint64, blockLen uint32, flags uint32) [16]uint32 {
+	v0, v1, v2, v3, v4, v5, v6, v7 := cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7]
+	v8, v9, v10, v11 := blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3]
+	v12, v13, v14, v15 := uint32(counter), uint32(counter>>32), blockLen, flags
+	for r := range blake3Schedule {
+		s := &blake3Schedule[r]
+		v0, v4, v8, v12 = blake3G(v0, v4, v8, v12, m[s[0]&15], m[s[1]&15])
+		v1, v5, v9, v13 = blake3G(v1, v5, v9, v13, m[s[2]&15], m[s[3]&15])
+		v2, v6, v10, v14 = blake3G(v2, v6, v10, v14, m[s[4]&15], m[s[5]&15])
+		v3, v7, v11, v15 = blake3G(v3, v7, v11, v15, m[s[6]&15], m[s[7]&15])
+		v0, v5, v10, v15 = blake3G(v0, v5, v10, v15, m[s[8]&15], m[s[9]&15])
+		v1, v6, v11, v12 = blake3G(v1, v6, v11, v12, m[s[10]&15], m[s[11]&15])
+		v2, v7, v8, v13 = blake3G(v2, v7, v8, v13, m[s[12]&15], m[s[13]&15])
+		v3, v4, v9, v14 = blake3G(v3, v4, v9, v14, m[s[14]&15], m[s[15]&15])
+	}
+	return [16]uint32{
+		v0 ^ v8, v1 ^ v9, v2 ^ v10, v3 ^ v11, v4 ^ v12, v5 ^ v13, v6 ^ v14, v7 ^ v15,
+		v8 ^ cv[0], v9 ^ cv[1], v10 ^ cv[2], v11 ^ cv[3], v12 ^ cv[4], v13 ^ cv[5], v14 ^ cv[6], v15 ^ cv[7],
+	}
+}
+
+func blake3Words(b []byte) [16]uint32 {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return m
+}
+
+// What is compressed last for a chunk or parent node: its chaining value,
+// or (with the root flag) the hash.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	s := blake3Compress(&o.cv, o.block, o.counter, o.blockLen, o.flags)
+	return [8]uint32(s[:8])
+}
+
+func (o blake3Output) rootHash() []byte {
+	s := blake3Compress(&o.cv, o.block, 0, o.blockLen, o.flags|blake3Root)
+	out := make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], s[i])
+	}
+	return out
+}
+
+func blake3ParentOutput(left [8]uint32, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: blake3BlockLen, flags: blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockLen]byte
+	blockLen   int
+	compressed int // Blocks
+}
+
+func newBLAKE3Chunk(counter uint64) blake3Chunk {
+	return blake3Chunk{cv: blake3IV, counter: counter}
+}
+
+func (c *blake3Chunk) len() int {
+	return c.compressed*blake3BlockLen + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.compressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) write(p []byte) {
+	for len(p) > 0 {
+		// A full block is only compressed once more input follows, since
+		// the last is compressed with the chunk end flag
+		if c.blockLen == blake3BlockLen {
+			s := blake3Compress(&c.cv, blake3Words(c.block[:]), c.counter, blake3BlockLen, c.startFlag())
+			c.cv = [8]uint32(s[:8])
+			c.compressed++
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	var block [blake3BlockLen]byte
+	copy(block[:], c.block[:c.blockLen])
+	return blake3Output{
+		cv:       c.cv,
+		block:    blake3Words(block[:]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | blake3ChunkEnd,
+	}
+}
+
+// A hash.Hash. The stack holds the chaining values of the complete subtrees
+// so far, one per set bit of the number of chunks.
+type blake3Hasher struct {
+	chunk blake3Chunk
+	stack [][8]uint32
+}
+
+func newBLAKE3() hash.Hash {
+	return &blake3Hasher{chunk: newBLAKE3Chunk(0)}
+}
+
+func (h *blake3Hasher) Size() int      { return 32 }
+func (h *blake3Hasher) BlockSize() int { return blake3BlockLen }
+
+func (h *blake3Hasher) Reset() {
+	h.chunk = newBLAKE3Chunk(0)
+	h.stack = h.stack[:0]
+}
+
+// Adds the chaining value of a subtree, merging it with those before it while
+// total (the subtrees so far, counting it) is even.
+func (h *blake3Hasher) push(cv [8]uint32, total uint64) {
+	for total&1 == 0 {
+		cv = blake3ParentOutput(h.stack[len(h.stack)-1], cv).chainingValue()
+		h.stack = h.stack[:len(h.stack)-1]
+		total >>= 1
+	}
+	h.stack = append(h.stack, cv)
+}
+
+func (h *blake3Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// Whole chunks with more input after them are hashed without copying
+		if h.chunk.len() == 0 && len(p) > blake3ChunkLen {
+			total := h.chunk.counter + 1
+			h.push(blake3ChunkCV(p[:blake3ChunkLen], h.chunk.counter), total)
+			h.chunk = newBLAKE3Chunk(total)
+			p = p[blake3ChunkLen:]
+			continue
+		}
+		if h.chunk.len() == blake3ChunkLen {
+			total := h.chunk.counter + 1
+			h.push(h.chunk.output().chainingValue(), total)
+			h.chunk = newBLAKE3Chunk(total)
+		}
+		take := min(blake3ChunkLen-h.chunk.len(), len(p))
+		h.chunk.write(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (h *blake3Hasher) Sum(b []byte) []byte {
+	o := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3ParentOutput(h.stack[i], o.chainingValue())
+	}
+	return append(b, o.rootHash()...)
+}
+
+// The chaining value of a whole chunk which is not the root.
+func blake3ChunkCV(b []byte, counter uint64) [8]uint32 {
+	cv := blake3IV
+	for i := 0; i < blake3ChunkLen/blake3BlockLen; i++ {
+		var flags uint32
+		switch i {
+		case 0:
+			flags = blake3ChunkStart
+		case blake3ChunkLen/blake3BlockLen - 1:
+			flags = blake3ChunkEnd
+		}
+		s := blake3Compress(&cv, blake3Words(b[i*blake3BlockLen:]), counter, blake3BlockLen, flags)
+		cv = [8]uint32(s[:8])
+	}
+	return cv
+}
+
+// The chaining value of the segment (a whole subtree, never the root).
+func blake3Segment(b []byte, firstChunk uint64) [8]uint32 {
+	h := blake3Hasher{}
+	for i := uint64(0); i < blake3SegmentChunks; i++ {
+		h.push(blake3ChunkCV(b[i*blake3ChunkLen:(i+1)*blake3ChunkLen], firstChunk+i), i+1)
+	}
+	return h.stack[0]
+}
+
+// Hashes the file's segments in parallel, bar the last (which may be the
+// root), then the rest of it in turn.
+func blake3File(f *os.File, size int64) ([]byte, error) {
+	h := &blake3Hasher{chunk: newBLAKE3Chunk(0)}
+	segments := 0
+	if size > 2*blake3SegmentLen {
+		segments = int((size - 1) / blake3SegmentLen)
+	}
+	cvs := make([][8]uint32, segments)
+	errs := make([]error, segments)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), segments) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, blake3SegmentLen)
+			for i := range next {
+				_, err := f.ReadAt(buf, int64(i)*blake3SegmentLen)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				cvs[i] = blake3Segment(buf, uint64(i)*blake3SegmentChunks)
+			}
+		}()
+	}
+	for i := range segments {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, cv := range cvs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		h.push(cv, uint64(i+1))
+	}
+
+	h.chunk = newBLAKE3Chunk(uint64(segments) * blake3SegmentChunks)
+	rest := io.NewSectionReader(f, int64(segments)*blake3SegmentLen, size-int64(segments)*blake3SegmentLen)
+	_, err := io.CopyBuffer(h, rest, make([]byte, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
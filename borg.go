@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For out folders given as borg:<repository>, e.g. borg:/mnt/backup/borg or
+// borg:ssh://nas/./borg.
+type borgConfig struct {
+	// The binary to run (default borg) and extra args for borg create.
+	Path      string
+	ExtraArgs []string
+
+	// The repository's passphrase, as for the Restic Password. If none is
+	// given, borg's own BORG_PASSPHRASE (or BORG_PASSCOMMAND) env var applies.
+	Passphrase        string
+	PassphraseCommand []string
+	PassphraseKeyring *keyringRef
+
+	// After each backup, prune (and compact) the folder's archives not kept
+	// by this policy. If all are 0, nothing is pruned.
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+
+	// Run borg check after the backup, if the repository has not been
+	// checked in CheckEveryDays (0 means every run).
+	Check          bool
+	CheckEveryDays int
+}
+
+const borgScheme = "borg:"
+
+// The repository, if out is a borg destination.
+func borgRepo(out string) (string, bool) {
+	return strings.CutPrefix(out, borgScheme)
+}
+
+func validateBorg(c *config) error {
+	var errs []error
+	for _, k := range []struct {
+		name string
+		n    int
+	}{
+		{"KeepLast", c.Borg.KeepLast},
+		{"KeepDaily", c.Borg.KeepDaily},
+		{"KeepWeekly", c.Borg.KeepWeekly},
+		{"KeepMonthly", c.Borg.KeepMonthly},
+		{"KeepYearly", c.Borg.KeepYearly},
+		{"CheckEveryDays", c.Borg.CheckEveryDays},
+	} {
+		if k.n < 0 {
+			errs = append(errs, fmt.Errorf("Borg %s can't be negative, not %d", k.name, k.n))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Env vars for borg, holding the passphrase (if configured).
+func borgEnv() map[string]string {
+	env := map[string]string{}
+	if cfg.Borg.Passphrase != "" {
+		env["BORG_PASSPHRASE"] = cfg.Borg.Passphrase
+	}
+	return env
+}
+
+// Archives are named after the job (or in folder) and the run's start, e.g.
+// backup-helper-photos-2024-05-01T02:00:00, so that each is pruned on its own.
+func borgArchivePrefix(p folderPair) string {
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(p.live()))
+	}
+	return "backup-helper-" + name + "-"
+}
+
+func borgCreateArgs(p folderPair, repo string, start time.Time) []string {
+	args := []string{"create", "--list", "--filter=AME"}
+	if cfg.dryRun {
+		// --stats can't be combined with --dry-run
+		args = append(args, "--dry-run")
+	} else {
+		args = append(args, "--stats")
+	}
+	if cfg.BwLimit != "" {
+		args = append(args, "--upload-ratelimit", strconv.Itoa(bwLimitKiB(cfg.BwLimit)))
+	}
+	if cfg.tag != "" {
+		args = append(args, "--comment", "tag: "+cfg.tag)
+	}
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		args = append(args, "--exclude", e)
+	}
+	args = append(args, cfg.Borg.ExtraArgs...)
+	archive := borgArchivePrefix(p) + start.Format("2006-01-02T15:04:05")
+	return append(args, repo+"::"+archive, p.In)
+}
+
+// The prune args for the Keep* policy, or nil if there is none.
+func borgPruneArgs(p folderPair, repo string) []string {
+	var keep []string
+	for _, k := range []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", cfg.Borg.KeepLast},
+		{"--keep-daily", cfg.Borg.KeepDaily},
+		{"--keep-weekly", cfg.Borg.KeepWeekly},
+		{"--keep-monthly", cfg.Borg.KeepMonthly},
+		{"--keep-yearly", cfg.Borg.KeepYearly},
+	} {
+		if k.n > 0 {
+			keep = append(keep, k.flag, strconv.Itoa(k.n))
+		}
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	args := []string{"prune", "--list", "--glob-archives", borgArchivePrefix(p) + "*"}
+	if cfg.dryRun {
+		args = append(args, "--dry-run")
+	}
+	args = append(args, keep...)
+	return append(args, repo)
+}
+
+// Backs up into a new archive in the borg repository, then prunes and checks
+// as configured.
+type borgBackend struct {
+	repo string
+	st   *state
+}
+
+func openBorg(out string, st *state) (backend, error) {
+	repo, _ := borgRepo(out)
+	return &borgBackend{repo: repo, st: st}, nil
+}
+
+func (b *borgBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	args := []string{"info", b.repo}
+	lines, err := execCommand("borg:check-repo", cfg.Borg.Path, args...)
+	if err != nil {
+		addExecSection(r, "borg repository check", lines, cfg.Borg.Path, args...)
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("borg repository %s could not be opened (does it need a borg init?): %w", b.repo, err))
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    "Folders checked",
+		Detail:   "The input folder was checked as usual, and the borg repository was opened.",
+		LogLines: []string{fmt.Sprintf("%s: OK", p.live()), fmt.Sprintf("%s: OK", b.repo)},
+	})
+	return p, nil
+}
+
+func (b *borgBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "backed up")
+}
+
+func (b *borgBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	args := borgCreateArgs(p, b.repo, rec.Start)
+	start := time.Now()
+	lines, err := execCommand("borg", cfg.Borg.Path, args...)
+	addExecSection(r, "borg create from input folder", lines, cfg.Borg.Path, args...)
+	added := borgDeduplicatedBytes(lines)
+	createSection := &r.Sections[len(r.Sections)-1]
+	createSection.Detail += " " + throughput(added, time.Since(start))
+	created, updated := borgChanges(lines)
+	rec.BytesSent += added
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	// Exit code 1 is only a warning, e.g. for a file which changed while read
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		logger.Warn("borg create finished with warnings", "err", err.Error())
+		createSection.Detail += " borg finished with warnings (see the output), but the archive was created."
+		err = nil
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("borg create failed: %w", err))
+	}
+	if cfg.dryRun {
+		addChangeSection(r, "Files that would be created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be updated", updated, cfg.ChangeListMax)
+	} else {
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+	}
+
+	if args = borgPruneArgs(p, b.repo); args != nil {
+		lines, err = execCommand("borg:prune", cfg.Borg.Path, args...)
+		desc := "borg prune"
+		if cfg.dryRun {
+			desc = "borg prune (would remove)"
+		}
+		addExecSection(r, desc, lines, cfg.Borg.Path, args...)
+		if err != nil {
+			return withExitCode(exitRsync, fmt.Errorf("borg prune failed: %w", err))
+		}
+		if !cfg.dryRun {
+			// Since borg 1.2, prune only frees the space once compacted
+			args = []string{"compact", b.repo}
+			lines, err = execCommand("borg:compact", cfg.Borg.Path, args...)
+			addExecSection(r, "borg compact", lines, cfg.Borg.Path, args...)
+			if err != nil {
+				return withExitCode(exitRsync, fmt.Errorf("borg compact failed: %w", err))
+			}
+		}
+	}
+
+	if cfg.Borg.Check && !cfg.dryRun {
+		err = borgCheck(r, b.st, b.repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("folder backed up", "in", p.In, "repository", b.repo)
+	return nil
+}
+
+func (b *borgBackend) Cleanup(r *report) error {
+	return nil
+}
+
+// Runs borg check, unless the repository was checked in the last
+// CheckEveryDays (as per the state).
+func borgCheck(r *report, st *state, repo string) error {
+	stateMu.Lock()
+	last := st.Checked[repo]
+	stateMu.Unlock()
+	every := time.Duration(cfg.Borg.CheckEveryDays) * 24 * time.Hour
+	if !last.IsZero() && time.Since(last) < every {
+		logger.Debug("borg repository checked recently, so skipping check", "repository", repo, "last", last.Format(time.RFC3339))
+		r.Sections = append(r.Sections, section{
+			Title: "borg check skipped",
+			Detail: fmt.Sprintf("The repository was last checked at %s, and is checked every %d day(s).",
+				last.Format(time.RFC3339), cfg.Borg.CheckEveryDays),
+		})
+		return nil
+	}
+
+	args := []string{"check", repo}
+	lines, err := execCommand("borg:check", cfg.Borg.Path, args...)
+	addExecSection(r, "borg repository check", lines, cfg.Borg.Path, args...)
+	if err != nil {
+		return withExitCode(exitCorruption, fmt.Errorf("borg check failed: %w", err))
+	}
+	stateMu.Lock()
+	if st.Checked == nil {
+		st.Checked = map[string]time.Time{}
+	}
+	st.Checked[repo] = time.Now()
+	stateMu.Unlock()
+	updateState(st)
+	return nil
+}
+
+// E.g. "A some/file" from borg create --list --filter=AME.
+var borgListRe = regexp.MustCompile(`^([AM]) (.+)$`)
+
+// E.g. "This archive:   1.23 MB   1.00 MB   500.00 kB", of the original,
+// compressed and deduplicated sizes.
+var borgStatsRe = regexp.MustCompile(`^This archive:\s+\S+ \S+\s+\S+ \S+\s+([0-9.]+) (B|kB|MB|GB|TB)`)
+
+// The added and modified files, from borg create's --list output.
+func borgChanges(lines []string) (created []string, updated []string) {
+	for _, l := range lines {
+		m := borgListRe.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		if m[1] == "A" {
+			created = append(created, m[2])
+		} else {
+			updated = append(updated, m[2])
+		}
+	}
+	return created, updated
+}
+
+// Bytes this archive added to the repository, from borg create's --stats.
+func borgDeduplicatedBytes(lines []string) uint64 {
+	units := map[string]float64{"B": 1, "kB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12}
+	for _, l := range lines {
+		m := borgStatsRe.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err == nil {
+			return uint64(n * units[m[2]])
+		}
+	}
+	return 0
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// For out folders given as btrfs:<dir> or btrfs://[user@]host[:port]/<dir>,
+// on a btrfs filesystem: read-only snapshots of the in folder (a subvolume)
+// are sent there with btrfs send | btrfs receive, rather than synced.
+type btrfsConfig struct {
+	// Where the in folder's snapshots are kept, as the parent of the next
+	// (incremental) send. It must be on the in folder's filesystem.
+	SnapshotDir string
+
+	// The binary to run (default btrfs), on this host and the out host, and
+	// extra args for btrfs send and btrfs receive.
+	Path        string
+	SendArgs    []string
+	ReceiveArgs []string
+	// The newest snapshots kept in the out folder (0 keeps all). The
+	// SnapshotDir only keeps the newest, as the next parent.
+	Keep int
+}
+
+const btrfsScheme = "btrfs:"
+
+func validateBtrfs(c *config) error {
+	if c.Btrfs.SnapshotDir != "" && !filepath.IsAbs(c.Btrfs.SnapshotDir) {
+		return fmt.Errorf("Btrfs SnapshotDir must be absolute, not %s", c.Btrfs.SnapshotDir)
+	}
+	if c.Btrfs.Keep < 0 {
+		return fmt.Errorf("Btrfs Keep must not be negative, not %d", c.Btrfs.Keep)
+	}
+	return nil
+}
+
+// A folder to receive into: on this host, or over ssh.
+type btrfsDest struct {
+	host string // [user@]host, or blank for this host
+	port string
+	dir  string
+}
+
+func (d btrfsDest) String() string {
+	if d.host == "" {
+		return d.dir
+	}
+	return d.host + ":" + d.dir
+}
+
+// The folder to receive into, if out is a btrfs destination.
+func btrfsTarget(out string) (btrfsDest, bool, error) {
+	if strings.HasPrefix(out, "btrfs://") {
+		u, err := url.Parse(out)
+		if err != nil {
+			return btrfsDest{}, true, err
+		}
+		d := btrfsDest{host: u.Hostname(), port: u.Port(), dir: u.Path}
+		if u.User != nil {
+			d.host = u.User.Username() + "@" + d.host
+		}
+		if d.host == "" || d.dir == "" || d.dir == "/" {
+			return btrfsDest{}, true, errors.New("btrfs:// needs a host and folder, e.g. btrfs://backup@nas/srv/backup")
+		}
+		return d, true, nil
+	}
+	dir, ok := strings.CutPrefix(out, btrfsScheme)
+	if !ok {
+		return btrfsDest{}, false, nil
+	}
+	if dir == "" {
+		return btrfsDest{}, true, errors.New("no folder given after btrfs:")
+	}
+	return btrfsDest{dir: filepath.Clean(dir)}, true, nil
+}
+
+func isBtrfs(out string) bool {
+	_, ok, _ := btrfsTarget(out)
+	return ok
+}
+
+// The command to run btrfs with the args: on the host over ssh, if not blank.
+func btrfsCommand(host string, port string, args []string) (string, []string) {
+	if host == "" {
+		return cfg.Btrfs.Path, args
+	}
+	return remoteCommand(host, port, cfg.Btrfs.Path, args)
+}
+
+// The fields of btrfs subvolume show for the subvolume, e.g. "UUID" and
+// "Received UUID".
+func btrfsShow(host string, port string, path string) (map[string]string, error) {
+	name, argv := btrfsCommand(host, port, []string{"subvolume", "show", path})
+	lines, err := commandLines("btrfs subvolume show", name, argv...)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, l := range lines {
+		k, v, ok := strings.Cut(strings.TrimSpace(l), ":")
+		if ok {
+			fields[k] = strings.TrimSpace(v)
+		}
+	}
+	return fields, nil
+}
+
+// Runs btrfs for what it does (e.g. btrfs subvolume delete), adding its output
+// to the report if it fails.
+func btrfsRun(r *report, host string, port string, args ...string) error {
+	name, argv := btrfsCommand(host, port, args)
+	lines, err := execCommand("btrfs:"+args[0], name, argv...)
+	if err != nil {
+		addExecSection(r, "btrfs "+strings.Join(args[:2], " "), lines, name, argv...)
+	}
+	return err
+}
+
+// As btrfsRun, but for cleaning up (see execCleanup).
+func btrfsCleanup(r *report, host string, port string, args ...string) error {
+	name, argv := btrfsCommand(host, port, args)
+	lines, err := execCleanup("btrfs:"+args[0], name, argv...)
+	if err != nil {
+		addExecSection(r, "btrfs "+strings.Join(args[:2], " "), lines, name, argv...)
+	}
+	return err
+}
+
+// The prefix of the pair's snapshots, e.g. photos-1a2b3c4d-. The tag is per
+// in and out folder, so that pruning for one pair never deletes the parent of
+// another's.
+func btrfsSnapPrefix(p folderPair) string {
+	abs, _ := filepath.Abs(p.In)
+	sum := sha256.Sum256([]byte(abs + "\x00" + p.Out))
+	return filepath.Base(abs) + "-" + hex.EncodeToString(sum[:4]) + "-"
+}
+
+// The snapshots with the prefix in the out folder, oldest first (as they are
+// named by date).
+func btrfsReceived(d btrfsDest, prefix string) ([]string, error) {
+	var names []string
+	if d.host == "" {
+		entries, err := os.ReadDir(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	} else {
+		name, argv := remoteCommand(d.host, d.port, "ls", []string{"-1", d.dir})
+		lines, err := commandLines("ls", name, argv...)
+		if err != nil {
+			return nil, err
+		}
+		names = lines
+	}
+	names = slices.DeleteFunc(names, func(n string) bool { return !strings.HasPrefix(n, prefix) })
+	slices.Sort(names)
+	return names, nil
+}
+
+// Like checkFolder for the out folder (over ssh, for another host): it must
+// have its smoke file.
+func checkBtrfsDest(d btrfsDest) error {
+	if d.host == "" {
+		return checkFolder(d.dir)
+	}
+	script := remoteCd(d.dir) + fmt.Sprintf("test -e %s || exit 11", smokeFilename)
+	name, argv := remoteCommand(d.host, d.port, "sh", []string{"-c", script})
+	_, err := commandLines("ssh", name, argv...)
+	if err != nil && strings.Contains(err.Error(), "exit status 11") {
+		return errors.New("smoke file check err (maybe not mounted?)")
+	}
+	if err != nil && strings.Contains(err.Error(), "exit status 10") {
+		return errors.New("no such folder")
+	}
+	return err
+}
+
+// Snapshots the in folder (a subvolume) read only, and sends the snapshot to
+// the out folder - incrementally from the parent recorded in the state, if
+// both still have it. The snapshot is taken as it is prepared, and backed up
+// (and verified with cshatag, read only) from.
+type btrfsBackend struct {
+	d        btrfsDest
+	st       *state
+	key      string   // Of the parent in the state
+	prefix   string   // Of the pair's snapshots
+	parent   string   // Blank to send in full
+	received []string // The pair's snapshots in the out folder
+	snap     string   // Set once taken
+	sent     bool
+}
+
+func openBtrfs(out string, st *state) (backend, error) {
+	d, _, err := btrfsTarget(out)
+	if err != nil {
+		return nil, err
+	}
+	return &btrfsBackend{d: d, st: st}, nil
+}
+
+func (b *btrfsBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	d := b.d
+	if cfg.Btrfs.SnapshotDir == "" {
+		return p, withExitCode(exitConfig, errors.New("btrfs: outputs need a Btrfs SnapshotDir, on the in folder's filesystem"))
+	}
+	_, err := btrfsShow("", "", p.In)
+	if err != nil {
+		return p, withExitCode(exitConfig, fmt.Errorf("in folder: btrfs: outputs need the in folder to be a subvolume: %w", err))
+	}
+	err = withRunTimeout("folder check", func() error { return checkBtrfsDest(d) })
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out folder: %w", err))
+	}
+	err = os.MkdirAll(cfg.Btrfs.SnapshotDir, 0700)
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("could not create the SnapshotDir: %w", err))
+	}
+
+	// The parent is as recorded, if both still have it
+	b.prefix = btrfsSnapPrefix(p)
+	b.key = p.In + " -> " + p.Out
+	stateMu.Lock()
+	parent := b.st.BtrfsParents[b.key]
+	stateMu.Unlock()
+	b.received, err = btrfsReceived(d, b.prefix)
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out folder: %w", err))
+	}
+	checked := []string{fmt.Sprintf("%s: OK (subvolume)", p.In), fmt.Sprintf("%s: OK", d)}
+	if parent != "" {
+		_, err := os.Stat(filepath.Join(cfg.Btrfs.SnapshotDir, parent))
+		switch {
+		case err != nil:
+			checked = append(checked, fmt.Sprintf("parent %s is gone from %s, so the snapshot is sent in full", parent, cfg.Btrfs.SnapshotDir))
+			parent = ""
+		case !slices.Contains(b.received, parent):
+			checked = append(checked, fmt.Sprintf("parent %s is gone from %s, so the snapshot is sent in full", parent, d))
+			parent = ""
+		default:
+			checked = append(checked, fmt.Sprintf("parent: %s", parent))
+		}
+	}
+	b.parent = parent
+	r.Sections = append(r.Sections, section{
+		Title: "Folders checked",
+		Detail: `This test tries to write, read, and delete a temporary file
+		in the input folder, and checks for the .backup-helper-check files of
+		the input and output folders.`,
+		LogLines: checked,
+	})
+	if cfg.dryRun {
+		return p, nil
+	}
+
+	snap := b.prefix + time.Now().UTC().Format(logDateFormat)
+	snapPath := filepath.Join(cfg.Btrfs.SnapshotDir, snap)
+	err = btrfsRun(r, "", "", "subvolume", "snapshot", "-r", p.In, snapPath)
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("could not snapshot %s: %w", p.In, err))
+	}
+	b.snap = snap
+	setSnapshotDir(snapPath, true)
+	p.Live, p.In = p.In, snapPath
+	return p, nil
+}
+
+func (b *btrfsBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "sent")
+}
+
+func (b *btrfsBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	d, parent, prefix, received := b.d, b.parent, b.prefix, b.received
+	how := "in full"
+	if parent != "" {
+		how = "incrementally from " + parent
+	}
+	if cfg.dryRun {
+		r.Sections = append(r.Sections, section{
+			Title:  "Send (dry run)",
+			Detail: fmt.Sprintf("Would snapshot %s as %s, and send it %s to %s.", p.In, filepath.Join(cfg.Btrfs.SnapshotDir, prefix+time.Now().UTC().Format(logDateFormat)), how, d),
+		})
+		return nil
+	}
+
+	snap := b.snap
+	snapPath := p.In
+	sendArgs := append([]string{"send"}, cfg.Btrfs.SendArgs...)
+	if parent != "" {
+		sendArgs = append(sendArgs, "-p", filepath.Join(cfg.Btrfs.SnapshotDir, parent))
+	}
+	sendArgs = append(sendArgs, snapPath)
+	recvArgs := append(append([]string{"receive"}, cfg.Btrfs.ReceiveArgs...), d.dir)
+	name, argv := btrfsCommand(d.host, d.port, recvArgs)
+	start := time.Now()
+	n, err := sendStream("btrfs send", append([]string{cfg.Btrfs.Path}, sendArgs...), "btrfs receive", append([]string{name}, argv...))
+	recordStep("btrfs send", append([]string{cfg.Btrfs.Path}, sendArgs...), start, err)
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("btrfs send to %s failed: %w", d, err))
+	}
+	rec.BytesSent += uint64(n)
+
+	// The received snapshot must be the one sent
+	srcInfo, err := btrfsShow("", "", snapPath)
+	if err != nil {
+		return withExitCode(exitRsync, err)
+	}
+	destInfo, err := btrfsShow(d.host, d.port, filepath.Join(d.dir, snap))
+	if err != nil {
+		return withExitCode(exitRsync, err)
+	}
+	if srcInfo["UUID"] == "" || destInfo["Received UUID"] != srcInfo["UUID"] {
+		return withExitCode(exitRsync, fmt.Errorf("%s was not received as sent (its received UUID is %s, not %s)", filepath.Join(d.dir, snap), destInfo["Received UUID"], srcInfo["UUID"]))
+	}
+	b.sent = true
+	stateMu.Lock()
+	if b.st.BtrfsParents == nil {
+		b.st.BtrfsParents = map[string]string{}
+	}
+	b.st.BtrfsParents[b.key] = snap
+	stateMu.Unlock()
+	updateState(b.st)
+
+	// Prune: the SnapshotDir only needs the new snapshot, as the next parent
+	lines := []string{
+		fmt.Sprintf("sent %s %s (%s)", snapPath, how, humanBytes(float64(n))),
+		fmt.Sprintf("received %s (received UUID %s, as sent)", filepath.Join(d.dir, snap), srcInfo["UUID"]),
+	}
+	var errs []error
+	local, err := btrfsReceived(btrfsDest{dir: cfg.Btrfs.SnapshotDir}, prefix)
+	errs = append(errs, err)
+	for _, s := range slices.DeleteFunc(local, func(s string) bool { return s == snap }) {
+		err := btrfsRun(r, "", "", "subvolume", "delete", filepath.Join(cfg.Btrfs.SnapshotDir, s))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("deleted %s", filepath.Join(cfg.Btrfs.SnapshotDir, s)))
+	}
+	received = append(received, snap)
+	if cfg.Btrfs.Keep > 0 && len(received) > cfg.Btrfs.Keep {
+		for _, s := range received[:len(received)-cfg.Btrfs.Keep] {
+			err := btrfsRun(r, d.host, d.port, "subvolume", "delete", filepath.Join(d.dir, s))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("deleted %s", filepath.Join(d.dir, s)))
+		}
+	}
+	if len(cfg.Excludes) > 0 || len(p.Excludes) > 0 {
+		lines = append(lines, "Excludes are not applied, since the whole subvolume is sent")
+	}
+	lines = append(lines, "<end of logs>")
+	r.Sections = append(r.Sections, section{
+		Title:    fmt.Sprintf("btrfs send from %s to %s", p.live(), d),
+		Detail:   fmt.Sprintf("[%s %s | %s %s]. %s", cfg.Btrfs.Path, strings.Join(sendArgs, " "), name, strings.Join(argv, " "), throughput(uint64(n), time.Since(start))),
+		LogLines: lines,
+	})
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("could not prune snapshots: %w", err)
+	}
+	logger.Info("subvolume sent", "in", p.live(), "out", d.String())
+	return nil
+}
+
+// Until it is received, the new snapshot is deleted (on both sides, as a
+// failed receive leaves a partial one).
+func (b *btrfsBackend) Cleanup(r *report) error {
+	if b.snap == "" {
+		return nil
+	}
+	snapPath := filepath.Join(cfg.Btrfs.SnapshotDir, b.snap)
+	setSnapshotDir(snapPath, false)
+	if b.sent {
+		return nil
+	}
+	err := btrfsCleanup(r, "", "", "subvolume", "delete", snapPath)
+	if names, _ := btrfsReceived(b.d, b.prefix); slices.Contains(names, b.snap) {
+		err = errors.Join(err, btrfsCleanup(r, b.d.host, b.d.port, "subvolume", "delete", filepath.Join(b.d.dir, b.snap)))
+	}
+	return err
+}
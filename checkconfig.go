@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// The result of one check-config (or doctor) check.
+type check struct {
+	Name string
+	Err  error
+	Info string // Shown on a pass
+	Hint string // How to fix a fail
+}
+
+func (c check) String() string {
+	if c.Err != nil {
+		// Joined errors get a line each
+		msg := strings.ReplaceAll(c.Err.Error(), "\n", "\n      - ")
+		if c.Hint != "" {
+			msg += "\n       hint: " + c.Hint
+		}
+		return fmt.Sprintf("[FAIL] %s: %s", c.Name, msg)
+	}
+	if c.Info != "" {
+		return fmt.Sprintf("[PASS] %s: %s", c.Name, c.Info)
+	}
+	return fmt.Sprintf("[PASS] %s", c.Name)
+}
+
+// Checks that a backup could run with the config (without running one), and
+// prints a pass/fail line per check.
+func checkConfig(opts options) error {
+	var checks []check
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		checks = append(checks, check{Name: "config loaded", Err: err})
+	} else {
+		checks = append(checks, check{Name: "config loaded", Info: strings.Join(cfg.files, ", ")})
+		checks = append(checks, mailChecks()...)
+	}
+	bins := []string{"cshatag", "rsync"}
+	if cfg != nil {
+		bins = []string{cfg.CshatagPath, cfg.RsyncPath}
+		if nativeChecksums() {
+			bins = bins[1:]
+		}
+	}
+	for _, bin := range bins {
+		path, err := exec.LookPath(bin)
+		if err != nil && cfg != nil && bin == cfg.RsyncPath && cfg.CopyEngine != copyEngineRsync {
+			checks = append(checks, check{Name: bin + " installed", Info: "no, so local out folders are synced with the built in engine"})
+			continue
+		}
+		checks = append(checks, check{Name: bin + " installed", Err: err, Info: path})
+	}
+
+	failed := printChecks("Backup Helper config check", checks)
+	if failed > 0 {
+		return fmt.Errorf("%d config check(s) failed", failed)
+	}
+	return nil
+}
+
+// Prints a line per check, and returns how many failed.
+func printChecks(title string, checks []check) int {
+	var lines []string
+	failed := 0
+	for _, c := range checks {
+		lines = append(lines, c.String())
+		if c.Err != nil {
+			failed++
+		}
+	}
+	printReport(report{
+		Title:  title,
+		Detail: fmt.Sprintf("%d of %d checks passed.", len(checks)-failed, len(checks)),
+		Sections: []section{{
+			Title:    "Checks",
+			LogLines: lines,
+		}},
+	})
+	return failed
+}
+
+func mailChecks() []check {
+	var checks []check
+	for _, f := range []struct{ name, value string }{{"FromMail", cfg.FromMail}, {"ToMail", cfg.ToMail}} {
+		c := check{Name: f.name + " set", Info: f.value}
+		if f.value == "" {
+			c.Err = fmt.Errorf("%s is required", f.name)
+		}
+		checks = append(checks, c)
+	}
+	if cfg.OutboxOnly {
+		return append(checks, check{Name: "mail server", Info: "skipped, since OutboxOnly is set"})
+	}
+
+	for i, srv := range cfg.mailServers() {
+		name := fmt.Sprintf("mail server %d (%s:%d)", i+1, srv.Host, srv.Port)
+		if srv.Host == "" || srv.Port == 0 {
+			checks = append(checks, check{Name: name, Err: errors.New("host and port are required")})
+			continue
+		}
+		addrs, err := net.LookupHost(srv.Host)
+		checks = append(checks, check{Name: name + " resolves", Err: err, Info: strings.Join(addrs, ", "),
+			Hint: "check the host name, and this machine's DNS"})
+		if err != nil {
+			continue
+		}
+		client, err := mailClient(srv)
+		if err == nil {
+			client.Close()
+		}
+		checks = append(checks, check{Name: name + " accepts connection", Err: err,
+			Hint: "check the port, encryption, user and pass - and that a firewall allows the connection"})
+	}
+	return checks
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type options struct {
+	ConfigDir   string
+	ConfigFile  string
+	AgeIdentity string
+	EnvFile     string
+	In          string
+	Out         string
+
+	DryRun     bool
+	NoDelete   bool
+	Force      bool
+	VerifyOnly bool
+	Offsite    bool
+	TUI        bool
+	SkipVerify bool
+
+	NoMail          bool
+	MailOnErrorOnly bool
+	// Override the BwLimit, Nice and IONice config, if set
+	BwLimit string
+	Nice    int
+	IONice  string
+	// Override the ToMail and SubjectPrefix config (also of jobs), if set
+	MailTo        string
+	SubjectPrefix string
+
+	// Overrides the LogLevel config, if set
+	LogLevel string
+	// Only log to the log file (and report), not stderr
+	Quiet bool
+
+	ValidatePaths bool
+
+	// Added to the Excludes config
+	Excludes stringsFlag
+
+	SourcesFrom string
+	// Given as in:out positional args, instead of a single in and out
+	Pairs []folderPair
+
+	// text (the default), or json to print the result on stdout at the end
+	Output string
+
+	// Labels the run, in the log file name, the mail subject and the history
+	Tag string
+	// Labels the tape a tar: stream is written to, in the catalog (instead of
+	// the Tar TapeLabelCommand)
+	TapeLabel string
+
+	// Overrides the TimeoutSeconds config, if set
+	Timeout time.Duration
+
+	// Instead of a backup, print the Jobs in the config
+	ListJobs bool
+
+	// For history: how many of the last runs to list
+	Last int
+
+	ReportSince    string
+	ReportMail     bool
+	VerifySnapshot string
+
+	// For completion: bash, zsh or fish (or jobs, to list the job names)
+	Shell string
+
+	// The subcommand, if any (see commands)
+	Command string
+	// Set for run (or verify) without folder flags: run the named Jobs from
+	// the config (all if none are named)
+	RunJobs  bool
+	JobNames []string
+}
+
+// Subcommands, in the order shown in the usage.
+var commands = []struct{ name, desc string }{
+	{"run", "back up the named jobs (all if none are named, and names may be globs like docs-*), or the folders given with -in/-out or -sources-from"},
+	{"verify", "like run, but only run cshatag and skip the sync (same as -verify-only) - or given folders instead of jobs, only run cshatag on them"},
+	{"resume", "carry on with an interrupted (or failed) run, backing up the folders it did not get to"},
+	{"report", "mail the last report again"},
+	{"history", "list the last runs (see -last), or print them as JSON with -output json"},
+	{"version", "print the version and build info"},
+	{"check-config", "check the config, without running a backup"},
+	{"doctor", "check the tools, the folders of the named jobs (or -in/-out), the mail server and the log dir"},
+	{"init", "write a new config, asking for the settings"},
+	{"migrate-config", "upgrade an old config to the current format"},
+	{"gdrive-auth", "sign in to Google Drive, for gdrive:// outputs"},
+	{"completion", "print a shell completion script: completion bash|zsh|fish"},
+}
+
+// Commands which run a backup (or verify), so have a result for -output json.
+var resultCommands = map[string]bool{"": true, "run": true, "verify": true, "resume": true}
+
+// Commands which take no args, and need no folders.
+var noArgCommands = map[string]bool{"resume": true, "report": true, "history": true, "version": true, "check-config": true, "init": true, "migrate-config": true, "gdrive-auth": true}
+
+// The first arg may be a subcommand. Without one, folders can be given as
+// -in/-out flags, or as positional args (but not both).
+func parseArgs(args []string) (options, error) {
+	var o options
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				o.Command, args = args[0], args[1:]
+				break
+			}
+		}
+	}
+	fs := newFlagSet(&o)
+	err := fs.Parse(args)
+	if err != nil {
+		return o, err
+	}
+	pos := fs.Args()
+	switch {
+	case o.Output != "text" && o.Output != "json":
+		return o, fmt.Errorf("invalid -output %q: expect text or json", o.Output)
+	case o.Output == "json" && !resultCommands[o.Command] && o.Command != "history":
+		return o, fmt.Errorf("-output json can't be used with %s", o.Command)
+	case o.Output == "json" && (o.TUI || o.ValidatePaths || o.ReportSince != ""):
+		return o, errors.New("-output json can't be used with -tui, -validate-paths or -report-since, since they print to stdout too")
+	}
+	err = validatePriority(&config{BwLimit: o.BwLimit, Nice: o.Nice, IONice: o.IONice})
+	if err != nil {
+		return o, fmt.Errorf("invalid flag: %w", err)
+	}
+	if o.SkipVerify && (o.VerifyOnly || o.Command == "verify") {
+		return o, errors.New("-skip-verify can't be used with verify, since then there is nothing to do")
+	}
+	if !tagRe.MatchString(o.Tag) {
+		return o, fmt.Errorf("invalid -tag %q: may only have letters, digits, and . _ -", o.Tag)
+	}
+	if o.LogLevel != "" {
+		var l slog.Level
+		err = l.UnmarshalText([]byte(o.LogLevel))
+		if err != nil {
+			return o, fmt.Errorf("invalid -log-level: %w", err)
+		}
+	}
+
+	// No folders needed
+	if o.ReportSince != "" || o.ListJobs {
+		return o, nil
+	}
+	if noArgCommands[o.Command] {
+		if len(pos) > 0 {
+			return o, fmt.Errorf("%s takes no args", o.Command)
+		}
+		return o, nil
+	}
+	if o.Command == "completion" {
+		if len(pos) != 1 {
+			return o, errors.New("completion takes one arg: bash, zsh or fish")
+		}
+		o.Shell = pos[0]
+		return o, nil
+	}
+	if o.Command == "verify" {
+		o.VerifyOnly = true
+	}
+	if o.Command != "" {
+		if o.VerifySnapshot != "" {
+			return o, fmt.Errorf("-verify-restore can't be used with %s", o.Command)
+		}
+		// Folders come from flags, else the args are job names
+		if o.In != "" || o.Out != "" || o.SourcesFrom != "" {
+			if len(pos) > 0 {
+				return o, fmt.Errorf("%s takes either job names or folder flags, not both", o.Command)
+			}
+			if o.Out == "" {
+				return o, errors.New("no output folder given")
+			}
+			return o, nil
+		}
+		o.RunJobs, o.JobNames = true, pos
+		return o, nil
+	}
+
+	wantOut := o.VerifySnapshot == ""
+	if o.In != "" || o.Out != "" {
+		if len(pos) > 0 {
+			return o, errors.New("give folders either as -in/-out flags or as positional args, not both")
+		}
+	} else if wantOut && allPairs(pos) {
+		for _, a := range pos {
+			in, out, _ := cutPair(a)
+			if in == "" || out == "" {
+				return o, fmt.Errorf("invalid folder pair %q: expect input:output", a)
+			}
+			o.Pairs = append(o.Pairs, folderPair{In: in, Out: out})
+		}
+		return o, nil
+	} else if wantOut {
+		// A single arg is the output folder, with the sources from a file
+		switch len(pos) {
+		case 1:
+			o.Out = pos[0]
+		case 2:
+			o.In, o.Out = pos[0], pos[1]
+		default:
+			return o, fmt.Errorf("expect exactly two args: first for input folder, second for output folder - but received %d", len(pos))
+		}
+	} else {
+		if len(pos) != 1 {
+			return o, fmt.Errorf("expect exactly one arg with -verify-restore: the input folder - but received %d", len(pos))
+		}
+		o.In = pos[0]
+	}
+
+	// The input folder may come from a sources file, which is checked later
+	if !wantOut && o.In == "" {
+		return o, errors.New("no input folder given")
+	}
+	if wantOut && o.Out == "" {
+		return o, errors.New("no output folder given")
+	}
+	return o, nil
+}
+
+// Whether the args are all input:output folder pairs. If only some have a
+// colon (after any drive letter), they are taken as plain folders (which may
+// have colons in them).
+func allPairs(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for _, a := range args {
+		if _, _, ok := cutPair(a); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// E.g. C:\ or D:/ - so that C:\src isn't taken for a pair, on any OS.
+var drivePrefixRe = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// The input and output folders of an input:output pair, split at the first
+// colon after any drive letter (or UNC volume) the input starts with, so that
+// C:\src:D:\dst is a pair but C:\src is not.
+func cutPair(a string) (string, string, bool) {
+	n := len(filepath.VolumeName(a))
+	if n == 0 && drivePrefixRe.MatchString(a) {
+		n = 2
+	}
+	i := strings.IndexByte(a[n:], ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return a[:n+i], a[n+i+1:], true
+}
+
+// The flags, set on o when parsed.
+func newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("backup-helper", flag.ContinueOnError)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintln(w, "Usage: backup-helper [command] [flags] [args]")
+		fmt.Fprintln(w, "\nWithout a command, the args are the input and output folders (or just the output folder, with -sources-from),")
+		fmt.Fprintln(w, "or any number of input:output folder pairs, backed up in one run with a combined report.")
+		fmt.Fprintln(w, "\nCommands:")
+		for _, c := range commands {
+			fmt.Fprintf(w, "  %-15s %s\n", c.name, c.desc)
+		}
+		fmt.Fprintln(w, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.ConfigDir, "config-dir", "", "dir with config.json (or config.yaml) and optional conf.d/*.json drop-ins (default: merge /etc/backup-helper, ~/.config/backup-helper and PWD)")
+	fs.StringVar(&o.ConfigFile, "config", "", "config file (instead of -config-dir), with any conf.d drop-ins next to it (default $BACKUP_HELPER_CONFIG)")
+	fs.StringVar(&o.AgeIdentity, "age-identity", "", "identity file for decrypting a .age config (default $BACKUP_HELPER_AGE_IDENTITY, else age prompts for a passphrase)")
+	fs.StringVar(&o.EnvFile, "env-file", "", "dotenv file to load, besides any .env next to the config")
+	fs.StringVar(&o.In, "in", "", "input folder (instead of the first positional arg)")
+	fs.StringVar(&o.Out, "out", "", "output folder (instead of the second positional arg)")
+	fs.StringVar(&o.SourcesFrom, "sources-from", "", "file of input folders (one per line), each backed up into a subfolder of the output folder")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "run cshatag and rsync without changing anything")
+	fs.BoolVar(&o.NoDelete, "no-delete", false, "don't delete files in the output folder (overrides the Delete config)")
+	fs.BoolVar(&o.Force, "force", false, "go ahead with the sync even if it would delete more than MaxDeletes files, without asking")
+	fs.Var(&o.Excludes, "exclude", "rsync exclude pattern, added to the Excludes config (may be repeated)")
+	fs.BoolVar(&o.VerifyOnly, "verify-only", false, "only run cshatag (read only), and skip the sync")
+	fs.BoolVar(&o.Offsite, "offsite", false, "back up to the jobs' Offsite destinations too, even if they are not due")
+	fs.BoolVar(&o.SkipVerify, "skip-verify", false, "skip cshatag, and only sync (e.g. for a quick sync of a big tree)")
+	fs.StringVar(&o.BwLimit, "bwlimit", "", "limit the sync's bandwidth, as per rsync --bwlimit (e.g. 10M) - overrides the BwLimit config")
+	fs.IntVar(&o.Nice, "nice", 0, "run the commands at this niceness (-20 to 19) - overrides the Nice config")
+	fs.StringVar(&o.IONice, "ionice", "", "run the commands with this ionice class and optional :level (e.g. idle, or best-effort:7) - overrides the IONice config")
+	fs.BoolVar(&o.NoMail, "no-mail", false, "don't mail any report (e.g. for a manual test run)")
+	fs.StringVar(&o.MailTo, "mail-to", "", "mail the report(s) here, instead of to the ToMail config (of the jobs too)")
+	fs.StringVar(&o.SubjectPrefix, "subject-prefix", "", "put this at the start of the mail subject(s), instead of the SubjectPrefix config (of the jobs too)")
+	fs.BoolVar(&o.MailOnErrorOnly, "mail-on-error-only", false, "only mail the report if the run failed (same as the MailOnFailureOnly config)")
+	fs.StringVar(&o.LogLevel, "log-level", "", "the lowest level logged: debug, info, warn or error (default the LogLevel config, else info)")
+	fs.BoolVar(&o.Quiet, "quiet", false, "don't log (or mirror cshatag and rsync output) to stderr - it still goes in the log file and report")
+	fs.DurationVar(&o.Timeout, "timeout", 0, "stop the backup after this long (e.g. 6h), still mailing the report (default the TimeoutSeconds config, else no limit)")
+	fs.StringVar(&o.Tag, "tag", "", "label for the run (e.g. weekly-full), added to the log file name, the mail subject and the history")
+	fs.StringVar(&o.TapeLabel, "tape-label", "", "label of the tape a tar: stream is written to, for the catalog (instead of the Tar TapeLabelCommand's)")
+	fs.StringVar(&o.Output, "output", "text", "text, or json to print the run's result (status, stats, and each step) as JSON on stdout at the end")
+	fs.BoolVar(&o.TUI, "tui", false, "show a live progress view instead of the log (only if stdout is a terminal)")
+	fs.BoolVar(&o.ValidatePaths, "validate-paths", false, "print the resolved paths, their usage, free space, and the rsync command - without running anything")
+	fs.BoolVar(&o.ListJobs, "list-jobs", false, "instead of a backup, list the Jobs in the config")
+	fs.IntVar(&o.Last, "last", 20, "with history, how many of the last runs to list (0 for all)")
+	fs.StringVar(&o.ReportSince, "report-since", "", "instead of a backup, summarise the history since this date (YYYY-MM-DD)")
+	fs.BoolVar(&o.ReportMail, "report-mail", false, "with -report-since, also mail the summary")
+	fs.StringVar(&o.VerifySnapshot, "verify-restore", "", "instead of a backup, compare this backup/snapshot folder with the input folder, without changing anything")
+	return fs
+}
+
+// Tags go in file names, so are kept simple.
+var tagRe = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// A flag which may be repeated, collecting each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// Set at build time (see make build), e.g. with -ldflags "-X main.version=v1.2.3
+// -X main.commit=0a1b2c3 -X main.buildDate=2024-05-01T10:00:00Z". Without
+// them, the commit and its time come from the VCS info go build embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// The optional features built in. The files implementing them (e.g. for an
+// OS) add to this in init.
+var features []string
+
+type buildMeta struct {
+	Version   string
+	Commit    string
+	Modified  bool   // Built from a tree with uncommitted changes
+	BuildDate string // Else the commit's time, if known
+	Go        string // Version and platform
+	Features  []string
+}
+
+func readBuildMeta() buildMeta {
+	m := buildMeta{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Go:        fmt.Sprintf("%s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		Features:  slices.Clone(features),
+	}
+	slices.Sort(m.Features)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return m
+	}
+	if m.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		m.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if m.Commit == "" {
+				m.Commit = s.Value
+			}
+		case "vcs.time":
+			if m.BuildDate == "" {
+				m.BuildDate = s.Value + " (commit time)"
+			}
+		case "vcs.modified":
+			m.Modified = s.Value == "true"
+		}
+	}
+	return m
+}
+
+func printVersion() {
+	m := readBuildMeta()
+	fmt.Printf("backup-helper %s\n", m.Version)
+	if m.Commit != "" {
+		modified := ""
+		if m.Modified {
+			modified = " (modified)"
+		}
+		fmt.Printf("commit: %s%s\n", m.Commit, modified)
+	}
+	if m.BuildDate != "" {
+		fmt.Printf("built: %s\n", m.BuildDate)
+	}
+	fmt.Printf("go: %s\n", m.Go)
+	if len(m.Features) == 0 {
+		fmt.Println("features: none")
+	} else {
+		fmt.Printf("features: %s\n", strings.Join(m.Features, ", "))
+	}
+}
+
+// One line of the build metadata, for the report footer.
+func versionSummary() string {
+	m := readBuildMeta()
+	parts := []string{m.Version}
+	if m.Commit != "" {
+		c := m.Commit
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		if m.Modified {
+			c += "+modified"
+		}
+		parts = append(parts, "commit "+c)
+	}
+	if buildDate != "" {
+		parts = append(parts, "built "+buildDate)
+	}
+	parts = append(parts, m.Go)
+	if len(m.Features) > 0 {
+		parts = append(parts, "features: "+strings.Join(m.Features, ", "))
+	}
+	return "backup-helper " + strings.Join(parts, ", ")
+}
+
+// Kept unredacted, like the log file - the redaction is done when mailing.
+func saveLastReport(r report) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("could not marshal report: %w", err)
+	}
+	err = os.WriteFile(cfg.LastReportFile, b, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write last report file %s: %w", cfg.LastReportFile, err)
+	}
+	return nil
+}
+
+// Mails the last run's report again, with a new Message-ID.
+func resendReport(opts options) error {
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(cfg.LastReportFile)
+	if err != nil {
+		return fmt.Errorf("could not read last report file (has a run mailed a report yet?): %w", err)
+	}
+	var r report
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return fmt.Errorf("could not parse last report file %s: %w", cfg.LastReportFile, err)
+	}
+	r.Title += " (resent)"
+	r.MessageID = ""
+	logger.Info("resending last report", "title", r.Title)
+	return sendMail(r)
+}
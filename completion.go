@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Prints the completion script for the shell. The scripts complete job names
+// by running "backup-helper completion jobs", which lists the Jobs in the
+// (default) config.
+func printCompletion(opts options) error {
+	switch opts.Shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	case "jobs":
+		err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+		if err != nil {
+			return err
+		}
+		for _, j := range cfg.Jobs {
+			fmt.Println(j.Name)
+		}
+	default:
+		return fmt.Errorf("no completion for shell %q: expect bash, zsh or fish", opts.Shell)
+	}
+	return nil
+}
+
+type completionFlag struct {
+	name, usage string
+	takesValue  bool
+}
+
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	newFlagSet(&options{}).VisitAll(func(f *flag.Flag) {
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{
+			name:       f.Name,
+			usage:      f.Usage,
+			takesValue: !ok || !bf.IsBoolFlag(),
+		})
+	})
+	return flags
+}
+
+func commandNames() []string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func bashCompletion() string {
+	var flags []string
+	for _, f := range completionFlags() {
+		flags = append(flags, "-"+f.name)
+	}
+	return fmt.Sprintf(`# bash completion for backup-helper
+_backup_helper() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W %s -- "$cur"))
+        return
+    fi
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W %s -- "$cur") $(compgen -d -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+    run|verify)
+        COMPREPLY=($(compgen -W "$(backup-helper completion jobs 2>/dev/null)" -- "$cur"))
+        ;;
+    completion)
+        COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+        ;;
+    *)
+        COMPREPLY=($(compgen -d -- "$cur"))
+        ;;
+    esac
+}
+complete -F _backup_helper backup-helper
+`, shQuote(strings.Join(flags, " ")), shQuote(strings.Join(commandNames(), " ")))
+}
+
+func zshCompletion() string {
+	var cmds, flags []string
+	for _, c := range commands {
+		cmds = append(cmds, shQuote(c.name+":"+c.desc))
+	}
+	for _, f := range completionFlags() {
+		flags = append(flags, "-"+f.name)
+	}
+	return fmt.Sprintf(`#compdef backup-helper
+_backup_helper() {
+    local -a commands flags
+    commands=(%s)
+    flags=(%s)
+    if [[ $words[CURRENT] == -* ]]; then
+        compadd -- $flags
+        return
+    fi
+    if (( CURRENT == 2 )); then
+        _describe command commands
+        _files -/
+        return
+    fi
+    case $words[2] in
+    run|verify)
+        compadd -- ${(f)"$(backup-helper completion jobs 2>/dev/null)"}
+        ;;
+    completion)
+        compadd bash zsh fish
+        ;;
+    *)
+        _files -/
+        ;;
+    esac
+}
+compdef _backup_helper backup-helper
+`, strings.Join(cmds, " "), strings.Join(flags, " "))
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString("# fish completion for backup-helper\n")
+	b.WriteString("complete -c backup-helper -f\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c backup-helper -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.desc))
+	}
+	b.WriteString("complete -c backup-helper -n '__fish_seen_subcommand_from run verify' -a '(backup-helper completion jobs 2>/dev/null)'\n")
+	b.WriteString("complete -c backup-helper -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	b.WriteString("complete -c backup-helper -n 'not __fish_seen_subcommand_from run verify completion' -a '(__fish_complete_directories)'\n")
+	for _, f := range completionFlags() {
+		req := ""
+		if f.takesValue {
+			req = " -r -F"
+		}
+		fmt.Fprintf(&b, "complete -c backup-helper -o %s%s -d %s\n", f.name, req, fishQuote(f.usage))
+	}
+	return b.String()
+}
+
+// Single quoted for bash or zsh.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Single quoted for fish, which allows escaped quotes (and backslashes) inside.
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
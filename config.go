@@ -0,0 +1,818 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	// Matches json tags directly
+
+	MailHost       string
+	MailPort       int
+	MailUser       string
+	MailPass       string
+	MailEncryption string
+
+	// Instead of MailPass: a command (+ args) whose first line of output is
+	// the pass, or an OS keyring entry holding it.
+	MailPassCommand []string
+	MailPassKeyring *keyringRef
+
+	FromMail string
+	ToMail   string
+	// Put at the start of the mail subject, e.g. "[nas]"
+	SubjectPrefix string
+
+	// Servers to try in order, if the first fails. If empty, the Mail* fields
+	// above are the only server.
+	MailServers []mailServer
+
+	// A netrc-style file whose entry for each mail server's host (or default
+	// entry) overrides the user and pass.
+	NetrcFile string
+
+	// Number of times to try sending the mail, waiting MailRetrySeconds
+	// (times the attempt number) in between.
+	MailAttempts     int
+	MailRetrySeconds int
+
+	// Write the complete mail message (RFC 822) into this dir, for an external
+	// agent to deliver. If OutboxOnly is set, it is not sent via SMTP.
+	OutboxDir  string
+	OutboxOnly bool
+
+	// Section logs bigger than this (in bytes) go in a collapsed block in the
+	// mail. 0 means never.
+	LogCollapseBytes int
+	// Section logs bigger than this (in bytes) are gzipped and attached to the
+	// mail instead. 0 means never.
+	LogAttachBytes int
+
+	// Connect to the mail server before the backup, so that problems are seen early.
+	ProbeMail bool
+	// Abort the run if the probe fails (otherwise just warn).
+	ProbeMailFatal bool
+
+	// Only mail the report if the run failed, or (for MailOnChangeOnly) if it
+	// failed or rsync changed any files.
+	MailOnFailureOnly bool
+	MailOnChangeOnly  bool
+
+	// If set, only run if this file exists, and remove it after a successful
+	// run. If it does not exist, the run exits without sending mail.
+	TriggerFile string
+
+	// Only run within these daily windows. Outside of them, the run is skipped
+	// (or, if WaitForWindow is set, waits for the next window).
+	AllowedWindows []timeWindow
+	WaitForWindow  bool
+
+	// Which config files were loaded, in order
+	files []string
+	// The config as loaded, as JSON - before the flags override any of it
+	// (see applyOptions), since those are one-off
+	loaded []byte
+	// Set by the -dry-run and -no-mail flags
+	dryRun     bool
+	noMail     bool
+	skipVerify bool
+	force      bool
+	// Set by the resume command
+	resume bool
+	// Set by the -tag flag
+	tag string
+	// Set by the -tape-label flag
+	tapeLabel string
+
+	// Keep only this many of the newest log files (and rsync log files). 0
+	// means keep all.
+	LogKeep int
+
+	// Where the log file goes (default PWD), and its name, in which {date},
+	// {job} (the job names, or "backup") and {hostname} are replaced.
+	LogDir         string
+	LogNamePattern string
+
+	// Have rsync write its own log (via --log-file) next to the log file, with
+	// an optional --log-file-format.
+	RsyncLogFile   bool
+	RsyncLogFormat string
+	rsyncLogPath   string
+
+	// Fail the run (stopping any running command) if the log file would grow
+	// beyond this many bytes. 0 means no limit.
+	MaxLogBytes int64
+
+	// Stop the backup (i.e. its commands and folder checks) after this many
+	// seconds, so that e.g. a hung mount still gets a report mailed. The
+	// -timeout flag overrides it. 0 means no limit.
+	TimeoutSeconds int
+	// Stop any one cshatag or rsync command after this many seconds. 0 means
+	// no limit.
+	CshatagTimeoutSeconds int
+	RsyncTimeoutSeconds   int
+	// For connecting to the mail server, and for sending to it. 0 means the
+	// default of 10 seconds each.
+	MailTimeoutSeconds int
+
+	// The lowest level logged: debug, info (the default), warn or error. The
+	// -log-level flag overrides it.
+	LogLevel string
+	logLevel slog.Level
+
+	// Where info is kept between runs (e.g. to detect config changes).
+	StateFile string
+	// Each run is recorded as a line of JSON here.
+	HistoryFile string
+	// The last run's report is kept here, for the report command.
+	LastReportFile string
+
+	// A file of input folders (one per line, ignoring blank lines and #
+	// comments), each backed up into a subfolder (named after it) of the output
+	// folder.
+	SourcesFile string
+
+	// Named backups, run in order by "backup-helper run [job...]".
+	Jobs []job
+
+	// Run (as command + args) before the folder checks, e.g. to bring up a
+	// tunnel. The run is aborted if it fails.
+	ConnectCommand []string
+	// Always run at the end of the run, if set.
+	DisconnectCommand []string
+
+	// Shares to mount (after the ConnectCommand) before the folder checks, if
+	// not mounted already - and to unmount at the end.
+	Mounts []mountConfig
+
+	// Run (as command + args) if cshatag finds corrupt files, with the files
+	// appended as extra args.
+	OnCorruptionCommand []string
+
+	// Before syncing, check that the output filesystem keeps xattrs,
+	// permissions, and hard links, warning in the report if not.
+	CheckFeatures bool
+
+	// Before syncing, check that the output filesystem has enough free bytes
+	// and inodes for what the sync would add, plus these margins.
+	CheckFreeSpace   bool
+	FreeBytesMargin  uint64
+	FreeInodesMargin uint64
+
+	// Pass -dry-run to cshatag, so that stored checksums are never changed
+	// (needs cshatag v2.1+).
+	CshatagDryRun bool
+
+	// rsync --exclude and --include patterns for every sync (and the rsync
+	// checks), e.g. "node_modules/". Includes win over excludes.
+	Excludes []string
+	Includes []string
+
+	// Whether rsync deletes files in the output folder which are no longer in
+	// the input folder (default true).
+	Delete bool
+	// Limit the sync's bandwidth, as per rsync's --bwlimit (e.g. "10M").
+	BwLimit string
+	// Run the commands at this niceness (-20 to 19), and with this ionice
+	// class (realtime, best-effort, idle, or 1 to 3) and optional :level (0
+	// to 7), e.g. "best-effort:7". The -bwlimit, -nice and -ionice flags
+	// override these.
+	Nice   int
+	IONice string
+
+	// If the sync would delete more than this many files (as per a dry run
+	// first), ask to go ahead - or if not on a terminal, fail unless -force is
+	// given. Guards against e.g. an empty input folder wiping the output. 0
+	// means no limit.
+	MaxDeletes int
+
+	// For out folders given as restic:<repository> or borg:<repository>,
+	// instead of rsync.
+	Restic resticConfig
+	Borg   borgConfig
+	// For out folders given as tar:<path>, written as an archive.
+	Tar tarConfig
+	// For snapshots of in folders on ZFS, and out folders given as
+	// zfs:pool/dataset, sent to with zfs send.
+	ZFS zfsConfig
+	// For snapshots of in folders on LVM logical volumes.
+	LVM lvmConfig
+	// For out folders given as btrfs:<dir>, sent to with btrfs send.
+	Btrfs btrfsConfig
+	// For out folders given as s3://bucket/prefix, uploaded to natively.
+	S3 s3Config
+	// For out folders given as b2://bucket/prefix.
+	B2 b2Config
+	// For out folders given as azure://container/prefix.
+	Azure azureConfig
+	// For out folders given as gdrive://<folder path>.
+	GDrive gdriveConfig
+	// For out folders given as [user@]host:/path or sftp://[user@]host[:port]/path.
+	SSH sshConfig
+	// For out folders given as davs://host/path (or dav://).
+	WebDAV webdavConfig
+	// For out folders given as rclone:<remote>:<path>, synced to with rclone.
+	Rclone rcloneConfig
+	// Encrypts tar: archives, and files uploaded to object stores.
+	Encryption encryptionConfig
+
+	// Force permissions and ownership on the output, as per rsync's --chmod,
+	// --chown, --usermap and --groupmap options.
+	Chmod    string
+	Chown    string
+	Usermap  string
+	Groupmap string
+
+	// Max number of created/deleted files to list in the report. 0 means no
+	// limit.
+	ChangeListMax int
+
+	// Run cshatag on the input folder in dry run mode, for read-only sources.
+	// Files tagged before the source became read-only are still checked.
+	CshatagReadOnlyInput bool
+
+	// After syncing, do a checksum-based rsync dry run and fail if it finds
+	// any differences.
+	DoubleCheckChecksum bool
+	// After syncing (and writing any manifest), hash each file synced in the
+	// out folder, and fail if any differs from the checksum stored with the
+	// in folder's file (or is missing). Hashes in the manifest just written
+	// are used rather than hashing again.
+	VerifyDestination bool
+
+	// After syncing, write a manifest (for sha256sum -c, or as for the
+	// HashAlgorithm) of the out folder into it, keeping LogKeep of them.
+	WriteManifest bool
+	// sums (as sha256sum lists files) or sfv (of CRC-32s, as cksfv writes).
+	// Either lists each file's size too, in comments.
+	ManifestFormat  string
+	ManifestSigning manifestSigningConfig
+
+	// Regexes for text to replace with [redacted] in the mail report (but not
+	// the log file), e.g. sensitive filenames.
+	RedactPatterns []string
+	redactRes      []*regexp.Regexp
+
+	// The binaries to run (looked up in PATH if not a path), e.g. a local build
+	// or a wrapper script, and extra args for each. rsync's extra args are
+	// used for every rsync run, before the folders.
+	CshatagPath      string
+	RsyncPath        string
+	RobocopyPath     string
+	CshatagExtraArgs []string
+	RsyncExtraArgs   []string
+	// How local out folders are synced: auto (rsync if installed, else
+	// robocopy on Windows, else the built in engine), rsync, native or
+	// robocopy.
+	CopyEngine string
+	// How checksums are checked and stored: auto (the built in engine on
+	// Windows, with NTFS streams, and on Linux if cshatag is not installed,
+	// else cshatag), cshatag or native.
+	ChecksumEngine string
+	// The hash algorithm of the checksums and manifests: sha256, sha512,
+	// blake3 (multithreaded for big files) or xxh3 (fastest, but not
+	// cryptographic). Any but sha256 need the native ChecksumEngine, and are
+	// stored apart from cshatag's checksums.
+	HashAlgorithm string
+
+	// Extra env vars for executed commands, merged over the inherited env.
+	CommandEnv map[string]string
+	// Keyed by the binary's base name (e.g. "rsync"), merged over CommandEnv.
+	CommandEnvOverrides map[string]map[string]string
+}
+
+type mailServer struct {
+	Host       string
+	Port       int
+	User       string
+	Pass       string
+	Encryption string // SSL/TLS or STARTTLS
+
+	// Instead of Pass, as for MailPassCommand and MailPassKeyring
+	PassCommand []string
+	PassKeyring *keyringRef
+}
+
+func (c *config) mailServers() []mailServer {
+	if len(c.MailServers) > 0 {
+		return c.MailServers
+	}
+	return []mailServer{{
+		Host:       c.MailHost,
+		Port:       c.MailPort,
+		User:       c.MailUser,
+		Pass:       c.MailPass,
+		Encryption: c.MailEncryption,
+	}}
+}
+
+// Fields which should never be written to the state file or the report. For
+// maps, only the values are secret. "A.B" means field B of A, or of each
+// element of A.
+var secretConfigFields = []string{"MailPass", "MailServers.Pass", "Restic.Password", "Borg.Passphrase", "S3.SecretAccessKey", "S3.SessionToken", "Mounts.Password", "WebDAV.Password", "B2.ApplicationKey", "Azure.AccountKey", "Azure.SASToken", "GDrive.ClientSecret", "CommandEnv", "CommandEnvOverrides"}
+
+const redacted = "[redacted]"
+
+var cfg *config
+
+// Loads each config file (see configFiles), each followed by any conf.d/*.json
+// drop-ins next to it in lexical order, each overriding what came before. Sets
+// on cfg global var.
+func loadConfig(dir string, file string) error {
+	bases, err := configFiles(dir, file)
+	if err != nil {
+		return err
+	}
+	err = loadDotenvs(bases)
+	if err != nil {
+		return err
+	}
+
+	c := config{
+		Delete:           true,
+		ChangeListMax:    100,
+		MailAttempts:     3,
+		MailRetrySeconds: 10,
+		StateFile:        "backup-helper-state.json",
+		HistoryFile:      "backup-helper-history.jsonl",
+		LastReportFile:   "backup-helper-last-report.json",
+		CshatagPath:      "cshatag",
+		RsyncPath:        "rsync",
+		RobocopyPath:     "robocopy",
+		CopyEngine:       copyEngineAuto,
+		ChecksumEngine:   checksumEngineAuto,
+		HashAlgorithm:    hashSHA256,
+		ManifestFormat:   manifestFormatSums,
+		Restic:           resticConfig{Path: "restic"},
+		Borg:             borgConfig{Path: "borg"},
+		Tar:              tarConfig{ZstdPath: "zstd", CatalogFile: "backup-helper-catalog.jsonl"},
+		ZFS:              zfsConfig{Path: "zfs"},
+		LVM:              lvmConfig{Path: "lvm"},
+		Btrfs:            btrfsConfig{Path: "btrfs"},
+		SSH:              sshConfig{Path: "ssh"},
+		Rclone:           rcloneConfig{Path: "rclone", Check: true},
+		B2:               b2Config{AuthURL: "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"},
+		GDrive:           gdriveConfig{OAuthURL: "https://oauth2.googleapis.com", APIURL: "https://www.googleapis.com"},
+		LogNamePattern:   defaultLogNamePattern,
+	}
+	// Every problem is collected, so that they can all be fixed in one go
+	var errs []error
+	for _, base := range bases {
+		errs = append(errs, readConfigFile(base, &c))
+		c.files = append(c.files, base)
+
+		var dropIns []string
+		for _, ext := range configExts {
+			matches, err := filepath.Glob(filepath.Join(filepath.Dir(base), "conf.d", "*"+ext))
+			if err != nil {
+				return fmt.Errorf("could not list conf.d drop-ins: %w", err)
+			}
+			dropIns = append(dropIns, matches...)
+		}
+		sort.Strings(dropIns)
+		for _, f := range dropIns {
+			errs = append(errs, readConfigFile(f, &c))
+			c.files = append(c.files, f)
+		}
+	}
+	errs = append(errs, applyEnvFields(&c))
+	err = errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	err = resolveSecrets(&c)
+	if err != nil {
+		return err
+	}
+	if c.NetrcFile != "" {
+		applyNetrc(&c)
+	}
+	if c.GDrive.TokenFile == "" {
+		// Next to the (last) config file, rather than in PWD
+		base, _ := filepath.Abs(bases[len(bases)-1])
+		c.GDrive.TokenFile = filepath.Join(filepath.Dir(base), gdriveTokenName)
+	}
+	errs = append(errs, validateRequired(&c), validateJobs(c.Jobs), validatePermissions(&c), validateCopyEngine(&c), validateChecksumEngine(&c), validateHashAlgorithms(&c), validateManifest(&c), validateVerifyDestination(&c), validatePriority(&c), validateRestic(&c), validateBorg(&c), validateTar(&c), validateZFS(&c), validateLVM(&c), validateSnapshot(&c), validateBtrfs(&c), validateEncryption(&c), validateS3(&c), validateB2(&c), validateAzure(&c), validateGDrive(&c), validateRclone(&c), validateMounts(c.Mounts))
+	for i := range c.AllowedWindows {
+		err = c.AllowedWindows[i].parse()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid AllowedWindows entry %d: %w", i, err))
+		}
+	}
+	for _, t := range []struct {
+		name string
+		secs int
+	}{
+		{"TimeoutSeconds", c.TimeoutSeconds},
+		{"CshatagTimeoutSeconds", c.CshatagTimeoutSeconds},
+		{"RsyncTimeoutSeconds", c.RsyncTimeoutSeconds},
+		{"MailTimeoutSeconds", c.MailTimeoutSeconds},
+	} {
+		if t.secs < 0 {
+			errs = append(errs, fmt.Errorf("%s can't be negative, not %d", t.name, t.secs))
+		}
+	}
+	if c.LogLevel != "" {
+		err = c.logLevel.UnmarshalText([]byte(c.LogLevel))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid LogLevel: %w", err))
+		}
+	}
+	for _, p := range c.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid RedactPatterns entry %q: %w", p, err))
+			continue
+		}
+		c.redactRes = append(c.redactRes, re)
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	c.loaded, _ = json.Marshal(c)
+	cfg = &c
+
+	logger.Debug("config loaded", "files", c.files)
+	return nil
+}
+
+// Each may also be encrypted with age, with a .age suffix
+var configExts = []string{".json", ".yaml", ".yml", ".toml", ".json.age", ".yaml.age", ".yml.age", ".toml.age"}
+
+// Env var naming the config file, if neither -config nor -config-dir is given.
+const configEnv = "BACKUP_HELPER_CONFIG"
+
+// The system-wide config dir, the first layer.
+const systemConfigDir = "/etc/backup-helper"
+
+// The config files to load, in order. If a file, a dir, or BACKUP_HELPER_CONFIG
+// is given, it is the only one. Otherwise the layers are merged: the config in
+// /etc/backup-helper, then $XDG_CONFIG_HOME/backup-helper
+// (~/.config/backup-helper by default), then PWD - skipping any which don't
+// exist, but at least one must.
+func configFiles(dir string, file string) ([]string, error) {
+	switch {
+	case file != "" && dir != "":
+		return nil, errors.New("give either a config file or a config dir, not both")
+	case file != "":
+		return []string{file}, nil
+	case dir != "":
+		path, err := findConfigFile(dir)
+		return []string{path}, err
+	}
+	if env := os.Getenv(configEnv); env != "" {
+		return []string{env}, nil
+	}
+
+	dirs := []string{systemConfigDir}
+	if xdgDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(xdgDir, "backup-helper"))
+	}
+	wd, _ := os.Getwd()
+	dirs = append(dirs, wd)
+
+	var paths []string
+	var errs []error
+	seen := map[string]bool{}
+	for _, d := range dirs {
+		// E.g. when run from ~/.config/backup-helper
+		abs, _ := filepath.Abs(d)
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+		path, err := findConfigFile(d)
+		if errors.Is(err, errNoConfigFile) {
+			errs = append(errs, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return paths, nil
+}
+
+var errNoConfigFile = errors.New("could not find config.json, config.yaml, config.yml or config.toml (or a .age encrypted one)")
+
+// The one config.json, config.yaml, config.yml or config.toml (or .age
+// encrypted one) in dir.
+func findConfigFile(dir string) (string, error) {
+	var found []string
+	for _, ext := range configExts {
+		path := filepath.Join(dir, "config"+ext)
+		_, err := os.Stat(path)
+		if err == nil {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w in %s", errNoConfigFile, dir)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("found more than one config file, keep only one: %s", strings.Join(found, ", "))
+	}
+}
+
+// Unmarshals over c, so only the fields in the file are overridden.
+func readConfigFile(path string, c *config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config %s: %w", path, err)
+	}
+	plainPath, encrypted := strings.CutSuffix(path, ".age")
+	if encrypted {
+		b, err = decryptAge(path)
+		if err != nil {
+			return fmt.Errorf("could not read config %s: %w", path, err)
+		}
+	}
+	switch filepath.Ext(plainPath) {
+	case ".yaml", ".yml":
+		b, err = yamlToJSON(b)
+	case ".toml":
+		b, err = tomlToJSON(b)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+	b, err = expandEnv(b)
+	if err != nil {
+		return fmt.Errorf("could not expand config %s: %w", path, err)
+	}
+	// Typos would otherwise be silently ignored. Unknown top-level fields are
+	// all listed, while the decoder catches any (first) nested one.
+	unknown, err := unknownFields(b)
+	if err != nil {
+		return fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown field(s) in config %s: %s", path, strings.Join(unknown, ", "))
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// ${NAME}, or $${NAME} for a literal ${NAME}. A lone $ is left alone, as it
+// is common in passwords.
+var envRefRe = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replaces ${NAME} in every string value of the JSON with the env var, which
+// must be set. Numbers are kept as written, since a float64 would round big
+// uint64s (e.g. FreeBytesMargin), and write 1e21 and up as exponents.
+func expandEnv(b []byte) ([]byte, error) {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("invalid data after the top-level value")
+	}
+	unset := map[string]bool{}
+	var expand func(v any) any
+	expand = func(v any) any {
+		switch t := v.(type) {
+		case string:
+			return envRefRe.ReplaceAllStringFunc(t, func(ref string) string {
+				if strings.HasPrefix(ref, "$$") {
+					return ref[1:]
+				}
+				name := envRefRe.FindStringSubmatch(ref)[1]
+				val, ok := os.LookupEnv(name)
+				if !ok {
+					unset[name] = true
+				}
+				return val
+			})
+		case map[string]any:
+			for k, inner := range t {
+				t[k] = expand(inner)
+			}
+		case []any:
+			for i, inner := range t {
+				t[i] = expand(inner)
+			}
+		}
+		return v
+	}
+	v = expand(v)
+	if len(unset) > 0 {
+		names := make([]string, 0, len(unset))
+		for n := range unset {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unset env var(s): %s", strings.Join(names, ", "))
+	}
+	return json.Marshal(v)
+}
+
+// Top-level keys of the JSON object which are not config fields, sorted.
+func unknownFields(b []byte) ([]string, error) {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() {
+			known[strings.ToLower(f.Name)] = true
+		}
+	}
+	var unknown []string
+	for k := range m {
+		// Like json.Unmarshal, field names are matched case-insensitively
+		if !known[strings.ToLower(k)] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// Fields needed for the mail report, and sane ports.
+func validateRequired(c *config) error {
+	var errs []error
+	if c.FromMail == "" {
+		errs = append(errs, errors.New("FromMail is required"))
+	}
+	if c.ToMail == "" {
+		errs = append(errs, errors.New("ToMail is required"))
+	}
+	if c.OutboxOnly {
+		return errors.Join(errs...)
+	}
+	for i, srv := range c.mailServers() {
+		name := "MailHost"
+		port := "MailPort"
+		if len(c.MailServers) > 0 {
+			name = fmt.Sprintf("MailServers entry %d Host", i)
+			port = fmt.Sprintf("MailServers entry %d Port", i)
+		}
+		if srv.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is required (unless OutboxOnly is set)", name))
+		}
+		if srv.Port < 1 || srv.Port > 65535 {
+			errs = append(errs, fmt.Errorf("%s must be between 1 and 65535, not %d", port, srv.Port))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// YAML keys are the same as the JSON ones, so YAML is just converted to JSON
+// (to avoid needing yaml tags on every field).
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v any
+	err := yaml.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// As for YAML, e.g. a [[Jobs]] table per job.
+func tomlToJSON(b []byte) ([]byte, error) {
+	var v map[string]any
+	err := toml.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Hash of the redacted config (as JSON), since it is kept in the state file.
+// Secrets are covered by secretsHash instead.
+func configHash(b []byte) string {
+	b, _ = json.Marshal(redactedConfig(b))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Keyed hash of the whole config, so that a changed password is still
+// noticed. The key is random per install, so the hash can't be checked against
+// guessed secrets without the state file, nor matched across installs.
+func secretsHash(b []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A random key for secretsHash.
+func newSecretsKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Config (as JSON) as a field -> value map, with secrets replaced.
+func redactedConfig(b []byte) map[string]any {
+	var m map[string]any
+	json.Unmarshal(b, &m)
+	for _, f := range secretConfigFields {
+		field, inner, nested := strings.Cut(f, ".")
+		v, ok := m[field]
+		if !ok {
+			continue
+		}
+		if !nested {
+			m[field] = redactValue(v)
+			continue
+		}
+		elems, _ := v.([]any)
+		if obj, ok := v.(map[string]any); ok {
+			elems = []any{obj}
+		}
+		for _, e := range elems {
+			if em, ok := e.(map[string]any); ok {
+				if iv, ok := em[inner]; ok {
+					em[inner] = redactValue(iv)
+				}
+			}
+		}
+	}
+	return m
+}
+
+func redactValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, inner := range t {
+			t[k] = redactValue(inner)
+		}
+		return t
+	case string:
+		if t == "" {
+			return t
+		}
+		return redacted
+	case nil:
+		return nil
+	default:
+		return redacted
+	}
+}
+
+// Gives a line per field which differs, sorted by field name.
+func configDiff(prev, curr map[string]any) []string {
+	keys := map[string]bool{}
+	for k := range prev {
+		keys[k] = true
+	}
+	for k := range curr {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, k := range sorted {
+		p, _ := json.Marshal(prev[k])
+		c, _ := json.Marshal(curr[k])
+		if string(p) == string(c) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s -> %s", k, p, c))
+	}
+	return lines
+}
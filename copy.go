@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How local out folders are synced: "rsync", "native" (the built in engine,
+// which needs no rsync), "robocopy" (on Windows), or "auto" (rsync if
+// installed, else robocopy on Windows, else native).
+const (
+	copyEngineAuto     = "auto"
+	copyEngineRsync    = "rsync"
+	copyEngineNative   = "native"
+	copyEngineRobocopy = "robocopy"
+)
+
+func validateCopyEngine(c *config) error {
+	switch c.CopyEngine {
+	case copyEngineAuto, copyEngineRsync, copyEngineNative, copyEngineRobocopy:
+		return nil
+	}
+	return fmt.Errorf("CopyEngine must be auto, rsync, native or robocopy, not %q", c.CopyEngine)
+}
+
+// The engine the pair is synced with. Remote out folders always need rsync.
+func syncEngine(p folderPair) string {
+	if isRemote(p.Out) {
+		return copyEngineRsync
+	}
+	if cfg.CopyEngine != copyEngineAuto {
+		return cfg.CopyEngine
+	}
+	if _, err := exec.LookPath(cfg.RsyncPath); err == nil {
+		return copyEngineRsync
+	}
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath(cfg.RobocopyPath); err == nil {
+			return copyEngineRobocopy
+		}
+	}
+	return copyEngineNative
+}
+
+// A file, symlink or dir in the in folder.
+type copyItem struct {
+	rel  string // Relative to the in folder, with / separators
+	info fs.FileInfo
+	link string // For symlinks, the target
+}
+
+func (c copyItem) isDir() bool {
+	return c.info.IsDir()
+}
+
+func (c copyItem) isLink() bool {
+	return c.info.Mode()&fs.ModeSymlink != 0
+}
+
+// What the sync would change in the out folder.
+type copyPlan struct {
+	dirs    []copyItem // Every dir in the in folder (and the in folder itself), parents first
+	created []copyItem // Files and symlinks
+	updated []copyItem
+	same    []copyItem // Regular files with the same size and modification time
+	deleted []string   // Parents before their contents
+	skipped int        // Special files (e.g. sockets), which are not copied
+}
+
+// Compares the in and out folders by size and modification time (to the
+// second), as rsync's quick check does.
+func planCopy(p folderPair) (copyPlan, error) {
+	var plan copyPlan
+	seen := map[string]bool{}
+	err := filepath.WalkDir(p.In, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.In, fp)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && excluded(p, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			plan.skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		item := copyItem{rel: rel, info: info}
+		if item.isLink() {
+			item.link, err = os.Readlink(fp)
+			if err != nil {
+				return err
+			}
+		}
+		seen[rel] = true
+		dst, err := os.Lstat(filepath.Join(p.Out, filepath.FromSlash(rel)))
+		// ENOTDIR if a parent is a file in the out folder, to be replaced
+		if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+		switch {
+		case item.isDir():
+			plan.dirs = append(plan.dirs, item)
+		case err != nil:
+			plan.created = append(plan.created, item)
+		case item.isLink():
+			if target, lErr := os.Readlink(filepath.Join(p.Out, filepath.FromSlash(rel))); lErr != nil || target != item.link {
+				plan.updated = append(plan.updated, item)
+			}
+		case !dst.Mode().IsRegular() || dst.Size() != info.Size() || dst.ModTime().Unix() != info.ModTime().Unix():
+			plan.updated = append(plan.updated, item)
+		default:
+			plan.same = append(plan.same, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return plan, fmt.Errorf("could not compare the folders: %w", err)
+	}
+	if !p.delete() {
+		return plan, nil
+	}
+
+	err = filepath.WalkDir(p.Out, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.Out, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// Excluded files (and manifests) are kept, as by rsync
+		if excluded(p, rel, d.IsDir()) || (cfg.WriteManifest && isManifest(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !seen[rel] {
+			plan.deleted = append(plan.deleted, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return plan, fmt.Errorf("could not list the out folder: %w", err)
+	}
+	return plan, nil
+}
+
+// Syncs the pair's in folder to its out folder with the native engine, as
+// rsync would with the same config.
+func nativeSync(r *report, rec *historyRecord, p folderPair) error {
+	if len(permissionArgs()) > 0 || len(cfg.RsyncExtraArgs) > 0 {
+		return withExitCode(exitConfig, errors.New("Chmod, Chown, Usermap, Groupmap and RsyncExtraArgs need rsync, so set CopyEngine to rsync (and install it)"))
+	}
+	ctx, cancel := commandContext(cfg.RsyncPath)
+	defer cancel()
+
+	start := time.Now()
+	plan, err := planCopy(p)
+	if err != nil {
+		return withExitCode(exitRsync, err)
+	}
+	var created, updated []string
+	for _, c := range plan.created {
+		created = append(created, c.rel)
+	}
+	for _, c := range plan.updated {
+		updated = append(updated, c.rel)
+	}
+	if p.delete() && cfg.MaxDeletes > 0 && !cfg.dryRun && !cfg.force {
+		err = guardDeletes(r, p, plan.deleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lines []string
+	var sent uint64
+	var errs []error
+	if cfg.dryRun {
+		for _, rel := range created {
+			lines = append(lines, "would create "+rel)
+		}
+		for _, rel := range updated {
+			lines = append(lines, "would update "+rel)
+		}
+		for _, rel := range plan.deleted {
+			lines = append(lines, "would delete "+rel)
+		}
+	} else {
+		lines, sent, errs = applyCopy(ctx, p, plan)
+	}
+	if plan.skipped > 0 {
+		lines = append(lines, fmt.Sprintf("skipped %d special file(s) (e.g. sockets or devices), which are not copied", plan.skipped))
+	}
+	lines = append(lines, "<end of logs>")
+
+	desc := "Native copy from input to output folder"
+	if cfg.dryRun {
+		desc += " (dry run)"
+	}
+	if !p.delete() {
+		desc += " (deletions disabled)"
+	}
+	detail := "rsync is not installed, so the built in engine was used."
+	if cfg.CopyEngine == copyEngineNative {
+		detail = "CopyEngine is native, so the built in engine was used instead of rsync."
+	}
+	detail += fmt.Sprintf(" %d file(s) to create, %d to update, and %d to delete. %s",
+		len(created), len(updated), len(plan.deleted), throughput(sent, time.Since(start)))
+	if cfg.BwLimit != "" {
+		detail += " BwLimit is not applied by the built in engine."
+	}
+	r.Sections = append(r.Sections, section{Title: desc, Detail: detail, LogLines: lines})
+
+	rec.BytesSent += sent
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	rec.FilesDeleted += len(plan.deleted)
+	if cfg.dryRun {
+		addChangeSection(r, "Files that would be created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be updated", updated, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be deleted", plan.deleted, cfg.ChangeListMax)
+	} else {
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files deleted", plan.deleted, cfg.ChangeListMax)
+	}
+	err = errors.Join(errs...)
+	if ctx.Err() != nil {
+		err = errors.Join(commandTimeoutErr("native copy", ctx), err)
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("native copy failed: %w", err))
+	}
+	return nil
+}
+
+// Deletes first (children before their parents), then makes the dirs, copies
+// the files and symlinks, and sets the dirs' modes and times last (since
+// copying into them changes their times). Stops early if ctx is done.
+func applyCopy(ctx context.Context, p folderPair, plan copyPlan) (lines []string, sent uint64, errs []error) {
+	out := func(rel string) string {
+		return filepath.Join(p.Out, filepath.FromSlash(rel))
+	}
+	fail := func(what string, rel string, err error) {
+		errs = append(errs, fmt.Errorf("%s %s: %w", what, rel, err))
+		lines = append(lines, fmt.Sprintf("FAILED to %s %s: %s", what, rel, err))
+	}
+
+	for i := len(plan.deleted) - 1; i >= 0; i-- {
+		rel := plan.deleted[i]
+		err := os.Remove(out(rel))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if entries, rErr := os.ReadDir(out(rel)); rErr == nil && len(entries) > 0 {
+				lines = append(lines, "kept dir "+rel+", since it has excluded files")
+				continue
+			}
+			fail("delete", rel, err)
+			continue
+		}
+		lines = append(lines, "deleted "+rel)
+	}
+
+	for _, d := range plan.dirs {
+		dst := out(d.rel)
+		info, err := os.Lstat(dst)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = nil
+		case err == nil && !info.IsDir():
+			err = replaceable(p, dst, info)
+			if err == nil {
+				lines = append(lines, "replaced "+d.rel+" with a dir")
+			}
+		}
+		if err == nil {
+			err = os.MkdirAll(dst, 0700)
+		}
+		if err != nil {
+			fail("create dir", d.rel, err)
+		}
+	}
+
+	copyItems := func(items []copyItem, verb string) {
+		for _, c := range items {
+			if ctx.Err() != nil {
+				return
+			}
+			src := filepath.Join(p.In, filepath.FromSlash(c.rel))
+			var err error
+			if c.isLink() {
+				err = copySymlink(p, c, out(c.rel))
+			} else {
+				err = copyFile(ctx, p, src, out(c.rel), c.info)
+			}
+			if err != nil {
+				fail(strings.TrimSuffix(verb, "d"), c.rel, err)
+				continue
+			}
+			if !c.isLink() {
+				sent += uint64(c.info.Size())
+			}
+			lines = append(lines, verb+" "+c.rel)
+		}
+	}
+	copyItems(plan.created, "created")
+	copyItems(plan.updated, "updated")
+
+	// Modes of unchanged files, as rsync -a would fix
+	for _, c := range plan.same {
+		dst := out(c.rel)
+		info, err := os.Lstat(dst)
+		if err == nil && info.Mode() != c.info.Mode() {
+			err = os.Chmod(dst, c.info.Mode()&fs.ModePerm|c.info.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+		}
+		if err != nil {
+			fail("set mode of", c.rel, err)
+		}
+	}
+
+	for i := len(plan.dirs) - 1; i >= 0; i-- {
+		d := plan.dirs[i]
+		src := filepath.Join(p.In, filepath.FromSlash(d.rel))
+		err := copyAttrs(src, out(d.rel), d.info)
+		if err != nil {
+			fail("set attributes of dir", d.rel, err)
+		}
+	}
+	return lines, sent, errs
+}
+
+// Whether the entry in the out folder may be removed to make way for one of
+// another type - not if it is a dir and deletions are disabled.
+func replaceable(p folderPair, dst string, info fs.FileInfo) error {
+	if info.IsDir() && !p.delete() {
+		return errors.New("is a dir in the out folder, and deletions are disabled")
+	}
+	return os.RemoveAll(dst)
+}
+
+// Copies to a temp file beside dst (so that a half copied file is never
+// left in its place), then renames it over dst.
+func copyFile(ctx context.Context, p folderPair, src string, dst string, info fs.FileInfo) error {
+	if dstInfo, err := os.Lstat(dst); err == nil && !dstInfo.Mode().IsRegular() {
+		err = replaceable(p, dst, dstInfo)
+		if err != nil {
+			return err
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	_, err = io.Copy(tmp, ctxReader{ctx, in})
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = copyAttrs(src, tmp.Name(), info)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
+
+func copySymlink(p folderPair, c copyItem, dst string) error {
+	if info, err := os.Lstat(dst); err == nil {
+		err = replaceable(p, dst, info)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Symlink(c.link, dst)
+	if err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(c.info); ok && os.Geteuid() == 0 {
+		return os.Lchown(dst, uid, gid)
+	}
+	return nil
+}
+
+// Sets the mode, xattrs, owner (if root, as rsync -a only does then) and
+// modification time of dst to src's.
+func copyAttrs(src string, dst string, info fs.FileInfo) error {
+	root := os.Geteuid() == 0
+	if uid, gid, ok := fileOwner(info); ok && root {
+		err := os.Lchown(dst, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	mode := info.Mode()
+	err := os.Chmod(dst, mode&fs.ModePerm|mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	if err != nil {
+		return err
+	}
+	names, err := listXattrs(src)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("could not list xattrs: %w", err)
+	}
+	for _, name := range names {
+		// Only root may set the other namespaces, as for rsync -X
+		if !root && !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		val, err := getXattr(src, name)
+		if err != nil {
+			return fmt.Errorf("could not read xattr %s: %w", name, err)
+		}
+		err = setXattr(dst, name, val)
+		if err != nil {
+			return fmt.Errorf("could not set xattr %s: %w", name, err)
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Fails reads once ctx is done, so that a big copy stops on a timeout.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// Like checksumDoubleCheck, for the native engine: hashes every file which
+// the quick check considers unchanged, in both folders.
+func nativeChecksumDoubleCheck(r *report, p folderPair) error {
+	plan, err := planCopy(p)
+	if err != nil {
+		return err
+	}
+	var diffs []string
+	for _, c := range plan.created {
+		diffs = append(diffs, "missing "+c.rel)
+	}
+	for _, c := range plan.updated {
+		diffs = append(diffs, "differs "+c.rel)
+	}
+	for _, rel := range plan.deleted {
+		diffs = append(diffs, "extra "+rel)
+	}
+	for _, c := range plan.same {
+		inSum, err := fileSHA256(filepath.Join(p.In, filepath.FromSlash(c.rel)))
+		if err != nil {
+			return fmt.Errorf("checksum double check failed: %w", err)
+		}
+		outSum, err := fileSHA256(filepath.Join(p.Out, filepath.FromSlash(c.rel)))
+		if err != nil {
+			return fmt.Errorf("checksum double check failed: %w", err)
+		}
+		if inSum != outSum {
+			diffs = append(diffs, fmt.Sprintf("differs %s (sha256 %s, but %s in the output)", c.rel, inSum, outSum))
+		}
+	}
+	r.Sections = append(r.Sections, section{
+		Title:  "Checksum double check",
+		Detail: fmt.Sprintf("Hashed %d file(s) in both the input and output folders (SHA-256).", len(plan.same)),
+	})
+	if len(diffs) > 0 {
+		r.Sections = append(r.Sections, section{
+			Title:    "Checksum double check found differences",
+			Detail:   fmt.Sprintf("%d item(s) differ between the input and output folders after syncing.", len(diffs)),
+			LogLines: diffs,
+		})
+		return fmt.Errorf("checksum double check found %d difference(s)", len(diffs))
+	}
+	logger.Info("checksum double check passed")
+	return nil
+}
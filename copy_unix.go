@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// The file's owner and group, where the OS has them.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Args for running cshatag on dir. In dry run mode, cshatag reports what it
+// finds but never writes stored checksums. readOnly forces dry run mode, for
+// dirs where the xattrs can't be written.
+func cshatagArgs(dir string, readOnly bool) []string {
+	args := []string{"-q", "-recursive"}
+	if cfg.CshatagDryRun || cfg.dryRun || readOnly {
+		args = append(args, "-dry-run")
+	}
+	args = append(args, cfg.CshatagExtraArgs...)
+	return append(args, dir)
+}
+
+// Paths of the files found to be corrupt.
+func corruptFiles(files []checksumFile) []string {
+	var paths []string
+	for _, f := range files {
+		if f.Status == "corrupt" {
+			paths = append(paths, f.Path)
+		}
+	}
+	return paths
+}
+
+// Reports the corrupt files, and runs OnCorruptionCommand (if configured)
+// with the files as extra args. A failure of the command is only reported.
+func handleCorruption(r *report, files []string) {
+	logger.Error("corruption detected", "files", len(files))
+	r.Sections = append(r.Sections, section{
+		Title:    fmt.Sprintf("Corruption detected (%d)", len(files)),
+		Detail:   "cshatag found these files to be corrupt - their content changed, but their modification time did not.",
+		LogLines: files,
+	})
+	if len(cfg.OnCorruptionCommand) == 0 {
+		return
+	}
+
+	name := cfg.OnCorruptionCommand[0]
+	args := append(cfg.OnCorruptionCommand[1:len(cfg.OnCorruptionCommand):len(cfg.OnCorruptionCommand)], files...)
+	lines, err := execCommand("on-corruption", name, args...)
+	addExecSection(r, "On corruption command", lines, name, args...)
+	if err != nil {
+		logger.Warn("on corruption command failed", "err", err.Error())
+		r.Sections = append(r.Sections, section{
+			Title:  "On corruption command failed",
+			Detail: err.Error(),
+		})
+	}
+}
+
+// Checksums are stored with each file (in xattrs, or streams for the native
+// engine on Windows), so this just describes where they are (and whether they
+// are updated). The out folder may be blank.
+func checksumStorageLines(inFolder string, outFolder string, algo string, readOnly bool) []string {
+	store := "xattrs"
+	if algo != hashSHA256 || nativeChecksums() {
+		store = tagStoreDesc
+	}
+	sumName, tsName := hashTagNames(algo)
+	desc := func(dir string, dirReadOnly bool) string {
+		if cfg.CshatagDryRun || cfg.dryRun || readOnly || dirReadOnly {
+			return fmt.Sprintf("%s: %s and %s %s on each file (read only - not updated)", dir, sumName, tsName, store)
+		}
+		return fmt.Sprintf("%s: %s and %s %s on each file", dir, sumName, tsName, store)
+	}
+	lines := []string{desc(inFolder, cfg.CshatagReadOnlyInput || isSnapshotDir(inFolder))}
+	if outFolder != "" {
+		lines = append(lines, desc(outFolder, false))
+	}
+	return lines
+}
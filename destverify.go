@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rsync's filter options, whose rules the destination verification can't
+// follow (unlike the Excludes and Includes).
+var rsyncFilterOpts = []string{"--exclude", "--include", "--exclude-from", "--include-from", "--filter", "-f", "-F", "--cvs-exclude", "-C", "--files-from"}
+
+// If RsyncExtraArgs filter what is synced, the output folder could be told
+// apart from the input's by files they leave out.
+func validateVerifyDestination(c *config) error {
+	if !c.VerifyDestination {
+		return nil
+	}
+	for _, a := range c.RsyncExtraArgs {
+		opt, _, _ := strings.Cut(a, "=")
+		if slices.Contains(rsyncFilterOpts, opt) {
+			return fmt.Errorf("VerifyDestination can't be used with %s in RsyncExtraArgs - give the patterns as Excludes or Includes instead", opt)
+		}
+	}
+	return nil
+}
+
+// The checksum with the algorithm which the native engine (or cshatag, for
+// sha256) stored with the file, if it was stored for the file's current
+// modification time.
+func storedHash(path string, algo string, modTime time.Time) (string, bool) {
+	sumName, tsName := hashTagNames(algo)
+	ts, err := getTag(path, tsName)
+	if err != nil || !tagTimeMatches(ts, modTime) {
+		return "", false
+	}
+	sum, err := getTag(path, sumName)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(sum)), true
+}
+
+// Checks each file synced to the out folder against the checksum stored with
+// the in folder's file (as checked before syncing), rather than trusting the
+// sync's exit code. Only the out folder's copies are hashed - or not even
+// those, if they are in the manifest just written (its hashes, by path). Files
+// with no stored checksum for their modification time are hashed in the in
+// folder too.
+func verifyDestination(r *report, p folderPair, manifest map[string]string) error {
+	plan, err := planCopy(p)
+	if err != nil {
+		return fmt.Errorf("destination verification failed: %w", err)
+	}
+	algo := p.hash()
+	var diffs []string
+	for _, c := range plan.created {
+		diffs = append(diffs, "missing "+c.rel)
+	}
+	for _, c := range plan.updated {
+		diffs = append(diffs, "differs "+c.rel)
+	}
+	for _, rel := range plan.deleted {
+		diffs = append(diffs, "extra "+rel)
+	}
+	var fromManifest, hashedIn int
+	for _, c := range plan.same {
+		inPath := filepath.Join(p.In, filepath.FromSlash(c.rel))
+		inSum, ok := storedHash(inPath, algo, c.info.ModTime())
+		if !ok {
+			inSum, err = fileHash(inPath, algo)
+			if err != nil {
+				return fmt.Errorf("destination verification failed: %w", err)
+			}
+			hashedIn++
+		}
+		outSum, ok := manifest[c.rel]
+		if ok {
+			fromManifest++
+		} else {
+			outSum, err = fileHash(filepath.Join(p.Out, filepath.FromSlash(c.rel)), algo)
+			if err != nil {
+				return fmt.Errorf("destination verification failed: %w", err)
+			}
+		}
+		if inSum != outSum {
+			diffs = append(diffs, fmt.Sprintf("differs %s (%s %s, but %s in the output)", c.rel, algo, inSum, outSum))
+		}
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Destination verification",
+		Detail: fmt.Sprintf("Checked %d file(s) in the output folder against the input folder's stored checksums (%s): %d hashed in the output folder, and %d taken from the manifest. %d had no stored checksum, so were hashed in the input folder too.",
+			len(plan.same), algo, len(plan.same)-fromManifest, fromManifest, hashedIn),
+	})
+	if len(diffs) > 0 {
+		r.Sections = append(r.Sections, section{
+			Title:    "Destination verification found differences",
+			Detail:   fmt.Sprintf("%d item(s) differ between the input and output folders after syncing.", len(diffs)),
+			LogLines: diffs,
+		})
+		return fmt.Errorf("destination verification found %d difference(s)", len(diffs))
+	}
+	logger.Info("destination verified", "files", len(plan.same), "hashed_in", hashedIn)
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checks the environment a backup needs - the tools, the folders' filesystems,
+// the mail server and the log dir - and prints a pass/fail line per check,
+// with a hint for each fail.
+func doctor(opts options) error {
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		printChecks("Backup Helper doctor", []check{{Name: "config loaded", Err: err,
+			Hint: "fix the config (see check-config), or write a new one with init"}})
+		return fmt.Errorf("config check failed: %w", err)
+	}
+	checks := []check{{Name: "config loaded", Info: strings.Join(cfg.files, ", ")}}
+
+	cshatagMin, rsyncMin := "2.0.0", "3.0.0"
+	if cfg.CshatagDryRun {
+		cshatagMin = "2.1.0"
+	}
+	if cfg.Chown != "" {
+		rsyncMin = "3.1.0"
+	}
+	if nativeChecksums() {
+		info := "built in, with " + tagStoreDesc
+		if cfg.ChecksumEngine == checksumEngineAuto && runtime.GOOS != "windows" {
+			info += " (since cshatag is not installed)"
+		}
+		checks = append(checks, check{Name: "checksum engine", Info: info})
+	} else {
+		checks = append(checks, toolCheck(cfg.CshatagPath, cshatagMin, "install cshatag from https://github.com/rfjakob/cshatag (or set CshatagPath)"))
+	}
+	checks = append(checks, rsyncCheck(rsyncMin))
+	if cfg.CopyEngine == copyEngineRobocopy {
+		// robocopy has no --version
+		path, err := exec.LookPath(cfg.RobocopyPath)
+		checks = append(checks, check{Name: cfg.RobocopyPath + " installed", Err: err, Info: path,
+			Hint: "robocopy comes with Windows, so set RobocopyPath if it is not on PATH (or set CopyEngine to native)"})
+	}
+
+	if opts.RunJobs && len(opts.JobNames) == 0 && len(cfg.Jobs) == 0 {
+		checks = append(checks, check{Name: "folders", Info: "skipped, since no Jobs are configured and no folders were given"})
+	} else {
+		pairs, err := folderPairs(opts)
+		if err != nil {
+			checks = append(checks, check{Name: "folders", Err: err})
+		}
+		var restic, borg, encryptable, zfs, btrfs, rclone bool
+		for _, p := range pairs {
+			checks = append(checks, folderChecks(p.In)...)
+			if _, ok := resticRepo(p.Out); ok {
+				restic = true
+				continue
+			}
+			if _, ok := borgRepo(p.Out); ok {
+				borg = true
+				continue
+			}
+			if dest, ok := rcloneTarget(p.Out); ok {
+				rclone = true
+				_, err := rcloneRemoteType(dest)
+				checks = append(checks, check{Name: "rclone remote " + dest, Err: err,
+					Hint: "add the remote with rclone config (or set Rclone ConfigFile)"})
+				continue
+			}
+			if d, ok, err := zfsTarget(p.Out); ok {
+				zfs = true
+				if err == nil {
+					var mountpoint string
+					_, mountpoint, err = zfsDataset(p.In)
+					if abs, _ := filepath.Abs(p.In); err == nil && filepath.Clean(abs) != mountpoint {
+						err = fmt.Errorf("%s is not a dataset's mountpoint (it is in the one at %s)", p.In, mountpoint)
+					}
+				}
+				checks = append(checks, check{Name: p.In + " is a ZFS dataset", Err: err,
+					Hint: "zfs: outputs need the in folder to be a dataset's mountpoint"})
+				if d.host != "" {
+					checks = append(checks, sshToolCheck())
+				}
+				continue
+			}
+			if d, ok, err := btrfsTarget(p.Out); ok {
+				btrfs = true
+				if err == nil && cfg.Btrfs.SnapshotDir == "" {
+					err = errors.New("no Btrfs SnapshotDir is set")
+				}
+				if err == nil {
+					_, err = btrfsShow("", "", p.In)
+				}
+				checks = append(checks, check{Name: p.In + " is a btrfs subvolume", Err: err,
+					Hint: "btrfs: outputs need the in folder to be a subvolume, and a SnapshotDir on its filesystem"})
+				if err == nil {
+					checks = append(checks, check{Name: p.Out + " writable", Err: checkBtrfsDest(d),
+						Hint: fmt.Sprintf("check that the folder exists (on btrfs) with its %s file", smokeFilename)})
+				}
+				if d.host != "" {
+					checks = append(checks, sshToolCheck())
+				}
+				continue
+			}
+			if isArchive(p.Out) {
+				encryptable = true
+				t, err := resolveTarTarget(p, time.Now())
+				if err != nil {
+					checks = append(checks, check{Name: p.Out, Err: err})
+					continue
+				}
+				if t.compression == "zstd" {
+					checks = append(checks, toolCheck(cfg.Tar.ZstdPath, "1.0.0", "install zstd with your package manager (or set Tar ZstdPath)"))
+				}
+				if !t.stream {
+					checks = append(checks, folderChecks(t.folder())...)
+					continue
+				}
+				if c := cfg.Tar.StreamCommand; len(c) > 0 {
+					if _, err := exec.LookPath(c[0]); err != nil {
+						checks = append(checks, check{Name: p.Out + " streamed via " + c[0], Err: fmt.Errorf("%s is not installed", c[0]),
+							Hint: "install it with your package manager (or fix Tar StreamCommand)"})
+					}
+				}
+				if len(cfg.Tar.TapeLabelCommand) > 0 {
+					_, err := tapeLabel()
+					checks = append(checks, check{Name: p.Out + " tape label", Err: err,
+						Hint: "check that the Tar TapeLabelCommand prints the loaded tape's label (or give -tape-label)"})
+				}
+				continue
+			}
+			if store, ok, err := objectDestination(p.Out); ok {
+				encryptable = true
+				if _, isSFTP := store.(*sftpStore); isSFTP {
+					checks = append(checks, sshToolCheck())
+				}
+				if err == nil {
+					err = checkStore(store)
+				}
+				if c, ok := store.(io.Closer); ok {
+					c.Close()
+				}
+				checks = append(checks, check{Name: p.Out + " writable", Err: err,
+					Hint: "check the destination's URL, endpoint and credentials - and that they allow writing, reading and deleting objects"})
+				continue
+			}
+			if host, dir, ok := remoteOut(p.Out); ok {
+				if _, err := exec.LookPath(cfg.RsyncPath); err != nil {
+					checks = append(checks, check{Name: p.Out + " synced with rsync", Err: errors.New("remote out folders need rsync, which is not installed"),
+						Hint: "install rsync with your package manager (or set RsyncPath)"})
+				}
+				checks = append(checks, sshToolCheck(), check{Name: p.Out + " writable", Err: checkRemote(host, dir),
+					Hint: fmt.Sprintf("check that ssh %s works without a password (see the SSH config), and that the folder has its %s file", host, smokeFilename)})
+				continue
+			}
+			checks = append(checks, folderChecks(p.Out)...)
+		}
+		if restic {
+			checks = append(checks, toolCheck(cfg.Restic.Path, "0.13.0", "install restic from https://restic.net (or set Restic Path)"))
+		}
+		if borg {
+			checks = append(checks, toolCheck(cfg.Borg.Path, "1.2.0", "install borg from https://www.borgbackup.org (or set Borg Path)"))
+		}
+		if zfs || cfg.ZFS.Snapshot {
+			checks = append(checks, toolCheck(cfg.ZFS.Path, "0.8.0", "install ZFS with your package manager (or set ZFS Path)"))
+		}
+		if cfg.LVM.Snapshot {
+			checks = append(checks, toolCheck(cfg.LVM.Path, "2.02.0", "install lvm2 with your package manager (or set LVM Path)"))
+		}
+		if rclone {
+			checks = append(checks, toolCheck(cfg.Rclone.Path, "1.55.0", "install rclone from https://rclone.org (or set Rclone Path)"))
+		}
+		if btrfs {
+			checks = append(checks, toolCheck(cfg.Btrfs.Path, "4.0", "install btrfs-progs with your package manager (or set Btrfs Path)"))
+		}
+		if encryptable && encrypting() {
+			checks = append(checks, encryptionToolCheck())
+		}
+	}
+
+	if cfg.WriteManifest && cfg.ManifestSigning.Tool != "" {
+		checks = append(checks, signingChecks()...)
+	}
+
+	checks = append(checks, mailChecks()...)
+	checks = append(checks, logDirCheck())
+
+	failed := printChecks("Backup Helper doctor", checks)
+	if failed > 0 {
+		return fmt.Errorf("%d doctor check(s) failed", failed)
+	}
+	return nil
+}
+
+var versionRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// rsync is only needed for local out folders if CopyEngine is rsync, since
+// otherwise the built in engine is used without it.
+func rsyncCheck(min string) check {
+	c := toolCheck(cfg.RsyncPath, min, "install rsync with your package manager (or set RsyncPath)")
+	if errors.Is(c.Err, exec.ErrNotFound) && cfg.CopyEngine != copyEngineRsync {
+		engine := "the built in engine"
+		if syncEngine(folderPair{}) == copyEngineRobocopy {
+			engine = "robocopy"
+		}
+		return check{Name: c.Name, Info: "no, so local out folders are synced with " + engine}
+	}
+	return c
+}
+
+// Checks that the tool is on PATH, and (if its --version can be parsed) at
+// least the min version.
+func toolCheck(bin string, min string, installHint string) check {
+	name := bin + " installed"
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return check{Name: name, Err: err, Hint: installHint}
+	}
+	out, _ := exec.Command(path, "--version").CombinedOutput()
+	m := versionRe.FindString(string(out))
+	if m == "" {
+		return check{Name: name, Info: path + " (unknown version)"}
+	}
+	if compareVersions(m, min) < 0 {
+		return check{Name: name, Err: fmt.Errorf("%s is version %s, but %s or later is needed", path, m, min),
+			Hint: fmt.Sprintf("upgrade %s to %s or later", filepath.Base(bin), min)}
+	}
+	return check{Name: name, Info: fmt.Sprintf("%s (version %s)", path, m)}
+}
+
+// Like strings.Compare, for dotted version numbers.
+func compareVersions(a string, b string) int {
+	am, bm := versionRe.FindStringSubmatch(a), versionRe.FindStringSubmatch(b)
+	for i := 1; i <= 3; i++ {
+		ai, _ := strconv.Atoi(am[i])
+		bi, _ := strconv.Atoi(bm[i])
+		if ai != bi {
+			if ai < bi {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Checks the folder is mounted (has its smoke file) and keeps xattrs.
+func folderChecks(dir string) []check {
+	smoke := filepath.Join(dir, smokeFilename)
+	_, err := os.Stat(smoke)
+	checks := []check{{Name: dir + " mounted", Err: err,
+		Hint: fmt.Sprintf("mount the folder, or if it is mounted, create the smoke file with: touch %s", smoke)}}
+	if err != nil {
+		return checks
+	}
+
+	name := dir + " keeps extended attributes"
+	probe, err := os.CreateTemp(dir, "doctor-check-*.txt")
+	if err != nil {
+		return append(checks, check{Name: name, Err: err,
+			Hint: "make the folder writable by this user"})
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	// On Linux, the native engine's tags are the xattrs, as checked below
+	if nativeChecksums() && runtime.GOOS == "windows" {
+		err = checkTags(probe.Name())
+		return append(checks, check{Name: dir + " keeps " + tagStoreDesc, Err: err,
+			Hint: "use an NTFS filesystem, since the built in checksum engine stores its checksums in streams"})
+	}
+	err = checkXattr(probe.Name())
+	return append(checks, check{Name: name, Err: err,
+		Hint: "use a filesystem with user xattrs (e.g. ext4, xfs, btrfs or zfs - mounted with user_xattr, if needed), since cshatag stores its checksums in them and rsync -X copies them"})
+}
+
+// Checks a log file could be written. A missing log dir is created by the
+// run, so then its nearest existing parent is checked.
+func logDirCheck() check {
+	dir := filepath.Dir(logPath(cfg, time.Now(), "", ""))
+	name := "log dir " + dir + " writable"
+	for {
+		_, err := os.Stat(dir)
+		if err == nil || !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := os.CreateTemp(dir, "doctor-check-*.log")
+	if err != nil {
+		return check{Name: name, Err: err,
+			Hint: "set LogDir to a dir this user can write to, or run from one"}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return check{Name: name}
+}
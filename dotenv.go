@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Set from the -env-file flag
+var envFile string
+
+// Config fields can be set by env vars with this prefix, e.g.
+// BACKUP_HELPER_MAIL_PASS for MailPass.
+const envFieldPrefix = "BACKUP_HELPER_"
+
+// Loads the -env-file, if given, then the .env next to each config file (the
+// last first). Vars already set are never overridden, so the real env, the
+// -env-file, and later config layers win.
+func loadDotenvs(bases []string) error {
+	var files []string
+	if envFile != "" {
+		files = append(files, envFile)
+	}
+	for i := len(bases) - 1; i >= 0; i-- {
+		files = append(files, filepath.Join(filepath.Dir(bases[i]), ".env"))
+	}
+	for _, f := range files {
+		err := loadDotenv(f)
+		if errors.Is(err, os.ErrNotExist) && f != envFile {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not load env file %s: %w", f, err)
+		}
+		logger.Debug("env file loaded", "file", f)
+	}
+	return nil
+}
+
+// KEY=VALUE lines, ignoring blank lines and # comments. A leading "export "
+// is allowed, and the value may be in single or double quotes.
+func loadDotenv(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, val)
+		}
+	}
+	return sc.Err()
+}
+
+// Sets each top-level string, number or bool field which has a
+// BACKUP_HELPER_<FIELD_NAME> env var.
+func applyEnvFields(c *config) error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := envFieldPrefix + screamingSnake(f.Name)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		fv := v.Field(i)
+		var err error
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(val)
+		case reflect.Int, reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(val, 10, 64)
+			fv.SetInt(n)
+		case reflect.Uint64:
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 64)
+			fv.SetUint(n)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(val)
+			fv.SetBool(b)
+		default:
+			err = errors.New("only string, number and bool fields can be set from the env")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+			continue
+		}
+		logger.Debug("config field set from env", "field", f.Name, "env", name)
+	}
+	return errors.Join(errs...)
+}
+
+// E.g. MailPass -> MAIL_PASS.
+func screamingSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
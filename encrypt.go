@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Encrypts tar: archives, and each file uploaded to an object store, with
+// age or gpg (run as a command, so their own config and keyrings apply).
+type encryptionConfig struct {
+	// age or gpg. Blank means no encryption.
+	Tool string
+	// The binary to run (default the Tool's name).
+	Path string
+
+	// For age: public keys (age1...) or SSH public keys, plus any in the
+	// RecipientsFile. For gpg: key IDs, fingerprints or emails, whose public
+	// keys are in the keyring.
+	Recipients     []string
+	RecipientsFile string
+
+	// After writing, test-decrypt the archive (or a sample of VerifySamples
+	// of the files uploaded, default 1) and check it matches. age needs the
+	// IdentityFile for this, and gpg the secret key in its keyring (without a
+	// passphrase prompt).
+	Verify        bool
+	VerifySamples int
+	IdentityFile  string
+}
+
+func validateEncryption(c *config) error {
+	e := c.Encryption
+	switch e.Tool {
+	case "":
+		return nil
+	case "age", "gpg":
+	default:
+		return fmt.Errorf("Encryption Tool must be age or gpg, not %q", e.Tool)
+	}
+	if len(e.Recipients) == 0 && e.RecipientsFile == "" {
+		return errors.New("Encryption needs Recipients (or a RecipientsFile)")
+	}
+	if e.RecipientsFile != "" && e.Tool == "gpg" {
+		return errors.New("Encryption RecipientsFile is only for age - give gpg's Recipients instead")
+	}
+	if e.Verify && e.Tool == "age" && e.IdentityFile == "" {
+		return errors.New("Encryption Verify needs an IdentityFile for age, to test-decrypt with")
+	}
+	if e.VerifySamples < 0 {
+		return fmt.Errorf("Encryption VerifySamples must not be negative, not %d", e.VerifySamples)
+	}
+	return nil
+}
+
+func encrypting() bool {
+	return cfg.Encryption.Tool != ""
+}
+
+func encryptionPath() string {
+	return firstNonEmpty(cfg.Encryption.Path, cfg.Encryption.Tool)
+}
+
+var errDecryptCheck = errors.New("test decrypt failed")
+
+// Appended to archive names, e.g. ".age".
+func encryptionExt() string {
+	if !encrypting() {
+		return ""
+	}
+	return "." + cfg.Encryption.Tool
+}
+
+// Args to encrypt stdin to stdout.
+func encryptArgs() []string {
+	e := cfg.Encryption
+	if e.Tool == "age" {
+		args := []string{"-e"}
+		for _, r := range e.Recipients {
+			args = append(args, "-r", r)
+		}
+		if e.RecipientsFile != "" {
+			args = append(args, "-R", e.RecipientsFile)
+		}
+		return args
+	}
+	args := []string{"--batch", "--yes", "--trust-model", "always", "--encrypt"}
+	for _, r := range e.Recipients {
+		args = append(args, "--recipient", r)
+	}
+	return append(args, "--output", "-")
+}
+
+// Args to decrypt stdin to stdout.
+func decryptArgs() []string {
+	if cfg.Encryption.Tool == "age" {
+		return []string{"-d", "-i", cfg.Encryption.IdentityFile}
+	}
+	return []string{"--batch", "--quiet", "--decrypt"}
+}
+
+// A command in the middle of a pipeline (e.g. zstd, or the encryption):
+// what is written to it goes through the command into w.
+type pipeCmd struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+func startPipeCmd(name string, args []string, w io.Writer) (*pipeCmd, error) {
+	p := &pipeCmd{cmd: exec.CommandContext(runCtx, name, args...)}
+	p.cmd.Stdout = w
+	p.cmd.Stderr = &p.stderr
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdin = stdin
+	err = p.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not run %s: %w", name, err)
+	}
+	logger.Debug("pipe command started", "cmd", name, "args", strings.Join(args, " "))
+	return p, nil
+}
+
+func (p *pipeCmd) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+// Ends the input, and waits for the command. Does nothing if run again.
+func (p *pipeCmd) Close() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+	p.stdin.Close()
+	err := p.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", p.cmd.Path, err, strings.TrimSpace(p.stderr.String()))
+	}
+	return nil
+}
+
+// Encrypts r into w.
+func encryptTo(w io.Writer, r io.Reader) error {
+	p, err := startPipeCmd(encryptionPath(), encryptArgs(), w)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(p, r)
+	return errors.Join(err, p.Close())
+}
+
+// Decrypts r, returning the SHA-256 (hex) of the plaintext.
+func testDecrypt(r io.Reader) (string, error) {
+	h := sha256.New()
+	cmd := exec.CommandContext(runCtx, encryptionPath(), decryptArgs()...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, h, &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt with %s: %w: %s", encryptionPath(), err, strings.TrimSpace(stderr.String()))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// For -validate-paths.
+func encryptionLine() string {
+	return fmt.Sprintf("encryption: %s %s (test-decrypt %t)", encryptionPath(), strings.Join(encryptArgs(), " "), cfg.Encryption.Verify)
+}
+
+func encryptionToolCheck() check {
+	if cfg.Encryption.Tool == "gpg" {
+		return toolCheck(encryptionPath(), "2.1.0", "install GnuPG with your package manager (or set Encryption Path)")
+	}
+	return toolCheck(encryptionPath(), "1.0.0", "install age from https://age-encryption.org (or set Encryption Path)")
+}
@@ -0,0 +1,70 @@
+package main
+
+// Exit codes for each class of failure, so that e.g. monitoring can tell a bad
+// backup from flaky mail.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // Any other failure
+	exitConfig      = 2 // Invalid args or config
+	exitFolderCheck = 3 // A folder is not mounted, or not writable
+	exitCorruption  = 4 // cshatag found corrupt files
+	exitRsync       = 5 // rsync (or its checksum double check) failed
+	exitMail        = 6 // The report could not be mailed
+)
+
+// Most serious first: if the run failed in more than one way, the first of
+// these classes is the exit code.
+var exitPriority = []int{exitCorruption, exitRsync, exitFolderCheck, exitConfig, exitMail}
+
+// An error with the exit code of its class.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitError) Unwrap() error {
+	return e.err
+}
+
+// Classes err (if not nil) with the exit code.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return exitError{code: code, err: err}
+}
+
+// The exit code for the (possibly joined) error.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	codes := map[int]bool{}
+	collectExitCodes(err, codes)
+	for _, c := range exitPriority {
+		if codes[c] {
+			return c
+		}
+	}
+	return exitFailure
+}
+
+func collectExitCodes(err error, codes map[int]bool) {
+	if ee, ok := err.(exitError); ok {
+		codes[ee.code] = true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			collectExitCodes(inner, codes)
+		}
+	case interface{ Unwrap() error }:
+		if inner := e.Unwrap(); inner != nil {
+			collectExitCodes(inner, codes)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Probes whether the dir's filesystem keeps what rsync -aX (and cshatag) rely
+// on. Problems are only reported, since the backup still mostly works.
+func checkFeatures(r *report, dir string) {
+	probe := filepath.Join(dir, fmt.Sprintf("feature-check-%d.txt", rand.Int()))
+	err := os.WriteFile(probe, []byte("backup-helper feature check"), 0644)
+	if err != nil {
+		logger.Warn("could not write feature check file", "err", err.Error())
+		return
+	}
+	defer os.Remove(probe)
+
+	checks := []struct {
+		name  string
+		check func(string) error
+	}{
+		{"extended attributes (for -X and cshatag)", checkXattr},
+		{"permissions", checkPerms},
+		{"hard links", checkHardlink},
+	}
+	if nativeChecksums() && runtime.GOOS == "windows" {
+		checks[0].name, checks[0].check = tagStoreDesc+" (for the checksums)", checkTags
+	}
+	var lines []string
+	lost := 0
+	for _, c := range checks {
+		err := c.check(probe)
+		if err != nil {
+			lost++
+			lines = append(lines, fmt.Sprintf("%s: NOT SUPPORTED (%s)", c.name, err.Error()))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: OK", c.name))
+	}
+
+	title := "Output filesystem features checked"
+	detail := "A test file was written to the output folder to check what its filesystem keeps."
+	if lost > 0 {
+		title = "WARNING: output filesystem drops features"
+		detail += " Some features are not kept, so the backup is not as faithful as the source - and cshatag checksums may not persist."
+		logger.Warn("output filesystem drops features", "dir", dir, "lost", lost)
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    title,
+		Detail:   detail,
+		LogLines: lines,
+	})
+}
+
+func checkXattr(path string) error {
+	const name = "user.backup-helper.check"
+	err := setXattr(path, name, []byte("1"))
+	if err != nil {
+		return err
+	}
+	v, err := getXattr(path, name)
+	if err != nil {
+		return err
+	}
+	if string(v) != "1" {
+		return fmt.Errorf("read back %q", v)
+	}
+	return nil
+}
+
+// As checkXattr, for the native checksum engine's tags.
+func checkTags(path string) error {
+	const name = "user.backup-helper.check"
+	err := setTag(path, name, []byte("1"))
+	if err != nil {
+		return err
+	}
+	v, err := getTag(path, name)
+	if err != nil {
+		return err
+	}
+	if string(v) != "1" {
+		return fmt.Errorf("read back %q", v)
+	}
+	return nil
+}
+
+func checkPerms(path string) error {
+	const want os.FileMode = 0750
+	err := os.Chmod(path, want)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() != want {
+		return fmt.Errorf("set %v but read back %v", want, info.Mode().Perm())
+	}
+	return nil
+}
+
+func checkHardlink(path string) error {
+	link := path + ".link"
+	err := os.Link(path, link)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(link)
+
+	a, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := os.Stat(link)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(a, b) {
+		return fmt.Errorf("link is a separate file")
+	}
+	return nil
+}
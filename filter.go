@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Matches the Excludes and Includes like rsync does (the first match wins, and
+// includes come first): a pattern with a trailing / only matches dirs, and
+// dir/*** matches dir and everything in it. One with a leading / is matched
+// against the whole path, one with any other / (or a **) against its trailing
+// components, and others against the name.
+func excluded(p folderPair, rel string, isDir bool) bool {
+	for _, i := range cfg.Includes {
+		if rsyncMatch(i, rel, isDir) {
+			return false
+		}
+	}
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		if rsyncMatch(e, rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the rsync pattern matches rel (with / separators).
+func rsyncMatch(pattern string, rel string, isDir bool) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/***"); ok {
+		return rsyncMatch(dir, rel, true) || rsyncMatch(dir+"/**", rel, isDir)
+	}
+	pattern, dirOnly := strings.CutSuffix(pattern, "/")
+	if dirOnly && !isDir {
+		return false
+	}
+	if anchored, ok := strings.CutPrefix(pattern, "/"); ok {
+		return wildMatch(anchored, rel)
+	}
+	if !strings.Contains(pattern, "/") && !strings.Contains(pattern, "**") {
+		return wildMatch(pattern, path.Base(rel))
+	}
+	for i := 0; i < len(rel); i++ {
+		if (i == 0 || rel[i-1] == '/') && wildMatch(pattern, rel[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// As rsync's wildmatch: * and ? don't match a /, ** matches anything (and
+// **/ no dirs at all), [...] is a class and \ escapes.
+func wildMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			if strings.HasPrefix(pattern, "**") {
+				rest := strings.TrimLeft(pattern, "*")
+				if strings.HasPrefix(rest, "/") && wildMatch(rest[1:], s) {
+					return true
+				}
+				for i := 0; i <= len(s); i++ {
+					if wildMatch(rest, s[i:]) {
+						return true
+					}
+				}
+				return false
+			}
+			rest := pattern[1:]
+			for i := 0; i <= len(s); i++ {
+				if wildMatch(rest, s[i:]) {
+					return true
+				}
+				if i < len(s) && s[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case '?', '[':
+			r, size := utf8.DecodeRuneInString(s)
+			if s == "" || r == '/' {
+				return false
+			}
+			n := 1
+			if pattern[0] == '[' {
+				end := strings.IndexByte(pattern[min(2, len(pattern)):], ']')
+				if end < 0 {
+					return false
+				}
+				n = end + min(2, len(pattern)) + 1
+				class := pattern[:n]
+				// rsync negates with ! (or ^, as path.Match does)
+				if strings.HasPrefix(class, "[!") {
+					class = "[^" + class[2:]
+				}
+				ok, err := path.Match(class, string(r))
+				if err != nil || !ok {
+					return false
+				}
+			}
+			pattern, s = pattern[n:], s[size:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestRsyncMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.tmp", "a/b/c.tmp", false, true},
+		{"*.tmp", "a/b/c.tmpx", false, false},
+		{"node_modules/", "x/node_modules", true, true},
+		{"node_modules/", "x/node_modules", false, false},
+		{".Trash*/", ".Trash-1000", true, true},
+		{"/cache", "cache", true, true},
+		{"/cache", "x/cache", true, false},
+		{"foo/bar", "foo/bar", false, true},
+		{"foo/bar", "x/foo/bar", false, true},
+		{"foo/bar", "xfoo/bar", false, false},
+		{"a/*/c", "a/b/c", false, true},
+		{"a/*/c", "a/b/d/c", false, false},
+		{"a/**/c", "a/b/d/c", false, true},
+		{"a/**/c", "a/c", false, true},
+		{"**/*.log", "x/y/z.log", false, true},
+		{"/data/**", "data/x/y", false, true},
+		{"/data/**", "other/data/x", false, false},
+		{"build/***", "build", true, true},
+		{"build/***", "build/x/y.o", false, true},
+		{"build/***", "builds", true, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[!ab].txt", "b.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"?.txt", "é.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{`\*.txt`, "*.txt", false, true},
+		{`\*.txt`, "a.txt", false, false},
+	} {
+		got := rsyncMatch(tc.pattern, tc.rel, tc.isDir)
+		if got != tc.want {
+			t.Errorf("rsyncMatch(%q, %q, %v) = %v, want %v", tc.pattern, tc.rel, tc.isDir, got, tc.want)
+		}
+	}
+}
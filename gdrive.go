@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For out folders given as gdrive://<folder path>, a folder in My Drive
+// (created as needed), via the Drive API.
+type gdriveConfig struct {
+	// The OAuth client to sign in with (of the "TVs and Limited Input
+	// devices" type), from the Google Cloud console. The secret may be a
+	// secret reference, or given as a command or OS keyring entry instead
+	// (as for MailPass).
+	ClientID            string
+	ClientSecret        string
+	ClientSecretCommand []string
+	ClientSecretKeyring *keyringRef
+
+	// Where gdrive-auth keeps the refresh token, default gdrive-token.json
+	// next to the config file.
+	TokenFile string
+
+	// Files are uploaded in chunks of this size (default 8).
+	ChunkSizeMB int
+
+	// Default https://oauth2.googleapis.com and https://www.googleapis.com
+	OAuthURL string
+	APIURL   string
+}
+
+const gdriveScheme = "gdrive://"
+
+const gdriveTokenName = "gdrive-token.json"
+
+// Only gives access to the files backup-helper created, rather than the whole
+// drive.
+const gdriveScope = "https://www.googleapis.com/auth/drive.file"
+
+const gdriveFolderType = "application/vnd.google-apps.folder"
+
+func validateGDrive(c *config) error {
+	if c.GDrive.ChunkSizeMB < 0 || c.GDrive.ChunkSizeMB > 1024 {
+		return fmt.Errorf("GDrive ChunkSizeMB must be between 1 and 1024, not %d", c.GDrive.ChunkSizeMB)
+	}
+	return nil
+}
+
+// What gdrive-auth keeps in the TokenFile.
+type gdriveToken struct {
+	// The client it was given to, since it only works with that one
+	ClientID     string
+	RefreshToken string
+	Created      time.Time
+}
+
+func readGDriveToken() (gdriveToken, error) {
+	var t gdriveToken
+	b, err := os.ReadFile(cfg.GDrive.TokenFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, fmt.Errorf("not signed in to Google Drive yet (there is no %s), so run backup-helper gdrive-auth", cfg.GDrive.TokenFile)
+	}
+	if err != nil {
+		return t, fmt.Errorf("could not read the Google Drive token: %w", err)
+	}
+	err = json.Unmarshal(b, &t)
+	if err != nil || t.RefreshToken == "" {
+		return t, fmt.Errorf("%s has no Google Drive token, so run backup-helper gdrive-auth again", cfg.GDrive.TokenFile)
+	}
+	if t.ClientID != cfg.GDrive.ClientID {
+		return t, fmt.Errorf("the Google Drive token in %s is for another GDrive ClientID, so run backup-helper gdrive-auth again", cfg.GDrive.TokenFile)
+	}
+	return t, nil
+}
+
+type gdriveStore struct {
+	path      string // E.g. Backups/home
+	refresh   string
+	chunkSize int64
+
+	// Set once signed in
+	token  string
+	expiry time.Time
+	// By path under the folder (with "" for the folder itself), from the
+	// last list, and as created
+	folders map[string]string
+	files   map[string]string
+}
+
+// The store for out, if it is a gdrive:// URL.
+func gdriveDestination(out string) (*gdriveStore, bool, error) {
+	rest, ok := strings.CutPrefix(out, gdriveScheme)
+	if !ok {
+		return nil, false, nil
+	}
+	var parts []string
+	for _, p := range strings.Split(rest, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, true, fmt.Errorf("no folder in %s", out)
+	}
+	if cfg.GDrive.ClientID == "" {
+		return nil, true, errors.New("no GDrive ClientID set, to sign in to Google Drive with")
+	}
+	t, err := readGDriveToken()
+	if err != nil {
+		return nil, true, err
+	}
+	chunkMB := cfg.GDrive.ChunkSizeMB
+	if chunkMB == 0 {
+		chunkMB = 8
+	}
+	s := &gdriveStore{
+		path:      strings.Join(parts, "/"),
+		refresh:   t.RefreshToken,
+		chunkSize: int64(chunkMB) << 20,
+		folders:   map[string]string{},
+		files:     map[string]string{},
+	}
+	return s, true, nil
+}
+
+func (s *gdriveStore) String() string {
+	return gdriveScheme + s.path
+}
+
+type gdriveError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *gdriveError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Reason, e.Message)
+}
+
+// Whether the request may work if sent again, after a while: Drive is rate
+// limiting, or failed.
+func (e *gdriveError) retryable() bool {
+	return e.Status == 429 || e.Status/100 == 5 || e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded"
+}
+
+func gdriveResponseError(req *http.Request, resp *http.Response) error {
+	e := &gdriveError{Status: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Message string
+			Errors  []struct{ Reason string }
+		}
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(b, &body) != nil || body.Error.Message == "" {
+		e.Reason, e.Message = "error", resp.Status
+	} else {
+		e.Reason, e.Message = "error", body.Error.Message
+		if len(body.Error.Errors) > 0 {
+			e.Reason = body.Error.Errors[0].Reason
+		}
+	}
+	return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, e)
+}
+
+// Waits before the nth retry: 1s, 2s, 4s...
+func gdriveBackoff(n int) error {
+	select {
+	case <-time.After(time.Second << (n - 1)):
+		return nil
+	case <-runCtx.Done():
+		return runCtx.Err()
+	}
+}
+
+type gdriveOAuthError struct {
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *gdriveOAuthError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Description)
+}
+
+// Posts the form to Google's OAuth endpoint (e.g. token), decoding the JSON
+// response into out.
+func gdriveOAuth(endpoint string, form url.Values, out any) error {
+	req, err := http.NewRequestWithContext(runCtx, http.MethodPost, strings.TrimSuffix(cfg.GDrive.OAuthURL, "/")+"/"+endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logger.Debug("gdrive request", "method", req.Method, "url", req.URL.Redacted())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e := &gdriveOAuthError{Status: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, e) != nil || e.Code == "" {
+			e.Code, e.Description = "error", resp.Status
+		}
+		return fmt.Errorf("POST %s: %w", req.URL.Path, e)
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("could not parse %s response: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// Signs in to Google Drive with the OAuth device flow: prints a code to enter
+// on Google's page (on any device), waits until it is, and keeps the refresh
+// token in the TokenFile.
+func gdriveAuth(opts options) error {
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if cfg.GDrive.ClientID == "" {
+		return withExitCode(exitConfig, errors.New("no GDrive ClientID set, to sign in to Google Drive with"))
+	}
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	err = gdriveOAuth("device/code", url.Values{"client_id": {cfg.GDrive.ClientID}, "scope": {gdriveScope}}, &code)
+	if err != nil {
+		return fmt.Errorf("could not start signing in to Google Drive: %w", err)
+	}
+	fmt.Printf("To let backup-helper back up to your Google Drive, go to %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+	fmt.Println("Waiting for it to be entered...")
+
+	interval := time.Duration(max(code.Interval, 5)) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	var tok struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	for {
+		if time.Now().After(deadline) {
+			return errors.New("the code expired before it was entered, so run gdrive-auth again")
+		}
+		select {
+		case <-time.After(interval):
+		case <-runCtx.Done():
+			return runCtx.Err()
+		}
+		err = gdriveOAuth("token", url.Values{
+			"client_id":     {cfg.GDrive.ClientID},
+			"client_secret": {cfg.GDrive.ClientSecret},
+			"device_code":   {code.DeviceCode},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &tok)
+		var oErr *gdriveOAuthError
+		if errors.As(err, &oErr) && oErr.Code == "authorization_pending" {
+			continue
+		}
+		if errors.As(err, &oErr) && oErr.Code == "slow_down" {
+			interval += 5 * time.Second
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not sign in to Google Drive: %w", err)
+		}
+		break
+	}
+	if tok.RefreshToken == "" {
+		return errors.New("Google gave no refresh token, so backup-helper could not stay signed in")
+	}
+
+	b, err := json.MarshalIndent(gdriveToken{ClientID: cfg.GDrive.ClientID, RefreshToken: tok.RefreshToken, Created: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(cfg.GDrive.TokenFile), 0700)
+	if err == nil {
+		err = os.WriteFile(cfg.GDrive.TokenFile, b, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("could not save the Google Drive token: %w", err)
+	}
+	fmt.Printf("Signed in. The token is kept in %s (readable only by you), and can be revoked at https://myaccount.google.com/permissions\n", cfg.GDrive.TokenFile)
+	return nil
+}
+
+// Gets an access token with the refresh token, if there is none yet or it is
+// about to expire.
+func (s *gdriveStore) authorize() error {
+	if s.token != "" && time.Until(s.expiry) > time.Minute {
+		return nil
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err := gdriveOAuth("token", url.Values{
+		"client_id":     {cfg.GDrive.ClientID},
+		"client_secret": {cfg.GDrive.ClientSecret},
+		"refresh_token": {s.refresh},
+		"grant_type":    {"refresh_token"},
+	}, &tok)
+	var oErr *gdriveOAuthError
+	if errors.As(err, &oErr) && oErr.Code == "invalid_grant" {
+		return fmt.Errorf("the Google Drive token in %s has expired or been revoked, so run backup-helper gdrive-auth again: %w", cfg.GDrive.TokenFile, err)
+	}
+	if err != nil {
+		return fmt.Errorf("could not sign in to Google Drive: %w", err)
+	}
+	s.token, s.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	logger.Debug("signed in to Google Drive", "expires", s.expiry.Format(time.RFC3339))
+	return nil
+}
+
+// The Drive API URL for the path (e.g. files), or its upload URL.
+func gdriveURL(upload bool, p string, query url.Values) string {
+	base := strings.TrimSuffix(cfg.GDrive.APIURL, "/")
+	if upload {
+		base += "/upload"
+	}
+	u := base + "/drive/v3/" + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// Calls the API with the JSON body (if not nil) and any other headers,
+// decoding the JSON response into out - or copying it, if out is an
+// io.Writer. Rate limited and failed
+// requests are sent again (up to 4 times, with backoff), and a rejected
+// access token is renewed once. Returns the response's headers.
+func (s *gdriveStore) call(method string, u string, body any, headers map[string]string, out any) (http.Header, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	renewed := false
+	for attempt := 1; ; attempt++ {
+		err := s.authorize()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(runCtx, method, u, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		h, err := gdriveDo(req, out)
+		var gErr *gdriveError
+		switch {
+		case err == nil || !errors.As(err, &gErr):
+			return h, err
+		case gErr.Status == 401 && !renewed:
+			s.token, renewed = "", true
+		case gErr.retryable() && attempt < 5:
+			logger.Debug("gdrive request failed, retrying", "err", err.Error(), "attempt", attempt)
+			err = gdriveBackoff(attempt)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return h, err
+		}
+	}
+}
+
+func gdriveDo(req *http.Request, out any) (http.Header, error) {
+	logger.Debug("gdrive request", "method", req.Method, "url", req.URL.Redacted())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.Header, gdriveResponseError(req, resp)
+	}
+	switch o := out.(type) {
+	case nil:
+		return resp.Header, nil
+	case io.Writer:
+		_, err = io.Copy(o, resp.Body)
+	default:
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	if err != nil {
+		return resp.Header, fmt.Errorf("could not read %s response: %w", req.URL.Path, err)
+	}
+	return resp.Header, nil
+}
+
+type gdriveFile struct {
+	ID          string
+	Name        string
+	MimeType    string
+	Size        int64  `json:",string"`
+	MD5Checksum string `json:"md5Checksum"`
+}
+
+// Quoted for a files.list query, e.g. 'it\'s'.
+func gdriveQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// The ID of the folder at dir under the store's folder ("" for the folder
+// itself), which is found - or created, along with those above it - on first
+// use.
+func (s *gdriveStore) folderID(dir string) (string, error) {
+	if id, ok := s.folders[dir]; ok {
+		return id, nil
+	}
+	parent, parentDir, name := "root", "", dir
+	if dir == "" {
+		// Each folder of the path, from the top of My Drive
+		for _, name := range strings.Split(s.path, "/") {
+			id, err := s.childFolder(parent, name)
+			if err != nil {
+				return "", fmt.Errorf("could not find (or create) %s: %w", s, err)
+			}
+			parent = id
+		}
+		s.folders[""] = parent
+		return parent, nil
+	}
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		parentDir, name = dir[:i], dir[i+1:]
+	}
+	parent, err := s.folderID(parentDir)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.childFolder(parent, name)
+	if err != nil {
+		return "", fmt.Errorf("could not create folder %s: %w", dir, err)
+	}
+	s.folders[dir] = id
+	return id, nil
+}
+
+// The ID of the parent's folder with the name, creating it if there is none.
+func (s *gdriveStore) childFolder(parent string, name string) (string, error) {
+	q := fmt.Sprintf("%s in parents and name = %s and mimeType = '%s' and trashed = false", gdriveQuote(parent), gdriveQuote(name), gdriveFolderType)
+	var res struct{ Files []gdriveFile }
+	_, err := s.call(http.MethodGet, gdriveURL(false, "files", url.Values{"q": {q}, "fields": {"files(id)"}}), nil, nil, &res)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Files) > 0 {
+		return res.Files[0].ID, nil
+	}
+	var f gdriveFile
+	_, err = s.call(http.MethodPost, gdriveURL(false, "files", url.Values{"fields": {"id"}}),
+		map[string]any{"name": name, "mimeType": gdriveFolderType, "parents": []string{parent}}, nil, &f)
+	if err != nil {
+		return "", err
+	}
+	logger.Debug("created Google Drive folder", "name", name, "id", f.ID)
+	return f.ID, nil
+}
+
+// Lists the folder's tree, a folder at a time. Google Docs (and such) are
+// skipped, since they have no content to compare.
+func (s *gdriveStore) list() (map[string]storedObject, error) {
+	root, err := s.folderID("")
+	if err != nil {
+		return nil, err
+	}
+	objs := map[string]storedObject{}
+	s.folders, s.files = map[string]string{"": root}, map[string]string{}
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		pageToken := ""
+		for {
+			query := url.Values{
+				"q":        {gdriveQuote(s.folders[dir]) + " in parents and trashed = false"},
+				"fields":   {"nextPageToken,files(id,name,mimeType,size)"},
+				"pageSize": {"1000"},
+			}
+			if pageToken != "" {
+				query.Set("pageToken", pageToken)
+			}
+			var res struct {
+				Files         []gdriveFile
+				NextPageToken string
+			}
+			_, err := s.call(http.MethodGet, gdriveURL(false, "files", query), nil, nil, &res)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range res.Files {
+				key := path.Join(dir, f.Name)
+				switch {
+				case f.MimeType == gdriveFolderType:
+					s.folders[key] = f.ID
+					dirs = append(dirs, key)
+				case !strings.HasPrefix(f.MimeType, "application/vnd.google-apps."):
+					objs[key] = storedObject{Size: f.Size}
+					s.files[key] = f.ID
+				}
+			}
+			if res.NextPageToken == "" {
+				break
+			}
+			pageToken = res.NextPageToken
+		}
+	}
+	return objs, nil
+}
+
+// Uploads as a resumable upload, in chunks of chunkSize (as a new revision,
+// for a file which is there already). Drive's MD5 of what it stored must
+// match the content's.
+func (s *gdriveStore) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	h := md5.New()
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return fmt.Errorf("could not hash: %w", err)
+	}
+	md5Sum := hex.EncodeToString(h.Sum(nil))
+
+	meta := map[string]any{"appProperties": map[string]string{"sha256": hex.EncodeToString(sum)}}
+	query := url.Values{"uploadType": {"resumable"}, "fields": {"id,md5Checksum"}}
+	method, u := http.MethodPost, gdriveURL(true, "files", query)
+	if id, ok := s.files[key]; ok {
+		method, u = http.MethodPatch, gdriveURL(true, "files/"+url.PathEscape(id), query)
+	} else {
+		dir, name := path.Split(key)
+		parent, err := s.folderID(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return err
+		}
+		meta["name"], meta["parents"] = name, []string{parent}
+	}
+	headers, err := s.call(method, u, meta, map[string]string{
+		"X-Upload-Content-Type":   "application/octet-stream",
+		"X-Upload-Content-Length": strconv.FormatInt(size, 10),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("could not start upload: %w", err)
+	}
+	session := headers.Get("Location")
+	if session == "" {
+		return errors.New("could not start upload: Drive gave no upload URL")
+	}
+	f, err := s.uploadChunks(session, r, size)
+	if err != nil {
+		return err
+	}
+	s.files[key] = f.ID
+	if f.MD5Checksum != md5Sum {
+		return fmt.Errorf("upload check failed: Drive has MD5 %s, not %s", f.MD5Checksum, md5Sum)
+	}
+	return nil
+}
+
+// Sends the content to the upload session a chunk at a time. If a chunk
+// fails, Drive is asked how much it has, and the upload carried on from there
+// (up to 4 times in a row, with backoff).
+func (s *gdriveStore) uploadChunks(session string, r io.ReaderAt, size int64) (gdriveFile, error) {
+	off, failures, query := int64(0), 0, false
+	for {
+		n := min(s.chunkSize, size-off)
+		if query {
+			n = 0
+		}
+		f, next, err := gdriveSendChunk(session, r, off, n, size)
+		if err == nil && f != nil {
+			return *f, nil
+		}
+		if err == nil {
+			off, failures, query = next, 0, false
+			continue
+		}
+		var gErr *gdriveError
+		failures++
+		if (errors.As(err, &gErr) && !gErr.retryable()) || failures > 4 || runCtx.Err() != nil {
+			return gdriveFile{}, fmt.Errorf("could not upload (at byte %d of %d): %w", off, size, err)
+		}
+		logger.Debug("gdrive chunk failed, resuming", "err", err.Error(), "offset", off)
+		err = gdriveBackoff(failures)
+		if err != nil {
+			return gdriveFile{}, err
+		}
+		query = true
+	}
+}
+
+// Sends n bytes at off to the upload session - or for n 0, nothing, to ask
+// how much Drive has. Returns the file once the upload is done, else the
+// offset Drive wants next.
+func gdriveSendChunk(session string, r io.ReaderAt, off int64, n int64, size int64) (*gdriveFile, int64, error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if n > 0 {
+		body = io.NewSectionReader(r, off, n)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size)
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodPut, session, body)
+	if err != nil {
+		return nil, off, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", contentRange)
+	logger.Debug("gdrive request", "method", req.Method, "range", contentRange)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, off, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// Drive's "resume incomplete", with what it has as e.g. bytes=0-1048575
+		// (or no Range, if it has nothing yet)
+		_, last, ok := strings.Cut(resp.Header.Get("Range"), "-")
+		if !ok {
+			return nil, 0, nil
+		}
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return nil, off, fmt.Errorf("could not parse upload Range %q", resp.Header.Get("Range"))
+		}
+		return nil, end + 1, nil
+	case resp.StatusCode/100 == 2:
+		var f gdriveFile
+		err = json.NewDecoder(resp.Body).Decode(&f)
+		if err != nil {
+			return nil, off, fmt.Errorf("could not parse upload response: %w", err)
+		}
+		return &f, size, nil
+	}
+	return nil, off, gdriveResponseError(req, resp)
+}
+
+func (s *gdriveStore) get(key string) ([]byte, error) {
+	id, ok := s.files[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	var b bytes.Buffer
+	_, err := s.call(http.MethodGet, gdriveURL(false, "files/"+url.PathEscape(id), url.Values{"alt": {"media"}}), nil, nil, &b)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Deletes the file for good, rather than moving it to the bin (where it
+// would still count towards the quota). Folders are kept.
+func (s *gdriveStore) delete(key string) error {
+	id, ok := s.files[key]
+	if !ok {
+		return nil
+	}
+	_, err := s.call(http.MethodDelete, gdriveURL(false, "files/"+url.PathEscape(id), nil), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	delete(s.files, key)
+	return nil
+}
@@ -3,6 +3,11 @@ module github.com/liampulles/backup-helper
 go 1.22.1
 
 require (
-	github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208 // indirect
-	github.com/xhit/go-simple-mail/v2 v2.16.0 // indirect
+	github.com/BurntSushi/toml v1.4.0
+	github.com/xhit/go-simple-mail/v2 v2.16.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208 // indirect
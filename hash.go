@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// The hash algorithms the native engine's checksums and the manifests can
+// use. sha256 is the default, and the only one cshatag knows.
+const (
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+	hashBLAKE3 = "blake3"
+	hashXXH3   = "xxh3"
+)
+
+type hashAlgo struct {
+	new func() hash.Hash
+	// Hashes the whole file, if faster than with new (e.g. in parallel)
+	file func(f *os.File, size int64) ([]byte, error)
+	// The command which checks a manifest of these hashes, if there is one,
+	// and whether it skips comments (e.g. the sizes listed)
+	check    string
+	comments bool
+}
+
+var hashAlgos = map[string]hashAlgo{
+	hashSHA256: {new: sha256.New, check: "sha256sum -c", comments: true},
+	hashSHA512: {new: sha512.New, check: "sha512sum -c", comments: true},
+	// Multithreaded for big files, so the fastest bar xxh3 with a few cores
+	hashBLAKE3: {new: newBLAKE3, file: blake3File, check: "b3sum -c"},
+	// Not cryptographic, but fine for noticing bitrot
+	hashXXH3: {new: newXXH3},
+}
+
+func hashNames() []string {
+	var names []string
+	for name := range hashAlgos {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// The HashAlgorithm, and each job's. Any but sha256 are checked by the native
+// engine, even if cshatag is installed.
+func validateHashAlgorithms(c *config) error {
+	check := func(name string) error {
+		if _, ok := hashAlgos[name]; !ok {
+			return fmt.Errorf("HashAlgorithm must be one of %s, not %q", strings.Join(hashNames(), ", "), name)
+		}
+		switch {
+		case name == hashSHA256:
+			return nil
+		case c.ChecksumEngine == checksumEngineCshatag:
+			return fmt.Errorf("HashAlgorithm %s needs the native ChecksumEngine, since cshatag only does sha256", name)
+		case tagStoreDesc == "":
+			return fmt.Errorf("HashAlgorithm %s needs the native ChecksumEngine, which is not supported on %s", name, runtime.GOOS)
+		}
+		return nil
+	}
+	err := check(c.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	for _, j := range c.Jobs {
+		if j.HashAlgorithm == "" {
+			continue
+		}
+		err = check(j.HashAlgorithm)
+		if err != nil {
+			return fmt.Errorf("job %q: %w", j.Name, err)
+		}
+	}
+	return nil
+}
+
+// The xattrs (or streams) the native engine keeps the algorithm's checksum,
+// and the modification time it was for, in. For sha256 they are cshatag's, so
+// that either can check the other's.
+func hashTagNames(algo string) (sumName string, tsName string) {
+	if algo == hashSHA256 {
+		return shatagSumName, shatagTsName
+	}
+	return "user.shatag." + algo, "user.shatag." + algo + ".ts"
+}
+
+// The file's checksum (in hex) with the algorithm.
+func fileHash(path string, algo string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	a := hashAlgos[algo]
+	if a.file != nil {
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		sum, err := a.file(f, info.Size())
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	h := a.new()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// One line (as JSON) in cfg.HistoryFile per run.
+type historyRecord struct {
+	Start           time.Time
+	End             time.Time
+	DurationSeconds float64
+	Status          string // success, error, or skipped
+	Error           string `json:",omitempty"`
+	Jobs            string `json:",omitempty"` // Names, comma separated
+	In              string
+	Out             string
+	BytesSent       uint64
+	FilesCreated    int
+	FilesUpdated    int
+	FilesDeleted    int
+	CorruptFiles    int
+	MessageID       string `json:",omitempty"` // Of the report mail
+	DryRun          bool   `json:",omitempty"` // Counts are of what would have changed
+	Tag             string `json:",omitempty"` // Given with -tag
+	ResumeOf        string `json:",omitempty"` // Message-ID of the interrupted run's report
+}
+
+func (rec *historyRecord) finish(err error, skipReason string) {
+	rec.End = time.Now()
+	rec.DurationSeconds = rec.End.Sub(rec.Start).Seconds()
+	switch {
+	case err != nil:
+		rec.Status = "error"
+		rec.Error = err.Error()
+	case skipReason != "":
+		rec.Status = "skipped"
+	default:
+		rec.Status = "success"
+	}
+}
+
+// Adds the counts of o (e.g. of one of a job's destinations).
+func (rec *historyRecord) add(o historyRecord) {
+	rec.BytesSent += o.BytesSent
+	rec.FilesCreated += o.FilesCreated
+	rec.FilesUpdated += o.FilesUpdated
+	rec.FilesDeleted += o.FilesDeleted
+	rec.CorruptFiles += o.CorruptFiles
+}
+
+// The number of files rsync created, updated or deleted.
+func (rec historyRecord) changes() int {
+	return rec.FilesCreated + rec.FilesUpdated + rec.FilesDeleted
+}
+
+func appendHistory(rec historyRecord) error {
+	// Keep e.g. the <> of message IDs readable
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(rec)
+	if err != nil {
+		return fmt.Errorf("could not marshal history record: %w", err)
+	}
+	f, err := os.OpenFile(cfg.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open history file %s: %w", cfg.HistoryFile, err)
+	}
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not write history file %s: %w", cfg.HistoryFile, err)
+	}
+	return nil
+}
+
+// All records which started at or after since. A missing history file just
+// means no records.
+func readHistory(since time.Time) ([]historyRecord, error) {
+	f, err := os.Open(cfg.HistoryFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open history file %s: %w", cfg.HistoryFile, err)
+	}
+	defer f.Close()
+
+	var recs []historyRecord
+	sc := bufio.NewScanner(f)
+	for i := 1; sc.Scan(); i++ {
+		var rec historyRecord
+		err = json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse history file %s line %d: %w", cfg.HistoryFile, i, err)
+		}
+		if !rec.Start.Before(since) {
+			recs = append(recs, rec)
+		}
+	}
+	if sc.Err() != nil {
+		return nil, fmt.Errorf("could not read history file %s: %w", cfg.HistoryFile, sc.Err())
+	}
+	return recs, nil
+}
+
+// A report summarising the runs in recs.
+func historySummary(since time.Time, recs []historyRecord) report {
+	counts := map[string]int{}
+	var bytes uint64
+	var duration float64
+	var corruptRuns, corruptFiles int
+	var corruptLines []string
+	for _, rec := range recs {
+		counts[rec.Status]++
+		bytes += rec.BytesSent
+		duration += rec.DurationSeconds
+		if rec.CorruptFiles > 0 {
+			corruptRuns++
+			corruptFiles += rec.CorruptFiles
+			corruptLines = append(corruptLines, fmt.Sprintf("%s: %d corrupt file(s) (%s -> %s)",
+				rec.Start.Format(time.RFC3339), rec.CorruptFiles, rec.In, rec.Out))
+		}
+	}
+	avg := 0.0
+	if len(recs) > 0 {
+		avg = duration / float64(len(recs))
+	}
+
+	r := report{
+		Title:  fmt.Sprintf("Backup Helper history since %s", since.Format(time.DateOnly)),
+		Detail: fmt.Sprintf("Summary of the %d run(s) recorded in %s.", len(recs), cfg.HistoryFile),
+		Sections: []section{
+			{
+				Title: "Runs",
+				LogLines: []string{
+					fmt.Sprintf("success: %d", counts["success"]),
+					fmt.Sprintf("error: %d", counts["error"]),
+					fmt.Sprintf("skipped: %d", counts["skipped"]),
+					fmt.Sprintf("total bytes sent: %d", bytes),
+					fmt.Sprintf("average duration: %s", time.Duration(avg*float64(time.Second)).Round(time.Second)),
+				},
+			},
+			{
+				Title:    fmt.Sprintf("Corruption events (%d run(s), %d file(s))", corruptRuns, corruptFiles),
+				LogLines: corruptLines,
+			},
+		},
+	}
+	return r
+}
+
+// Prints the report as plain text.
+func printReport(r report) {
+	fmt.Println(r.Title)
+	fmt.Println(r.Detail)
+	for _, sec := range r.Sections {
+		fmt.Printf("\n## %s\n", sec.Title)
+		if sec.Detail != "" {
+			fmt.Println(sec.Detail)
+		}
+		for _, l := range sec.LogLines {
+			fmt.Printf("  %s\n", l)
+		}
+	}
+}
+
+// Prints the last runs as a table, or as JSON with -output json.
+func listHistory(opts options) error {
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	recs, err := readHistory(time.Time{})
+	if err != nil {
+		return err
+	}
+	if opts.Last > 0 && len(recs) > opts.Last {
+		recs = recs[len(recs)-opts.Last:]
+	}
+
+	if opts.Output == "json" {
+		if recs == nil {
+			recs = []historyRecord{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "    ")
+		err = enc.Encode(recs)
+		if err != nil {
+			return fmt.Errorf("could not print history: %w", err)
+		}
+		return nil
+	}
+	if len(recs) == 0 {
+		fmt.Printf("No runs recorded in %s\n", cfg.HistoryFile)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tJOB\tSTATUS\tFILES\tBYTES\tDURATION")
+	for _, rec := range recs {
+		job := rec.Jobs
+		if job == "" {
+			job = "-"
+		}
+		status := rec.Status
+		if rec.DryRun {
+			status += " (dry run)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			rec.Start.Local().Format(time.DateTime), job, status,
+			rec.FilesCreated+rec.FilesUpdated, rec.BytesSent,
+			time.Duration(rec.DurationSeconds*float64(time.Second)).Round(time.Second))
+	}
+	return tw.Flush()
+}
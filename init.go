@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+	"golang.org/x/term"
+)
+
+// Asks questions on in, and writes the prompts to out.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// Gives def if the answer is blank.
+func (p *prompter) ask(question string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", fmt.Errorf("could not read answer: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// Doesn't echo the answer, if on a terminal.
+func (p *prompter) askSecret(question string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return p.ask(question, "")
+	}
+	fmt.Fprintf(p.out, "%s: ", question)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(p.out)
+	if err != nil {
+		return "", fmt.Errorf("could not read answer: %w", err)
+	}
+	return string(b), nil
+}
+
+func (p *prompter) askInt(question string, def int) (int, error) {
+	for {
+		a, err := p.ask(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.Atoi(a)
+		if err == nil {
+			return n, nil
+		}
+		fmt.Fprintf(p.out, "%q is not a number\n", a)
+	}
+}
+
+func (p *prompter) askYes(question string) (bool, error) {
+	a, err := p.ask(question+" (y/n)", "n")
+	return strings.HasPrefix(strings.ToLower(a), "y"), err
+}
+
+// Prompts for the mail settings and a default job, sends a test mail, and
+// writes the config file (which must not exist yet).
+func initConfig(opts options) error {
+	path := opts.ConfigFile
+	if path == "" {
+		dir := opts.ConfigDir
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		path = filepath.Join(dir, "config.json")
+	}
+	_, err := os.Stat(path)
+	if err == nil {
+		return fmt.Errorf("config %s already exists, not overwriting it", path)
+	}
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	fmt.Fprintf(p.out, "This writes a new config to %s.\n", path)
+	srv, from, to, err := askMail(p)
+	if err != nil {
+		return err
+	}
+	in, err := p.ask("Default input folder (blank to skip)", "")
+	if err != nil {
+		return err
+	}
+	var out string
+	if in != "" {
+		out, err = p.ask("Default output folder", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(p.out, "Sending a test mail to %s...\n", to)
+	err = sendTestMail(srv, from, to)
+	if err != nil {
+		fmt.Fprintf(p.out, "Test mail failed: %s\n", err)
+		yes, err := p.askYes("Write the config anyway?")
+		if err != nil {
+			return err
+		}
+		if !yes {
+			return errors.New("config not written, since the test mail failed")
+		}
+	} else {
+		fmt.Fprintln(p.out, "Test mail sent - check that it arrived.")
+	}
+
+	return writeInitConfig(path, srv, from, to, in, out)
+}
+
+func askMail(p *prompter) (srv mailServer, from string, to string, err error) {
+	srv.Host, err = p.ask("SMTP host", "smtp.gmail.com")
+	if err != nil {
+		return
+	}
+	srv.Port, err = p.askInt("SMTP port", 587)
+	if err != nil {
+		return
+	}
+	srv.Encryption, err = askEncryption(p)
+	if err != nil {
+		return
+	}
+	srv.User, err = p.ask("SMTP user (blank for none)", "")
+	if err != nil {
+		return
+	}
+	if srv.User != "" {
+		srv.Pass, err = p.askSecret("SMTP pass")
+		if err != nil {
+			return
+		}
+	}
+	from, err = p.ask("From address", srv.User)
+	if err != nil {
+		return
+	}
+	to, err = p.ask("To address", from)
+	return
+}
+
+func askEncryption(p *prompter) (string, error) {
+	for {
+		a, err := p.ask("Encryption (SSL/TLS or STARTTLS)", "STARTTLS")
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToUpper(a) {
+		case "SSL/TLS", "STARTTLS":
+			return strings.ToUpper(a), nil
+		}
+		fmt.Fprintf(p.out, "%q is not SSL/TLS or STARTTLS\n", a)
+	}
+}
+
+func sendTestMail(srv mailServer, from string, to string) error {
+	email := mail.NewMSG().
+		SetFrom(fmt.Sprintf("backup-helper <%s>", from)).
+		AddTo(to).
+		SetSubject("[TEST] Backup Helper report").
+		SetBody(mail.TextPlain, "This is a test mail from backup-helper init. Reports will be sent like this.")
+	if email.Error != nil {
+		return fmt.Errorf("could not build email: %w", email.Error)
+	}
+	return sendVia(email, srv)
+}
+
+// Only writes the fields asked for, in the same order as config.json.example.
+func writeInitConfig(path string, srv mailServer, from string, to string, in string, out string) error {
+	type initJob struct {
+		Name string
+		In   string
+		Out  string
+	}
+	c := struct {
+		MailHost       string
+		MailPort       int
+		MailUser       string `json:",omitempty"`
+		MailPass       string `json:",omitempty"`
+		MailEncryption string
+		FromMail       string
+		ToMail         string
+		Jobs           []initJob `json:",omitempty"`
+	}{
+		MailHost:       srv.Host,
+		MailPort:       srv.Port,
+		MailUser:       srv.User,
+		MailPass:       srv.Pass,
+		MailEncryption: srv.Encryption,
+		FromMail:       from,
+		ToMail:         to,
+	}
+	if in != "" {
+		c.Jobs = []initJob{{Name: "default", In: in, Out: out}}
+	}
+	b, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not marshal config: %w", err)
+	}
+
+	// The pass is in it, so keep it private
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create config %s: %w", path, err)
+	}
+	_, err = f.Write(append(b, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write config %s: %w", path, err)
+	}
+	fmt.Printf("Config written to %s. Run backup-helper check-config to check it.\n", path)
+	return nil
+}
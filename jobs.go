@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// A named backup of In to Out, with its own options.
+type job struct {
+	Name string
+	In   string
+	Out  string
+	// More destinations (of any kind Out can be), each backed up to (and
+	// verified, and reported on) as Out is - in turn, or at once if Parallel.
+	Outs     []string
+	Parallel bool
+	// A destination backed up to (as Out) only on every OffsiteEveryNthRun'th
+	// run of the job, and/or on OffsiteWeekdays (e.g. Sat), e.g. for a slow
+	// upload offsite.
+	Offsite            string
+	OffsiteEveryNthRun int
+	OffsiteWeekdays    []string
+
+	// rsync --exclude patterns
+	Excludes []string
+	// Overrides the Delete config for this job, if set
+	Delete *bool
+	// Overrides the HashAlgorithm config for this job, if set
+	HashAlgorithm string
+
+	jobMail
+}
+
+// If any are set, the job's report is also mailed on its own.
+type jobMail struct {
+	ToMail            string // Default ToMail
+	SubjectPrefix     string
+	MailOnFailureOnly bool
+}
+
+func (m jobMail) separate() bool {
+	return m.ToMail != "" || m.SubjectPrefix != "" || m.MailOnFailureOnly
+}
+
+func validateJobs(jobs []job) error {
+	seen := map[string]bool{}
+	for i, j := range jobs {
+		if j.Name == "" {
+			return fmt.Errorf("invalid Jobs entry %d: no Name", i)
+		}
+		if seen[j.Name] {
+			return fmt.Errorf("invalid Jobs entry %d: more than one job named %q", i, j.Name)
+		}
+		seen[j.Name] = true
+		if j.In == "" || j.Out == "" {
+			return fmt.Errorf("job %q needs both In and Out", j.Name)
+		}
+		outs := map[string]bool{j.Out: true}
+		for _, o := range j.Outs {
+			if o == "" || outs[o] {
+				return fmt.Errorf("job %q has a blank or repeated destination in Outs: %q", j.Name, o)
+			}
+			outs[o] = true
+		}
+		if j.Parallel && len(j.Outs) == 0 && j.Offsite == "" {
+			return fmt.Errorf("job %q is Parallel, but has no Outs to back up to at once", j.Name)
+		}
+		err := validateOffsite(j, outs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The named jobs in the order given, or all jobs in config order if none are
+// named. Names may be globs (e.g. docs-*), matching jobs in config order.
+func jobPairs(names []string) ([]folderPair, error) {
+	if len(cfg.Jobs) == 0 {
+		return nil, errors.New("no Jobs in the config")
+	}
+	jobs := cfg.Jobs
+	if len(names) > 0 {
+		jobs = nil
+		seen := map[string]bool{}
+		var unknown []string
+		for _, n := range names {
+			matched, err := matchJobs(n)
+			if err != nil {
+				return nil, err
+			}
+			if len(matched) == 0 {
+				unknown = append(unknown, n)
+			}
+			for _, j := range matched {
+				if !seen[j.Name] {
+					seen[j.Name] = true
+					jobs = append(jobs, j)
+				}
+			}
+		}
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("no such job(s): %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	// One pair per destination, so a job's pairs are next to each other
+	var pairs []folderPair
+	for _, j := range jobs {
+		for _, out := range append([]string{j.Out}, j.Outs...) {
+			pairs = append(pairs, folderPair{
+				In:       j.In,
+				Out:      out,
+				Name:     j.Name,
+				Excludes: j.Excludes,
+				Delete:   j.Delete,
+				Hash:     j.HashAlgorithm,
+				Parallel: j.Parallel,
+				jobMail:  j.jobMail,
+			})
+		}
+		if j.Offsite != "" {
+			pairs = append(pairs, folderPair{
+				In:       j.In,
+				Out:      j.Offsite,
+				Name:     j.Name,
+				Excludes: j.Excludes,
+				Delete:   j.Delete,
+				Hash:     j.HashAlgorithm,
+				Parallel: j.Parallel,
+				Offsite:  true,
+				jobMail:  j.jobMail,
+			})
+		}
+	}
+	return pairs, nil
+}
+
+// The jobs whose name matches the glob (or is the name).
+func matchJobs(pattern string) ([]job, error) {
+	var jobs []job
+	for _, j := range cfg.Jobs {
+		ok, err := path.Match(pattern, j.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job name glob %q: %w", pattern, err)
+		}
+		if ok {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// For the {job} in the log file name: the names of the jobs, with any globs
+// expanded (if they match).
+func jobsLogName(names []string) string {
+	pairs, err := jobPairs(names)
+	if len(names) == 0 || err != nil {
+		return strings.Join(names, "+")
+	}
+	var matched []string
+	for _, p := range pairs {
+		matched = append(matched, p.Name)
+	}
+	return strings.Join(matched, "+")
+}
+
+// Prints the configured jobs, for -list-jobs.
+func listJobs(opts options) error {
+	err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Jobs) == 0 {
+		fmt.Println("No Jobs in the config")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tIN\tOUT")
+	for _, j := range cfg.Jobs {
+		outs := append([]string{j.Out}, j.Outs...)
+		if j.Offsite != "" {
+			outs = append(outs, "offsite "+j.Offsite)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", j.Name, j.In, strings.Join(outs, ", "))
+	}
+	return tw.Flush()
+}
+
+// E.g. for section titles.
+func (p folderPair) title() string {
+	if p.Name != "" {
+		return fmt.Sprintf("job %s (%s to %s)", p.Name, p.In, p.Out)
+	}
+	return fmt.Sprintf("%s to %s", p.In, p.Out)
+}
+
+// E.g. for errors.
+func (p folderPair) label() string {
+	if p.Name != "" {
+		return "job " + p.Name
+	}
+	return p.In
+}
+
+// Mails the report of the job on its own, as per its mail overrides.
+func sendJobMail(p folderPair, r report, jobErr error, changes int) error {
+	if jobErr == nil && p.MailOnFailureOnly {
+		logger.Debug("job succeeded, so not mailing it on its own", "job", p.Name)
+		return nil
+	}
+	if reason := mailSkipReason(jobErr, changes); reason != "" {
+		logger.Debug("not mailing the job on its own", "job", p.Name, "reason", reason)
+		return nil
+	}
+	r.Title = "[SUCCESS] Backup Helper report: job " + p.Name
+	r.Sections = append(r.Sections, section{
+		Title:  "Success",
+		Detail: "No error reported - looking good!",
+	})
+	if jobErr != nil {
+		r.Title = "[ERROR] Backup Helper report: job " + p.Name
+		r.Sections[len(r.Sections)-1] = section{
+			Title:  "Error",
+			Detail: fmt.Sprintf("Error contents: %s", jobErr.Error()),
+		}
+	}
+	prefix := p.SubjectPrefix
+	if prefix == "" {
+		prefix = cfg.SubjectPrefix
+	}
+	if prefix != "" {
+		r.Title = prefix + " " + r.Title
+	}
+	if cfg.tag != "" {
+		r.Title += tagSuffix(cfg.tag)
+	}
+	r.To = p.ToMail
+	err := sendMail(r)
+	if err != nil {
+		return withExitCode(exitMail, fmt.Errorf("could not mail report of job %s: %w", p.Name, err))
+	}
+	return nil
+}
+
+// Backs up a job's pairs (one per destination), or a single pair, returning
+// each one's error. A Parallel job's pairs are backed up at once, each into its
+// own sections, which are then added in order.
+func backupDestinations(r *report, rec *historyRecord, st *state, group []folderPair, headings bool, verifyOnly bool) []error {
+	errs := make([]error, len(group))
+	if !group[0].Parallel || len(group) == 1 {
+		for i, p := range group {
+			if headings {
+				r.Sections = append(r.Sections, section{Title: "Backing up " + p.title()})
+			}
+			errs[i] = backupFolder(r, rec, st, p, verifyOnly)
+		}
+		return errs
+	}
+
+	logger.Info("backing up the job's destinations at once", "job", group[0].Name, "destinations", len(group))
+	// One snapshot for all of them, since each would be taken at the same
+	// moment - with the same name
+	pairs := slices.Clone(group)
+	release := func() error { return nil }
+	if cfg.ZFS.Snapshot || cfg.LVM.Snapshot {
+		err := withRunTimeout("folder check", func() error { return checkFolder(group[0].In) })
+		if err != nil {
+			err = withExitCode(exitFolderCheck, fmt.Errorf("in folder: %w", err))
+		} else {
+			var snap folderPair
+			snap, release, err = snapshotSource(r, group[0])
+			for i, p := range pairs {
+				if outKind(p.Out).snapshots {
+					pairs[i].In, pairs[i].Live = snap.In, snap.live()
+				}
+			}
+		}
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+	}
+	reports := make([]report, len(group))
+	recs := make([]historyRecord, len(group))
+	var wg sync.WaitGroup
+	for i, p := range pairs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = backupFolder(&reports[i], &recs[i], st, p, verifyOnly)
+		}()
+	}
+	wg.Wait()
+	// Reported once, with the first destination
+	errs[0] = errors.Join(errs[0], release())
+	for i, p := range group {
+		r.Sections = append(r.Sections, section{
+			Title:  "Backing up " + p.title(),
+			Detail: fmt.Sprintf("Backed up at the same time as the job's other %d destination(s).", len(group)-1),
+		})
+		r.Sections = append(r.Sections, reports[i].Sections...)
+		rec.add(recs[i])
+	}
+	return errs
+}
@@ -0,0 +1,10 @@
+package main
+
+func init() {
+	features = append(features, "keyring")
+}
+
+// Uses the login keychain.
+func keyringCommand(ref keyringRef) ([]string, error) {
+	return []string{"security", "find-generic-password", "-s", ref.Service, "-a", ref.User, "-w"}, nil
+}
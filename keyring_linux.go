@@ -0,0 +1,10 @@
+package main
+
+func init() {
+	features = append(features, "keyring")
+}
+
+// Uses libsecret's secret-tool (e.g. GNOME Keyring, KWallet).
+func keyringCommand(ref keyringRef) ([]string, error) {
+	return []string{"secret-tool", "lookup", "service", ref.Service, "username", ref.User}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func keyringCommand(ref keyringRef) ([]string, error) {
+	return nil, fmt.Errorf("keyring is not supported on %s, use a pass command instead", runtime.GOOS)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultLogNamePattern = "backup-helper-{date}.log"
+
+// Sorts by time, and has no colons (which some filesystems don't allow).
+const logDateFormat = "2006-01-02T150405Z0700"
+
+var logPlaceholderRe = regexp.MustCompile(`\{(date|job|hostname|tag)\}`)
+
+// Characters which Windows doesn't allow in file names, replaced in what goes
+// into log names.
+var unsafeNameRe = regexp.MustCompile(`[<>:"/\\|?*]`)
+
+// The log file for a run started at start, as per LogDir and LogNamePattern
+// (c may be nil, for the defaults). If the run has a tag but the pattern has
+// no {tag}, the tag is added before the extension.
+func logPath(c *config, start time.Time, job string, tag string) string {
+	dir, pattern := "", defaultLogNamePattern
+	if c != nil {
+		dir = c.LogDir
+		if c.LogNamePattern != "" {
+			pattern = c.LogNamePattern
+		}
+	}
+	if job == "" {
+		job = "backup"
+	}
+	host, _ := os.Hostname()
+	job, tag, host = unsafeNameRe.ReplaceAllString(job, "-"), unsafeNameRe.ReplaceAllString(tag, "-"), unsafeNameRe.ReplaceAllString(host, "-")
+	name := logPlaceholderRe.ReplaceAllStringFunc(pattern, func(p string) string {
+		switch p {
+		case "{date}":
+			return start.Format(logDateFormat)
+		case "{job}":
+			return job
+		case "{tag}":
+			return tag
+		default:
+			return host
+		}
+	})
+	if tag != "" && !strings.Contains(pattern, "{tag}") {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + tag + ext
+	}
+	return filepath.Join(dir, name)
+}
+
+// Glob for the log files (from any run) of the config.
+func logGlob(c *config) string {
+	pattern := defaultLogNamePattern
+	if c.LogNamePattern != "" {
+		pattern = c.LogNamePattern
+	}
+	return filepath.Join(c.LogDir, logPlaceholderRe.ReplaceAllString(pattern, "*"))
+}
+
+// rsync's own log goes next to the log file.
+func rsyncLogPath(logPath string) string {
+	return strings.TrimSuffix(logPath, ".log") + ".rsync.log"
+}
+
+// Removes all but the newest keep files matching pattern (which should sort by
+// time, e.g. via an embedded timestamp). Files ending in any of the exclude
+// suffixes are left alone. keep <= 0 keeps everything.
+func pruneFiles(pattern string, keep int, exclude ...string) {
+	if keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		logger.Warn("could not list files to prune", "pattern", pattern, "err", err.Error())
+		return
+	}
+	var files []string
+	for _, m := range matches {
+		excluded := false
+		for _, suffix := range exclude {
+			excluded = excluded || strings.HasSuffix(m, suffix)
+		}
+		if !excluded {
+			files = append(files, m)
+		}
+	}
+	if len(files) <= keep {
+		return
+	}
+
+	sort.Strings(files)
+	for _, f := range files[:len(files)-keep] {
+		err = os.Remove(f)
+		if err != nil {
+			logger.Warn("could not prune file", "file", f, "err", err.Error())
+			continue
+		}
+		logger.Debug("pruned file", "file", f)
+	}
+}
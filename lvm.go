@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For snapshots of in folders on LVM logical volumes: the volume is
+// snapshotted, and the snapshot mounted read only to back up from.
+type lvmConfig struct {
+	// Back up in folders on LVM logical volumes from a snapshot.
+	Snapshot bool
+	// The lvm binary to run (default lvm), for lvcreate, lvs and lvremove.
+	Path string
+	// Space for changes to the volume while the snapshot exists, as for
+	// lvcreate -L (e.g. 5G) or -l (e.g. 20%ORIGIN, the default). Thin
+	// volumes get a thin snapshot, which needs none.
+	Size string
+	// Where snapshots are mounted (in a subfolder each), default the temp
+	// dir.
+	MountDir string
+	// Extra mount -o options (ro is always given, and nouuid for xfs).
+	MountOptions []string
+}
+
+// Snapshots are named <lv>-backup-helper-run-<date>.
+const lvmRunSuffix = "-backup-helper-run-"
+
+func validateLVM(c *config) error {
+	if c.LVM.MountDir != "" && !filepath.IsAbs(c.LVM.MountDir) {
+		return fmt.Errorf("LVM MountDir must be absolute, not %s", c.LVM.MountDir)
+	}
+	return nil
+}
+
+// A logical volume, and where it is mounted.
+type lvmVolume struct {
+	vg, lv     string
+	thin       bool
+	mountpoint string
+	fstype     string
+}
+
+func (v lvmVolume) String() string {
+	return v.vg + "/" + v.lv
+}
+
+// Runs lvm for what it does (e.g. lvcreate), adding its output to the report
+// if it fails.
+func lvmRun(r *report, args ...string) error {
+	lines, err := execCommand("lvm:"+args[0], cfg.LVM.Path, args...)
+	if err != nil {
+		addExecSection(r, "lvm "+args[0], lines, cfg.LVM.Path, args...)
+	}
+	return err
+}
+
+// As lvmRun, but for cleaning up (see execCleanup).
+func lvmCleanup(r *report, args ...string) error {
+	lines, err := execCleanup("lvm:"+args[0], cfg.LVM.Path, args...)
+	if err != nil {
+		addExecSection(r, "lvm "+args[0], lines, cfg.LVM.Path, args...)
+	}
+	return err
+}
+
+// The logical volume dir is on.
+func lvmVolumeOf(dir string) (lvmVolume, error) {
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return lvmVolume{}, err
+	}
+	lines, err := commandLines("findmnt", "findmnt", "-n", "-r", "-o", "SOURCE,TARGET,FSTYPE", "-T", abs)
+	if err != nil {
+		return lvmVolume{}, err
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 {
+		return lvmVolume{}, fmt.Errorf("could not parse findmnt: %q", lines[0])
+	}
+	// findmnt -r escapes spaces and such as \x20
+	for i, f := range fields {
+		if s, err := strconv.Unquote(`"` + f + `"`); err == nil {
+			fields[i] = s
+		}
+	}
+	source := fields[0]
+	v := lvmVolume{mountpoint: fields[1], fstype: fields[2]}
+	lines, err = commandLines("lvm lvs", cfg.LVM.Path, "lvs", "--noheadings", "--separator", ",", "-o", "vg_name,lv_name,segtype", source)
+	if err != nil {
+		return lvmVolume{}, fmt.Errorf("%s is not a logical volume: %w", source, err)
+	}
+	parts := strings.Split(strings.TrimSpace(lines[0]), ",")
+	if len(parts) != 3 {
+		return lvmVolume{}, fmt.Errorf("could not parse lvs: %q", lines[0])
+	}
+	v.vg, v.lv, v.thin = parts[0], parts[1], parts[2] == "thin"
+	return v, nil
+}
+
+// The lvcreate args to snapshot the volume as name.
+func lvmCreateArgs(v lvmVolume, name string) []string {
+	args := []string{"lvcreate", "--snapshot", "--name", name}
+	if v.thin {
+		// Thin snapshots are not activated by default
+		args = append(args, "--setactivationskip", "n")
+	} else {
+		size := firstNonEmpty(cfg.LVM.Size, "20%ORIGIN")
+		if strings.Contains(size, "%") {
+			args = append(args, "--extents", size)
+		} else {
+			args = append(args, "--size", size)
+		}
+	}
+	return append(args, v.String())
+}
+
+// The mount -o options for the snapshot.
+func lvmMountOptions(v lvmVolume) string {
+	// The snapshot itself is writable, so that the filesystem can replay its
+	// journal on mounting (as it was crash consistent)
+	opts := append([]string{"ro"}, cfg.LVM.MountOptions...)
+	if v.fstype == "xfs" {
+		// Else it clashes with the mounted volume's UUID
+		opts = append(opts, "nouuid")
+	}
+	return strings.Join(opts, ",")
+}
+
+func snapshotLVM(r *report, p folderPair) (folderPair, func() error, error) {
+	noop := func() error { return nil }
+	v, err := lvmVolumeOf(p.In)
+	if err != nil {
+		logger.Info("in folder not on a logical volume, so not snapshotting it", "in", p.In, "err", err.Error())
+		r.Sections = append(r.Sections, section{
+			Title:  "Snapshot skipped",
+			Detail: fmt.Sprintf("%s does not seem to be on an LVM logical volume (%s), so it was backed up as it is.", p.In, err),
+		})
+		return p, noop, nil
+	}
+	abs, _ := filepath.Abs(p.In)
+	abs, _ = filepath.EvalSymlinks(abs)
+	rel, err := filepath.Rel(v.mountpoint, abs)
+	if err != nil {
+		return p, noop, err
+	}
+	name := v.lv + lvmRunSuffix + time.Now().UTC().Format(logDateFormat)
+	device := "/dev/" + v.vg + "/" + name
+	mountDir := filepath.Join(firstNonEmpty(cfg.LVM.MountDir, os.TempDir()), name)
+	dir := filepath.Join(mountDir, rel)
+	if cfg.dryRun {
+		r.Sections = append(r.Sections, section{
+			Title:  "Snapshot (dry run)",
+			Detail: fmt.Sprintf("Would snapshot %s as %s/%s, mount it read only on %s, and back up from %s.", v, v.vg, name, mountDir, dir),
+		})
+		return p, noop, nil
+	}
+
+	err = lvmRun(r, lvmCreateArgs(v, name)...)
+	if err != nil {
+		return p, noop, withExitCode(exitFolderCheck, fmt.Errorf("could not snapshot %s: %w", v, err))
+	}
+	logger.Info("snapshot taken", "snapshot", v.vg+"/"+name)
+	remove := func() error {
+		err := lvmCleanup(r, "lvremove", "--yes", v.vg+"/"+name)
+		if err != nil {
+			return fmt.Errorf("could not remove snapshot %s/%s: %w", v.vg, name, err)
+		}
+		logger.Info("snapshot removed", "snapshot", v.vg+"/"+name)
+		return nil
+	}
+	err = os.MkdirAll(mountDir, 0700)
+	if err != nil {
+		return p, noop, errors.Join(fmt.Errorf("could not create snapshot mountpoint: %w", err), remove())
+	}
+	opts := lvmMountOptions(v)
+	lines, err := execCommand("mount", "mount", "-o", opts, device, mountDir)
+	if err != nil {
+		addExecSection(r, "Mount "+mountDir, lines, "mount", "-o", opts, device, mountDir)
+		os.Remove(mountDir)
+		return p, noop, withExitCode(exitFolderCheck, errors.Join(fmt.Errorf("could not mount snapshot %s on %s: %w", device, mountDir, err), remove()))
+	}
+	setSnapshotDir(dir, true)
+	r.Sections = append(r.Sections, section{
+		Title:  "Snapshot taken",
+		Detail: "The in folder's logical volume was snapshotted, and backed up (and verified) from the snapshot, mounted read only, which is removed after the backup.",
+		LogLines: []string{
+			fmt.Sprintf("snapshot: %s/%s of %s", v.vg, name, v),
+			fmt.Sprintf("backed up from: %s", dir),
+		},
+	})
+	p.Live, p.In = p.In, dir
+
+	released := false
+	return p, func() error {
+		if released {
+			return nil
+		}
+		released = true
+		setSnapshotDir(dir, false)
+		var errs []error
+		// A full snapshot is dropped by LVM, so reads from it fail
+		if !v.thin {
+			errs = append(errs, lvmCheckFull(v.vg+"/"+name))
+		}
+		lines, err := execCleanup("umount", "umount", mountDir)
+		if err != nil {
+			addExecSection(r, "Unmount "+mountDir, lines, "umount", mountDir)
+			// Removing it mounted would fail anyway
+			return errors.Join(append(errs, fmt.Errorf("could not unmount snapshot %s, so %s/%s is left (for umount and lvremove): %w", mountDir, v.vg, name, err))...)
+		}
+		os.Remove(mountDir)
+		return errors.Join(append(errs, remove())...)
+	}, nil
+}
+
+// Errors if the snapshot ran out of space for changes during the backup.
+func lvmCheckFull(snap string) error {
+	lines, err := commandLines("lvm lvs", cfg.LVM.Path, "lvs", "--noheadings", "-o", "snap_percent", snap)
+	if err != nil || len(lines) == 0 {
+		return nil
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSpace(lines[0]), 64)
+	if err != nil || pct < 100 {
+		return nil
+	}
+	return fmt.Errorf("snapshot %s filled up during the backup, so it may be incomplete - give LVM Size more space", snap)
+}
+
+// For -validate-paths.
+func lvmSnapshotLine(p folderPair) string {
+	v, err := lvmVolumeOf(p.In)
+	if err != nil {
+		return fmt.Sprintf("snapshot: none, since it does not seem to be on an LVM logical volume (%s)", err)
+	}
+	return fmt.Sprintf("snapshot: %s %s, mounted with -o %s", cfg.LVM.Path, strings.Join(lvmCreateArgs(v, v.lv+lvmRunSuffix+"<date>"), " "), lvmMountOptions(v))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+func sendMail(r report) error {
+	r = redactReport(r)
+	r, attachments := layoutSections(r)
+	r.Footer = versionSummary()
+	wr := strings.Builder{}
+	err := reportTmpl.Execute(&wr, r)
+	if err != nil {
+		return fmt.Errorf("could not template report: %w", err)
+	}
+	body := wr.String()
+
+	if r.MessageID == "" {
+		r.MessageID = messageID(time.Now())
+	}
+	to := cfg.ToMail
+	if r.To != "" {
+		to = r.To
+	}
+	email := mail.NewMSG().
+		SetFrom(fmt.Sprintf("backup-helper <%s>", cfg.FromMail)).
+		AddTo(to).
+		SetSubject(r.Title).
+		AddHeader("Message-ID", r.MessageID).
+		SetBody(mail.TextHTML, body)
+	if r.InReplyTo != "" {
+		email.AddHeader("In-Reply-To", r.InReplyTo).
+			AddHeader("References", r.InReplyTo)
+	}
+	for _, a := range attachments {
+		email.Attach(a)
+	}
+	if email.Error != nil {
+		return fmt.Errorf("could not build email: %w", email.Error)
+	}
+
+	var outboxErr, sendErr error
+	if cfg.OutboxDir != "" {
+		outboxErr = writeOutbox(email, cfg.OutboxDir)
+	}
+	logger.Info("mail built", "message_id", r.MessageID)
+	if !cfg.OutboxOnly {
+		sendErr = sendWithRetry(email, to, r.Title)
+	}
+	// Don't lose the report if no server could take it
+	if sendErr != nil && cfg.OutboxDir == "" {
+		fErr := writeOutbox(email, ".")
+		if fErr == nil {
+			logger.Warn("all mail servers failed, so the mail was written to PWD instead")
+		}
+		sendErr = errors.Join(sendErr, fErr)
+	}
+	return errors.Join(outboxErr, sendErr)
+}
+
+// Unique per host and run start, but the same for every attempt at sending
+// the run's report - so it can be correlated with the relay's logs.
+func messageID(start time.Time) string {
+	host, _ := os.Hostname()
+	ts := start.UTC().Format("20060102T150405.000000000Z")
+	sum := sha256.Sum256([]byte(host + "|" + ts))
+	domain := host
+	if _, d, ok := strings.Cut(cfg.FromMail, "@"); ok {
+		domain = d
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+	return fmt.Sprintf("<backup-helper.%s.%s@%s>", ts, hex.EncodeToString(sum[:6]), domain)
+}
+
+func sendWithRetry(email *mail.Email, to string, subject string) error {
+	// Each attempt gets a fresh connection, since a dropped one can't be reused
+	for attempt := 1; ; attempt++ {
+		err := sendAttempt(email)
+		if err == nil {
+			break
+		}
+		if attempt >= cfg.MailAttempts {
+			return fmt.Errorf("giving up on mail after %d attempt(s): %w", attempt, err)
+		}
+		logger.Warn("mail attempt failed, will retry",
+			"attempt", attempt,
+			"err", err.Error())
+		time.Sleep(time.Duration(attempt*cfg.MailRetrySeconds) * time.Second)
+	}
+
+	logger.Info("mail sent",
+		"to", to,
+		"subject", subject)
+	return nil
+}
+
+// Writes the complete message into dir (e.g. OutboxDir), for an external agent
+// to deliver.
+func writeOutbox(email *mail.Email, dir string) error {
+	name := fmt.Sprintf("backup-helper-%s-%d.eml", time.Now().Format("20060102T150405"), rand.Int())
+	path := filepath.Join(dir, name)
+
+	// Write then rename, so that the agent never picks up a partial message
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	err := os.WriteFile(tmp, []byte(email.GetMessage()), 0600)
+	if err != nil {
+		return fmt.Errorf("could not write outbox message: %w", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("could not move outbox message into place: %w", err)
+	}
+
+	logger.Info("mail written to outbox", "file", path)
+	return nil
+}
+
+// Decides per section whether the log goes inline, in a collapsed block, or in
+// a gzipped attachment, based on its size.
+func layoutSections(r report) (report, []*mail.File) {
+	var attachments []*mail.File
+	out := r
+	out.Sections = make([]section, len(r.Sections))
+	for i, sec := range r.Sections {
+		size := 0
+		for _, l := range sec.LogLines {
+			size += len(l) + 1
+		}
+
+		switch {
+		case cfg.LogAttachBytes > 0 && size > cfg.LogAttachBytes:
+			data, err := gzipLines(sec.LogLines)
+			if err != nil {
+				logger.Warn("could not gzip log, leaving inline",
+					"section", sec.Title,
+					"err", err.Error())
+				break
+			}
+			sec.Attachment = fmt.Sprintf("%02d-%s.log.gz", i+1, slug(sec.Title))
+			sec.LogLines = nil
+			attachments = append(attachments, &mail.File{
+				Name:     sec.Attachment,
+				MimeType: "application/gzip",
+				Data:     data,
+			})
+		case cfg.LogCollapseBytes > 0 && size > cfg.LogCollapseBytes:
+			sec.Collapsed = true
+		}
+		out.Sections[i] = sec
+	}
+	return out, attachments
+}
+
+func gzipLines(lines []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, l := range lines {
+		_, err := io.WriteString(gz, l+"\n")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var nonSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// e.g. "rsync from input" -> "rsync-from-input"
+func slug(s string) string {
+	return strings.Trim(nonSlugRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// Tries each mail server in order, until one sends the mail.
+func sendAttempt(email *mail.Email) error {
+	var errs []error
+	for i, srv := range cfg.mailServers() {
+		err := sendVia(email, srv)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", srv.Host, err))
+		if i < len(cfg.mailServers())-1 {
+			logger.Warn("mail server failed, failing over to next",
+				"host", srv.Host,
+				"err", err.Error())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sendVia(email *mail.Email, srv mailServer) error {
+	mailClient, err := mailClient(srv)
+	if err != nil {
+		return err
+	}
+	defer mailClient.Close()
+
+	err = email.Send(mailClient)
+	if err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+	return nil
+}
+
+func mailClient(srv mailServer) (*mail.SMTPClient, error) {
+	mailSrv := mail.NewSMTPClient()
+	mailSrv.Host = srv.Host
+	mailSrv.Port = srv.Port
+	mailSrv.Username = srv.User
+	mailSrv.Password = srv.Pass
+	if cfg.MailTimeoutSeconds > 0 {
+		mailSrv.ConnectTimeout = time.Duration(cfg.MailTimeoutSeconds) * time.Second
+		mailSrv.SendTimeout = mailSrv.ConnectTimeout
+	}
+	switch srv.Encryption {
+	case "SSL/TLS":
+		mailSrv.Encryption = mail.EncryptionSSLTLS
+	case "STARTTLS":
+		mailSrv.Encryption = mail.EncryptionSTARTTLS
+	default:
+		return nil, fmt.Errorf("unknown encryption in config: %q", srv.Encryption)
+	}
+
+	mailClient, err := mailSrv.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to mail server: %w", err)
+	}
+
+	return mailClient, nil
+}
+
+// Connects to the mail servers and disconnects straight away. Passes if any
+// server works.
+func probeMail() error {
+	var errs []error
+	for _, srv := range cfg.mailServers() {
+		mailClient, err := mailClient(srv)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", srv.Host, err))
+			continue
+		}
+		mailClient.Close()
+
+		logger.Info("mail probe passed", "host", srv.Host)
+		return nil
+	}
+	return fmt.Errorf("mail probe: %w", errors.Join(errs...))
+}
+
+// Every value is escaped by html/template, based on where it is in the
+// template. Command output must never be marked as template.HTML, so that it
+// can't inject markup, however odd the filenames are.
+var reportFmt = `
+<h2>{{.Title}}</h2>
+<p>{{.Detail}}</p>
+
+{{range .Sections}}
+<h3>{{.Title}}</h3>
+
+{{if .Detail}}<p>{{.Detail}}</p>{{end}}
+
+{{if .Attachment}}<p><i>Full output is attached as {{.Attachment}}</i></p>{{end}}
+
+{{if .LogLines}}
+{{if .Collapsed}}<details><summary>Show output ({{len .LogLines}} lines)</summary>{{end}}
+<pre style="font-family: monospace; font-size: 10px; line-height: 12px; background-color: #b5b5b5;"><code>
+{{range .LogLines}}
+{{printable .}}
+{{end}}
+</code></pre>
+{{if .Collapsed}}</details>{{end}}
+{{end}}
+
+{{end}}
+
+{{if .Footer}}<hr><p style="font-size: 10px; color: #777777;">{{.Footer}}</p>{{end}}
+`
+var reportTmpl = template.Must(template.New("report").
+	Funcs(template.FuncMap{"printable": printable}).
+	Parse(reportFmt))
+
+// Drops carriage returns (e.g. from progress output) and replaces other control
+// characters and invalid UTF-8, which mail clients render inconsistently.
+// Escaping is still left to the template.
+func printable(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r':
+			return -1
+		case r == '\t':
+			return r
+		case unicode.IsControl(r):
+			return '\uFFFD'
+		default:
+			return r
+		}
+	}, s)
+}
@@ -1,44 +1,55 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"log/slog"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	mail "github.com/xhit/go-simple-mail/v2"
+	"golang.org/x/term"
 )
 
 var logWriter io.Writer
+var logCap *capWriter
+var logFile *pendingFile
 var logger *slog.Logger
+var logLevel = new(slog.LevelVar)
+var progress *tui // Only set in TUI mode
 
 func main() {
 	err := run()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
 func run() (err error) {
-	// Setup logging
-	logFilename := fmt.Sprintf("backup-helper-%s.log", time.Now().Format(time.RFC3339))
-	logFile, err := os.Create(logFilename)
-	if err != nil {
-		return fmt.Errorf("could not create log file %s: %w", logFilename, err)
-	}
-	defer logFile.Close()
-	logWriter = io.MultiWriter(os.Stderr, logFile)
-	logger = slog.New(slog.NewTextHandler(logWriter, nil))
+	// Setup logging. The log file is only created once the config is loaded,
+	// or (if it is not) with the default name at the end.
+	start := time.Now()
+	logFile = &pendingFile{}
+	var noLogFile bool
+	var tag string
+	defer func() {
+		if !logFile.IsOpen() && !noLogFile {
+			oErr := logFile.Open(logPath(cfg, start, "", tag))
+			if oErr != nil {
+				fmt.Fprintln(os.Stderr, oErr)
+			}
+		}
+		logFile.Close()
+	}()
+	logCap = newCapWriter(logFile)
+	setLogWriter(io.MultiWriter(os.Stderr, logCap))
 
 	// Log any error
 	defer func() {
@@ -47,13 +58,48 @@ func run() (err error) {
 		}
 	}()
 
+	// Record the run in the history at the very end, and print the result
+	rec := historyRecord{Start: start}
+	var skipReason string
+	var recordHistory, jsonResult bool
+	defer func() {
+		if !jsonResult {
+			return
+		}
+		rec.finish(err, skipReason)
+		pErr := printResult(rec, err)
+		if pErr != nil {
+			logger.Warn("could not print the result", "err", pErr.Error())
+		}
+	}()
+	defer func() {
+		if !recordHistory {
+			return
+		}
+		rec.finish(err, skipReason)
+		hErr := appendHistory(rec)
+		if hErr != nil {
+			logger.Warn("could not record run in history", "err", hErr.Error())
+		}
+	}()
+
 	// Send an email at the end
 	mailReport := report{
 		Detail: fmt.Sprintf("Started at %s. This report includes info on the cshatag output, and the rsync output.",
 			time.Now().Format(time.RFC3339)),
 	}
+	var noMail bool
 	defer func() {
-		if err != nil {
+		if noMail {
+			return
+		}
+		if err == nil && skipReason != "" {
+			mailReport.Title = "[SKIPPED] Backup Helper report"
+			mailReport.Sections = append(mailReport.Sections, section{
+				Title:  "Skipped",
+				Detail: skipReason,
+			})
+		} else if err != nil {
 			mailReport.Title = "[ERROR] Backup Helper report"
 			mailReport.Sections = append(mailReport.Sections, section{
 				Title:  "Error",
@@ -66,96 +112,465 @@ func run() (err error) {
 				Detail: "No error reported - looking good!",
 			})
 		}
+		if logCap.IsExceeded() {
+			mailReport.Sections = append(mailReport.Sections, section{
+				Title:  "Log file truncated",
+				Detail: fmt.Sprintf("The log file %s was truncated at the MaxLogBytes cap of %d bytes.", logFile.Path, cfg.MaxLogBytes),
+			})
+		}
+		if cfg == nil {
+			err = errors.Join(err, errors.New("no mail sent, since config was not loaded"))
+			return
+		}
+		if cfg.dryRun {
+			mailReport.Title = "[DRY RUN] " + mailReport.Title
+			mailReport.Detail += " This was a dry run, so nothing was changed - the lists are of what a real run would change."
+		}
+		if tag != "" {
+			mailReport.Title += tagSuffix(tag)
+			mailReport.Detail += fmt.Sprintf(" The run is tagged %s.", tag)
+		}
+		if cfg.SubjectPrefix != "" {
+			mailReport.Title = cfg.SubjectPrefix + " " + mailReport.Title
+		}
+		mailReport.MessageID = messageID(rec.Start)
+		rec.MessageID = mailReport.MessageID
+		lErr := saveLastReport(mailReport)
+		if lErr != nil {
+			logger.Warn("could not save the report for resending", "err", lErr.Error())
+		}
+		if reason := mailSkipReason(err, rec.changes()); reason != "" {
+			logger.Info("not mailing the report", "reason", reason)
+			return
+		}
+		mailStart := time.Now()
 		mErr := sendMail(mailReport)
-		err = errors.Join(err, mErr)
+		recordStep("mail", nil, mailStart, mErr)
+		err = errors.Join(err, withExitCode(exitMail, mErr))
 	}()
 
 	// Parse args
-	args := os.Args[1:]
-	if len(args) != 2 {
-		return fmt.Errorf("expect exactly two args: first for input folder, second for output folder - but received %d", len(args))
+	opts, err := parseArgs(os.Args[1:])
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	ageIdentity, envFile, tag = opts.AgeIdentity, opts.EnvFile, opts.Tag
+	jsonResult = opts.Output == "json"
+	rec.Tag = tag
+	if opts.LogLevel != "" {
+		logLevel.UnmarshalText([]byte(opts.LogLevel)) // Checked by parseArgs
+	}
+	if opts.Quiet {
+		setLogWriter(logCap)
+	}
+	if opts.NoMail {
+		noMail = true
+	}
+
+	// Show live progress instead of the log, if on a terminal
+	if opts.TUI && term.IsTerminal(int(os.Stdout.Fd())) {
+		setLogWriter(logCap)
+		progress = newTUI(os.Stdout)
+		defer progress.Stop()
+	}
+	if opts.ReportSince != "" {
+		noMail = true
+		return historyReport(opts)
+	}
+	if opts.ListJobs {
+		noMail = true
+		return listJobs(opts)
+	}
+	switch opts.Command {
+	case "completion":
+		// Listing jobs is run on each tab, so should leave no trace
+		noMail, noLogFile = true, true
+		if opts.Shell == "jobs" {
+			setLogWriter(logCap)
+		}
+		return printCompletion(opts)
+	case "version":
+		noMail, noLogFile = true, true
+		printVersion()
+		return nil
+	case "report":
+		noMail = true
+		return resendReport(opts)
+	case "history":
+		noMail = true
+		return listHistory(opts)
+	case "check-config":
+		noMail = true
+		return checkConfig(opts)
+	case "doctor":
+		noMail = true
+		return doctor(opts)
+	case "init":
+		noMail = true
+		return initConfig(opts)
+	case "migrate-config":
+		noMail = true
+		return migrateConfig(opts)
+	case "gdrive-auth":
+		noMail = true
+		return gdriveAuth(opts)
 	}
-	inFolder, outFolder := args[0], args[1]
-	logger.Debug("args parsed", "in", inFolder, "out", outFolder)
+	logger.Debug("args parsed", "in", opts.In, "out", opts.Out, "config-dir", opts.ConfigDir, "config", opts.ConfigFile)
 
 	// Load config
-	err = loadConfig()
+	err = loadConfig(opts.ConfigDir, opts.ConfigFile)
 	if err != nil {
-		return err
+		return withExitCode(exitConfig, err)
 	}
-
-	// Check folders
-	err = checkFolder(inFolder)
+	scrubDirs, err := verifyDirs(opts)
 	if err != nil {
-		return fmt.Errorf("in folder: %w", err)
+		return withExitCode(exitConfig, err)
 	}
-	err = checkFolder(outFolder)
+	logJob := jobsLogName(opts.JobNames)
+	if len(scrubDirs) > 0 {
+		logJob = "verify"
+	}
+	err = logFile.Open(logPath(cfg, start, logJob, opts.Tag))
 	if err != nil {
-		return fmt.Errorf("out folder: %w", err)
-	}
-	mailReport.Sections = append(mailReport.Sections, section{
-		Title: "Folders checked",
-		Detail: `This test tries to write, read, and delete a temporary file
-		in both the input and output folders. It also checks for the existence
-		of .backup-helper-check files.`,
-		LogLines: []string{
-			fmt.Sprintf("%s: OK", inFolder),
-			fmt.Sprintf("%s: OK", outFolder),
-		},
-	})
+		return err
+	}
+	applyOptions(opts)
+	pruneFiles(logGlob(cfg), cfg.LogKeep, ".rsync.log")
+	pruneFiles(rsyncLogPath(logGlob(cfg)), cfg.LogKeep)
+	if opts.VerifySnapshot != "" {
+		mailReport.Detail = fmt.Sprintf("Started at %s. This report compares %s with %s, to see if a restore would work.",
+			time.Now().Format(time.RFC3339), opts.VerifySnapshot, opts.In)
+		return verifyRestore(&mailReport, opts.VerifySnapshot, opts.In)
+	}
+	if opts.ValidatePaths {
+		noMail = true
+		pairs, pErr := folderPairs(opts)
+		if pErr != nil {
+			return pErr
+		}
+		printReport(explainPairs(pairs))
+		return nil
+	}
+	logCap.SetMax(cfg.MaxLogBytes)
+	recordHistory = true
+	rec.DryRun = cfg.dryRun
+	if len(cfg.files) > 1 {
+		mailReport.Sections = append(mailReport.Sections, section{
+			Title:    "Config files merged",
+			Detail:   "Later files override earlier ones.",
+			LogLines: cfg.files,
+		})
+	}
 
-	// Run cshatag for both folders (concurrently)
-	logger.Debug("running cshatag on input and output folders (concurrently)")
-	var wg sync.WaitGroup
-	var cshaInErr, cshaOutErr error
-	var cshaInLines, cshaOutLines []string
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		cshaInLines, cshaInErr = execCommand("cshatag:input", "cshatag", "-q", "-recursive", inFolder)
-		logger.Info("cshatag on input finished",
-			"dir", inFolder,
-			"lines", len(cshaInLines))
-	}()
-	go func() {
-		defer wg.Done()
-		cshaOutLines, cshaOutErr = execCommand("cshatag:output", "cshatag", "-q", "-recursive", outFolder)
-		logger.Info("cshatag on output finished",
-			"dir", outFolder,
-			"lines", len(cshaOutLines))
+	// Only run if triggered (if configured)
+	if cfg.TriggerFile != "" {
+		_, tErr := os.Stat(cfg.TriggerFile)
+		if errors.Is(tErr, os.ErrNotExist) {
+			logger.Info("trigger file not present, skipping run", "file", cfg.TriggerFile)
+			noMail, recordHistory = true, false
+			return nil
+		}
+		if tErr != nil {
+			return fmt.Errorf("could not check trigger file: %w", tErr)
+		}
+		logger.Info("triggered by trigger file", "file", cfg.TriggerFile)
+		mailReport.Sections = append(mailReport.Sections, section{
+			Title:  "Triggered",
+			Detail: fmt.Sprintf("The run was triggered by %s.", cfg.TriggerFile),
+		})
+		// The one which triggered the run, even if a reload changes it
+		trigger := cfg.TriggerFile
+		defer func() {
+			if err != nil || skipReason != "" {
+				return
+			}
+			rmErr := os.Remove(trigger)
+			if rmErr != nil {
+				err = fmt.Errorf("could not remove trigger file: %w", rmErr)
+				return
+			}
+			logger.Debug("trigger file removed", "file", trigger)
+		}()
+	}
+
+	// Only run in the allowed windows
+	ok, next := inAllowedWindow(cfg.AllowedWindows, time.Now())
+	if !ok && cfg.WaitForWindow {
+		logger.Info("outside of allowed windows, waiting", "until", next.Format(time.RFC3339))
+		next = waitForWindow(&mailReport, opts, next)
+		mailReport.Sections = append(mailReport.Sections, section{
+			Title:  "Waited for allowed window",
+			Detail: fmt.Sprintf("The run was started outside of the allowed windows, so it waited until %s.", next.Format(time.RFC3339)),
+		})
+	} else if !ok {
+		skipReason = fmt.Sprintf("The run was started outside of the allowed windows %v. The next window opens at %s.",
+			cfg.AllowedWindows, next.Format(time.RFC3339))
+		logger.Info("outside of allowed windows, skipping", "next", next.Format(time.RFC3339))
+		return nil
+	}
+
+	// Check mail works before spending hours on the backup
+	if cfg.ProbeMail {
+		pErr := probeMail()
+		if pErr != nil && cfg.ProbeMailFatal {
+			return withExitCode(exitMail, pErr)
+		}
+		if pErr != nil {
+			logger.Warn("mail probe failed, continuing anyway", "err", pErr.Error())
+			mailReport.Sections = append(mailReport.Sections, section{
+				Title:  "Mail probe failed",
+				Detail: fmt.Sprintf("Could not connect to any mail server at the start of the run: %s", pErr.Error()),
+			})
+		}
+	}
+
+	// Compare config with the last run (problems with state are not fatal)
+	st, stErr := loadState()
+	if stErr != nil {
+		logger.Warn("ignoring previous state", "err", stErr.Error())
+	}
+	checkConfigChange(&mailReport, st, !cfg.dryRun)
+	if !cfg.dryRun {
+		updateState(st)
+	}
+
+	// Connect to the destination (if needed), and always disconnect at the end
+	if len(cfg.DisconnectCommand) > 0 {
+		defer func() {
+			dcLines, dcErr := execCleanup("disconnect", cfg.DisconnectCommand[0], cfg.DisconnectCommand[1:]...)
+			addExecSection(&mailReport, "Disconnect command", dcLines,
+				cfg.DisconnectCommand[0], cfg.DisconnectCommand[1:]...)
+			if dcErr != nil {
+				err = errors.Join(err, fmt.Errorf("disconnect command failed: %w", dcErr))
+			}
+		}()
+	}
+	stopTimeout := startRunTimeout(opts)
+	defer stopTimeout()
+	if len(cfg.ConnectCommand) > 0 {
+		cLines, cErr := execCommand("connect", cfg.ConnectCommand[0], cfg.ConnectCommand[1:]...)
+		addExecSection(&mailReport, "Connect command", cLines,
+			cfg.ConnectCommand[0], cfg.ConnectCommand[1:]...)
+		if cErr != nil {
+			return fmt.Errorf("connect command failed: %w", cErr)
+		}
+	}
+
+	// Mount the shares (if needed), and unmount those mounted at the end
+	unmount, mErr := mountShares(&mailReport)
+	defer func() {
+		err = errors.Join(err, unmount())
 	}()
-	wg.Wait()
-	addExecSection(&mailReport, "cshatag on input folder", cshaInLines,
-		"cshatag", "-q", "-recursive", inFolder)
-	addExecSection(&mailReport, "cshatag on output folder", cshaOutLines,
-		"cshatag", "-q", "-recursive", outFolder)
-	if cshaInErr != nil {
-		err = errors.Join(err, fmt.Errorf("cshatag on input folder failed: %w", cshaInErr))
+	if mErr != nil {
+		return mErr
+	}
+
+	// Scrub the folders, if that is all
+	if len(scrubDirs) > 0 {
+		mailReport.Detail = fmt.Sprintf("Started at %s. This report includes info on the cshatag output, for a verify of %s (without a sync).",
+			time.Now().Format(time.RFC3339), strings.Join(scrubDirs, ", "))
+		return scrubFolders(&mailReport, &rec, scrubDirs)
 	}
-	if cshaOutErr != nil {
-		err = errors.Join(err, fmt.Errorf("cshatag on output folder failed: %w", cshaOutErr))
+
+	// Back up each pair of folders
+	var pairs []folderPair
+	out := opts.Out
+	var resumed *runState
+	if opts.Command == "resume" {
+		resumed = st.Running
+		pairs, out, err = resumeRun(&mailReport, &rec, st)
+	} else {
+		pairs, err = folderPairs(opts)
 	}
 	if err != nil {
 		return err
 	}
-
-	// Sync with rsync
-	// -> Need a slash at the end of the in folder to indicate to rsync to sync the contents into out
-	inWithSlash := inFolder + string(filepath.Separator)
-	rsyncLines, err := execCommand("rsync", "rsync", "-avX", "--delete", inWithSlash, outFolder)
-	addExecSection(&mailReport, "rsync from input to output folder", rsyncLines,
-		"rsync", "-avX", "--delete", inWithSlash, outFolder)
+	// Resumed runs already left out the offsite destinations not due
+	var offsiteSkipped map[string]section
+	if opts.Command != "resume" {
+		pairs, offsiteSkipped = offsitePairs(st, pairs, opts.Offsite, !cfg.dryRun && !opts.VerifyOnly)
+	}
+	err = prepareSubfolders(out, pairs)
+	if err != nil {
+		return withExitCode(exitFolderCheck, err)
+	}
+	if !cfg.dryRun && !opts.VerifyOnly {
+		running := &runState{ID: messageID(rec.Start), Start: rec.Start, Out: out, Pairs: pairs}
+		// Still the interrupted run, so that resuming again follows on from
+		// its report too
+		if resumed != nil {
+			running.ID, running.Start = resumed.ID, resumed.Start
+		}
+		st.Running = running
+		updateState(st)
+	}
+	var ins, outs, names []string
+	for _, p := range pairs {
+		ins, outs = append(ins, p.In), append(outs, p.Out)
+		if p.Name != "" {
+			names = append(names, p.Name)
+		}
+	}
+	rec.In, rec.Out, rec.Jobs = strings.Join(ins, ","), strings.Join(outs, ","), strings.Join(names, ",")
+	for start := 0; start < len(pairs); {
+		// A job's destinations are backed up (and mailed on their own) together
+		end := start + 1
+		for end < len(pairs) && pairs[start].Name != "" && pairs[end].Name == pairs[start].Name {
+			end++
+		}
+		group := pairs[start:end]
+		p := group[0]
+		r := &mailReport
+		if p.separate() {
+			// The job's sections go in the run's report too
+			r = &report{
+				Detail: fmt.Sprintf("Started at %s. This report includes info on the cshatag output, and the rsync output, for job %s.",
+					time.Now().Format(time.RFC3339), p.Name),
+			}
+		}
+		if sec, ok := offsiteSkipped[p.Name]; ok {
+			r.Sections = append(r.Sections, sec)
+		}
+		before := rec.changes()
+		var jobErr error
+		for k, pErr := range backupDestinations(r, &rec, st, group, len(pairs) > 1 || p.Name != "", opts.VerifyOnly) {
+			if pErr != nil {
+				label := group[k].label()
+				if len(group) > 1 {
+					label += " to " + group[k].Out
+				}
+				jobErr = errors.Join(jobErr, fmt.Errorf("%s: %w", label, pErr))
+			} else {
+				markPairDone(st, start+k)
+				if !cfg.dryRun && !opts.VerifyOnly {
+					offsiteDone(st, group[k])
+				}
+			}
+		}
+		err = errors.Join(err, jobErr)
+		if p.separate() {
+			mailReport.Sections = append(mailReport.Sections, r.Sections...)
+			err = errors.Join(err, sendJobMail(p, *r, jobErr, rec.changes()-before))
+		}
+		start = end
+	}
+	if err != nil {
+		return err
+	}
+	if st.Running != nil {
+		st.Running = nil
+		updateState(st)
+	}
 
 	logger.Info("sync successful!")
 	return nil
 }
 
+// For the end of mail subjects.
+func tagSuffix(tag string) string {
+	return " [" + tag + "]"
+}
+
+// Logs (and mirrors command output) to w, at logLevel.
+func setLogWriter(w io.Writer) {
+	logWriter = w
+	logger = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel}))
+}
+
+// Applies the flags which override the config.
+func applyOptions(opts options) {
+	if opts.NoDelete {
+		cfg.Delete = false
+		for i := range cfg.Jobs {
+			cfg.Jobs[i].Delete = nil
+		}
+	}
+	if opts.MailTo != "" {
+		cfg.ToMail = opts.MailTo
+		for i := range cfg.Jobs {
+			cfg.Jobs[i].ToMail = ""
+		}
+	}
+	if opts.SubjectPrefix != "" {
+		cfg.SubjectPrefix = opts.SubjectPrefix
+		for i := range cfg.Jobs {
+			cfg.Jobs[i].SubjectPrefix = ""
+		}
+	}
+	if opts.BwLimit != "" {
+		cfg.BwLimit = opts.BwLimit
+	}
+	if opts.Nice != 0 {
+		cfg.Nice = opts.Nice
+	}
+	if opts.IONice != "" {
+		cfg.IONice = opts.IONice
+	}
+	cfg.Excludes = append(cfg.Excludes, opts.Excludes...)
+	cfg.rsyncLogPath = rsyncLogPath(logFile.Path)
+	if opts.LogLevel == "" && cfg.LogLevel != "" {
+		logLevel.Set(cfg.logLevel)
+	}
+	cfg.dryRun = opts.DryRun
+	cfg.skipVerify = opts.SkipVerify
+	cfg.force = opts.Force
+	cfg.tag = opts.Tag
+	cfg.tapeLabel = opts.TapeLabel
+	cfg.noMail = opts.NoMail
+	if opts.MailOnErrorOnly {
+		cfg.MailOnFailureOnly = true
+	}
+}
+
+// Why the report of a run with the error and number of changed files should
+// not be mailed, if it shouldn't.
+func mailSkipReason(err error, changes int) string {
+	switch {
+	case cfg.noMail:
+		return "-no-mail is set"
+	case err != nil:
+		return ""
+	case cfg.MailOnFailureOnly:
+		return "the run did not fail, and MailOnFailureOnly is set"
+	case cfg.MailOnChangeOnly && changes == 0:
+		return "the run did not fail or change any files, and MailOnChangeOnly is set"
+	}
+	return ""
+}
+
+// Prints (and optionally mails) a summary of the history since the date.
+func historyReport(opts options) error {
+	since, err := time.ParseInLocation(time.DateOnly, opts.ReportSince, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid -report-since date: %w", err)
+	}
+	err = loadConfig(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	recs, err := readHistory(since)
+	if err != nil {
+		return err
+	}
+	r := historySummary(since, recs)
+	printReport(r)
+	if opts.ReportMail {
+		r.Title = "[REPORT] " + r.Title
+		return sendMail(r)
+	}
+	return nil
+}
+
+// Should be in each folder, to show that it is mounted
+const smokeFilename = ".backup-helper-check"
+
 // Check the folders allow for read/write before doing anything
 func checkFolder(dir string) error {
 	testVal := rand.Int()
 	filename := fmt.Sprintf("testfile-%d.txt", testVal)
 	checkFile := filepath.Join(dir, filename)
-	smokeFile := filepath.Join(dir, ".backup-helper-check")
+	smokeFile := filepath.Join(dir, smokeFilename)
 
 	// Check for "smoke file"
 	_, err := os.Stat(smokeFile)
@@ -194,25 +609,94 @@ func execCommand(
 	name string,
 	args ...string,
 ) (lines []string, err error) {
+	return runCommand(logDesc, false, name, args...)
+}
+
+// As execCommand, for cleaning up (e.g. unmounting, or removing a snapshot):
+// it still runs once the run has timed out, under cleanupTimeout instead.
+func execCleanup(
+	logDesc string,
+	name string,
+	args ...string,
+) (lines []string, err error) {
+	return runCommand(logDesc, true, name, args...)
+}
+
+func runCommand(
+	logDesc string,
+	cleanup bool,
+	name string,
+	args ...string,
+) (lines []string, err error) {
+	stepStart := time.Now()
+	defer func() {
+		recordStep(logDesc, append([]string{name}, args...), stepStart, err)
+	}()
+
 	// Write program output both to logs and to a buffer
+	capped := logCap.IsExceeded()
 	linew := linesWriter{}
 	logw := lineBuffer{
-		Out:    logWriter,
+		Out:    commandLog{},
 		Prefix: []byte(fmt.Sprintf("[%s] ", logDesc)),
 	}
 	wr := io.MultiWriter(&logw, &linew)
+	if progress != nil {
+		wr = io.MultiWriter(wr, progress.Start(logDesc))
+		defer progress.Done(logDesc)
+	}
 
 	logger.Debug("executing command",
 		"command", name,
 		"args", args)
-	cmd := exec.Command(name, args...)
+	ctx, cancel := commandContext(name)
+	if cleanup {
+		ctx, cancel = context.WithTimeout(context.Background(), cleanupTimeout)
+	}
+	defer cancel()
+	pName, pArgs := withPriority(name, args)
+	cmd := exec.CommandContext(ctx, pName, pArgs...)
+	cmd.Env = commandEnv(name)
 	cmd.Stdout = wr
 	cmd.Stderr = wr
-
-	err = cmd.Run()
+	// Don't wait forever for output from any children left running
+	cmd.WaitDelay = 10 * time.Second
+
+	// Stop the command if it floods the log - but not one started after, or
+	// one cleaning up
+	killable := !capped && !cleanup
+	err = cmd.Start()
+	if err == nil && killable {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-logCap.Exceeded():
+				cmd.Process.Kill()
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	} else if err == nil {
+		err = cmd.Wait()
+	}
 	logw.Flush()
 	lines = linew.Lines()
 	lines = append(lines, "<end of logs>")
+	if killable && logCap.IsExceeded() {
+		return lines, fmt.Errorf("command %s stopped: %w", name, errLogCapExceeded)
+	}
+	if cleanup && ctx.Err() != nil {
+		return lines, fmt.Errorf("command %s stopped by the cleanup timeout: %w", name, ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return lines, commandTimeoutErr(name, ctx)
+	}
+	// robocopy exits 1 to 7 when it copied, or found extra, files
+	var exitErr *exec.ExitError
+	if name == cfg.RobocopyPath && errors.As(err, &exitErr) && exitErr.ExitCode() < 8 {
+		err = nil
+	}
 	if err != nil {
 		return lines, fmt.Errorf("command %s failed: %w", name, err)
 	}
@@ -220,16 +704,58 @@ func execCommand(
 	return lines, nil
 }
 
+// Inherited env plus any configured for the command. Only keys are logged, since
+// values may be secret.
+func commandEnv(name string) []string {
+	extra := map[string]string{}
+	switch name {
+	case cfg.Restic.Path:
+		extra = resticEnv()
+	case cfg.Borg.Path:
+		extra = borgEnv()
+	}
+	for k, v := range cfg.CommandEnv {
+		extra[k] = v
+	}
+	for k, v := range cfg.CommandEnvOverrides[filepath.Base(name)] {
+		extra[k] = v
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+
+	env := os.Environ()
+	keys := make([]string, 0, len(extra))
+	for k, v := range extra {
+		env = append(env, k+"="+v)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	logger.Debug("setting command env",
+		"command", name,
+		"keys", keys)
+	return env
+}
+
 type report struct {
 	Title    string
 	Detail   string
 	Sections []section
+
+	MessageID string // Generated when mailed, if blank
+	InReplyTo string // Message-ID of the report this follows on from, if any
+	To        string // Default ToMail
+	Footer    string // The build metadata, set when mailed
 }
 
 type section struct {
 	Title    string
 	Detail   string
 	LogLines []string
+
+	// Set when laying out the mail
+	Collapsed  bool   // Put LogLines in a collapsed block
+	Attachment string // LogLines were moved to this attachment
 }
 
 func addExecSection(r *report, desc string, outLines []string, name string, args ...string) {
@@ -240,114 +766,32 @@ func addExecSection(r *report, desc string, outLines []string, name string, args
 	})
 }
 
-func sendMail(r report) error {
-	wr := strings.Builder{}
-	err := reportTmpl.Execute(&wr, r)
-	if err != nil {
-		return fmt.Errorf("could not template report: %w", err)
-	}
-	body := wr.String()
-
-	email := mail.NewMSG().
-		SetFrom(fmt.Sprintf("backup-helper <%s>", cfg.FromMail)).
-		AddTo(cfg.ToMail).
-		SetSubject(r.Title).
-		SetBody(mail.TextHTML, body)
-	if email.Error != nil {
-		return fmt.Errorf("could not build email: %w", email.Error)
-	}
-
-	mailClient, err := mailClient()
-	if err != nil {
-		return err
-	}
-	defer mailClient.Close()
-
-	err = email.Send(mailClient)
-	if err != nil {
-		return fmt.Errorf("could not send email: %w", err)
-	}
-
-	logger.Info("mail sent",
-		"to", cfg.ToMail,
-		"subject", r.Title)
-	return nil
-}
-
-func mailClient() (*mail.SMTPClient, error) {
-	mailSrv := mail.NewSMTPClient()
-	mailSrv.Host = cfg.MailHost
-	mailSrv.Port = cfg.MailPort
-	mailSrv.Username = cfg.MailUser
-	mailSrv.Password = cfg.MailPass
-	switch cfg.MailEncryption {
-	case "SSL/TLS":
-		mailSrv.Encryption = mail.EncryptionSSLTLS
-	case "STARTTLS":
-		mailSrv.Encryption = mail.EncryptionSTARTTLS
-	default:
-		return nil, fmt.Errorf("unknown encryption in config: %q", cfg.MailEncryption)
-	}
-
-	mailClient, err := mailSrv.Connect()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to mail server: %w", err)
+// Applies RedactPatterns to the report's and its sections' text (titles too,
+// since they have paths in them - and attachments are named after them).
+// Should only be done once all parsing of the lines (e.g. for corruption) is
+// done.
+func redactReport(r report) report {
+	if len(cfg.redactRes) == 0 {
+		return r
 	}
-
-	return mailClient, nil
-}
-
-var reportFmt = `
-<h2>{{.Title}}</h2>
-<p>{{.Detail}}</p>
-
-{{range .Sections}}
-<h3>{{.Title}}</h3>
-
-{{if .Detail}}<p>{{.Detail}}</p>{{end}}
-
-{{if .LogLines}}
-<pre style="font-family: monospace; font-size: 10px; line-height: 12px; background-color: #b5b5b5;"><code>
-{{range .LogLines}}
-{{.}}
-{{end}}
-</code></pre>
-{{end}}
-
-{{end}}
-`
-var reportTmpl = template.Must(template.New("report").Parse(reportFmt))
-
-type config struct {
-	// Matches json tags directly
-
-	MailHost       string
-	MailPort       int
-	MailUser       string
-	MailPass       string
-	MailEncryption string
-
-	FromMail string
-	ToMail   string
-}
-
-var cfg *config
-
-// Assumes config is in PWD as config.json. Sets on cfg global var.
-func loadConfig() error {
-	b, err := os.ReadFile("config.json")
-	if err != nil {
-		wd, _ := os.Getwd()
-		return fmt.Errorf("could not read config.json in PWD (%s): %w", wd, err)
+	redact := func(s string) string {
+		for _, re := range cfg.redactRes {
+			s = re.ReplaceAllLiteralString(s, redacted)
+		}
+		return s
 	}
 
-	var c config
-	err = json.Unmarshal(b, &c)
-	if err != nil {
-		wd, _ := os.Getwd()
-		return fmt.Errorf("could not parse config.json in PWD (%s): %w", wd, err)
+	out := r
+	out.Title, out.Detail = redact(r.Title), redact(r.Detail)
+	out.Sections = make([]section, len(r.Sections))
+	for i, sec := range r.Sections {
+		sec.Title, sec.Detail = redact(sec.Title), redact(sec.Detail)
+		lines := make([]string, len(sec.LogLines))
+		for j, l := range sec.LogLines {
+			lines[j] = redact(l)
+		}
+		sec.LogLines = lines
+		out.Sections[i] = sec
 	}
-	cfg = &c
-
-	return nil
+	return out
 }
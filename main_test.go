@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Output with markup in it, as a filename might have, is escaped all the way
+// from execCommand into the mailed report.
+func TestReportEscapesCommandOutput(t *testing.T) {
+	printf, err := exec.LookPath("printf")
+	if err != nil {
+		t.Skip("no printf to run")
+	}
+	cfg = &config{}
+	logCap = newCapWriter(io.Discard)
+	logWriter = logCap
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	names := []string{
+		`a<b>.txt`,
+		`fish & chips.txt`,
+		`say "hi" it's.txt`,
+		`<script>alert(1)</script>`,
+		`</code></pre><img src=x onerror=alert(1)>`,
+	}
+	lines, err := execCommand("test", printf, append([]string{`%s\n`}, names...)...)
+	if err != nil {
+		t.Fatalf("execCommand: %v", err)
+	}
+	// And "<end of logs>"
+	if len(lines) != len(names)+1 {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(names)+1, lines)
+	}
+	r := report{Title: "Backup <done> & \"ok\"", Detail: `it's <b>fine</b>`}
+	addExecSection(&r, "cshatag on <input>", lines, printf, names...)
+
+	var b strings.Builder
+	err = reportTmpl.Execute(&b, r)
+	if err != nil {
+		t.Fatalf("could not template report: %v", err)
+	}
+	html := b.String()
+	for _, want := range []string{
+		`a&lt;b&gt;.txt`,
+		`fish &amp; chips.txt`,
+		`say &#34;hi&#34; it&#39;s.txt`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;`,
+		`&lt;/code&gt;&lt;/pre&gt;&lt;img src=x onerror=alert(1)&gt;`,
+		`Backup &lt;done&gt; &amp; &#34;ok&#34;`,
+		`it&#39;s &lt;b&gt;fine&lt;/b&gt;`,
+		`cshatag on &lt;input&gt;`,
+		`&lt;end of logs&gt;`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report does not contain %s:\n%s", want, html)
+		}
+	}
+	for _, bad := range []string{"<script>", "<img", "<b>", "<input>", "<done>"} {
+		if strings.Contains(html, bad) {
+			t.Errorf("report contains unescaped %s:\n%s", bad, html)
+		}
+	}
+	// The only markup is the template's own
+	if n := strings.Count(html, "</pre>"); n != 1 {
+		t.Errorf("report has %d </pre> tags, want 1:\n%s", n, html)
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		in   string
+		want string
+	}{
+		{"plain", "some/file.txt", "some/file.txt"},
+		{"markup is left to the template", `<a href="x">&</a>`, `<a href="x">&</a>`},
+		{"tabs are kept", "a\tb", "a\tb"},
+		{"CRLF endings lose the CR", "line\r", "line"},
+		{"progress redraws are joined", "10%\r20%\r30%", "10%20%30%"},
+		{"escape sequences", "\x1b[31mred\x1b[0m", "\uFFFD[31mred\uFFFD[0m"},
+		{"other control characters", "a\x00b\x07c\x7fd", "a\uFFFDb\uFFFDc\uFFFDd"},
+		{"C1 control characters", "a\u0085b", "a\uFFFDb"},
+		{"invalid UTF-8", "caf\xe9", "caf\uFFFD"},
+		{"valid UTF-8", "café ☕", "café ☕"},
+	} {
+		got := printable(tc.in)
+		if got != tc.want {
+			t.Errorf("%s: printable(%q) = %q, want %q", tc.desc, tc.in, got, tc.want)
+		}
+	}
+}
+
+// Control characters in output are replaced before escaping, so they never
+// reach the mail raw.
+func TestReportReplacesControlCharacters(t *testing.T) {
+	r := report{Title: "t", Sections: []section{{Title: "s", LogLines: []string{"bad\x1b]0;title\x07\r<x>"}}}}
+	var b strings.Builder
+	err := reportTmpl.Execute(&b, r)
+	if err != nil {
+		t.Fatalf("could not template report: %v", err)
+	}
+	html := b.String()
+	if strings.ContainsAny(html, "\x1b\x07\r") {
+		t.Errorf("report contains control characters: %q", html)
+	}
+	want := "bad\uFFFD]0;title\uFFFD&lt;x&gt;"
+	if !strings.Contains(html, want) {
+		t.Errorf("report does not contain %q: %q", want, html)
+	}
+}
+
+// Paths are in titles too, and attachments are named after the sections'.
+func TestRedactReport(t *testing.T) {
+	cfg = &config{LogAttachBytes: 1, redactRes: []*regexp.Regexp{regexp.MustCompile(`secret-[a-z]+`)}}
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := report{
+		Title:  "[FAILURE] Backup of /home/secret-alice",
+		Detail: "Started at 10:00. This compares /home/secret-alice with /mnt/backup.",
+		Sections: []section{{
+			Title:    "Backing up /home/secret-alice to /mnt/backup",
+			Detail:   "[rsync /home/secret-alice/ /mnt/backup]",
+			LogLines: []string{">f+++++++++ secret-bob.txt"},
+		}},
+	}
+	out, attachments := layoutSections(redactReport(r))
+	sec := out.Sections[0]
+	for _, s := range []string{out.Title, out.Detail, sec.Title, sec.Detail, sec.Attachment, attachments[0].Name} {
+		if strings.Contains(s, "secret") {
+			t.Errorf("not redacted: %q", s)
+		}
+	}
+	if want := "Backing up /home/" + redacted + " to /mnt/backup"; sec.Title != want {
+		t.Errorf("section title = %q, want %q", sec.Title, want)
+	}
+	// The report itself is left as is
+	if !strings.Contains(r.Sections[0].LogLines[0], "secret-bob") {
+		t.Errorf("original report was changed: %q", r.Sections[0].LogLines[0])
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How manifests are written: as sha256sum lists files (or as for the
+// HashAlgorithm, e.g. b3sum), or as an SFV file of their CRC-32s.
+const (
+	manifestFormatSums = "sums"
+	manifestFormatSFV  = "sfv"
+)
+
+// Tools manifests can be signed with (ssh being ssh-keygen -Y sign).
+const (
+	signToolGPG = "gpg"
+	signToolSSH = "ssh"
+)
+
+// Signs each manifest written, with a detached signature next to it (.asc for
+// gpg, .sig for ssh), so that a copy of the backup can be trusted wherever it
+// is checked.
+type manifestSigningConfig struct {
+	// gpg or ssh. Blank means unsigned.
+	Tool string
+	// For gpg: the key ID, fingerprint or email to sign with (default gpg's
+	// default key), whose secret key is in the keyring (without a passphrase
+	// prompt). For ssh: the private key file (or its public key, with the
+	// private key in ssh-agent).
+	Key string
+	// The binary to run (default gpg, or ssh-keygen).
+	Path string
+}
+
+func validateManifest(c *config) error {
+	switch c.ManifestFormat {
+	case manifestFormatSums, manifestFormatSFV:
+	default:
+		return fmt.Errorf("ManifestFormat must be sums or sfv, not %q", c.ManifestFormat)
+	}
+	switch c.ManifestSigning.Tool {
+	case "", signToolGPG:
+	case signToolSSH:
+		if c.ManifestSigning.Key == "" {
+			return errors.New("ManifestSigning with ssh needs a Key, the private key file to sign with")
+		}
+	default:
+		return fmt.Errorf("ManifestSigning Tool must be gpg or ssh, not %q", c.ManifestSigning.Tool)
+	}
+	return nil
+}
+
+func signingPath() string {
+	if cfg.ManifestSigning.Tool == signToolSSH {
+		return firstNonEmpty(cfg.ManifestSigning.Path, "ssh-keygen")
+	}
+	return firstNonEmpty(cfg.ManifestSigning.Path, "gpg")
+}
+
+// Appended to a manifest's name for its signature.
+func signatureExt() string {
+	if cfg.ManifestSigning.Tool == signToolSSH {
+		return ".sig"
+	}
+	return ".asc"
+}
+
+// Manifests are kept in the out folder itself, so that they travel with the
+// backup. rsync is told not to delete them. Each is named for its hash
+// algorithm (e.g. manifest-*.blake3), or is a manifest-*.sfv.
+func manifestPattern(ext string) string {
+	return "manifest-*." + ext
+}
+
+// The manifests (and signatures) of every algorithm and format, so that those
+// written before the config was changed are kept too.
+func manifestPatterns() []string {
+	var patterns []string
+	for _, ext := range append(hashNames(), manifestFormatSFV) {
+		for _, sig := range []string{"", ".asc", ".sig"} {
+			patterns = append(patterns, manifestPattern(ext)+sig)
+		}
+	}
+	return patterns
+}
+
+// rsync args which keep the manifests in the out folder from being deleted.
+func manifestFilterArgs() []string {
+	if !cfg.WriteManifest {
+		return nil
+	}
+	var args []string
+	for _, pattern := range manifestPatterns() {
+		args = append(args, "--filter=P /"+pattern)
+	}
+	return args
+}
+
+type manifestEntry struct {
+	rel     string
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// Writes a manifest of every regular file in outFolder (paths relative to it)
+// with the hash algorithm, in the format read by sha256sum -c (and
+// sha512sum -c and b3sum -c), or as an SFV file. Each file's size is listed in
+// comments before the hashes. The manifest is then signed, if configured. The
+// hashes are returned by path, unless it is an SFV file.
+func writeManifest(r *report, outFolder string, algo string) (map[string]string, error) {
+	ext, desc := algo, algo
+	if cfg.ManifestFormat == manifestFormatSFV {
+		ext, desc = manifestFormatSFV, "SFV, of CRC-32s"
+	}
+	now := time.Now()
+	name := fmt.Sprintf("manifest-%s.%s", now.UTC().Format(logDateFormat), ext)
+	path := filepath.Join(outFolder, name)
+
+	var entries []manifestEntry
+	var total int64
+	skipped := 0
+	err := filepath.WalkDir(outFolder, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(outFolder, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// Including any left over by a run which failed
+		if isManifest(rel) || isManifest(strings.TrimSuffix(rel, ".tmp")) {
+			return nil
+		}
+		// SFV has no way to escape these
+		if ext == manifestFormatSFV && (strings.Contains(rel, "\n") || strings.HasPrefix(rel, ";")) {
+			logger.Warn("file not listed in SFV manifest, since its name can't be", "file", rel)
+			skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var sum string
+		if ext == manifestFormatSFV {
+			sum, err = fileCRC32(p)
+		} else {
+			sum, err = fileHash(p, algo)
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{rel: rel, size: info.Size(), modTime: info.ModTime(), sum: sum})
+		total += info.Size()
+		return nil
+	})
+	if err == nil {
+		var b bytes.Buffer
+		if ext == manifestFormatSFV {
+			writeSFV(&b, entries, now)
+		} else {
+			writeSums(&b, entries, now)
+		}
+		err = writeFileAtomic(path, b.Bytes())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not write manifest %s: %w", path, err)
+	}
+	pattern := filepath.Join(outFolder, manifestPattern(ext))
+	pruneFiles(pattern, cfg.LogKeep)
+
+	logger.Info("manifest written", "file", path, "files", len(entries), "hash", desc)
+	detail := fmt.Sprintf("Hashed %d file(s) (%s) into %s (%s).", len(entries), humanBytes(float64(total)), path, desc)
+	if skipped > 0 {
+		detail += fmt.Sprintf(" %d file(s) were not listed, since SFV can't give their names.", skipped)
+	}
+	switch check := hashAlgos[algo].check; {
+	case ext == manifestFormatSFV:
+		detail += fmt.Sprintf(" Verify anywhere by running cksfv -f %s (or any SFV tool) from within the out folder.", name)
+	case check != "" && hashAlgos[algo].comments:
+		detail += fmt.Sprintf(" Verify anywhere by running %s %s from within the out folder.", check, name)
+	case check != "":
+		detail += fmt.Sprintf(" Verify anywhere by running grep -v '^#' %s | %s from within the out folder.", name, check)
+	default:
+		detail += " Each line is a file's hash (in hex) and path, as sha256sum lists them, for checking with a tool for the algorithm."
+	}
+
+	if cfg.ManifestSigning.Tool != "" {
+		verify, err := signManifest(r, path)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s was written, but could not be signed: %w", path, err)
+		}
+		pruneFiles(pattern+signatureExt(), cfg.LogKeep)
+		detail += fmt.Sprintf(" It is signed in %s%s, which can be checked with %s.", name, signatureExt(), verify)
+	}
+	r.Sections = append(r.Sections, section{
+		Title:  "Checksum manifest",
+		Detail: detail,
+	})
+	if ext == manifestFormatSFV {
+		return nil, nil
+	}
+	sums := map[string]string{}
+	for _, e := range entries {
+		sums[e.rel] = e.sum
+	}
+	return sums, nil
+}
+
+// As sha256sum lists files, after a header of comments (which sha256sum -c
+// skips) giving each's size.
+func writeSums(w io.Writer, entries []manifestEntry, now time.Time) {
+	fmt.Fprintf(w, "# Written by backup-helper at %s. Each file's size in bytes:\n", now.UTC().Format(time.RFC3339))
+	for _, e := range entries {
+		fmt.Fprintf(w, "# %d  %s\n", e.size, escapeManifestName(e.rel))
+	}
+	for _, e := range entries {
+		io.WriteString(w, manifestLine(e.sum, e.rel))
+	}
+}
+
+// As cksfv writes them: comments of each file's size and modification time,
+// then a line of its name and CRC-32.
+func writeSFV(w io.Writer, entries []manifestEntry, now time.Time) {
+	fmt.Fprintf(w, "; Generated by backup-helper on %s\n", now.Format("2006-01-02 at 15:04.05"))
+	for _, e := range entries {
+		fmt.Fprintf(w, ";%13d  %s %s\n", e.size, e.modTime.Format("15:04.05 2006-01-02"), e.rel)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s %s\n", e.rel, e.sum)
+	}
+}
+
+// Signs the manifest with a detached signature next to it, returning how to
+// check it. The tool's output is only reported if it fails.
+func signManifest(r *report, path string) (string, error) {
+	s := cfg.ManifestSigning
+	name := filepath.Base(path)
+	if s.Tool == signToolSSH {
+		// Writes path.sig itself
+		os.Remove(path + ".sig")
+		args := []string{"-Y", "sign", "-f", s.Key, "-n", "file", path}
+		lines, err := execCommand("manifest-sign", signingPath(), args...)
+		if err != nil {
+			addExecSection(r, "Manifest signing", lines, signingPath(), args...)
+			return "", err
+		}
+		return fmt.Sprintf("ssh-keygen -Y verify -f <allowed signers file> -I <signer> -n file -s %s.sig < %s", name, name), nil
+	}
+	tmp := path + ".asc.tmp"
+	defer os.Remove(tmp)
+	args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--output", tmp}
+	if s.Key != "" {
+		args = append(args, "--local-user", s.Key)
+	}
+	args = append(args, path)
+	lines, err := execCommand("manifest-sign", signingPath(), args...)
+	if err != nil {
+		addExecSection(r, "Manifest signing", lines, signingPath(), args...)
+		return "", err
+	}
+	err = os.Rename(tmp, path+".asc")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gpg --verify %s.asc %s", name, name), nil
+}
+
+// Checks the signing tool is installed, and has the Key.
+func signingChecks() []check {
+	s := cfg.ManifestSigning
+	path, err := exec.LookPath(signingPath())
+	checks := []check{{Name: signingPath() + " installed", Err: err, Info: path,
+		Hint: "install it (GnuPG, or an OpenSSH client) with your package manager (or set ManifestSigning Path)"}}
+	if err != nil {
+		return checks
+	}
+	if s.Tool == signToolSSH {
+		_, err = os.Stat(s.Key)
+		return append(checks, check{Name: "manifest signing key " + s.Key, Err: err,
+			Hint: "set ManifestSigning Key to the private key file (e.g. made with ssh-keygen -t ed25519)"})
+	}
+	args := []string{"--batch", "--list-secret-keys"}
+	if s.Key != "" {
+		args = append(args, s.Key)
+	}
+	lines, err := commandLines("gpg secret keys", signingPath(), args...)
+	if err == nil && len(lines) == 0 {
+		err = errors.New("gpg has no secret key")
+	}
+	return append(checks, check{Name: "manifest signing key " + firstNonEmpty(s.Key, "(gpg's default)"), Err: err,
+		Hint: "import or generate the secret key in gpg's keyring (e.g. gpg --quick-gen-key), or fix ManifestSigning Key"})
+}
+
+// A line as written by sha256sum. It escapes names with a backslash or
+// newline, marking the line with a leading backslash.
+func manifestLine(sum string, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		return fmt.Sprintf("\\%s  %s\n", sum, escapeManifestName(name))
+	}
+	return fmt.Sprintf("%s  %s\n", sum, name)
+}
+
+func escapeManifestName(name string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+}
+
+// Only manifests at the top of the out folder are ours.
+func isManifest(rel string) bool {
+	for _, pattern := range manifestPatterns() {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func fileSHA256(path string) (string, error) {
+	return fileHash(path, hashSHA256)
+}
+
+// In upper case hex, as SFV files have it.
+func fileCRC32(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08X", h.Sum32()), nil
+}
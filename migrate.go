@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Upgrades one top-level field of an old config, giving the new key and value
+// and a note per change made.
+type migration func(key string, val any) (string, any, []string)
+
+var migrations = []migration{
+	migrateFieldCase,
+	migrateEncryption,
+	migratePort,
+}
+
+// Field names used to be matched case-insensitively, e.g. "mailhost".
+func migrateFieldCase(key string, val any) (string, any, []string) {
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name != key && strings.EqualFold(name, key) {
+			return name, val, []string{fmt.Sprintf("renamed %s to %s", key, name)}
+		}
+	}
+	return key, val, nil
+}
+
+// E.g. "ssl", "TLS" or "starttls", in MailEncryption and each MailServers
+// entry.
+func migrateEncryption(key string, val any) (string, any, []string) {
+	norm := func(field string, v any) (any, []string) {
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		var fixed string
+		switch strings.ToUpper(s) {
+		case "SSL", "TLS", "SSL/TLS", "SSLTLS":
+			fixed = "SSL/TLS"
+		case "STARTTLS", "START_TLS":
+			fixed = "STARTTLS"
+		}
+		if fixed == "" || fixed == s {
+			return v, nil
+		}
+		return fixed, []string{fmt.Sprintf("changed %s from %q to %q", field, s, fixed)}
+	}
+	return migrateMailField(key, val, "MailEncryption", "Encryption", norm)
+}
+
+// Ports used to be given as strings, e.g. "587".
+func migratePort(key string, val any) (string, any, []string) {
+	norm := func(field string, v any) (any, []string) {
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return v, nil
+		}
+		return n, []string{fmt.Sprintf("changed %s from the string %q to the number %d", field, s, n)}
+	}
+	return migrateMailField(key, val, "MailPort", "Port", norm)
+}
+
+// Applies norm to the top-level field, or to the inner field of each
+// MailServers entry.
+func migrateMailField(key string, val any, field string, inner string, norm func(string, any) (any, []string)) (string, any, []string) {
+	if key == field {
+		v, notes := norm(field, val)
+		return key, v, notes
+	}
+	if key != "MailServers" {
+		return key, val, nil
+	}
+	var notes []string
+	servers, _ := val.([]any)
+	for i, srv := range servers {
+		m, ok := srv.(map[string]any)
+		if !ok {
+			continue
+		}
+		if v, ok := m[inner]; ok {
+			var n []string
+			m[inner], n = norm(fmt.Sprintf("MailServers entry %d %s", i, inner), v)
+			notes = append(notes, n...)
+		}
+	}
+	return key, val, notes
+}
+
+// Upgrades each config file (not the conf.d drop-ins) in place, keeping the
+// order of the fields (and, for YAML, the comments). The old file is kept with
+// a .bak suffix. With dryRun, only prints what would change.
+func migrateConfig(opts options) error {
+	bases, err := configFiles(opts.ConfigDir, opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range bases {
+		notes, err := migrateConfigFile(path, opts.DryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not migrate %s: %w", path, err))
+			continue
+		}
+		if len(notes) == 0 {
+			fmt.Printf("%s: already up to date\n", path)
+			continue
+		}
+		verb := "migrated"
+		if opts.DryRun {
+			verb = "would migrate (dry run)"
+		}
+		fmt.Printf("%s: %s\n", path, verb)
+		for _, n := range notes {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func migrateConfigFile(path string, dryRun bool) ([]string, error) {
+	if strings.HasSuffix(path, ".age") {
+		return nil, errors.New("encrypted configs can't be migrated in place, decrypt it first")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	var notes []string
+	switch filepath.Ext(path) {
+	case ".toml":
+		return nil, errors.New("TOML configs can't be migrated yet")
+	case ".yaml", ".yml":
+		out, notes, err = migrateYAML(b)
+	default:
+		out, notes, err = migrateJSON(b)
+	}
+	if err != nil || len(notes) == 0 || dryRun {
+		return notes, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path+".bak", b, info.Mode().Perm())
+	if err != nil {
+		return nil, fmt.Errorf("could not back up the old config: %w", err)
+	}
+	err = os.WriteFile(path, out, info.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func applyMigrations(key string, val any) (string, any, []string) {
+	var notes []string
+	for _, m := range migrations {
+		var n []string
+		key, val, n = m(key, val)
+		notes = append(notes, n...)
+	}
+	return key, val, notes
+}
+
+// Reads the top-level fields in order, only re-encoding the changed ones.
+func migrateJSON(b []byte) ([]byte, []string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, nil, errors.New("config is not a JSON object")
+	}
+
+	var notes []string
+	var fields [][]byte
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		var val any
+		err = json.Unmarshal(raw, &val)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newKey, newVal, n := applyMigrations(key, val)
+		notes = append(notes, n...)
+		k, _ := json.Marshal(newKey)
+		var v bytes.Buffer
+		if len(n) > 0 {
+			nb, err := json.MarshalIndent(newVal, "    ", "    ")
+			if err != nil {
+				return nil, nil, err
+			}
+			v.Write(nb)
+		} else {
+			err = json.Indent(&v, raw, "    ", "    ")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		fields = append(fields, []byte(fmt.Sprintf("    %s: %s", k, v.Bytes())))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("{\n")
+	out.Write(bytes.Join(fields, []byte(",\n")))
+	out.WriteString("\n}\n")
+	return out.Bytes(), notes, nil
+}
+
+// Edits the nodes of the top-level mapping, so that comments are kept.
+func migrateYAML(b []byte) ([]byte, []string, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.New("config is not a YAML mapping")
+	}
+
+	var notes []string
+	m := doc.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		keyNode, valNode := m.Content[i], m.Content[i+1]
+		var val any
+		err = valNode.Decode(&val)
+		if err != nil {
+			return nil, nil, err
+		}
+		newKey, newVal, n := applyMigrations(keyNode.Value, val)
+		if len(n) == 0 {
+			continue
+		}
+		notes = append(notes, n...)
+		keyNode.Value = newKey
+		var newNode yaml.Node
+		err = newNode.Encode(newVal)
+		if err != nil {
+			return nil, nil, err
+		}
+		newNode.HeadComment, newNode.LineComment, newNode.FootComment = valNode.HeadComment, valNode.LineComment, valNode.FootComment
+		*valNode = newNode
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), notes, enc.Close()
+}
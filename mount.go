@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A share to mount before the run, and unmount after it.
+type mountConfig struct {
+	// As for mount -t, e.g. "cifs" or "nfs"
+	Type string
+	// E.g. //nas/backup for cifs, or nas:/export/backup for nfs
+	Source     string
+	Mountpoint string
+	// As for mount -o, e.g. ["vers=3.0", "uid=backup"]
+	Options []string
+
+	// For cifs: written to a credentials file (only readable by the user)
+	// for the mount, so that they are never on the command line. The
+	// Password may be a secret reference, or given as a PasswordCommand or
+	// PasswordKeyring instead.
+	Username        string
+	Password        string
+	PasswordCommand []string
+	PasswordKeyring *keyringRef
+	Domain          string
+}
+
+func validateMounts(mounts []mountConfig) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, m := range mounts {
+		if m.Type == "" || m.Source == "" || m.Mountpoint == "" {
+			errs = append(errs, fmt.Errorf("Mounts entry %d needs a Type, Source and Mountpoint", i))
+			continue
+		}
+		if !filepath.IsAbs(m.Mountpoint) {
+			errs = append(errs, fmt.Errorf("Mounts entry %d Mountpoint must be absolute, not %s", i, m.Mountpoint))
+		}
+		if seen[m.Mountpoint] {
+			errs = append(errs, fmt.Errorf("Mounts entry %d Mountpoint %s is mounted more than once", i, m.Mountpoint))
+		}
+		seen[m.Mountpoint] = true
+		if m.Username != "" && m.Type != "cifs" && m.Type != "smb3" {
+			errs = append(errs, fmt.Errorf("Mounts entry %d has a Username, but only cifs shares take one", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Mounts each share which is not mounted already (in order), and returns a
+// func unmounting those it mounted (in reverse), which does nothing if run
+// again. If a mount fails, those mounted before it are unmounted again.
+func mountShares(r *report) (func() error, error) {
+	var mounted []mountConfig
+	unmount := func() error {
+		var errs []error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			m := mounted[i]
+			lines, err := execCleanup("umount", "umount", m.Mountpoint)
+			if err != nil {
+				addExecSection(r, "Unmount "+m.Mountpoint, lines, "umount", m.Mountpoint)
+				errs = append(errs, fmt.Errorf("could not unmount %s: %w", m.Mountpoint, err))
+				continue
+			}
+			logger.Info("share unmounted", "mountpoint", m.Mountpoint)
+		}
+		mounted = nil
+		return errors.Join(errs...)
+	}
+	if len(cfg.Mounts) == 0 {
+		return unmount, nil
+	}
+
+	var lines []string
+	for _, m := range cfg.Mounts {
+		already, err := isMountpoint(m.Mountpoint)
+		if err == nil && already {
+			logger.Info("share already mounted, so leaving it", "mountpoint", m.Mountpoint)
+			lines = append(lines, fmt.Sprintf("%s: already mounted (left mounted)", m.Mountpoint))
+			continue
+		}
+		err = mountShare(r, m)
+		if err != nil {
+			r.Sections = append(r.Sections, section{Title: "Shares mounted", LogLines: lines})
+			return unmount, withExitCode(exitFolderCheck, errors.Join(err, unmount()))
+		}
+		mounted = append(mounted, m)
+		lines = append(lines, fmt.Sprintf("%s: %s mounted (unmounted after the run)", m.Mountpoint, m.Source))
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    "Shares mounted",
+		Detail:   "These shares were mounted before the folders were checked.",
+		LogLines: lines,
+	})
+	return unmount, nil
+}
+
+func mountShare(r *report, m mountConfig) error {
+	err := os.MkdirAll(m.Mountpoint, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create mountpoint: %w", err)
+	}
+	opts := append([]string{}, m.Options...)
+	if m.Username != "" {
+		creds, err := writeMountCredentials(m)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(creds)
+		opts = append(opts, "credentials="+creds)
+	}
+	args := []string{"-t", m.Type}
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	args = append(args, m.Source, m.Mountpoint)
+	lines, err := execCommand("mount", "mount", args...)
+	if err != nil {
+		addExecSection(r, "Mount "+m.Mountpoint, lines, "mount", args...)
+		return fmt.Errorf("could not mount %s on %s: %w", m.Source, m.Mountpoint, err)
+	}
+
+	// Make sure mount did not just succeed quietly, e.g. in a container
+	ok, err := isMountpoint(m.Mountpoint)
+	if err != nil {
+		return fmt.Errorf("could not verify mount of %s: %w", m.Mountpoint, err)
+	}
+	if !ok {
+		return fmt.Errorf("mount of %s on %s succeeded, but %s is not a mountpoint", m.Source, m.Mountpoint, m.Mountpoint)
+	}
+	logger.Info("share mounted", "source", m.Source, "mountpoint", m.Mountpoint)
+	return nil
+}
+
+// As per mount.cifs's credentials= option.
+func writeMountCredentials(m mountConfig) (string, error) {
+	f, err := os.CreateTemp("", "backup-helper-credentials-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create credentials file: %w", err)
+	}
+	defer f.Close()
+	content := fmt.Sprintf("username=%s\npassword=%s\n", m.Username, m.Password)
+	if m.Domain != "" {
+		content += fmt.Sprintf("domain=%s\n", m.Domain)
+	}
+	_, err = f.WriteString(content)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write credentials file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// Whether dir is on another filesystem than its parent.
+func isMountpoint(dir string) (bool, error) {
+	same, err := sameFilesystem(dir, filepath.Dir(filepath.Clean(dir)))
+	return !same, err
+}
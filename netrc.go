@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type netrcEntry struct {
+	Login    string
+	Password string
+}
+
+// Finds the entry for machine in a netrc-style file, falling back to the
+// "default" entry. ok is false if there is neither.
+func lookupNetrc(path string, machine string) (entry netrcEntry, ok bool, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return netrcEntry{}, false, fmt.Errorf("could not read netrc file %s: %w", path, err)
+	}
+
+	var def *netrcEntry
+	var curr *netrcEntry
+	entries := map[string]*netrcEntry{}
+	tokens := strings.Fields(string(b))
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			name := next()
+			curr = &netrcEntry{}
+			if _, seen := entries[name]; !seen {
+				entries[name] = curr
+			}
+		case "default":
+			curr = &netrcEntry{}
+			def = curr
+		case "login":
+			if v := next(); curr != nil {
+				curr.Login = v
+			}
+		case "password":
+			if v := next(); curr != nil {
+				curr.Password = v
+			}
+		case "account":
+			next()
+		case "macdef":
+			// Macros run until a blank line, which Fields has lost - so stop here, as
+			// any entries after a macro can't be told apart from it.
+			i = len(tokens)
+		}
+	}
+
+	if e, found := entries[machine]; found {
+		return *e, true, nil
+	}
+	if def != nil {
+		return *def, true, nil
+	}
+	return netrcEntry{}, false, nil
+}
+
+// Overrides each mail server's user and pass with the netrc entry for its
+// host, if there is one.
+func applyNetrc(c *config) {
+	if len(c.MailServers) == 0 {
+		c.MailUser, c.MailPass = netrcCredentials(c.NetrcFile, c.MailHost, c.MailUser, c.MailPass)
+		return
+	}
+	for i, srv := range c.MailServers {
+		c.MailServers[i].User, c.MailServers[i].Pass = netrcCredentials(c.NetrcFile, srv.Host, srv.User, srv.Pass)
+	}
+}
+
+func netrcCredentials(path string, host string, user string, pass string) (string, string) {
+	entry, ok, err := lookupNetrc(path, host)
+	if err != nil {
+		logger.Warn("ignoring netrc file", "err", err.Error())
+		return user, pass
+	}
+	if !ok {
+		logger.Warn("no netrc entry for mail host, using config values",
+			"file", path,
+			"host", host)
+		return user, pass
+	}
+
+	if entry.Login != "" {
+		user = entry.Login
+	}
+	if entry.Password != "" {
+		pass = entry.Password
+	}
+	logger.Debug("mail credentials read from netrc",
+		"file", path,
+		"host", host)
+	return user, pass
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A destination which holds files as objects under a prefix (e.g. an S3
+// bucket, or an SFTP or WebDAV server's folder), rather than a folder rsync can write to. Keys are relative to the
+// prefix, with / separators. A store may also give notes() []string for the
+// report.
+type objectStore interface {
+	// E.g. s3://bucket/prefix, for the report
+	String() string
+	// Every object under the prefix, keyed by key
+	list() (map[string]storedObject, error)
+	// Uploads size bytes of r, whose SHA-256 (as per sha256.Sum256) is sum
+	put(key string, r io.ReaderAt, size int64, sum []byte) error
+	get(key string) ([]byte, error)
+	delete(key string) error
+}
+
+type storedObject struct {
+	Size int64
+}
+
+// What a store's delete returns (wrapped, with why) for an object it keeps -
+// e.g. one under a retention policy - which is not a failure.
+var errObjectKept = errors.New("kept by the store")
+
+// The store for out, if it is an object store URL (e.g. s3://bucket/prefix).
+func objectDestination(out string) (objectStore, bool, error) {
+	s3, ok, err := s3Destination(out)
+	if ok {
+		return s3, true, err
+	}
+	b2, ok, err := b2Destination(out)
+	if ok {
+		return b2, true, err
+	}
+	az, ok, err := azureDestination(out)
+	if ok {
+		return az, true, err
+	}
+	gd, ok, err := gdriveDestination(out)
+	if ok {
+		return gd, true, err
+	}
+	sftp, ok, err := sftpDestination(out)
+	if ok {
+		return sftp, true, err
+	}
+	dav, ok, err := webdavDestination(out)
+	if ok {
+		return dav, true, err
+	}
+	return nil, false, nil
+}
+
+// Whether out is an object store URL, whatever its scheme.
+func isObjectStore(out string) bool {
+	for _, scheme := range []string{s3Scheme, b2Scheme, azureScheme, gdriveScheme, sftpScheme, davScheme, davsScheme} {
+		if strings.HasPrefix(out, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Kept at the top of the prefix, since listing objects doesn't give their
+// metadata: what was uploaded for each file, so that unchanged files are
+// skipped.
+const objectIndexKey = ".backup-helper-index.json"
+
+type objectIndex struct {
+	Files map[string]indexedFile
+	// Objects of deleted files which the store kept, so that they are only
+	// listed in the report by the run which first tried to delete them (and
+	// retried by each run after)
+	Kept map[string]bool `json:",omitempty"`
+}
+
+type indexedFile struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+	// For encrypted files: the tool, and the size of what was stored
+	Encryption string `json:",omitempty"`
+	StoredSize int64  `json:",omitempty"`
+}
+
+// The size the file's object should have.
+func (f indexedFile) storedSize() int64 {
+	if f.Encryption != "" {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+// A file in the in folder, as it would be stored.
+type localFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Mirrors the in folder into an object store, deleting objects of files no
+// longer in the in folder if Delete is on.
+type objectBackend struct {
+	store objectStore
+}
+
+func openObjects(out string, st *state) (backend, error) {
+	store, _, err := objectDestination(out)
+	if err != nil {
+		return nil, err
+	}
+	return &objectBackend{store: store}, nil
+}
+
+func (b *objectBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	store := b.store
+	err := withRunTimeout("destination check", func() error { return checkStore(store) })
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out: %w", err))
+	}
+	checked := []string{
+		fmt.Sprintf("%s: OK", p.live()),
+		fmt.Sprintf("%s: OK", store),
+	}
+	if n, ok := store.(interface{ notes() []string }); ok {
+		checked = append(checked, n.notes()...)
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Folders checked",
+		Detail: `This test tries to write, read, and delete a temporary file
+		in both the input folder and the destination. It also checks for the
+		existence of the input's .backup-helper-check file.`,
+		LogLines: checked,
+	})
+	return p, nil
+}
+
+func (b *objectBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "uploaded")
+}
+
+func (b *objectBackend) Sync(r *report, rec *historyRecord, p folderPair) (err error) {
+	store := b.store
+	start := time.Now()
+	defer func() {
+		recordStep("upload", nil, start, err)
+	}()
+	local, skipped, err := localFiles(p)
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("could not list the input folder: %w", err))
+	}
+	remote, err := store.list()
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("could not list %s: %w", store, err))
+	}
+	index, err := readObjectIndex(store, remote)
+	if err != nil {
+		return withExitCode(exitRsync, err)
+	}
+
+	// Upload what is new or changed since it was indexed, or which went
+	// missing (or changed size) in the store
+	var created, updated, deleted, kept []string
+	keptBefore := 0
+	for _, key := range sortedKeys(local) {
+		f := local[key]
+		prev, indexed := index.Files[key]
+		obj, stored := remote[key]
+		switch {
+		case !stored:
+			created = append(created, key)
+		case !indexed || prev.Size != f.size || !prev.ModTime.Equal(f.modTime) || obj.Size != prev.storedSize() || prev.Encryption != cfg.Encryption.Tool:
+			updated = append(updated, key)
+		}
+	}
+	if p.delete() {
+		for _, key := range sortedKeys(remote) {
+			if _, ok := local[key]; !ok && key != objectIndexKey {
+				deleted = append(deleted, key)
+			}
+		}
+	}
+	if cfg.MaxDeletes > 0 && !cfg.dryRun && !cfg.force {
+		err = guardDeletes(r, p, deleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lines []string
+	var sent uint64
+	var errs []error
+	corrupt := 0
+	if !cfg.dryRun {
+		for _, key := range append(append([]string{}, created...), updated...) {
+			f := local[key]
+			sum, storedSize, uErr := uploadFile(store, key, f)
+			if errors.Is(uErr, errCshatagMismatch) {
+				corrupt++
+			}
+			if uErr != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, uErr))
+				lines = append(lines, fmt.Sprintf("FAILED %s: %s", key, uErr))
+				delete(index.Files, key)
+				continue
+			}
+			entry := indexedFile{Size: f.size, ModTime: f.modTime, SHA256: sum}
+			if encrypting() {
+				entry.Encryption, entry.StoredSize = cfg.Encryption.Tool, storedSize
+			}
+			index.Files[key] = entry
+			sent += uint64(storedSize)
+			lines = append(lines, fmt.Sprintf("uploaded %s (%s, sha256 %s)", key, humanBytes(float64(f.size)), sum))
+		}
+		for _, key := range deleted {
+			dErr := store.delete(key)
+			if errors.Is(dErr, errObjectKept) {
+				delete(index.Files, key)
+				if index.Kept[key] {
+					keptBefore++
+					continue
+				}
+				if index.Kept == nil {
+					index.Kept = map[string]bool{}
+				}
+				index.Kept[key] = true
+				kept = append(kept, key)
+				lines = append(lines, fmt.Sprintf("kept %s: %s", key, dErr))
+				continue
+			}
+			if dErr != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, dErr))
+				lines = append(lines, fmt.Sprintf("FAILED to delete %s: %s", key, dErr))
+				continue
+			}
+			delete(index.Files, key)
+			delete(index.Kept, key)
+			lines = append(lines, fmt.Sprintf("deleted %s", key))
+		}
+		for key := range index.Files {
+			if _, ok := local[key]; !ok && p.delete() {
+				delete(index.Files, key)
+			}
+		}
+		for key := range index.Kept {
+			_, inLocal := local[key]
+			if _, stored := remote[key]; !stored || inLocal {
+				delete(index.Kept, key)
+			}
+		}
+		errs = append(errs, writeObjectIndex(store, index))
+	}
+	if len(kept) > 0 || keptBefore > 0 {
+		lines = append(lines, fmt.Sprintf("kept %d object(s) of deleted files, which the store would not delete (and %d kept before)", len(kept), keptBefore))
+	}
+	if skipped > 0 {
+		lines = append(lines, fmt.Sprintf("skipped %d symlink(s) and special file(s), which can't be stored as objects", skipped))
+	}
+	lines = append(lines, "<end of logs>")
+
+	desc := fmt.Sprintf("Upload from input folder to %s", store)
+	if cfg.dryRun {
+		desc += " (dry run)"
+	}
+	if !p.delete() {
+		desc += " (deletions disabled)"
+	}
+	r.Sections = append(r.Sections, section{
+		Title: desc,
+		Detail: fmt.Sprintf("%d file(s) to create, %d to update, and %d to delete, of %d file(s) in the input folder. %s",
+			len(created), len(updated), len(deleted), len(local), throughput(sent, time.Since(start))),
+		LogLines: lines,
+	})
+	rec.BytesSent += sent
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	rec.FilesDeleted += len(deleted) - len(kept) - keptBefore
+	if cfg.dryRun {
+		addChangeSection(r, "Files that would be created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be updated", updated, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be deleted", deleted, cfg.ChangeListMax)
+	} else {
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files deleted", slices.DeleteFunc(slices.Clone(deleted), func(key string) bool {
+			return index.Kept[key]
+		}), cfg.ChangeListMax)
+		if len(kept) > 0 {
+			addChangeSection(r, "Files kept in the store", kept, cfg.ChangeListMax)
+		}
+	}
+	if encrypting() && cfg.Encryption.Verify && !cfg.dryRun {
+		vErr := verifyEncryptedObjects(r, store, index, append(append([]string{}, created...), updated...))
+		if vErr != nil {
+			corrupt++
+			errs = append(errs, vErr)
+		}
+	}
+	rec.CorruptFiles += corrupt
+	err = errors.Join(errs...)
+	if err != nil && corrupt > 0 {
+		return withExitCode(exitCorruption, fmt.Errorf("upload to %s failed: %w", store, err))
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("upload to %s failed: %w", store, err))
+	}
+
+	logger.Info("folder backed up", "in", p.In, "out", store.String())
+	return nil
+}
+
+// Closes the store's connection, if it keeps one (e.g. for SFTP).
+func (b *objectBackend) Cleanup(r *report) error {
+	if c, ok := b.store.(io.Closer); ok {
+		c.Close()
+	}
+	return nil
+}
+
+// Like checkFolder, for a store: writes, reads, and deletes a test object -
+// after checking the smoke file, for stores which are folders.
+func checkStore(store objectStore) error {
+	if s, ok := store.(interface{ checkSmokeFile() error }); ok {
+		err := s.checkSmokeFile()
+		if err != nil {
+			return err
+		}
+	}
+	testVal := rand.Int()
+	key := fmt.Sprintf("testfile-%d.txt", testVal)
+	b := []byte(strconv.Itoa(testVal))
+	sum := sha256.Sum256(b)
+	err := store.put(key, bytes.NewReader(b), int64(len(b)), sum[:])
+	if err != nil {
+		return fmt.Errorf("write err: %w", err)
+	}
+	got, err := store.get(key)
+	if err != nil {
+		return fmt.Errorf("read err: %w", err)
+	}
+	if !bytes.Equal(got, b) {
+		return fmt.Errorf("read check failed: different value (wanted %d, got %s)", testVal, got)
+	}
+	err = store.delete(key)
+	if errors.Is(err, errObjectKept) {
+		logger.Warn("test object kept by the store", "out", store.String(), "key", key, "err", err.Error())
+	} else if err != nil {
+		return fmt.Errorf("cleanup err: %w", err)
+	}
+	logger.Info("destination check passed", "out", store.String())
+	return nil
+}
+
+// The regular files in the in folder (minus Excludes), keyed by their path
+// relative to it, and how many others (e.g. symlinks) were skipped.
+func localFiles(p folderPair) (map[string]localFile, int, error) {
+	files := map[string]localFile{}
+	skipped := 0
+	err := filepath.WalkDir(p.In, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.In, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(p, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = localFile{path: fp, size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, skipped, err
+}
+
+var errCshatagMismatch = errors.New("content does not match cshatag's stored sha256")
+
+// Uploads the file (encrypted, if Encryption is on), and returns its SHA-256
+// (hex) and the size stored. If cshatag has stored a checksum for the file's
+// current mtime, the uploaded content must match it.
+func uploadFile(store objectStore, key string, f localFile) (string, int64, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	// What is put: the file itself, or a temp file of it encrypted (which is
+	// hashed on the way, so that the file is only read once).
+	var body io.ReaderAt = file
+	size := f.size
+	h := sha256.New()
+	var encSum []byte
+	if encrypting() {
+		tmp, err := os.CreateTemp("", "backup-helper-encrypted-*")
+		if err != nil {
+			return "", 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		eh := sha256.New()
+		err = encryptTo(io.MultiWriter(tmp, eh), io.TeeReader(io.NewSectionReader(file, 0, f.size), h))
+		if err != nil {
+			return "", 0, fmt.Errorf("could not encrypt: %w", err)
+		}
+		info, err := tmp.Stat()
+		if err != nil {
+			return "", 0, err
+		}
+		body, size, encSum = tmp, info.Size(), eh.Sum(nil)
+	} else {
+		_, err = io.Copy(h, io.NewSectionReader(file, 0, f.size))
+		if err != nil {
+			return "", 0, fmt.Errorf("could not hash: %w", err)
+		}
+	}
+	sum := h.Sum(nil)
+	hexSum := hex.EncodeToString(sum)
+	if tagged, ok := cshatagSum(f.path, f.modTime); ok && tagged != hexSum {
+		return "", 0, fmt.Errorf("%w (%s, but read %s) - the file may be corrupt, or changed while uploading", errCshatagMismatch, tagged, hexSum)
+	}
+	if encSum != nil {
+		sum = encSum
+	}
+	err = store.put(key, body, size, sum)
+	if err != nil {
+		return "", 0, err
+	}
+	return hexSum, size, nil
+}
+
+// Downloads and test-decrypts a random sample of VerifySamples (default 1) of
+// the files uploaded (or if none were, of those stored before), which must
+// match the SHA-256 they were indexed with.
+func verifyEncryptedObjects(r *report, store objectStore, index objectIndex, uploaded []string) error {
+	keys := slices.DeleteFunc(uploaded, func(key string) bool {
+		_, ok := index.Files[key]
+		return !ok
+	})
+	if len(keys) == 0 {
+		for _, key := range sortedKeys(index.Files) {
+			if index.Files[key].Encryption == cfg.Encryption.Tool {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	n := max(cfg.Encryption.VerifySamples, 1)
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	keys = keys[:min(n, len(keys))]
+	slices.Sort(keys)
+
+	var lines []string
+	var errs []error
+	for _, key := range keys {
+		want := index.Files[key].SHA256
+		b, err := store.get(key)
+		if err == nil {
+			var got string
+			got, err = testDecrypt(bytes.NewReader(b))
+			if err == nil && got != want {
+				err = fmt.Errorf("decrypted to sha256 %s, not %s", got, want)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w of %s: %w", errDecryptCheck, key, err))
+			lines = append(lines, fmt.Sprintf("FAILED %s: %s", key, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: OK (sha256 %s)", key, want))
+	}
+	lines = append(lines, "<end of logs>")
+	r.Sections = append(r.Sections, section{
+		Title:    "Encryption verified",
+		Detail:   fmt.Sprintf("The files were encrypted with %s. This downloads %d of them, and checks that they decrypt to what was uploaded.", cfg.Encryption.Tool, len(keys)),
+		LogLines: lines,
+	})
+	return errors.Join(errs...)
+}
+
+// The SHA-256 which cshatag (or the native engine) stored with the file, if it
+// was stored for the file's current mtime.
+func cshatagSum(path string, modTime time.Time) (string, bool) {
+	return storedHash(path, hashSHA256, modTime)
+}
+
+// An empty index if there is none yet (so everything is uploaded).
+func readObjectIndex(store objectStore, remote map[string]storedObject) (objectIndex, error) {
+	index := objectIndex{Files: map[string]indexedFile{}}
+	if _, ok := remote[objectIndexKey]; !ok {
+		return index, nil
+	}
+	b, err := store.get(objectIndexKey)
+	if err != nil {
+		return index, fmt.Errorf("could not read %s from %s: %w", objectIndexKey, store, err)
+	}
+	err = json.Unmarshal(b, &index)
+	if err != nil {
+		logger.Warn("ignoring unreadable index, so every file is uploaded", "err", err.Error())
+		return objectIndex{Files: map[string]indexedFile{}}, nil
+	}
+	if index.Files == nil {
+		index.Files = map[string]indexedFile{}
+	}
+	return index, nil
+}
+
+func writeObjectIndex(store objectStore, index objectIndex) error {
+	b, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not marshal index: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	err = store.put(objectIndexKey, bytes.NewReader(b), int64(len(b)), sum[:])
+	if err != nil {
+		return fmt.Errorf("could not write %s to %s: %w", objectIndexKey, store, err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Weekday names for OffsiteWeekdays, in full or in short (e.g. Sat).
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+func validateOffsite(j job, outs map[string]bool) error {
+	scheduled := j.OffsiteEveryNthRun > 0 || len(j.OffsiteWeekdays) > 0
+	if j.Offsite == "" {
+		if scheduled {
+			return fmt.Errorf("job %q has an offsite schedule, but no Offsite to back up to", j.Name)
+		}
+		return nil
+	}
+	if outs[j.Offsite] {
+		return fmt.Errorf("job %q has its Offsite %q in Out or Outs too", j.Name, j.Offsite)
+	}
+	if !scheduled {
+		return fmt.Errorf("job %q needs OffsiteEveryNthRun and/or OffsiteWeekdays for its Offsite (else put it in Outs)", j.Name)
+	}
+	if j.OffsiteEveryNthRun < 0 {
+		return fmt.Errorf("job %q has a negative OffsiteEveryNthRun", j.Name)
+	}
+	for _, d := range j.OffsiteWeekdays {
+		_, err := parseWeekday(d)
+		if err != nil {
+			return fmt.Errorf("job %q: %w", j.Name, err)
+		}
+	}
+	return nil
+}
+
+// Whether the job's offsite destination is due, on its Nth run since it was
+// last backed up to (as per the state), or on one of its weekdays.
+func offsiteDue(j job, st *state, now time.Time) bool {
+	if j.OffsiteEveryNthRun > 0 && st.OffsiteSkips[j.Name] >= j.OffsiteEveryNthRun-1 {
+		return true
+	}
+	for _, d := range j.OffsiteWeekdays {
+		wd, _ := parseWeekday(d)
+		if now.Weekday() == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// Drops the offsite pairs which are not due this run (unless forced), and
+// counts them as skipped in the state. Returns a section on each one skipped,
+// by job name, for the job's report.
+func offsitePairs(st *state, pairs []folderPair, force bool, count bool) ([]folderPair, map[string]section) {
+	jobs := map[string]job{}
+	for _, j := range cfg.Jobs {
+		jobs[j.Name] = j
+	}
+	skipped := map[string]section{}
+	var due []folderPair
+	for _, p := range pairs {
+		j := jobs[p.Name]
+		if !p.Offsite || force || offsiteDue(j, st, time.Now()) {
+			due = append(due, p)
+			continue
+		}
+		skips := st.OffsiteSkips[j.Name]
+		if count {
+			if st.OffsiteSkips == nil {
+				st.OffsiteSkips = map[string]int{}
+			}
+			st.OffsiteSkips[j.Name]++
+		}
+		var when []string
+		if j.OffsiteEveryNthRun > 0 {
+			when = append(when, fmt.Sprintf("every %d runs (next in %d)", j.OffsiteEveryNthRun, j.OffsiteEveryNthRun-1-skips))
+		}
+		if len(j.OffsiteWeekdays) > 0 {
+			when = append(when, "on "+strings.Join(j.OffsiteWeekdays, ", "))
+		}
+		logger.Info("offsite destination not due, skipping it", "job", j.Name, "offsite", p.Out)
+		skipped[p.Name] = section{
+			Title:  "Offsite backup skipped",
+			Detail: fmt.Sprintf("The job's offsite destination %s was not backed up to this run, since it is backed up %s (or with -offsite). It has been skipped %d run(s) in a row.", p.Out, strings.Join(when, " and "), skips+1),
+		}
+	}
+	return due, skipped
+}
+
+// Records that the job's offsite destination was backed up to, restarting
+// its count of runs.
+func offsiteDone(st *state, p folderPair) {
+	if !p.Offsite || st.OffsiteSkips[p.Name] == 0 {
+		return
+	}
+	delete(st.OffsiteSkips, p.Name)
+	updateState(st)
+}
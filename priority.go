@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var bwLimitRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([A-Za-z]*)$`)
+
+// The BwLimit in KiB per second (rsync's unit, if none is given), for tools
+// which only take a number.
+func bwLimitKiB(v string) int {
+	m := bwLimitRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	switch strings.ToUpper(m[2][:min(len(m[2]), 1)]) {
+	case "M":
+		n *= 1 << 10
+	case "G":
+		n *= 1 << 20
+	}
+	return max(int(n), 1)
+}
+
+var ioniceClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+// Parses an IONice value - a class (a name, or 1 to 3), and for realtime and
+// best-effort an optional :level (0 to 7) - into ionice args.
+func ioniceArgs(v string) ([]string, error) {
+	class, level, hasLevel := strings.Cut(v, ":")
+	n, ok := ioniceClasses[class]
+	if !ok {
+		var err error
+		n, err = strconv.Atoi(class)
+		if err != nil || n < 1 || n > 3 {
+			return nil, fmt.Errorf("invalid class %q: expect realtime, best-effort, idle, or 1 to 3", class)
+		}
+	}
+	args := []string{"-c", strconv.Itoa(n)}
+	if !hasLevel {
+		return args, nil
+	}
+	l, err := strconv.Atoi(level)
+	if err != nil || l < 0 || l > 7 {
+		return nil, fmt.Errorf("invalid level %q: expect 0 to 7", level)
+	}
+	if n == 3 {
+		return nil, errors.New("the idle class has no level")
+	}
+	return append(args, "-n", strconv.Itoa(l)), nil
+}
+
+func validatePriority(c *config) error {
+	var errs []error
+	if c.BwLimit != "" && !bwLimitRe.MatchString(c.BwLimit) {
+		errs = append(errs, fmt.Errorf("invalid BwLimit %q: expect e.g. 500K or 10M", c.BwLimit))
+	}
+	if c.Nice < -20 || c.Nice > 19 {
+		errs = append(errs, fmt.Errorf("Nice must be between -20 and 19, not %d", c.Nice))
+	}
+	if c.IONice != "" {
+		_, err := ioniceArgs(c.IONice)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid IONice: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The command, run via nice and ionice as per Nice and IONice.
+func withPriority(name string, args []string) (string, []string) {
+	argv := append([]string{name}, args...)
+	if cfg.IONice != "" {
+		ioArgs, _ := ioniceArgs(cfg.IONice) // Checked with the config
+		argv = append(append([]string{"ionice"}, ioArgs...), argv...)
+	}
+	if cfg.Nice != 0 {
+		argv = append([]string{"nice", "-n", strconv.Itoa(cfg.Nice)}, argv...)
+	}
+	return argv[0], argv[1:]
+}
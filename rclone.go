@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For out folders given as rclone:<remote>:<path>, e.g. rclone:gdrive:backup,
+// synced to with rclone sync (or rclone copy, if Delete is off).
+type rcloneConfig struct {
+	// The binary to run (default rclone), its config file (default rclone's
+	// own), and extra args for rclone sync.
+	Path       string
+	ConfigFile string
+	ExtraArgs  []string
+
+	// After each sync, compare the remote with the in folder with rclone
+	// check - or cryptcheck, for crypt remotes (default true). Mismatches fail
+	// the run as corruption does. With CheckDownload, files are downloaded to
+	// be compared, for remotes which have no hashes in common with the local
+	// files.
+	Check         bool
+	CheckDownload bool
+}
+
+const rcloneScheme = "rclone:"
+
+// The rclone destination (remote:path), if out is an rclone one.
+func rcloneTarget(out string) (string, bool) {
+	return strings.CutPrefix(out, rcloneScheme)
+}
+
+func isRclone(out string) bool {
+	_, ok := rcloneTarget(out)
+	return ok
+}
+
+// The args every rclone command is given, before its own.
+func rcloneArgs(args ...string) []string {
+	if cfg.Rclone.ConfigFile != "" {
+		args = append([]string{"--config", cfg.Rclone.ConfigFile}, args...)
+	}
+	return args
+}
+
+func rcloneExcludeArgs(p folderPair) []string {
+	var args []string
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		args = append(args, "--exclude", e)
+	}
+	if cfg.WriteManifest {
+		for _, pattern := range manifestPatterns() {
+			args = append(args, "--exclude", pattern)
+		}
+	}
+	return args
+}
+
+func rcloneSyncArgs(p folderPair, dest string) []string {
+	cmd := "sync"
+	if !p.delete() {
+		cmd = "copy"
+	}
+	args := rcloneArgs(cmd, p.In, dest, "-v")
+	if cfg.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if cfg.BwLimit != "" {
+		args = append(args, "--bwlimit", cfg.BwLimit)
+	}
+	// rclone stops deleting past the limit, so no dry run is needed first
+	if p.delete() && cfg.MaxDeletes > 0 && !cfg.force {
+		args = append(args, "--max-delete", strconv.Itoa(cfg.MaxDeletes))
+	}
+	args = append(args, rcloneExcludeArgs(p)...)
+	return append(args, cfg.Rclone.ExtraArgs...)
+}
+
+// The rclone check (or cryptcheck) args, listing each file as = (same), *
+// (differs), + (only in the in folder), - (only on the remote) or ! (error).
+// Files only on the remote are left out when deletions are disabled, since
+// they are expected then.
+func rcloneCheckArgs(p folderPair, dest string, crypt bool) []string {
+	cmd := "check"
+	if crypt {
+		cmd = "cryptcheck"
+	}
+	args := rcloneArgs(cmd, p.In, dest, "--combined", "-")
+	if !p.delete() {
+		args = append(args, "--one-way")
+	}
+	if cfg.Rclone.CheckDownload && !crypt {
+		args = append(args, "--download")
+	}
+	return append(args, rcloneExcludeArgs(p)...)
+}
+
+// The backend type of the destination's remote, e.g. crypt, from rclone's
+// config - or of a connection string remote, e.g. :s3,provider=Minio:bucket.
+func rcloneRemoteType(dest string) (string, error) {
+	name, _, ok := strings.Cut(dest, ":")
+	if !ok {
+		return "", fmt.Errorf("%s is not an rclone remote:path", dest)
+	}
+	if name == "" {
+		backend, _, _ := strings.Cut(strings.TrimPrefix(dest, ":"), ":")
+		backend, _, _ = strings.Cut(backend, ",")
+		return backend, nil
+	}
+	lines, err := commandLines("rclone listremotes", cfg.Rclone.Path, rcloneArgs("listremotes", "--long")...)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) == 2 && fields[0] == name+":" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("there is no rclone remote named %s (see rclone config)", name)
+}
+
+// Syncs the in folder to the rclone destination (remote:path), then checks it
+// against the in folder.
+type rcloneBackend struct {
+	dest  string
+	crypt bool
+}
+
+func openRclone(out string, st *state) (backend, error) {
+	dest, _ := rcloneTarget(out)
+	return &rcloneBackend{dest: dest}, nil
+}
+
+func (b *rcloneBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	typ, err := rcloneRemoteType(b.dest)
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out: %w", err))
+	}
+	b.crypt = typ == "crypt"
+	r.Sections = append(r.Sections, section{
+		Title:    "Folders checked",
+		Detail:   "The input folder was checked as usual, and the rclone remote found in rclone's config.",
+		LogLines: []string{fmt.Sprintf("%s: OK", p.live()), fmt.Sprintf("%s: OK (%s remote)", b.dest, typ)},
+	})
+	return p, nil
+}
+
+func (b *rcloneBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "synced")
+}
+
+func (b *rcloneBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	err := rcloneSync(r, rec, p, b.dest)
+	if err != nil {
+		return err
+	}
+	if cfg.Rclone.Check && !cfg.dryRun {
+		err = rcloneCheck(r, p, b.dest, b.crypt)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Info("folder backed up", "in", p.In, "out", p.Out)
+	return nil
+}
+
+func (b *rcloneBackend) Cleanup(r *report) error {
+	return nil
+}
+
+func rcloneSync(r *report, rec *historyRecord, p folderPair, dest string) error {
+	args := rcloneSyncArgs(p, dest)
+	desc := "rclone sync from input folder"
+	if !p.delete() {
+		desc = "rclone copy from input folder (deletions disabled)"
+	}
+	if cfg.dryRun {
+		desc += " (dry run)"
+	}
+	start := time.Now()
+	lines, err := execCommand("rclone", cfg.Rclone.Path, args...)
+	addExecSection(r, desc, lines, cfg.Rclone.Path, args...)
+	created, updated, deleted := rcloneChanges(lines)
+	sent := rcloneTransferred(lines)
+	sec := &r.Sections[len(r.Sections)-1]
+	sec.Detail += fmt.Sprintf(" %d file(s) created, %d updated, and %d deleted.", len(created), len(updated), len(deleted))
+	if !cfg.dryRun {
+		sec.Detail += " " + throughput(sent, time.Since(start))
+	}
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	rec.FilesDeleted += len(deleted)
+	rec.BytesSent += sent
+	if cfg.dryRun {
+		addChangeSection(r, "Files that would be copied", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be deleted", deleted, cfg.ChangeListMax)
+	} else {
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files deleted", deleted, cfg.ChangeListMax)
+	}
+	if err != nil && rcloneMaxDeleteHit(lines) {
+		return withExitCode(exitRsync, fmt.Errorf("rclone stopped after deleting MaxDeletes (%d) files, so the remote is only partly synced (give -force to sync anyway): %w", cfg.MaxDeletes, err))
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("rclone sync failed: %w", err))
+	}
+	return nil
+}
+
+// Runs rclone check (or cryptcheck), with the files that don't match the in
+// folder in their own section.
+func rcloneCheck(r *report, p folderPair, dest string, crypt bool) error {
+	args := rcloneCheckArgs(p, dest, crypt)
+	desc := "rclone:check"
+	lines, err := execCommand(desc, cfg.Rclone.Path, args...)
+	var differ, missing, extra, failed, other []string
+	for _, l := range lines {
+		kind, path, ok := strings.Cut(l, " ")
+		switch {
+		case !ok || len(kind) != 1:
+			other = append(other, l)
+		case kind == "*":
+			differ = append(differ, path)
+		case kind == "+":
+			missing = append(missing, path)
+		case kind == "-":
+			extra = append(extra, path)
+		case kind == "!":
+			failed = append(failed, path)
+		}
+	}
+	title := "rclone check of remote"
+	if crypt {
+		title = "rclone cryptcheck of remote"
+	}
+	addExecSection(r, title, other, cfg.Rclone.Path, args...)
+	sec := &r.Sections[len(r.Sections)-1]
+	n := len(differ) + len(missing) + len(extra) + len(failed)
+	if n == 0 && err == nil {
+		sec.Detail += " Every file on the remote matches the input folder."
+	} else if n > 0 {
+		sec.Detail += fmt.Sprintf(" %d file(s) on the remote don't match the input folder, as listed below.", n)
+	}
+	for _, l := range other {
+		if strings.Contains(l, "No common hash found") {
+			sec.Detail += " The remote has no hash in common with the input folder, so only sizes were compared - set Rclone CheckDownload to compare the content."
+			break
+		}
+	}
+	for _, c := range []struct {
+		title string
+		files []string
+	}{
+		{"Files which differ on the remote", differ},
+		{"Files missing from the remote", missing},
+		{"Files only on the remote", extra},
+		{"Files which could not be checked", failed},
+	} {
+		if len(c.files) > 0 {
+			addChangeSection(r, c.title, c.files, cfg.ChangeListMax)
+		}
+	}
+	if n > 0 {
+		return withExitCode(exitCorruption, fmt.Errorf("rclone check found %d file(s) on the remote which don't match the input folder", n))
+	}
+	if err != nil {
+		return withExitCode(exitCorruption, fmt.Errorf("rclone check failed: %w", err))
+	}
+	return nil
+}
+
+// E.g. "INFO  : docs/a.txt: Copied (new)", or "NOTICE: docs/a.txt: Skipped
+// copy as --dry-run is set (size 5)" on a dry run (where new and changed
+// files are not told apart).
+var rcloneChangeRe = regexp.MustCompile(`(?:INFO|NOTICE)\s*: (.+): (Copied \(new\)|Copied \(replaced existing\)|Copied \(server-side copy\)|Deleted|Skipped copy|Skipped delete)`)
+
+// E.g. "Transferred:   	    1.205 KiB / 1.205 KiB, 100%, 0 B/s, ETA -"
+var rcloneTransferredRe = regexp.MustCompile(`^Transferred:\s+([0-9.]+) (B|KiB|MiB|GiB|TiB) /`)
+
+// The files created, updated and deleted, from rclone -v's log.
+func rcloneChanges(lines []string) (created []string, updated []string, deleted []string) {
+	for _, l := range lines {
+		m := rcloneChangeRe.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		switch m[2] {
+		case "Copied (replaced existing)":
+			updated = append(updated, m[1])
+		case "Deleted", "Skipped delete":
+			deleted = append(deleted, m[1])
+		default:
+			created = append(created, m[1])
+		}
+	}
+	return created, updated, deleted
+}
+
+// Bytes transferred, from rclone's final stats.
+func rcloneTransferred(lines []string) uint64 {
+	units := map[string]float64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+	var sent uint64
+	for _, l := range lines {
+		m := rcloneTransferredRe.FindStringSubmatch(strings.TrimSpace(l))
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err == nil {
+			sent = uint64(n * units[m[2]])
+		}
+	}
+	return sent
+}
+
+func rcloneMaxDeleteHit(lines []string) bool {
+	for _, l := range lines {
+		if strings.Contains(l, "--max-delete threshold reached") {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRclone(c *config) error {
+	if c.Rclone.CheckDownload && !c.Rclone.Check {
+		return errors.New("Rclone CheckDownload needs Rclone Check")
+	}
+	return nil
+}
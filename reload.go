@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often the config files are checked for changes while waiting.
+const reloadInterval = 30 * time.Second
+
+// Waits until next (the start of an allowed window), reloading the config
+// whenever its files change - so a long wait picks up edits without a
+// restart. An invalid config is not loaded, and the old one is kept.
+func waitForWindow(r *report, opts options, next time.Time) time.Time {
+	stamps := configStamps(cfg.files)
+	for {
+		wait := time.Until(next)
+		if wait <= 0 {
+			return next
+		}
+		time.Sleep(min(wait, reloadInterval))
+
+		curr := configStamps(cfg.files)
+		if curr == stamps {
+			continue
+		}
+		stamps = curr
+		old := cfg
+		err := loadConfig(opts.ConfigDir, opts.ConfigFile)
+		if err != nil {
+			cfg = old
+			logger.Warn("config changed but is invalid, keeping the old one", "err", err.Error())
+			continue
+		}
+		applyOptions(opts)
+		logCap.SetMax(cfg.MaxLogBytes)
+		stamps = configStamps(cfg.files)
+
+		diff := configDiff(redactedConfig(old.loaded), redactedConfig(cfg.loaded))
+		logger.Info("config reloaded", "fields", len(diff), "diff", diff)
+		r.Sections = append(r.Sections, section{
+			Title:    "Configuration reloaded while waiting",
+			Detail:   "The config files changed while waiting for an allowed window. Secret values are redacted.",
+			LogLines: diff,
+		})
+
+		ok, n := inAllowedWindow(cfg.AllowedWindows, time.Now())
+		if ok {
+			return time.Now()
+		}
+		next = n
+		logger.Info("waiting for allowed window", "until", next.Format(time.RFC3339))
+	}
+}
+
+// Mod time and size of each file, to tell when one has changed.
+func configStamps(files []string) string {
+	var s string
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			s += fmt.Sprintf("%s:missing;", f)
+			continue
+		}
+		s += fmt.Sprintf("%s:%d:%d;", f, info.ModTime().UnixNano(), info.Size())
+	}
+	return s
+}
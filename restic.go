@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For out folders given as restic:<repository>, e.g. restic:/mnt/backup/repo
+// or restic:sftp:nas:/srv/repo.
+type resticConfig struct {
+	// The binary to run (default restic) and extra args for restic backup.
+	Path      string
+	ExtraArgs []string
+
+	// The repository's password: plaintext (or a secret reference), a command
+	// (+ args) whose first line of output is the password, an OS keyring
+	// entry, or a file holding it. If none are given, restic's own
+	// RESTIC_PASSWORD* env vars apply.
+	Password        string
+	PasswordCommand []string
+	PasswordKeyring *keyringRef
+	PasswordFile    string
+
+	// After each backup, forget (and prune) the backup-helper snapshots not
+	// kept by this policy. If all are 0, nothing is forgotten.
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+
+	// After each backup, run restic check - also reading this subset of the
+	// data, if set (e.g. "5%").
+	Check               bool
+	CheckReadDataSubset string
+}
+
+const resticScheme = "restic:"
+
+// Every snapshot is tagged with this, so that forget only ever touches the
+// snapshots made by backup-helper.
+const resticTag = "backup-helper"
+
+// The repository, if out is a restic destination.
+func resticRepo(out string) (string, bool) {
+	return strings.CutPrefix(out, resticScheme)
+}
+
+func validateRestic(c *config) error {
+	var errs []error
+	for _, k := range []struct {
+		name string
+		n    int
+	}{
+		{"KeepLast", c.Restic.KeepLast},
+		{"KeepDaily", c.Restic.KeepDaily},
+		{"KeepWeekly", c.Restic.KeepWeekly},
+		{"KeepMonthly", c.Restic.KeepMonthly},
+		{"KeepYearly", c.Restic.KeepYearly},
+	} {
+		if k.n < 0 {
+			errs = append(errs, fmt.Errorf("Restic %s can't be negative, not %d", k.name, k.n))
+		}
+	}
+	if c.Restic.Password != "" && c.Restic.PasswordFile != "" {
+		errs = append(errs, errors.New("give only one of a Restic Password or PasswordFile"))
+	}
+	return errors.Join(errs...)
+}
+
+// Env vars for restic, holding the password (if configured).
+func resticEnv() map[string]string {
+	env := map[string]string{}
+	if cfg.Restic.Password != "" {
+		env["RESTIC_PASSWORD"] = cfg.Restic.Password
+	}
+	if cfg.Restic.PasswordFile != "" {
+		env["RESTIC_PASSWORD_FILE"] = cfg.Restic.PasswordFile
+	}
+	return env
+}
+
+func resticBackupArgs(p folderPair, repo string) []string {
+	args := []string{"-r", repo, "backup", "--tag", resticTag}
+	if cfg.tag != "" {
+		args = append(args, "--tag", cfg.tag)
+	}
+	if cfg.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if cfg.BwLimit != "" {
+		args = append(args, "--limit-upload", strconv.Itoa(bwLimitKiB(cfg.BwLimit)))
+	}
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		args = append(args, "--exclude", e)
+	}
+	args = append(args, cfg.Restic.ExtraArgs...)
+	return append(args, p.In)
+}
+
+// The forget args for the Keep* policy, or nil if there is none.
+func resticForgetArgs(repo string) []string {
+	var keep []string
+	for _, k := range []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", cfg.Restic.KeepLast},
+		{"--keep-daily", cfg.Restic.KeepDaily},
+		{"--keep-weekly", cfg.Restic.KeepWeekly},
+		{"--keep-monthly", cfg.Restic.KeepMonthly},
+		{"--keep-yearly", cfg.Restic.KeepYearly},
+	} {
+		if k.n > 0 {
+			keep = append(keep, k.flag, strconv.Itoa(k.n))
+		}
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	args := []string{"-r", repo, "forget", "--tag", resticTag}
+	if cfg.dryRun {
+		args = append(args, "--dry-run")
+	} else {
+		args = append(args, "--prune")
+	}
+	return append(args, keep...)
+}
+
+// Backs up into the restic repository, then forgets and checks as
+// configured.
+type resticBackend struct {
+	repo string
+}
+
+func openRestic(out string, st *state) (backend, error) {
+	repo, _ := resticRepo(out)
+	return &resticBackend{repo: repo}, nil
+}
+
+func (b *resticBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	args := []string{"-r", b.repo, "cat", "config"}
+	lines, err := execCommand("restic:check-repo", cfg.Restic.Path, args...)
+	if err != nil {
+		addExecSection(r, "restic repository check", lines, cfg.Restic.Path, args...)
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("restic repository %s could not be opened (does it need a restic init?): %w", b.repo, err))
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    "Folders checked",
+		Detail:   "The input folder was checked as usual, and the restic repository was opened.",
+		LogLines: []string{fmt.Sprintf("%s: OK", p.live()), fmt.Sprintf("%s: OK", b.repo)},
+	})
+	return p, nil
+}
+
+func (b *resticBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "backed up")
+}
+
+func (b *resticBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	args := resticBackupArgs(p, b.repo)
+	start := time.Now()
+	lines, err := execCommand("restic", cfg.Restic.Path, args...)
+	addExecSection(r, "restic backup of input folder", lines, cfg.Restic.Path, args...)
+	added := resticAddedBytes(lines)
+	backupSection := &r.Sections[len(r.Sections)-1]
+	backupSection.Detail += " " + throughput(added, time.Since(start))
+	if id := resticSnapshotID(lines); id != "" {
+		backupSection.Detail += fmt.Sprintf(" Saved as snapshot %s.", id)
+	}
+	created, updated := resticFileCounts(lines)
+	rec.BytesSent += added
+	rec.FilesCreated += created
+	rec.FilesUpdated += updated
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return withExitCode(exitRsync, fmt.Errorf("restic could not read some files (the snapshot was still saved): %w", err))
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("restic backup failed: %w", err))
+	}
+
+	if args = resticForgetArgs(b.repo); args != nil {
+		lines, err = execCommand("restic:forget", cfg.Restic.Path, args...)
+		desc := "restic forget and prune"
+		if cfg.dryRun {
+			desc = "restic forget (would remove)"
+		}
+		addExecSection(r, desc, lines, cfg.Restic.Path, args...)
+		if err != nil {
+			return withExitCode(exitRsync, fmt.Errorf("restic forget failed: %w", err))
+		}
+	}
+
+	if cfg.Restic.Check && !cfg.dryRun {
+		args = []string{"-r", b.repo, "check"}
+		if cfg.Restic.CheckReadDataSubset != "" {
+			args = append(args, "--read-data-subset="+cfg.Restic.CheckReadDataSubset)
+		}
+		lines, err = execCommand("restic:check", cfg.Restic.Path, args...)
+		addExecSection(r, "restic repository check", lines, cfg.Restic.Path, args...)
+		if err != nil {
+			return withExitCode(exitCorruption, fmt.Errorf("restic check failed: %w", err))
+		}
+	}
+
+	logger.Info("folder backed up", "in", p.In, "repository", b.repo)
+	return nil
+}
+
+func (b *resticBackend) Cleanup(r *report) error {
+	return nil
+}
+
+// E.g. "Files:           5 new,     2 changed,   100 unmodified"
+var resticFilesRe = regexp.MustCompile(`^Files:\s+(\d+) new,\s+(\d+) changed,`)
+
+// E.g. "Added to the repository: 1.234 MiB (800.5 KiB stored)", or "Would add
+// to the repository: ..." on a dry run.
+var resticAddedRe = regexp.MustCompile(`^(?:Added to|Would add to) the repository: ([0-9.]+) (B|KiB|MiB|GiB|TiB)`)
+
+var resticSnapshotRe = regexp.MustCompile(`^snapshot ([0-9a-f]+) saved`)
+
+// The new and changed files, from restic backup's summary.
+func resticFileCounts(lines []string) (created int, updated int) {
+	for _, l := range lines {
+		m := resticFilesRe.FindStringSubmatch(l)
+		if m != nil {
+			created, _ = strconv.Atoi(m[1])
+			updated, _ = strconv.Atoi(m[2])
+			return created, updated
+		}
+	}
+	return 0, 0
+}
+
+// Bytes added to the repository (before compression), from restic backup's
+// summary.
+func resticAddedBytes(lines []string) uint64 {
+	units := map[string]float64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+	for _, l := range lines {
+		m := resticAddedRe.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err == nil {
+			return uint64(n * units[m[2]])
+		}
+	}
+	return 0
+}
+
+func resticSnapshotID(lines []string) string {
+	for _, l := range lines {
+		m := resticSnapshotRe.FindStringSubmatch(l)
+		if m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
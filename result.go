@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Printed as JSON on stdout at the end of the run, with -output json.
+type runResult struct {
+	historyRecord
+	ExitCode int
+	Steps    []stepResult
+	// The files the checksum runs found to be new, outdated or corrupt (or
+	// could not check)
+	Checksums []checksumFile `json:",omitempty"`
+}
+
+// A command run (or the mail sent) during the run.
+type stepResult struct {
+	Name            string   // E.g. rsync:/mnt/backup, or cshatag:input
+	Command         []string `json:",omitempty"`
+	Start           time.Time
+	DurationSeconds float64
+	Error           string `json:",omitempty"`
+}
+
+// The steps so far, in the order they finished. cshatag runs concurrently, so
+// this is locked.
+var steps struct {
+	sync.Mutex
+	list []stepResult
+}
+
+func recordStep(name string, command []string, start time.Time, err error) {
+	s := stepResult{
+		Name:            name,
+		Command:         command,
+		Start:           start,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	steps.Lock()
+	defer steps.Unlock()
+	steps.list = append(steps.list, s)
+}
+
+// The files found by the checksum runs so far, which also run concurrently.
+var checksums struct {
+	sync.Mutex
+	list []checksumFile
+}
+
+func recordChecksums(files []checksumFile) {
+	checksums.Lock()
+	defer checksums.Unlock()
+	checksums.list = append(checksums.list, files...)
+}
+
+func printResult(rec historyRecord, err error) error {
+	steps.Lock()
+	defer steps.Unlock()
+	res := runResult{
+		historyRecord: rec,
+		ExitCode:      exitCode(err),
+		Steps:         steps.list,
+	}
+	checksums.Lock()
+	res.Checksums = checksums.list
+	checksums.Unlock()
+	if res.Steps == nil {
+		res.Steps = []stepResult{}
+	}
+	// Keep e.g. the <> of message IDs readable
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	eErr := enc.Encode(res)
+	if eErr != nil {
+		return fmt.Errorf("could not print result: %w", eErr)
+	}
+	return nil
+}
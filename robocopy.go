@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// robocopy args to sync the pair, as rsync would with the same config. Files
+// are copied with their data (including streams, so the native engine's
+// checksums go along), attributes and times, and junctions are skipped.
+// Excludes are passed as /XF and /XD, which robocopy also keeps from being
+// purged.
+func robocopyArgs(p folderPair) ([]string, error) {
+	if len(cfg.Includes) > 0 {
+		return nil, errors.New("Includes can't be given to robocopy, so set CopyEngine to native")
+	}
+	args := []string{p.In, p.Out, "/E", "/COPY:DAT", "/DCOPY:DAT", "/R:2", "/W:5", "/XJ", "/NP", "/NDL", "/NJH", "/BYTES"}
+	if p.delete() {
+		args = append(args, "/PURGE")
+	}
+	if cfg.dryRun {
+		args = append(args, "/L")
+	}
+	var files, dirs []string
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		pattern, dirOnly := strings.CutSuffix(e, "/")
+		if strings.Contains(pattern, "**") {
+			return nil, fmt.Errorf("exclude %q can't be given to robocopy, so set CopyEngine to native", e)
+		}
+		// Anchored patterns are matched as full paths
+		if strings.Contains(pattern, "/") {
+			pattern = filepath.Join(p.In, filepath.FromSlash(strings.TrimPrefix(pattern, "/")))
+		}
+		dirs = append(dirs, pattern)
+		if !dirOnly {
+			files = append(files, pattern)
+		}
+	}
+	if cfg.WriteManifest {
+		files = append(files, manifestPatterns()...)
+	}
+	if len(files) > 0 {
+		args = append(append(args, "/XF"), files...)
+	}
+	if len(dirs) > 0 {
+		args = append(append(args, "/XD"), dirs...)
+	}
+	return args, nil
+}
+
+// Syncs the pair's in folder to its out folder with robocopy. What it changes
+// is found beforehand as for the native engine, for the MaxDeletes check and
+// the report.
+func robocopySync(r *report, rec *historyRecord, p folderPair) error {
+	if len(permissionArgs()) > 0 || len(cfg.RsyncExtraArgs) > 0 {
+		return withExitCode(exitConfig, errors.New("Chmod, Chown, Usermap, Groupmap and RsyncExtraArgs need rsync, so set CopyEngine to rsync (and install it)"))
+	}
+	args, err := robocopyArgs(p)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	plan, err := planCopy(p)
+	if err != nil {
+		return withExitCode(exitRsync, err)
+	}
+	var created, updated []string
+	var size uint64
+	for _, c := range plan.created {
+		created = append(created, c.rel)
+		if c.info.Mode().IsRegular() {
+			size += uint64(c.info.Size())
+		}
+	}
+	for _, c := range plan.updated {
+		updated = append(updated, c.rel)
+		if c.info.Mode().IsRegular() {
+			size += uint64(c.info.Size())
+		}
+	}
+	if p.delete() && cfg.MaxDeletes > 0 && !cfg.dryRun && !cfg.force {
+		err = guardDeletes(r, p, plan.deleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	desc := "robocopy from input to output folder"
+	if cfg.dryRun {
+		desc += " (dry run)"
+	}
+	if !p.delete() {
+		desc += " (deletions disabled)"
+	}
+	start := time.Now()
+	lines, err := execCommand("robocopy:"+p.Out, cfg.RobocopyPath, args...)
+	addExecSection(r, desc, lines, cfg.RobocopyPath, args...)
+	sec := &r.Sections[len(r.Sections)-1]
+	sec.Detail += fmt.Sprintf(" %d file(s) to create, %d to update, and %d to delete.", len(created), len(updated), len(plan.deleted))
+	if !cfg.dryRun {
+		sec.Detail += " " + throughput(size, time.Since(start))
+	}
+	if cfg.BwLimit != "" {
+		sec.Detail += " BwLimit is not applied by robocopy."
+	}
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("robocopy failed: %w", err))
+	}
+
+	rec.FilesCreated += len(created)
+	rec.FilesUpdated += len(updated)
+	rec.FilesDeleted += len(plan.deleted)
+	if cfg.dryRun {
+		addChangeSection(r, "Files that would be created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be updated", updated, cfg.ChangeListMax)
+		addChangeSection(r, "Files that would be deleted", plan.deleted, cfg.ChangeListMax)
+	} else {
+		rec.BytesSent += size
+		addChangeSection(r, "Files created", created, cfg.ChangeListMax)
+		addChangeSection(r, "Files deleted", plan.deleted, cfg.ChangeListMax)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Matches lines from rsync's --itemize-changes, e.g. ">fc.T...... some/file"
+// or "*deleting some/file".
+var itemizeRe = regexp.MustCompile(`^([<>ch.][fdLDS][^ ]{9}|\*deleting) `)
+
+// Only the lines which describe an itemized change.
+func itemizedLines(lines []string) []string {
+	var items []string
+	for _, l := range lines {
+		if itemizeRe.MatchString(l) {
+			items = append(items, l)
+		}
+	}
+	return items
+}
+
+// Args for the sync from in to out.
+func syncArgs(p folderPair) []string {
+	args := []string{"-avX", "--itemize-changes", "--stats"}
+	if p.delete() {
+		args = append(args, "--delete")
+	}
+	if cfg.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if cfg.BwLimit != "" {
+		args = append(args, "--bwlimit="+cfg.BwLimit)
+	}
+	if cfg.resume {
+		// Keep partly copied files, for rsync's delta transfer to carry on
+		// from (unlike --append-verify, which would skip files changed since)
+		args = append(args, "--partial")
+	}
+	args = append(args, permissionArgs()...)
+	args = append(args, manifestFilterArgs()...)
+	args = append(args, filterArgs(p)...)
+	args = append(args, remoteShellArgs(p)...)
+	args = append(args, cfg.RsyncExtraArgs...)
+	if cfg.RsyncLogFile {
+		args = append(args, "--log-file="+p.rsyncLogPath())
+		if cfg.RsyncLogFormat != "" {
+			args = append(args, "--log-file-format="+cfg.RsyncLogFormat)
+		}
+	}
+	return append(args, p.inWithSlash(), p.Out)
+}
+
+// rsync's own log of syncing to the pair's out folder: one per destination, so
+// that those synced at once don't share one.
+func (p folderPair) rsyncLogPath() string {
+	return strings.TrimSuffix(cfg.rsyncLogPath, ".rsync.log") + "." + slug(p.Out) + ".rsync.log"
+}
+
+// The includes come first, so that they win over any matching exclude.
+func filterArgs(p folderPair) []string {
+	var args []string
+	for _, i := range cfg.Includes {
+		args = append(args, "--include="+i)
+	}
+	for _, e := range append(append([]string{}, cfg.Excludes...), p.Excludes...) {
+		args = append(args, "--exclude="+e)
+	}
+	return args
+}
+
+// rsync args for forcing permissions and ownership on the output.
+func permissionArgs() []string {
+	var args []string
+	if cfg.Chmod != "" {
+		args = append(args, "--chmod="+cfg.Chmod)
+	}
+	if cfg.Chown != "" {
+		args = append(args, "--chown="+cfg.Chown)
+	}
+	if cfg.Usermap != "" {
+		args = append(args, "--usermap="+cfg.Usermap)
+	}
+	if cfg.Groupmap != "" {
+		args = append(args, "--groupmap="+cfg.Groupmap)
+	}
+	return args
+}
+
+// e.g. "D2775,F664" or "Dg+s,ug+rw,o-w"
+var chmodItemRe = regexp.MustCompile(`^[DF]?([0-7]{3,4}|([ugoa]*[-+=][rwxXst]*)+)$`)
+
+// e.g. "user:group", "user" or ":group"
+var chownRe = regexp.MustCompile(`^[^\s:,]*(:[^\s:,]*)?$`)
+
+// e.g. "0-99:nobody,wayne:admin,*:normal"
+var mapItemRe = regexp.MustCompile(`^[^\s:,]+:[^\s:,]+$`)
+
+func validatePermissions(c *config) error {
+	if c.Chmod != "" {
+		for _, item := range strings.Split(c.Chmod, ",") {
+			if !chmodItemRe.MatchString(item) {
+				return fmt.Errorf("invalid Chmod item %q", item)
+			}
+		}
+	}
+	if c.Chown != "" && (!chownRe.MatchString(c.Chown) || c.Chown == ":") {
+		return fmt.Errorf("invalid Chown %q, expected USER, USER:GROUP or :GROUP", c.Chown)
+	}
+	if c.Chown != "" && (c.Usermap != "" || c.Groupmap != "") {
+		return errors.New("Chown can't be used with Usermap or Groupmap")
+	}
+	for name, m := range map[string]string{"Usermap": c.Usermap, "Groupmap": c.Groupmap} {
+		if m == "" {
+			continue
+		}
+		for _, item := range strings.Split(m, ",") {
+			if !mapItemRe.MatchString(item) {
+				return fmt.Errorf("invalid %s item %q, expected FROM:TO", name, item)
+			}
+		}
+	}
+	return nil
+}
+
+// Files (not dirs) created, and paths deleted, as per rsync's
+// --itemize-changes output.
+func rsyncChanges(lines []string) (created []string, updated []string, deleted []string) {
+	for _, l := range lines {
+		if !itemizeRe.MatchString(l) {
+			continue
+		}
+		item, path, _ := strings.Cut(l, " ")
+		switch {
+		case item == "*deleting":
+			deleted = append(deleted, strings.TrimLeft(path, " "))
+		case item[1] != 'd' && strings.HasSuffix(item, "+++++++++"):
+			created = append(created, path)
+		case item[0] == '>' && item[1] == 'f':
+			updated = append(updated, path)
+		}
+	}
+	return created, updated, deleted
+}
+
+// Adds a section listing up to max of the paths, noting any omitted.
+func addChangeSection(r *report, title string, paths []string, max int) {
+	lines := paths
+	if max > 0 && len(lines) > max {
+		lines = append(lines[:max:max], fmt.Sprintf("... and %d more (see the full rsync log)", len(paths)-max))
+	}
+	r.Sections = append(r.Sections, section{
+		Title:    fmt.Sprintf("%s (%d)", title, len(paths)),
+		LogLines: lines,
+	})
+}
+
+// Counts what the sync would delete (via a dry run). If it is more than
+// MaxDeletes, asks whether to go ahead - or if not on a terminal, fails (since
+// then -force was not given).
+func confirmDeletes(r *report, p folderPair) error {
+	args := []string{"-aX", "--dry-run", "--itemize-changes", "--delete"}
+	args = append(args, manifestFilterArgs()...)
+	args = append(args, filterArgs(p)...)
+	args = append(args, remoteShellArgs(p)...)
+	args = append(args, cfg.RsyncExtraArgs...)
+	args = append(args, p.inWithSlash(), p.Out)
+	lines, err := execCommand("rsync:delete-check:"+p.Out, cfg.RsyncPath, args...)
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("rsync delete check failed: %w", err))
+	}
+	_, _, deleted := rsyncChanges(lines)
+	return guardDeletes(r, p, deleted)
+}
+
+// If more than MaxDeletes would be deleted, asks whether to go ahead - or if
+// not on a terminal, fails.
+func guardDeletes(r *report, p folderPair, deleted []string) error {
+	if len(deleted) <= cfg.MaxDeletes {
+		logger.Debug("delete check passed", "files", len(deleted), "max", cfg.MaxDeletes)
+		return nil
+	}
+
+	logger.Warn("sync would delete more than MaxDeletes files", "files", len(deleted), "max", cfg.MaxDeletes)
+	addChangeSection(r, "Files the sync would delete", deleted, cfg.ChangeListMax)
+	msg := fmt.Sprintf("the sync would delete %d files from %s, more than MaxDeletes (%d)", len(deleted), p.Out, cfg.MaxDeletes)
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("%s - check that %s is not empty by mistake, and run with -force to go ahead", msg, p.In)
+	}
+	pr := prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+	yes, err := pr.askYes(strings.ToUpper(msg[:1]) + msg[1:] + ". Go ahead?")
+	if err != nil {
+		return err
+	}
+	if !yes {
+		return fmt.Errorf("%s, and going ahead was declined", msg)
+	}
+	r.Sections = append(r.Sections, section{
+		Title:  "Deletes confirmed",
+		Detail: fmt.Sprintf("The sync would delete %d files (more than MaxDeletes, %d), which was confirmed at the prompt.", len(deleted), cfg.MaxDeletes),
+	})
+	return nil
+}
+
+// Does a checksum comparison dry run, which should show nothing to transfer
+// after a successful sync.
+func checksumDoubleCheck(r *report, p folderPair) error {
+	args := []string{"-aX", "--checksum", "--dry-run", "--itemize-changes"}
+	if p.delete() {
+		args = append(args, "--delete")
+	}
+	// Compare with the permissions and owners the sync gave the output
+	args = append(args, permissionArgs()...)
+	args = append(args, manifestFilterArgs()...)
+	args = append(args, filterArgs(p)...)
+	args = append(args, remoteShellArgs(p)...)
+	args = append(args, cfg.RsyncExtraArgs...)
+	args = append(args, p.inWithSlash(), p.Out)
+	lines, err := execCommand("rsync:checksum:"+p.Out, cfg.RsyncPath, args...)
+	addExecSection(r, "rsync checksum double check (dry run)", lines,
+		cfg.RsyncPath, args...)
+	if err != nil {
+		return fmt.Errorf("rsync checksum double check failed: %w", err)
+	}
+
+	diffs := itemizedLines(lines)
+	if len(diffs) > 0 {
+		r.Sections = append(r.Sections, section{
+			Title:    "Checksum double check found differences",
+			Detail:   fmt.Sprintf("%d item(s) differ between the input and output folders after syncing.", len(diffs)),
+			LogLines: diffs,
+		})
+		return fmt.Errorf("checksum double check found %d difference(s)", len(diffs))
+	}
+
+	logger.Info("checksum double check passed")
+	return nil
+}
+
+var sentRe = regexp.MustCompile(`^sent ([0-9,.]+) bytes`)
+var transferredRe = regexp.MustCompile(`^Total transferred file size: ([0-9,.]+) bytes`)
+
+// Bytes sent, from the summary line rsync prints with -v, e.g.
+// "sent 1,234 bytes  received 56 bytes  2,580.00 bytes/sec".
+func rsyncSentBytes(lines []string) uint64 {
+	return firstBytesMatch(sentRe, lines)
+}
+
+// Size of the files transferred, from rsync's --stats output.
+func rsyncTransferredBytes(lines []string) uint64 {
+	return firstBytesMatch(transferredRe, lines)
+}
+
+func firstBytesMatch(re *regexp.Regexp, lines []string) uint64 {
+	for _, l := range lines {
+		m := re.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		// Digit grouping depends on locale
+		digits := strings.NewReplacer(",", "", ".", "").Replace(m[1])
+		n, err := strconv.ParseUint(digits, 10, 64)
+		if err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// e.g. "Transferred 4.2 GB in 6m0s (11.7 MB/s)."
+func throughput(bytes uint64, d time.Duration) string {
+	rate := 0.0
+	if d > 0 {
+		rate = float64(bytes) / d.Seconds()
+	}
+	return fmt.Sprintf("Transferred %s in %s (%s/s).",
+		humanBytes(float64(bytes)), d.Round(time.Second), humanBytes(rate))
+}
+
+// SI units, e.g. "4.2 GB"
+func humanBytes(b float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB", "PB"}
+	i := 0
+	for b >= 1000 && i < len(units)-1 {
+		b /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", b, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", b, units[i])
+}
+
+// Does a checksum-based dry run of restoring snapshot over inFolder, and
+// reports what would change. Nothing is written to either folder.
+func verifyRestore(r *report, snapshot string, inFolder string) error {
+	snapWithSlash := snapshot + string(filepath.Separator)
+	args := []string{"-aX", "--checksum", "--dry-run", "--itemize-changes", "--delete"}
+	args = append(args, filterArgs(folderPair{})...)
+	args = append(args, cfg.RsyncExtraArgs...)
+	args = append(args, snapWithSlash, inFolder)
+	lines, err := execCommand("rsync:verify-restore", cfg.RsyncPath, args...)
+	addExecSection(r, "rsync restore comparison (dry run)", lines,
+		cfg.RsyncPath, args...)
+	if err != nil {
+		return fmt.Errorf("rsync restore comparison failed: %w", err)
+	}
+
+	diffs := itemizedLines(lines)
+	r.Sections = append(r.Sections, section{
+		Title: fmt.Sprintf("Divergences (%d)", len(diffs)),
+		Detail: `These items would change if the snapshot were restored over the input
+		folder (e.g. files changed or added since the snapshot was taken).`,
+		LogLines: diffs,
+	})
+	logger.Info("restore comparison done", "divergences", len(diffs))
+	return nil
+}
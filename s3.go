@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// For out folders given as s3://bucket/prefix. Requests are signed with AWS
+// Signature Version 4, so this works with AWS and S3-compatible stores.
+type s3Config struct {
+	// Default https://s3.<Region>.amazonaws.com - set for an S3-compatible
+	// store, e.g. https://minio.lan:9000. With PathStyle, the bucket is in the
+	// path (https://host/bucket/key), rather than the host name.
+	Endpoint  string
+	PathStyle bool
+	// Default $AWS_REGION (or $AWS_DEFAULT_REGION), else us-east-1
+	Region string
+
+	// Default $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+	// $AWS_SESSION_TOKEN. The secret key may be a secret reference, or given
+	// as a command or OS keyring entry instead (as for MailPass).
+	AccessKeyID            string
+	SecretAccessKey        string
+	SecretAccessKeyCommand []string
+	SecretAccessKeyKeyring *keyringRef
+	SessionToken           string
+
+	// Files bigger than this are uploaded in parts of this size (default 64,
+	// at least 5), Concurrency parts at once (default 1, or 4 for a self
+	// hosted Profile).
+	PartSizeMB  int
+	Concurrency int
+	// E.g. STANDARD_IA, or DEEP_ARCHIVE. Default the bucket's.
+	StorageClass string
+
+	// The kind of store: aws (the default), or minio or seaweedfs, for a self
+	// hosted one. Those need an Endpoint, are always path style, default to
+	// us-east-1 (rather than the AWS env vars), and are sent a Content-MD5
+	// with each upload too, which they check.
+	Profile string
+	// Don't check the Endpoint's TLS certificate, e.g. a self-signed one on
+	// the LAN. Only for a self hosted Profile.
+	InsecureSkipVerify bool
+}
+
+const s3Scheme = "s3://"
+
+// S3 Profiles.
+const (
+	s3ProfileAWS       = "aws"
+	s3ProfileMinIO     = "minio"
+	s3ProfileSeaweedFS = "seaweedfs"
+)
+
+func selfHostedS3(profile string) bool {
+	return profile == s3ProfileMinIO || profile == s3ProfileSeaweedFS
+}
+
+func validateS3(c *config) error {
+	if c.S3.PartSizeMB != 0 && (c.S3.PartSizeMB < 5 || c.S3.PartSizeMB > 5120) {
+		return fmt.Errorf("S3 PartSizeMB must be between 5 and 5120, not %d", c.S3.PartSizeMB)
+	}
+	if c.S3.Concurrency < 0 || c.S3.Concurrency > 16 {
+		return fmt.Errorf("S3 Concurrency must be between 1 and 16, not %d", c.S3.Concurrency)
+	}
+	switch c.S3.Profile {
+	case "", s3ProfileAWS:
+		if c.S3.InsecureSkipVerify {
+			return errors.New("S3 InsecureSkipVerify is only for a self hosted Profile (minio or seaweedfs)")
+		}
+	case s3ProfileMinIO, s3ProfileSeaweedFS:
+		if c.S3.Endpoint == "" {
+			return fmt.Errorf("S3 Profile %s needs an Endpoint, e.g. https://minio.lan:9000", c.S3.Profile)
+		}
+	default:
+		return fmt.Errorf("S3 Profile must be aws, minio or seaweedfs, not %q", c.S3.Profile)
+	}
+	return nil
+}
+
+type s3Store struct {
+	bucket string
+	prefix string // Ends with / (or is blank)
+
+	endpoint     *url.URL
+	pathStyle    bool
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int64
+	concurrency  int
+	contentMD5   bool
+	client       *http.Client
+}
+
+// The store for out, if it is an s3:// URL.
+func s3Destination(out string) (*s3Store, bool, error) {
+	rest, ok := strings.CutPrefix(out, s3Scheme)
+	if !ok {
+		return nil, false, nil
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, true, fmt.Errorf("no bucket in %s", out)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	selfHosted := selfHostedS3(cfg.S3.Profile)
+	s := &s3Store{
+		bucket:       bucket,
+		prefix:       prefix,
+		pathStyle:    cfg.S3.PathStyle || selfHosted,
+		region:       firstNonEmpty(cfg.S3.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    firstNonEmpty(cfg.S3.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    firstNonEmpty(cfg.S3.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: firstNonEmpty(cfg.S3.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+		partSize:     int64(cfg.S3.PartSizeMB) << 20,
+		concurrency:  cfg.S3.Concurrency,
+		contentMD5:   selfHosted,
+		client:       http.DefaultClient,
+	}
+	if selfHosted {
+		s.region = firstNonEmpty(cfg.S3.Region, "us-east-1")
+	}
+	if s.partSize == 0 {
+		s.partSize = 64 << 20
+	}
+	if s.concurrency == 0 {
+		s.concurrency = 1
+		if selfHosted {
+			// The store is likely on the LAN, so the parts are held up more by
+			// its disks than by the link
+			s.concurrency = 4
+		}
+	}
+	if cfg.S3.InsecureSkipVerify {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		s.client = &http.Client{Transport: t}
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, true, errors.New("no S3 credentials: set the S3 AccessKeyID and SecretAccessKey config, or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars")
+	}
+	endpoint := firstNonEmpty(cfg.S3.Endpoint, fmt.Sprintf("https://s3.%s.amazonaws.com", s.region))
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, true, fmt.Errorf("invalid S3 Endpoint %q", endpoint)
+	}
+	s.endpoint = u
+	return s, true, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *s3Store) String() string {
+	return s3Scheme + s.bucket + "/" + s.prefix
+}
+
+func (s *s3Store) notes() []string {
+	if !cfg.S3.InsecureSkipVerify {
+		return nil
+	}
+	return []string{fmt.Sprintf("warning: the TLS certificate of %s is not checked (S3 InsecureSkipVerify)", s.endpoint.Host)}
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) list() (map[string]storedObject, error) {
+	objs := map[string]storedObject{}
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", q, nil, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse object list: %w", err)
+		}
+		for _, c := range res.Contents {
+			key := strings.TrimPrefix(c.Key, s.prefix)
+			if key != "" && !strings.HasSuffix(key, "/") {
+				objs[key] = storedObject{Size: c.Size}
+			}
+		}
+		if !res.IsTruncated {
+			return objs, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Store) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	headers := map[string]string{"x-amz-meta-sha256": hex.EncodeToString(sum)}
+	if cfg.S3.StorageClass != "" {
+		headers["x-amz-storage-class"] = cfg.S3.StorageClass
+	}
+	if size > s.partSize {
+		return s.putMultipart(key, r, size, headers)
+	}
+	// S3 checks the content against the checksum, and rejects it if they differ
+	headers["x-amz-checksum-sha256"] = base64.StdEncoding.EncodeToString(sum)
+	if s.contentMD5 {
+		h := md5.New()
+		_, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return fmt.Errorf("could not hash: %w", err)
+		}
+		headers["Content-MD5"] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	resp, err := s.do(http.MethodPut, key, nil, headers, r, size, hex.EncodeToString(sum))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber     int
+	ETag           string
+	ChecksumSHA256 string
+}
+
+// S3's limits for a multipart upload.
+const (
+	s3MaxParts    = 10000
+	s3MaxPartSize = 5 << 30
+)
+
+// The size of the parts to upload size in: partSize, or bigger if it would
+// take more than S3's 10,000 parts.
+func s3PartSize(size int64, partSize int64) (int64, error) {
+	if size <= s3MaxParts*partSize {
+		return partSize, nil
+	}
+	partSize = (size + s3MaxParts - 1) / s3MaxParts
+	if partSize > s3MaxPartSize {
+		return 0, fmt.Errorf("too big for S3, at %s: it takes at most %d parts of %s", humanBytes(float64(size)), s3MaxParts, humanBytes(s3MaxPartSize))
+	}
+	return partSize, nil
+}
+
+// Uploads in parts of partSize (or bigger, as per s3PartSize), each checked
+// against its SHA-256 by S3, up to concurrency of them at once. Once one
+// fails, no more are started.
+func (s *s3Store) putMultipart(key string, r io.ReaderAt, size int64, headers map[string]string) (err error) {
+	partSize, err := s3PartSize(size, s.partSize)
+	if err != nil {
+		return err
+	}
+	if partSize != s.partSize {
+		logger.Debug("raising the part size, to stay within S3's part limit", "key", key, "part_size", partSize)
+	}
+
+	headers["x-amz-checksum-algorithm"] = "SHA256"
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, headers, nil, 0, emptySHA256)
+	if err != nil {
+		return fmt.Errorf("could not start multipart upload: %w", err)
+	}
+	var created struct{ UploadId string }
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not parse multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Otherwise the parts are kept (and billed) until a lifecycle rule
+		// removes them
+		resp, aErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, emptySHA256)
+		if aErr != nil {
+			logger.Warn("could not abort multipart upload", "key", key, "err", aErr.Error())
+			return
+		}
+		resp.Body.Close()
+	}()
+
+	count := int((size + partSize - 1) / partSize)
+	parts := make([]s3CompletedPart, count)
+	errs := make([]error, count)
+	slots := make(chan struct{}, s.concurrency)
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i := range count {
+		slots <- struct{}{}
+		if failed.Load() {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			off := int64(i) * partSize
+			parts[i], errs[i] = s.putPart(key, uploadID, i+1, r, off, min(partSize, size-off))
+			if errs[i] != nil {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("could not marshal multipart completion: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil,
+		bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return fmt.Errorf("could not complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+	// A completion can fail after the 200 status was sent
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read multipart completion: %w", err)
+	}
+	if sErr := s3ErrorFrom(b); sErr != nil {
+		return fmt.Errorf("could not complete multipart upload: %w", sErr)
+	}
+	return nil
+}
+
+func (s *s3Store) putPart(key string, uploadID string, n int, r io.ReaderAt, off int64, partLen int64) (s3CompletedPart, error) {
+	h, md := sha256.New(), md5.New()
+	_, err := io.Copy(io.MultiWriter(h, md), io.NewSectionReader(r, off, partLen))
+	if err != nil {
+		return s3CompletedPart{}, fmt.Errorf("could not hash part %d: %w", n, err)
+	}
+	sum := h.Sum(nil)
+	checksum := base64.StdEncoding.EncodeToString(sum)
+	headers := map[string]string{"x-amz-checksum-sha256": checksum}
+	if s.contentMD5 {
+		headers["Content-MD5"] = base64.StdEncoding.EncodeToString(md.Sum(nil))
+	}
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, err := s.do(http.MethodPut, key, q, headers, io.NewSectionReader(r, off, partLen), partLen, hex.EncodeToString(sum))
+	if err != nil {
+		return s3CompletedPart{}, fmt.Errorf("could not upload part %d: %w", n, err)
+	}
+	resp.Body.Close()
+	return s3CompletedPart{PartNumber: n, ETag: resp.Header.Get("ETag"), ChecksumSHA256: checksum}, nil
+}
+
+func (s *s3Store) get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SHA-256 of no payload, as hex.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Sends the signed request for the key (under the prefix - or for the bucket
+// itself, if blank), failing on a non-2xx status.
+func (s *s3Store) do(method string, key string, query url.Values, headers map[string]string, body io.ReaderAt, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	objPath := ""
+	if key != "" {
+		objPath = s.prefix + key
+	}
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + objPath
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + objPath
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	var rd io.Reader
+	if body != nil {
+		rd = io.NewSectionReader(body, 0, size)
+	}
+	req, err := http.NewRequestWithContext(runCtx, method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	logger.Debug("s3 request", "method", method, "url", u.Redacted())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if sErr := s3ErrorFrom(b); sErr != nil {
+			return nil, fmt.Errorf("%s %s: %s: %w", method, u.Path, resp.Status, sErr)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, u.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (e s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// The error in an S3 error response body, if it is one.
+func s3ErrorFrom(b []byte) error {
+	var e struct {
+		XMLName xml.Name
+		s3Error
+	}
+	err := xml.Unmarshal(b, &e)
+	if err != nil || e.XMLName.Local != "Error" {
+		return nil
+	}
+	return e.s3Error
+}
+
+// Signs the request with AWS Signature Version 4.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	// Host, and every x-amz-* header, are signed
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			signed[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := sortedKeys(signed)
+	var canonHeaders strings.Builder
+	for _, n := range names {
+		canonHeaders.WriteString(n + ":" + signed[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	reqSum := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encodes s as SigV4 expects: everything but unreserved characters (and,
+// unless encodeSlash, /) is percent encoded.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// The query in SigV4's canonical form, which is also sent as is.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
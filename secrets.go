@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// An entry in the OS keyring (see keyringCommand).
+type keyringRef struct {
+	Service string
+	User    string
+}
+
+// Works out each mail server's pass (and the restic, borg, S3, B2, Azure, Google Drive, WebDAV and share secrets) from
+// its command or keyring entry, if given instead of a plaintext pass, and
+// looks up any user or pass given as a reference to a secrets provider.
+func resolveSecrets(c *config) error {
+	pass, err := resolveSecret("MailPass", c.MailPass, c.MailPassCommand, c.MailPassKeyring)
+	if err != nil {
+		return err
+	}
+	c.MailPass = pass
+	c.MailUser, err = resolveSecretRef("MailUser", c.MailUser)
+	if err != nil {
+		return err
+	}
+	c.Restic.Password, err = resolveSecret("Restic Password", c.Restic.Password, c.Restic.PasswordCommand, c.Restic.PasswordKeyring)
+	if err != nil {
+		return err
+	}
+	c.Borg.Passphrase, err = resolveSecret("Borg Passphrase", c.Borg.Passphrase, c.Borg.PassphraseCommand, c.Borg.PassphraseKeyring)
+	if err != nil {
+		return err
+	}
+	c.S3.SecretAccessKey, err = resolveSecret("S3 SecretAccessKey", c.S3.SecretAccessKey, c.S3.SecretAccessKeyCommand, c.S3.SecretAccessKeyKeyring)
+	if err != nil {
+		return err
+	}
+	c.B2.ApplicationKey, err = resolveSecret("B2 ApplicationKey", c.B2.ApplicationKey, c.B2.ApplicationKeyCommand, c.B2.ApplicationKeyKeyring)
+	if err != nil {
+		return err
+	}
+	c.Azure.AccountKey, err = resolveSecret("Azure AccountKey", c.Azure.AccountKey, c.Azure.AccountKeyCommand, c.Azure.AccountKeyKeyring)
+	if err != nil {
+		return err
+	}
+	c.Azure.SASToken, err = resolveSecretRef("Azure SASToken", c.Azure.SASToken)
+	if err != nil {
+		return err
+	}
+	c.GDrive.ClientSecret, err = resolveSecret("GDrive ClientSecret", c.GDrive.ClientSecret, c.GDrive.ClientSecretCommand, c.GDrive.ClientSecretKeyring)
+	if err != nil {
+		return err
+	}
+	c.WebDAV.Password, err = resolveSecret("WebDAV Password", c.WebDAV.Password, c.WebDAV.PasswordCommand, c.WebDAV.PasswordKeyring)
+	if err != nil {
+		return err
+	}
+	for i, m := range c.Mounts {
+		c.Mounts[i].Password, err = resolveSecret(fmt.Sprintf("Mounts entry %d Password", i), m.Password, m.PasswordCommand, m.PasswordKeyring)
+		if err != nil {
+			return err
+		}
+	}
+	for i, srv := range c.MailServers {
+		pass, err := resolveSecret(fmt.Sprintf("MailServers entry %d Pass", i), srv.Pass, srv.PassCommand, srv.PassKeyring)
+		if err != nil {
+			return err
+		}
+		c.MailServers[i].Pass = pass
+		c.MailServers[i].User, err = resolveSecretRef(fmt.Sprintf("MailServers entry %d User", i), srv.User)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveSecret(field string, plain string, command []string, keyring *keyringRef) (string, error) {
+	given := 0
+	for _, set := range []bool{plain != "", len(command) > 0, keyring != nil} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return "", fmt.Errorf("give only one of a plaintext pass, a pass command or a keyring entry for %s", field)
+	}
+
+	switch {
+	case len(command) > 0:
+		secret, err := secretFromCommand(command)
+		if err != nil {
+			return "", fmt.Errorf("%s command failed: %w", field, err)
+		}
+		return secret, nil
+	case keyring != nil:
+		command, err := keyringCommand(*keyring)
+		if err != nil {
+			return "", fmt.Errorf("%s keyring lookup: %w", field, err)
+		}
+		secret, err := secretFromCommand(command)
+		if err != nil {
+			return "", fmt.Errorf("%s keyring lookup failed: %w", field, err)
+		}
+		return secret, nil
+	}
+	return resolveSecretRef(field, plain)
+}
+
+// The first line of stdout. Not run via execCommand, so that the secret is
+// never logged.
+func secretFromCommand(command []string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	secret, _, _ := strings.Cut(stdout.String(), "\n")
+	secret = strings.TrimSuffix(secret, "\r")
+	if secret == "" {
+		return "", errors.New("no output")
+	}
+	logger.Debug("secret read from command", "command", command[0])
+	return secret, nil
+}
+
+// Looks up the key of the secret at path in some store.
+type secretsProvider interface {
+	lookup(path string, key string) (string, error)
+}
+
+// Keyed by the prefix of a reference, e.g. "vault" for "vault:kv/backup#pass".
+var secretsProviders = map[string]secretsProvider{
+	"vault":  vaultProvider{},
+	"aws-sm": awsSecretsProvider{},
+}
+
+// Replaces a reference like "vault:kv/backup#pass" with the secret it refers
+// to. Other values are returned as is.
+func resolveSecretRef(field string, value string) (string, error) {
+	prefix, ref, ok := strings.Cut(value, ":")
+	provider, known := secretsProviders[prefix]
+	if !ok || !known {
+		return value, nil
+	}
+	path, key, _ := strings.Cut(ref, "#")
+	secret, err := provider.lookup(path, key)
+	if err != nil {
+		return "", fmt.Errorf("could not look up %s from %s: %w", field, prefix, err)
+	}
+	logger.Debug("secret read from provider", "field", field, "provider", prefix, "path", path)
+	return secret, nil
+}
+
+// Via the vault CLI, so the usual VAULT_ADDR and VAULT_TOKEN env vars (or
+// token helper) apply. The key defaults to "value".
+type vaultProvider struct{}
+
+func (vaultProvider) lookup(path string, key string) (string, error) {
+	if key == "" {
+		key = "value"
+	}
+	return secretFromCommand([]string{"vault", "kv", "get", "-field=" + key, path})
+}
+
+// Via the aws CLI, so the usual AWS profile and region config applies. With a
+// key, the secret string is taken to be a JSON object holding it.
+type awsSecretsProvider struct{}
+
+func (awsSecretsProvider) lookup(path string, key string) (string, error) {
+	secret, err := secretFromCommand([]string{"aws", "secretsmanager", "get-secret-value",
+		"--secret-id", path, "--query", "SecretString", "--output", "text"})
+	if err != nil || key == "" {
+		return secret, err
+	}
+	var fields map[string]any
+	err = json.Unmarshal([]byte(secret), &fields)
+	if err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %w", path, err)
+	}
+	v, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no string %q", path, key)
+	}
+	return v, nil
+}
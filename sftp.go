@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// For out folders given as sftp://[user@]host[:port]/path (or /~/path, for a
+// path in the login dir). The SFTP protocol is spoken over the ssh binary's
+// sftp subsystem, so that ssh's own config, keys and known_hosts apply - and
+// the host needs no shell, or rsync.
+const sftpScheme = "sftp://"
+
+type sftpStore struct {
+	url  string
+	host string // [user@]host
+	port string
+	root string // Blank for the login dir
+
+	cmd    *exec.Cmd
+	w      io.WriteCloser
+	r      *bufio.Reader
+	stderr *lockedBuffer
+	nextID uint32
+	dirs   map[string]bool // Made (or found) already
+	// Whether the server has OpenSSH's rename which replaces the target
+	posixRename bool
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return strings.TrimSpace(b.Buffer.String())
+}
+
+// The store for out, if it is an sftp:// URL. It connects on first use.
+func sftpDestination(out string) (*sftpStore, bool, error) {
+	if !strings.HasPrefix(out, sftpScheme) {
+		return nil, false, nil
+	}
+	u, err := url.Parse(out)
+	if err != nil || u.Hostname() == "" {
+		return nil, true, fmt.Errorf("invalid SFTP destination %q: expect sftp://[user@]host[:port]/path", out)
+	}
+	s := &sftpStore{url: out, host: u.Hostname(), port: u.Port(), root: u.Path, dirs: map[string]bool{}}
+	if u.User != nil {
+		s.host = u.User.Username() + "@" + s.host
+	}
+	if rel, ok := strings.CutPrefix(s.root, "/~"); ok {
+		s.root = strings.TrimPrefix(rel, "/")
+	}
+	return s, true, nil
+}
+
+func (s *sftpStore) String() string {
+	return s.url
+}
+
+// SFTP v3 packet types and flags, as per draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpSetstat  = 9
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+	sshFxpExtended = 200
+	sshFxfRead     = 0x01
+	sshFxfWrite    = 0x02
+	sshFxfCreat    = 0x08
+	sshFxfTrunc    = 0x10
+	sshFxOK        = 0
+	sshFxEOF       = 1
+	sshFxNoSuch    = 2
+	sshAttrSize    = 0x01
+	sshAttrUIDGID  = 0x02
+	sshAttrPerm    = 0x04
+	sshAttrTimes   = 0x08
+	sshAttrExtend  = 0x80000000
+	sftpChunkSize  = 32 << 10
+	sftpMaxPending = 64
+)
+
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.code, e.msg)
+}
+
+type sftpAttrs struct {
+	size  uint64
+	perm  uint32
+	isDir bool
+	isReg bool
+}
+
+// Starts ssh with the sftp subsystem, and does the version handshake.
+func (s *sftpStore) connect() error {
+	if s.cmd != nil {
+		return nil
+	}
+	args := s.sshArgs()
+	logger.Debug("starting sftp session", "command", cfg.SSH.Path, "args", args)
+	cmd := exec.CommandContext(runCtx, cfg.SSH.Path, args...)
+	cmd.Env = commandEnv(cfg.SSH.Path)
+	s.stderr = &lockedBuffer{}
+	cmd.Stderr = s.stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("could not start %s: %w", cfg.SSH.Path, err)
+	}
+	s.cmd, s.w, s.r = cmd, w, bufio.NewReaderSize(r, 64<<10)
+
+	var p sftpPacket
+	p.uint32(3)
+	err = s.send(sshFxpInit, p)
+	if err != nil {
+		return s.connErr(err)
+	}
+	typ, ver, err := s.recv()
+	if err != nil {
+		return s.connErr(err)
+	}
+	if typ != sshFxpVersion {
+		return s.connErr(fmt.Errorf("unexpected packet type %d, instead of the version", typ))
+	}
+	// Then the extensions, as name and data pairs
+	ver.uint32()
+	for len(ver.b) > 0 && ver.err == nil {
+		name := ver.string()
+		ver.string()
+		if name == posixRenameExt {
+			s.posixRename = true
+		}
+	}
+	logger.Debug("sftp session started", "host", s.host)
+	return nil
+}
+
+// Args for ssh to start the session.
+func (s *sftpStore) sshArgs() []string {
+	return append(sshArgs(s.port), s.host, "-s", "sftp")
+}
+
+// Adds what ssh said, since that is usually why.
+func (s *sftpStore) connErr(err error) error {
+	if msg := s.stderr.String(); msg != "" {
+		return fmt.Errorf("sftp session to %s failed: %w: %s", s.host, err, msg)
+	}
+	return fmt.Errorf("sftp session to %s failed: %w", s.host, err)
+}
+
+func (s *sftpStore) Close() error {
+	if s.cmd == nil {
+		return nil
+	}
+	s.w.Close()
+	err := s.cmd.Wait()
+	s.cmd = nil
+	return err
+}
+
+type sftpPacket struct {
+	bytes.Buffer
+}
+
+func (p *sftpPacket) uint32(v uint32) {
+	binary.Write(p, binary.BigEndian, v)
+}
+
+func (p *sftpPacket) uint64(v uint64) {
+	binary.Write(p, binary.BigEndian, v)
+}
+
+func (p *sftpPacket) string(v string) {
+	p.uint32(uint32(len(v)))
+	p.WriteString(v)
+}
+
+func (p *sftpPacket) bytes(v []byte) {
+	p.uint32(uint32(len(v)))
+	p.Write(v)
+}
+
+func (s *sftpStore) send(typ byte, p sftpPacket) error {
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(p.Len()+1))
+	hdr[4] = typ
+	_, err := s.w.Write(append(hdr, p.Bytes()...))
+	return err
+}
+
+func (s *sftpStore) recv() (byte, *sftpReader, error) {
+	hdr := make([]byte, 5)
+	_, err := io.ReadFull(s.r, hdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr)
+	if n < 1 || n > 1<<24 {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	body := make([]byte, n-1)
+	_, err = io.ReadFull(s.r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], &sftpReader{b: body}, nil
+}
+
+// Reads the fields of a packet. Reading past the end gives zero values, and
+// sets err.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if uint32(len(r.b)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(r.b[:n])
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpReader) attrs() sftpAttrs {
+	var a sftpAttrs
+	flags := r.uint32()
+	if flags&sshAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if flags&sshAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sshAttrPerm != 0 {
+		a.perm = r.uint32()
+		a.isDir = a.perm&0170000 == 0040000
+		a.isReg = a.perm&0170000 == 0100000
+	}
+	if flags&sshAttrTimes != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sshAttrExtend != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+// Sends the request (with a new id prefixed), and reads its response.
+func (s *sftpStore) call(typ byte, build func(p *sftpPacket)) (byte, *sftpReader, error) {
+	err := s.connect()
+	if err != nil {
+		return 0, nil, err
+	}
+	s.nextID++
+	id := s.nextID
+	var p sftpPacket
+	p.uint32(id)
+	build(&p)
+	err = s.send(typ, p)
+	if err != nil {
+		return 0, nil, s.connErr(err)
+	}
+	rtyp, r, err := s.recv()
+	if err != nil {
+		return 0, nil, s.connErr(err)
+	}
+	if got := r.uint32(); got != id {
+		return 0, nil, fmt.Errorf("sftp response for request %d, not %d", got, id)
+	}
+	return rtyp, r, nil
+}
+
+// The OK status's nil, or the status as an error (or an error if the
+// response is not a status).
+func statusErr(typ byte, r *sftpReader) error {
+	if typ != sshFxpStatus {
+		return fmt.Errorf("unexpected sftp packet type %d, instead of a status", typ)
+	}
+	code := r.uint32()
+	msg := r.string()
+	if code == sshFxOK {
+		return nil
+	}
+	return &sftpStatusError{code: code, msg: msg}
+}
+
+func isSFTPStatus(err error, code uint32) bool {
+	var sErr *sftpStatusError
+	return errors.As(err, &sErr) && sErr.code == code
+}
+
+func (s *sftpStore) callStatus(typ byte, build func(p *sftpPacket)) error {
+	rtyp, r, err := s.call(typ, build)
+	if err != nil {
+		return err
+	}
+	return statusErr(rtyp, r)
+}
+
+func (s *sftpStore) callHandle(typ byte, build func(p *sftpPacket)) (string, error) {
+	rtyp, r, err := s.call(typ, build)
+	if err != nil {
+		return "", err
+	}
+	if rtyp != sshFxpHandle {
+		return "", statusErr(rtyp, r)
+	}
+	return r.string(), r.err
+}
+
+func (s *sftpStore) closeHandle(h string) error {
+	return s.callStatus(sshFxpClose, func(p *sftpPacket) { p.string(h) })
+}
+
+func (s *sftpStore) remotePath(key string) string {
+	if s.root == "" {
+		return key
+	}
+	return path.Join(s.root, key)
+}
+
+// Every regular file under the root (recursively), keyed by its path relative
+// to it.
+func (s *sftpStore) list() (map[string]storedObject, error) {
+	objs := map[string]storedObject{}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		dir := s.remotePath(rel)
+		if dir == "" {
+			dir = "."
+		}
+		h, err := s.callHandle(sshFxpOpendir, func(p *sftpPacket) { p.string(dir) })
+		if err != nil {
+			return fmt.Errorf("could not open dir %s: %w", dir, err)
+		}
+		s.dirs[dir] = true
+		var subdirs []string
+		for {
+			typ, r, err := s.call(sshFxpReaddir, func(p *sftpPacket) { p.string(h) })
+			if err != nil {
+				return err
+			}
+			if typ != sshFxpName {
+				err = statusErr(typ, r)
+				if isSFTPStatus(err, sshFxEOF) {
+					break
+				}
+				return fmt.Errorf("could not read dir %s: %w", dir, err)
+			}
+			for n := r.uint32(); n > 0 && r.err == nil; n-- {
+				name := r.string()
+				r.string() // The ls -l style long name
+				a := r.attrs()
+				if name == "." || name == ".." {
+					continue
+				}
+				key := path.Join(rel, name)
+				switch {
+				case a.isDir:
+					subdirs = append(subdirs, key)
+				case a.isReg:
+					objs[key] = storedObject{Size: int64(a.size)}
+				}
+			}
+			if r.err != nil {
+				return fmt.Errorf("could not parse dir %s: %w", dir, r.err)
+			}
+		}
+		err = s.closeHandle(h)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subdirs {
+			err = walk(sub)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return objs, walk("")
+}
+
+// Makes the dir and its parents, as needed.
+func (s *sftpStore) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" || dir == "" || s.dirs[dir] {
+		return nil
+	}
+	err := s.mkdirAll(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	typ, r, err := s.call(sshFxpLstat, func(p *sftpPacket) { p.string(dir) })
+	if err != nil {
+		return err
+	}
+	if typ == sshFxpAttrs {
+		if !r.attrs().isDir {
+			return fmt.Errorf("%s is not a dir", dir)
+		}
+		s.dirs[dir] = true
+		return nil
+	}
+	err = s.callStatus(sshFxpMkdir, func(p *sftpPacket) {
+		p.string(dir)
+		p.uint32(sshAttrPerm)
+		p.uint32(0755)
+	})
+	if err != nil {
+		return fmt.Errorf("could not make dir %s: %w", dir, err)
+	}
+	s.dirs[dir] = true
+	return nil
+}
+
+// Writes in chunks, with up to sftpMaxPending writes in flight, so that the
+// round trips don't limit the throughput. Writes to a temp file which is then
+// renamed into place (as copyFile does), so that an interrupted upload never
+// leaves the old copy half overwritten.
+func (s *sftpStore) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	remote := s.remotePath(key)
+	err := s.mkdirAll(path.Dir(remote))
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(remote), "."+path.Base(remote)+".tmp")
+	err = s.write(tmp, r, size)
+	if err != nil {
+		s.callStatus(sshFxpRemove, func(p *sftpPacket) { p.string(tmp) })
+		return err
+	}
+	err = s.rename(tmp, remote)
+	if err != nil {
+		s.callStatus(sshFxpRemove, func(p *sftpPacket) { p.string(tmp) })
+		return fmt.Errorf("could not rename %s to %s: %w", tmp, remote, err)
+	}
+	return nil
+}
+
+// Replaces newPath with oldPath. A plain SSH_FXP_RENAME fails if newPath
+// exists (in v3), so without posix-rename@openssh.com it is removed first.
+func (s *sftpStore) rename(oldPath, newPath string) error {
+	if s.posixRename {
+		return s.callStatus(sshFxpExtended, func(p *sftpPacket) {
+			p.string(posixRenameExt)
+			p.string(oldPath)
+			p.string(newPath)
+		})
+	}
+	err := s.callStatus(sshFxpRemove, func(p *sftpPacket) { p.string(newPath) })
+	if err != nil && !isSFTPStatus(err, sshFxNoSuch) {
+		return err
+	}
+	return s.callStatus(sshFxpRename, func(p *sftpPacket) {
+		p.string(oldPath)
+		p.string(newPath)
+	})
+}
+
+const posixRenameExt = "posix-rename@openssh.com"
+
+func (s *sftpStore) write(remote string, r io.ReaderAt, size int64) error {
+	h, err := s.callHandle(sshFxpOpen, func(p *sftpPacket) {
+		p.string(remote)
+		p.uint32(sshFxfWrite | sshFxfCreat | sshFxfTrunc)
+		p.uint32(sshAttrPerm)
+		p.uint32(0644)
+	})
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", remote, err)
+	}
+
+	pending := map[uint32]bool{}
+	await := func() error {
+		typ, resp, err := s.recv()
+		if err != nil {
+			return s.connErr(err)
+		}
+		id := resp.uint32()
+		if !pending[id] {
+			return fmt.Errorf("sftp response for unknown request %d", id)
+		}
+		delete(pending, id)
+		return statusErr(typ, resp)
+	}
+	buf := make([]byte, sftpChunkSize)
+	var wErr error
+	for off := int64(0); off < size && wErr == nil; off += sftpChunkSize {
+		n, err := r.ReadAt(buf[:min(sftpChunkSize, size-off)], off)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(n) == min(sftpChunkSize, size-off)) {
+			wErr = fmt.Errorf("could not read: %w", err)
+			break
+		}
+		s.nextID++
+		var p sftpPacket
+		p.uint32(s.nextID)
+		p.string(h)
+		p.uint64(uint64(off))
+		p.bytes(buf[:n])
+		err = s.send(sshFxpWrite, p)
+		if err != nil {
+			wErr = s.connErr(err)
+			break
+		}
+		pending[s.nextID] = true
+		if len(pending) >= sftpMaxPending {
+			wErr = await()
+		}
+	}
+	for len(pending) > 0 {
+		err := await()
+		if wErr == nil {
+			wErr = err
+		}
+	}
+	cErr := s.closeHandle(h)
+	if wErr != nil {
+		return fmt.Errorf("could not write %s: %w", remote, wErr)
+	}
+	if cErr != nil {
+		return fmt.Errorf("could not close %s: %w", remote, cErr)
+	}
+	return nil
+}
+
+func (s *sftpStore) get(key string) ([]byte, error) {
+	remote := s.remotePath(key)
+	h, err := s.callHandle(sshFxpOpen, func(p *sftpPacket) {
+		p.string(remote)
+		p.uint32(sshFxfRead)
+		p.uint32(0)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", remote, err)
+	}
+	defer s.closeHandle(h)
+	var b []byte
+	for {
+		typ, r, err := s.call(sshFxpRead, func(p *sftpPacket) {
+			p.string(h)
+			p.uint64(uint64(len(b)))
+			p.uint32(sftpChunkSize)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if typ != sshFxpData {
+			err = statusErr(typ, r)
+			if isSFTPStatus(err, sshFxEOF) {
+				return b, nil
+			}
+			return nil, fmt.Errorf("could not read %s: %w", remote, err)
+		}
+		b = append(b, r.string()...)
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+// Also removes the dirs which are left empty, as rsync --delete would.
+func (s *sftpStore) delete(key string) error {
+	remote := s.remotePath(key)
+	err := s.callStatus(sshFxpRemove, func(p *sftpPacket) { p.string(remote) })
+	if err != nil && !isSFTPStatus(err, sshFxNoSuch) {
+		return fmt.Errorf("could not remove %s: %w", remote, err)
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		rdir := s.remotePath(dir)
+		if s.callStatus(sshFxpRmdir, func(p *sftpPacket) { p.string(rdir) }) != nil {
+			break
+		}
+		delete(s.dirs, rdir)
+	}
+	return nil
+}
+
+// Like checkFolder's smoke file check, since the remote folder may be on a
+// drive which is not mounted.
+func (s *sftpStore) checkSmokeFile() error {
+	smoke := s.remotePath(smokeFilename)
+	typ, r, err := s.call(sshFxpLstat, func(p *sftpPacket) { p.string(smoke) })
+	if err != nil {
+		return err
+	}
+	if typ != sshFxpAttrs {
+		return fmt.Errorf("smoke file check err (maybe not mounted?): %s: %w", smoke, statusErr(typ, r))
+	}
+	return nil
+}
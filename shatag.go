@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How files' checksums are stored and checked: "cshatag" (run as a command,
+// keeping them in xattrs), "native" (the built in engine, which keeps them in
+// the same xattrs on Linux, and in NTFS streams on Windows), or "auto" (native
+// on Windows, and on Linux if cshatag is not installed, else cshatag).
+const (
+	checksumEngineAuto    = "auto"
+	checksumEngineCshatag = "cshatag"
+	checksumEngineNative  = "native"
+)
+
+// cshatag's xattr names, also used for the native engine's tags.
+const (
+	shatagSumName = "user.shatag.sha256"
+	shatagTsName  = "user.shatag.ts"
+)
+
+func validateChecksumEngine(c *config) error {
+	switch c.ChecksumEngine {
+	case checksumEngineAuto, checksumEngineCshatag:
+		return nil
+	case checksumEngineNative:
+		if tagStoreDesc == "" {
+			return fmt.Errorf("ChecksumEngine native is not supported on %s, so use cshatag", runtime.GOOS)
+		}
+		return nil
+	}
+	return fmt.Errorf("ChecksumEngine must be auto, cshatag or native, not %q", c.ChecksumEngine)
+}
+
+// Whether checksums are checked with the native engine, rather than cshatag.
+func nativeChecksums() bool {
+	switch cfg.ChecksumEngine {
+	case checksumEngineNative:
+		return true
+	case checksumEngineCshatag:
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	_, err := exec.LookPath(cfg.CshatagPath)
+	return tagStoreDesc != "" && err != nil
+}
+
+// A file which a checksum run found to be new, outdated or corrupt, or could
+// not check. For cshatag, as parsed from its output.
+type checksumFile struct {
+	Path   string
+	Status string // new, outdated, corrupt, changed (while hashing), or error
+	// For corrupt files: the checksum stored, and that of the content now
+	Stored string `json:",omitempty"`
+	Actual string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// The file's lines in cshatag's format, e.g. "<corrupt> some/file".
+func (f checksumFile) lines() []string {
+	switch f.Status {
+	case "error":
+		return []string{fmt.Sprintf("<error> %s: %s", f.Path, f.Error)}
+	case "changed":
+		return []string{fmt.Sprintf("<changed while hashing> %s", f.Path)}
+	case "corrupt":
+		return []string{
+			fmt.Sprintf("<corrupt> %s", f.Path),
+			fmt.Sprintf(" stored: %s", f.Stored),
+			fmt.Sprintf(" actual: %s", f.Actual),
+		}
+	}
+	return []string{fmt.Sprintf("<%s> %s", f.Status, f.Path)}
+}
+
+// What a checksum run found, and its output (and the command run) for the
+// report.
+type checksumRun struct {
+	files []checksumFile
+	lines []string
+	argv  []string
+}
+
+// E.g. "<corrupt> some/file", then " stored: <sha256> <ts>" and " actual:
+// <sha256> <ts>".
+func parseCshatagLines(lines []string) []checksumFile {
+	var files []checksumFile
+	for _, l := range lines {
+		if rest, ok := strings.CutPrefix(l, "<"); ok {
+			status, path, ok := strings.Cut(rest, "> ")
+			if ok {
+				files = append(files, checksumFile{Path: path, Status: status})
+			}
+			continue
+		}
+		if len(files) == 0 || files[len(files)-1].Status != "corrupt" {
+			continue
+		}
+		f := &files[len(files)-1]
+		if sum, ok := strings.CutPrefix(strings.TrimSpace(l), "stored: "); ok {
+			f.Stored, _, _ = strings.Cut(sum, " ")
+		} else if sum, ok := strings.CutPrefix(strings.TrimSpace(l), "actual: "); ok {
+			f.Actual, _, _ = strings.Cut(sum, " ")
+		}
+	}
+	return files
+}
+
+// E.g. "2 new, 1 outdated and 0 corrupt file(s)." plus any others.
+func checksumSummary(files []checksumFile) string {
+	counts := map[string]int{}
+	for _, f := range files {
+		counts[f.Status]++
+	}
+	s := fmt.Sprintf("%d new, %d outdated and %d corrupt file(s).", counts["new"], counts["outdated"], counts["corrupt"])
+	if n := counts["changed"]; n > 0 {
+		s += fmt.Sprintf(" %d changed while being hashed, so were skipped.", n)
+	}
+	if n := counts["error"]; n > 0 {
+		s += fmt.Sprintf(" %d could not be checked.", n)
+	}
+	return s
+}
+
+// Checksum runs on the same dir (e.g. the in folder of a job's destinations,
+// backed up at once) take turns, so that they don't store its checksums at the
+// same time.
+var checksumLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+func lockChecksums(dir string) func() {
+	checksumLocks.Lock()
+	mu := checksumLocks.m[dir]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		checksumLocks.m[dir] = mu
+	}
+	checksumLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Checks the checksums of the files in dir (storing them for new and changed
+// files, unless read only), with cshatag or the native engine (always, for
+// any hash algorithm but sha256). The lines are in cshatag's format (e.g.
+// "<corrupt> some/file") either way.
+func runChecksums(logDesc string, dir string, readOnly bool, algo string) (checksumRun, error) {
+	defer lockChecksums(dir)()
+	var run checksumRun
+	var err error
+	if algo == hashSHA256 && !nativeChecksums() {
+		args := cshatagArgs(dir, readOnly)
+		run.lines, err = execCommand(logDesc, cfg.CshatagPath, args...)
+		run.argv = append([]string{cfg.CshatagPath}, args...)
+		run.files = parseCshatagLines(run.lines)
+	} else {
+		readOnly = readOnly || cfg.CshatagDryRun || cfg.dryRun
+		run.argv = []string{"built in engine:", algo, "in", tagStoreDesc, dir}
+		if readOnly {
+			run.argv = append(run.argv, "(read only)")
+		}
+		start := time.Now()
+		run.files, run.lines, err = nativeShatag(logDesc, dir, readOnly, algo)
+		recordStep(logDesc, run.argv, start, err)
+	}
+	recordChecksums(run.files)
+	return run, err
+}
+
+// As cshatag -q -recursive: finds only new, outdated (modified since they
+// were stored) and corrupt (changed, but with the same modification time)
+// files, and errors, failing if any are corrupt. Corrupt files' stored
+// checksums are left as they are.
+func nativeShatag(logDesc string, dir string, readOnly bool, algo string) ([]checksumFile, []string, error) {
+	ctx, cancel := commandContext(cfg.CshatagPath)
+	defer cancel()
+	var files []checksumFile
+	var lines []string
+	logw := lineBuffer{Out: logWriter, Prefix: []byte(fmt.Sprintf("[%s] ", logDesc))}
+	defer logw.Flush()
+	found := func(f checksumFile) {
+		files = append(files, f)
+		for _, line := range f.lines() {
+			lines = append(lines, line)
+			fmt.Fprintln(&logw, line)
+		}
+	}
+	var errs []error
+	walkErr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && !d.Type().IsRegular() {
+			return nil
+		}
+		if err == nil {
+			err = nativeTagFile(path, readOnly, algo, found)
+		}
+		if err != nil {
+			found(checksumFile{Path: path, Status: "error", Error: err.Error()})
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	lines = append(lines, "<end of logs>")
+	if ctx.Err() != nil {
+		return files, lines, commandTimeoutErr("native checksums", ctx)
+	}
+	if walkErr != nil {
+		errs = append(errs, walkErr)
+	}
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("checksums of %d file(s) could not be checked: %w", len(errs), errors.Join(errs...))
+	}
+	// Fails as cshatag does, so that corrupt files are never synced
+	if n := len(corruptFiles(files)); n > 0 {
+		err = errors.Join(fmt.Errorf("%d corrupt file(s) found", n), err)
+	}
+	return files, lines, err
+}
+
+func nativeTagFile(path string, readOnly bool, algo string, found func(checksumFile)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mtime := info.ModTime()
+	sum, err := fileHash(path, algo)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !after.ModTime().Equal(mtime) {
+		found(checksumFile{Path: path, Status: "changed"})
+		return nil
+	}
+
+	sumName, tsName := hashTagNames(algo)
+	storedSum, sumErr := getTag(path, sumName)
+	storedTs, tsErr := getTag(path, tsName)
+	switch {
+	case errors.Is(sumErr, fs.ErrNotExist) || errors.Is(tsErr, fs.ErrNotExist):
+		found(checksumFile{Path: path, Status: "new"})
+	case sumErr != nil:
+		return sumErr
+	case tsErr != nil:
+		return tsErr
+	case !tagTimeMatches(storedTs, mtime):
+		found(checksumFile{Path: path, Status: "outdated"})
+	case strings.TrimSpace(string(storedSum)) != sum:
+		found(checksumFile{Path: path, Status: "corrupt", Stored: strings.TrimSpace(string(storedSum)), Actual: sum})
+		return nil
+	default:
+		return nil
+	}
+	if readOnly {
+		return nil
+	}
+	err = setTag(path, sumName, []byte(sum))
+	if err == nil {
+		err = setTag(path, tsName, []byte(tagTime(mtime)))
+	}
+	if err != nil {
+		return fmt.Errorf("could not store checksum: %w", err)
+	}
+	// Writing a stream may touch the file's modification time
+	return os.Chtimes(path, time.Time{}, mtime)
+}
+
+// The modification time as stored with a checksum, as cshatag writes it:
+// seconds (padded to 10 digits) and nanoseconds, e.g. "1700000000.000000042".
+func tagTime(mtime time.Time) string {
+	return fmt.Sprintf("%010d.%09d", mtime.Unix(), mtime.Nanosecond())
+}
+
+// Whether the stored modification time is mtime. Compared as numbers, since
+// not every tool pads the seconds as cshatag does.
+func tagTimeMatches(stored []byte, mtime time.Time) bool {
+	secs, nsecs, ok := strings.Cut(strings.TrimSpace(string(stored)), ".")
+	if !ok {
+		return false
+	}
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return false
+	}
+	ns, err := strconv.ParseInt(nsecs, 10, 64)
+	if err != nil {
+		return false
+	}
+	return s == mtime.Unix() && ns == int64(mtime.Nanosecond())
+}
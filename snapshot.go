@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// In folders are backed up from a snapshot (of their ZFS dataset or LVM
+// logical volume) if configured, so that what is verified and synced is
+// consistent, even if the folder changes during the run.
+
+// Snapshot dirs being backed up from, which cshatag can only read. A job's
+// destinations may be backed up at once, so it is locked.
+var snapshotDirs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+func isSnapshotDir(dir string) bool {
+	snapshotDirs.Lock()
+	defer snapshotDirs.Unlock()
+	return snapshotDirs.m[dir]
+}
+
+func setSnapshotDir(dir string, ok bool) {
+	snapshotDirs.Lock()
+	defer snapshotDirs.Unlock()
+	if ok {
+		snapshotDirs.m[dir] = true
+	} else {
+		delete(snapshotDirs.m, dir)
+	}
+}
+
+func validateSnapshot(c *config) error {
+	if !c.ZFS.Snapshot && !c.LVM.Snapshot {
+		return nil
+	}
+	if c.ZFS.Snapshot && c.LVM.Snapshot {
+		return errors.New("only one of ZFS Snapshot and LVM Snapshot can be set")
+	}
+	return nil
+}
+
+// Replaces the pair's in folder with a snapshot of it, if configured (and it
+// can be snapshotted). The returned func releases the snapshot, and does
+// nothing if run again.
+func snapshotSource(r *report, p folderPair) (folderPair, func() error, error) {
+	switch {
+	case cfg.ZFS.Snapshot:
+		return snapshotZFS(r, p)
+	case cfg.LVM.Snapshot:
+		return snapshotLVM(r, p)
+	}
+	return p, func() error { return nil }, nil
+}
+
+// For -validate-paths: how the pair's in folder would be snapshotted.
+func snapshotLines(p folderPair) []string {
+	if cfg.LVM.Snapshot {
+		return []string{lvmSnapshotLine(p)}
+	}
+	if !cfg.ZFS.Snapshot {
+		return nil
+	}
+	dataset, _, err := zfsDataset(p.In)
+	if err != nil {
+		return []string{fmt.Sprintf("snapshot: none, since it does not seem to be on a ZFS dataset (%s)", err)}
+	}
+	return []string{fmt.Sprintf("snapshot: of ZFS dataset %s, as @%s<date>", dataset, zfsRunPrefix)}
+}
+
+// Counts what is written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// Pipes the send command (e.g. zfs send) into the receive command, returning
+// how many bytes were sent. Each command is its name then args.
+func sendStream(sendDesc string, send []string, recvDesc string, recv []string) (int64, error) {
+	ctx, cancel := commandContext(send[0])
+	defer cancel()
+	sendCmd := exec.CommandContext(ctx, send[0], send[1:]...)
+	recvCmd := exec.CommandContext(ctx, recv[0], recv[1:]...)
+	var sendErr, recvErr bytes.Buffer
+	sendCmd.Stderr, recvCmd.Stderr = &sendErr, &recvErr
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer pr.Close()
+	var n byteCounter
+	sendCmd.Stdout = pw
+	recvCmd.Stdin = io.TeeReader(pr, &n)
+	logger.Debug("executing command", "command", send[0], "args", send[1:], "into", recv)
+	err = sendCmd.Start()
+	pw.Close()
+	if err != nil {
+		return 0, fmt.Errorf("could not run %s: %w", send[0], err)
+	}
+	err = recvCmd.Start()
+	if err != nil {
+		sendCmd.Process.Kill()
+		sendCmd.Wait()
+		return 0, fmt.Errorf("could not run %s: %w", recv[0], err)
+	}
+	// If the receive fails, closing the pipe stops the send
+	rErr := recvCmd.Wait()
+	pr.Close()
+	sErr := sendCmd.Wait()
+	if ctx.Err() != nil {
+		return int64(n), commandTimeoutErr(send[0], ctx)
+	}
+	var errs []error
+	if sErr != nil {
+		errs = append(errs, fmt.Errorf("%s failed: %w: %s", sendDesc, sErr, strings.TrimSpace(sendErr.String())))
+	}
+	if rErr != nil {
+		errs = append(errs, fmt.Errorf("%s failed: %w: %s", recvDesc, rErr, strings.TrimSpace(recvErr.String())))
+	}
+	return int64(n), errors.Join(errs...)
+}
+
+// Runs the command for its output (e.g. a listing), as lines. It is not
+// logged, but its stderr is in the error.
+func commandLines(desc string, name string, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(runCtx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", desc, err, strings.TrimSpace(stderr.String()))
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "" {
+		return nil, nil
+	}
+	return strings.Split(s, "\n"), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// Total size and number of entries (files, dirs, links...) under dir.
+func treeUsage(dir string) (bytes uint64, entries uint64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries++
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			bytes += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not walk %s: %w", dir, err)
+	}
+	return bytes, entries, nil
+}
+
+// Checks that the output filesystem has enough free bytes and inodes for what
+// the sync will add (plus the configured margins).
+func checkFreeSpace(r *report, inFolder string, outFolder string) error {
+	inBytes, inEntries, err := treeUsage(inFolder)
+	if err != nil {
+		return err
+	}
+	outBytes, outEntries, err := treeUsage(outFolder)
+	if err != nil {
+		return err
+	}
+	freeBytes, freeInodes, err := fsFree(outFolder)
+	if err != nil {
+		return err
+	}
+
+	needBytes := cfg.FreeBytesMargin
+	if inBytes > outBytes {
+		needBytes += inBytes - outBytes
+	}
+	needInodes := cfg.FreeInodesMargin
+	if inEntries > outEntries {
+		needInodes += inEntries - outEntries
+	}
+	lines := []string{
+		fmt.Sprintf("bytes: %d free, %d needed (with margin), %d headroom", freeBytes, needBytes, int64(freeBytes)-int64(needBytes)),
+		fmt.Sprintf("inodes: %d free, %d needed (with margin), %d headroom", freeInodes, needInodes, int64(freeInodes)-int64(needInodes)),
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Free space checked",
+		Detail: `Compares what the input folder would add to the output folder
+		with what is free on the output filesystem.`,
+		LogLines: lines,
+	})
+
+	if freeBytes < needBytes {
+		return fmt.Errorf("insufficient space on output filesystem: %d bytes free, %d needed", freeBytes, needBytes)
+	}
+	// Some filesystems (e.g. btrfs) report 0 inodes, since they allocate them dynamically
+	if freeInodes > 0 && freeInodes < needInodes {
+		return fmt.Errorf("insufficient inodes on output filesystem: %d free, %d needed", freeInodes, needInodes)
+	}
+	logger.Info("free space check passed",
+		"free_bytes", freeBytes,
+		"need_bytes", needBytes,
+		"free_inodes", freeInodes,
+		"need_inodes", needInodes)
+	return nil
+}
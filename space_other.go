@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func sameFilesystem(a string, b string) (bool, error) {
+	return false, fmt.Errorf("filesystem check is not supported on %s", runtime.GOOS)
+}
+
+func fsFree(dir string) (bytes uint64, inodes uint64, err error) {
+	return 0, 0, fmt.Errorf("free space check is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func sameFilesystem(a string, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	err := syscall.Stat(a, &sa)
+	if err != nil {
+		return false, fmt.Errorf("could not stat %s: %w", a, err)
+	}
+	err = syscall.Stat(b, &sb)
+	if err != nil {
+		return false, fmt.Errorf("could not stat %s: %w", b, err)
+	}
+	return sa.Dev == sb.Dev, nil
+}
+
+// Free bytes (for unprivileged users) and free inodes on the filesystem of dir.
+func fsFree(dir string) (bytes uint64, inodes uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not statfs %s: %w", dir, err)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Ffree), nil
+}
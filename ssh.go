@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// For out folders on another host: [user@]host:/path (synced with rsync over
+// ssh) or sftp:// URLs.
+type sshConfig struct {
+	// The binary to run (default ssh), and extra args for it.
+	Path      string
+	ExtraArgs []string
+
+	// The private key to log in with (only), the port (default ssh's, and
+	// overridden by an sftp:// URL's), and a known_hosts file to use instead
+	// of the user's.
+	KeyFile        string
+	Port           int
+	KnownHostsFile string
+	// Trust (and remember) the key of a host not in known_hosts yet, rather
+	// than failing. Keys which changed still fail.
+	AcceptNewHostKeys bool
+}
+
+// E.g. "nas:/srv/backup", "backup@nas:backup" (in the login dir) or
+// "backup@[fd00::1]:/srv". The host is at least 2 characters, so that it is
+// not mistaken for a drive letter - and host::module (for an rsync daemon) is
+// left to rsync.
+var remoteOutRe = regexp.MustCompile(`^((?:[^@/:\s]+@)?(?:[^@/:\s\[\]]{2,}|\[[0-9a-fA-F:.]+\])):([^:].*)?$`)
+
+// The [user@]host and path, if out is on another host for rsync over ssh.
+func remoteOut(out string) (string, string, bool) {
+	if _, ok := schemeKind(out); ok {
+		return "", "", false
+	}
+	m := remoteOutRe.FindStringSubmatch(out)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+func isRemote(out string) bool {
+	_, _, ok := remoteOut(out)
+	return ok
+}
+
+// out's subfolder, e.g. nas:/srv/photos for nas:/srv - or nas:photos for nas:.
+func remoteJoin(out string, sub string) string {
+	if strings.HasSuffix(out, ":") {
+		return out + sub
+	}
+	return strings.TrimSuffix(out, "/") + "/" + sub
+}
+
+// Args for ssh, as per the SSH config, before the host. BatchMode, since
+// there is no one to type a password (or accept a host key) in.
+func sshArgs(port string) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if port == "" && cfg.SSH.Port != 0 {
+		port = strconv.Itoa(cfg.SSH.Port)
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if cfg.SSH.KeyFile != "" {
+		args = append(args, "-i", cfg.SSH.KeyFile, "-o", "IdentitiesOnly=yes")
+	}
+	if cfg.SSH.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+cfg.SSH.KnownHostsFile)
+	}
+	if cfg.SSH.AcceptNewHostKeys {
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	return append(args, cfg.SSH.ExtraArgs...)
+}
+
+// rsync's -e arg, for remote out folders.
+func remoteShellArgs(p folderPair) []string {
+	if !isRemote(p.Out) {
+		return nil
+	}
+	words := []string{shellQuote(cfg.SSH.Path)}
+	for _, a := range sshArgs("") {
+		words = append(words, shellQuote(a))
+	}
+	return []string{"-e", strings.Join(words, " ")}
+}
+
+// The ssh command to run the command on the host (quoted for its shell).
+func remoteCommand(host string, port string, name string, args []string) (string, []string) {
+	words := []string{shellQuote(name)}
+	for _, a := range args {
+		words = append(words, shellQuote(a))
+	}
+	return cfg.SSH.Path, append(sshArgs(port), host, strings.Join(words, " "))
+}
+
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quotes s for sh (and rsync's -e), if need be.
+func shellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Changes to the remote dir (or stays in the login dir, if blank), exiting
+// with 10 if it can't.
+func remoteCd(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return "cd " + shellQuote(dir) + " || exit 10; "
+}
+
+// Runs the sh script on the host, turning its exit code into an error as per
+// failures (and ssh's 255 into a connection error).
+func runRemote(logDesc string, host string, script string, failures map[int]string) ([]string, error) {
+	args := append(sshArgs(""), host, script)
+	lines, err := execCommand(logDesc, cfg.SSH.Path, args...)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return lines, err
+	}
+	code := exitErr.ExitCode()
+	if code == 255 {
+		return lines, fmt.Errorf("could not connect to %s: %s", host, strings.Join(lines[:len(lines)-1], " "))
+	}
+	if code == 10 {
+		return lines, errors.New("no such folder")
+	}
+	if msg, ok := failures[code]; ok {
+		return lines, errors.New(msg)
+	}
+	return lines, err
+}
+
+// Like checkFolder, over ssh: checks for the smoke file, and that a test file
+// can be written, read and deleted.
+func checkRemote(host string, dir string) error {
+	testVal := rand.Int()
+	filename := fmt.Sprintf("testfile-%d.txt", testVal)
+	script := remoteCd(dir) +
+		fmt.Sprintf("test -e %s || exit 11; ", smokeFilename) +
+		fmt.Sprintf("echo %d > %s || exit 12; ", testVal, filename) +
+		fmt.Sprintf("cat %s || exit 13; ", filename) +
+		fmt.Sprintf("rm %s || exit 14", filename)
+	lines, err := runRemote("ssh:check", host, script, map[int]string{
+		11: "smoke file check err (maybe not mounted?)",
+		12: "write err",
+		13: "read err",
+		14: "cleanup err",
+	})
+	if err != nil {
+		return fmt.Errorf("%s:%s: %w", host, dir, err)
+	}
+	if !slices.Contains(lines, strconv.Itoa(testVal)) {
+		return fmt.Errorf("%s:%s: read check failed: different value (wanted %d, got %q)", host, dir, testVal, strings.Join(lines[:len(lines)-1], " "))
+	}
+	logger.Info("remote folder check passed", "host", host, "dir", dir)
+	return nil
+}
+
+// Like prepareSubfolders, over ssh.
+func prepareRemoteSubfolders(host string, dir string, pairs []folderPair) error {
+	script := remoteCd(dir) + fmt.Sprintf("test -e %s || exit 11", smokeFilename)
+	for _, p := range pairs {
+		_, subDir, _ := remoteOut(p.Out)
+		sub := shellQuote(path.Base(subDir))
+		smoke := sub + "/" + smokeFilename
+		script += fmt.Sprintf("; mkdir -p %s || exit 12; test -e %s || : > %s || exit 13", sub, smoke, smoke)
+	}
+	_, err := runRemote("ssh:subfolders", host, script, map[int]string{
+		11: "smoke file check err (maybe not mounted?)",
+		12: "could not create out subfolder",
+		13: "could not create smoke file in out subfolder",
+	})
+	if err != nil {
+		return fmt.Errorf("out folder: %s:%s: %w", host, dir, err)
+	}
+	return nil
+}
+
+func sshToolCheck() check {
+	_, err := exec.LookPath(cfg.SSH.Path)
+	return check{Name: cfg.SSH.Path + " installed", Err: err, Hint: "install an OpenSSH client (or set SSH Path)"}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Persisted between runs as JSON at cfg.StateFile.
+type state struct {
+	ConfigHash string
+	Config     map[string]any // Redacted
+	// Keyed hash of the secrets too, with the key for it (see secretsHash)
+	SecretsHash string `json:",omitempty"`
+	SecretsKey  string `json:",omitempty"`
+
+	// Set while a run backs up, and cleared once all its folders are backed
+	// up. So if it is set by the next run, that run was interrupted (or
+	// failed), and can be resumed.
+	Running *runState `json:",omitempty"`
+
+	// When each borg repository was last checked
+	Checked map[string]time.Time `json:",omitempty"`
+	// The snapshot last sent for each btrfs: pair ("<in> -> <out>"), as the
+	// parent for the next send
+	BtrfsParents map[string]string `json:",omitempty"`
+	// How many runs in a row each job's Offsite was skipped, as it was not
+	// due
+	OffsiteSkips map[string]int `json:",omitempty"`
+}
+
+type runState struct {
+	ID    string // Message-ID of its report
+	Start time.Time
+	Out   string // The output folder given, for subfolders
+	Pairs []folderPair
+	Done  []int // Indexes of the pairs backed up
+}
+
+// A missing state file is not an error - it is just a fresh state.
+func loadState() (*state, error) {
+	var st state
+	b, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	}
+	if err != nil {
+		return &st, fmt.Errorf("could not read state file %s: %w", cfg.StateFile, err)
+	}
+
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return &state{}, fmt.Errorf("could not parse state file %s: %w", cfg.StateFile, err)
+	}
+	return &st, nil
+}
+
+func saveState(st *state) error {
+	b, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %w", err)
+	}
+
+	// Write then rename, so that a crash never leaves a half-written state file
+	tmp := cfg.StateFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write state file %s: %w", tmp, err)
+	}
+	err = os.Rename(tmp, cfg.StateFile)
+	if err != nil {
+		return fmt.Errorf("could not replace state file %s: %w", cfg.StateFile, err)
+	}
+	return nil
+}
+
+// Records the config as loaded in the state (if record, so not for a dry
+// run), and reports on any change since the state was last saved. The flags' overrides are left out, so that a
+// one-off -mail-to or -exclude is not reported as a change (on that run, and
+// again on the next).
+func checkConfigChange(r *report, st *state, record bool) {
+	if st.SecretsKey == "" {
+		st.SecretsKey = newSecretsKey()
+	}
+	currHash := configHash(cfg.loaded)
+	currSecrets := secretsHash(cfg.loaded, st.SecretsKey)
+	currCfg := redactedConfig(cfg.loaded)
+	prevHash, prevSecrets, prevCfg := st.ConfigHash, st.SecretsHash, st.Config
+	if record {
+		st.ConfigHash, st.SecretsHash, st.Config = currHash, currSecrets, currCfg
+	}
+
+	if prevHash == "" {
+		logger.Info("no previous config recorded in state", "file", cfg.StateFile)
+		return
+	}
+	if prevHash == currHash && prevSecrets == currSecrets {
+		logger.Debug("config unchanged since last run")
+		return
+	}
+
+	diff := configDiff(prevCfg, currCfg)
+	if len(diff) == 0 {
+		if prevSecrets == "" {
+			// Recorded before secrets were hashed apart, so there is
+			// nothing to compare them with
+			logger.Debug("config unchanged since last run")
+			return
+		}
+		diff = []string{"Only secret values changed"}
+	}
+	logger.Warn("config changed since last run", "fields", len(diff))
+	r.Sections = append(r.Sections, section{
+		Title:    "Configuration changed since last run",
+		Detail:   "The config files differ from those recorded in the previous run (flags are left out). Secret values are redacted.",
+		LogLines: diff,
+	})
+}
+
+// Like saveState, but only warns on failure - since the state is not needed
+// for the backup itself.
+func updateState(st *state) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	err := saveState(st)
+	if err != nil {
+		logger.Warn("could not save state", "err", err.Error())
+	}
+}
+
+// Guards the state's maps and file, which a job's destinations backed up at
+// once share.
+var stateMu sync.Mutex
+
+// Records that the pair of the running run is backed up.
+func markPairDone(st *state, i int) {
+	if st.Running == nil {
+		return
+	}
+	st.Running.Done = append(st.Running.Done, i)
+	updateState(st)
+}
+
+// The pairs of the interrupted run in the state which were not backed up yet,
+// and its output folder. The run's report replies to the interrupted run's.
+func resumeRun(r *report, rec *historyRecord, st *state) ([]folderPair, string, error) {
+	run := st.Running
+	if run == nil {
+		return nil, "", fmt.Errorf("no interrupted run recorded in state file %s", cfg.StateFile)
+	}
+	done := map[int]bool{}
+	var doneLines []string
+	for _, i := range run.Done {
+		if i < len(run.Pairs) {
+			done[i] = true
+			doneLines = append(doneLines, run.Pairs[i].title())
+		}
+	}
+	var pairs []folderPair
+	for i, p := range run.Pairs {
+		if !done[i] {
+			pairs = append(pairs, p)
+		}
+	}
+
+	cfg.resume = true
+	rec.ResumeOf, r.InReplyTo = run.ID, run.ID
+	logger.Info("resuming interrupted run", "id", run.ID, "remaining", len(pairs))
+	r.Sections = append(r.Sections, section{
+		Title: "Resuming interrupted run",
+		Detail: fmt.Sprintf("This resumes the run started at %s (report %s), with rsync --partial. These were already backed up:",
+			run.Start.Format(time.RFC3339), run.ID),
+		LogLines: doneLines,
+	})
+	return pairs, run.Out, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// The native checksum engine keeps its checksums in the same xattrs as
+// cshatag, so that either can check what the other stored.
+const tagStoreDesc = "xattrs"
+
+func getTag(path string, name string) ([]byte, error) {
+	v, err := getXattr(path, name)
+	if errors.Is(err, unix.ENODATA) {
+		return nil, fs.ErrNotExist
+	}
+	return v, err
+}
+
+func setTag(path string, name string, value []byte) error {
+	return setXattr(path, name, value)
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !linux
+
+package main
+
+import (
+	"errors"
+)
+
+const tagStoreDesc = ""
+
+func getTag(path string, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setTag(path string, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// The native checksum engine keeps its checksums in NTFS alternate data
+// streams, named as cshatag's xattrs are. robocopy (and Explorer) copy them
+// with the file.
+const tagStoreDesc = "NTFS streams"
+
+func getTag(path string, name string) ([]byte, error) {
+	return os.ReadFile(path + ":" + name)
+}
+
+func setTag(path string, name string, value []byte) error {
+	return os.WriteFile(path+":"+name, value, 0644)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Writes in blocks of exactly len(buf) bytes (e.g. the block size of a tape
+// drive, in fixed block mode), padding the last with zeros on Flush.
+type blockWriter struct {
+	w       io.Writer
+	buf     []byte
+	n       int
+	blocks  int64
+	padding int
+}
+
+func newBlockWriter(w io.Writer, size int) *blockWriter {
+	return &blockWriter{w: w, buf: make([]byte, size)}
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		p = p[n:]
+		written += n
+		if b.n == len(b.buf) {
+			err := b.writeBlock()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) writeBlock() error {
+	_, err := b.w.Write(b.buf)
+	b.n = 0
+	b.blocks++
+	return err
+}
+
+func (b *blockWriter) Flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.padding = len(b.buf) - b.n
+	clear(b.buf[b.n:])
+	return b.writeBlock()
+}
+
+// The Tar StreamCommand to run for the device, with {} replaced by its path.
+func streamCommandArgs(device string) []string {
+	args := make([]string, len(cfg.Tar.StreamCommand))
+	for i, a := range cfg.Tar.StreamCommand {
+		args[i] = strings.ReplaceAll(a, "{}", device)
+	}
+	return args
+}
+
+// Opens the FIFO or device to stream into: directly, or via the Tar
+// StreamCommand (e.g. mbuffer), which is then waited for on Close.
+func openStream(device string) (io.WriteCloser, error) {
+	if len(cfg.Tar.StreamCommand) == 0 {
+		return os.OpenFile(device, os.O_WRONLY, 0)
+	}
+	args := streamCommandArgs(device)
+	return startPipeCmd(args[0], args[1:], io.Discard)
+}
+
+// How a stream is written and catalogued, for -validate-paths.
+func streamLines(t tarTarget) []string {
+	var lines []string
+	if cfg.Tar.BlockSizeKB > 0 {
+		lines = append(lines, fmt.Sprintf("block size: %d KiB", cfg.Tar.BlockSizeKB))
+	}
+	if len(cfg.Tar.StreamCommand) > 0 {
+		lines = append(lines, fmt.Sprintf("written via: %s", strings.Join(streamCommandArgs(t.path), " ")))
+	}
+	label := "none"
+	switch {
+	case cfg.tapeLabel != "":
+		label = cfg.tapeLabel
+	case len(cfg.Tar.TapeLabelCommand) > 0:
+		label = "as printed by " + strings.Join(cfg.Tar.TapeLabelCommand, " ")
+	}
+	return append(lines, fmt.Sprintf("catalog: %s (tape label %s)", cfg.Tar.CatalogFile, label))
+}
+
+// The label of the tape (or other medium) being written to: as given with
+// -tape-label, else the first line the Tar TapeLabelCommand prints (e.g. a
+// barcode), else none.
+func tapeLabel() (string, error) {
+	if cfg.tapeLabel != "" {
+		return cfg.tapeLabel, nil
+	}
+	c := cfg.Tar.TapeLabelCommand
+	if len(c) == 0 {
+		return "", nil
+	}
+	lines, err := commandLines("tape label command", c[0], c[1:]...)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) == "" {
+		return "", errors.New("tape label command printed no label")
+	}
+	return strings.TrimSpace(lines[0]), nil
+}
+
+// One line (as JSON) in the Tar CatalogFile per stream written, so that what
+// is on which tape can be found again.
+type catalogEntry struct {
+	Time        time.Time
+	Label       string `json:",omitempty"` // Of the tape
+	Device      string
+	Job         string `json:",omitempty"`
+	In          string
+	Files       int
+	Bytes       int64 // Of the archive, without the last block's padding
+	BlockSize   int   `json:",omitempty"`
+	SHA256      string
+	Index       string // The index file, of every file's SHA-256
+	Compression string
+	Encryption  string `json:",omitempty"`
+	Tag         string `json:",omitempty"` // Given with -tag
+}
+
+func appendCatalog(e catalogEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal catalog entry: %w", err)
+	}
+	f, err := os.OpenFile(cfg.Tar.CatalogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open catalog file %s: %w", cfg.Tar.CatalogFile, err)
+	}
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not write catalog file %s: %w", cfg.Tar.CatalogFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// For out folders given as tar:<path>: the in folder is written as one tar
+// archive, rather than mirrored. If the path is a dir (or ends with /), each
+// run writes a new <name>-<date>.tar archive in it. Otherwise it is the
+// archive itself (written via a temp file), or a FIFO or device (e.g. a tape
+// drive) to stream it into.
+type tarConfig struct {
+	// none, gzip or zstd (via the zstd binary). Default as per the archive's
+	// extension (.gz, .tgz or .zst), else none.
+	Compression string
+	// The compression level (default the compressor's), and the zstd binary
+	// to run (default zstd).
+	Level    int
+	ZstdPath string
+	// Archives written into a dir are pruned to the newest Keep (0 keeps all).
+	Keep int
+	// Where the index and checksum files go for FIFOs and devices (default the
+	// LogDir). For files, they go beside the archive.
+	IndexDir string
+
+	// For FIFOs and devices: the archive is written in blocks of exactly this
+	// size (e.g. the tape drive's), the last padded with zeros. Default 1 MiB
+	// writes, unpadded.
+	BlockSizeKB int
+	// Writes the stream to the device via this command (with {} replaced by
+	// the device's path), rather than directly, e.g. ["mbuffer", "-q", "-m",
+	// "1G", "-o", "{}"] to keep a tape drive streaming.
+	StreamCommand []string
+	// Each stream written is recorded as a line of JSON in the CatalogFile,
+	// with the label of its tape: as given with -tape-label, else the first
+	// line the TapeLabelCommand prints (e.g. the barcode, from mtx).
+	CatalogFile      string
+	TapeLabelCommand []string
+}
+
+const tarScheme = "tar:"
+
+// The archive path (or dir), if out is a tar destination.
+func tarArchive(out string) (string, bool) {
+	return strings.CutPrefix(out, tarScheme)
+}
+
+func isArchive(out string) bool {
+	_, ok := tarArchive(out)
+	return ok
+}
+
+func validateTar(c *config) error {
+	switch c.Tar.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return fmt.Errorf("Tar Compression must be none, gzip or zstd, not %q", c.Tar.Compression)
+	}
+	if c.Tar.Level < 0 || c.Tar.Level > 19 {
+		return fmt.Errorf("Tar Level must be between 1 and 19, not %d", c.Tar.Level)
+	}
+	if c.Tar.Compression == "gzip" && c.Tar.Level > 9 {
+		return fmt.Errorf("Tar Level must be between 1 and 9 for gzip, not %d", c.Tar.Level)
+	}
+	if c.Tar.Keep < 0 {
+		return fmt.Errorf("Tar Keep must not be negative, not %d", c.Tar.Keep)
+	}
+	if c.Tar.BlockSizeKB < 0 || c.Tar.BlockSizeKB > 16384 {
+		return fmt.Errorf("Tar BlockSizeKB must be between 0 and 16384, not %d", c.Tar.BlockSizeKB)
+	}
+	if len(c.Tar.StreamCommand) > 0 && !slices.ContainsFunc(c.Tar.StreamCommand, func(a string) bool { return strings.Contains(a, "{}") }) {
+		return errors.New("Tar StreamCommand must have {} in its args, for the device to write to")
+	}
+	return nil
+}
+
+// Where (and how) the pair's archive is written.
+type tarTarget struct {
+	path        string
+	stream      bool   // A FIFO or device, rather than a file
+	dir         string // Set if the archive was named for this run in it
+	prefix      string // Of the archives in dir (for pruning)
+	compression string
+	ext         string
+	index       string // Paths for the index and checksum files
+	sum         string
+}
+
+func resolveTarTarget(p folderPair, now time.Time) (tarTarget, error) {
+	out, _ := tarArchive(p.Out)
+	if out == "" {
+		return tarTarget{}, errors.New("no archive path given after tar:")
+	}
+	t := tarTarget{path: out, compression: cfg.Tar.Compression}
+	info, err := os.Stat(out)
+	isDir := strings.HasSuffix(out, "/") || (err == nil && info.IsDir())
+	if !isDir && t.compression == "" {
+		name := strings.TrimSuffix(out, encryptionExt())
+		switch {
+		case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+			t.compression = "gzip"
+		case strings.HasSuffix(name, ".zst"):
+			t.compression = "zstd"
+		}
+	}
+	if t.compression == "" {
+		t.compression = "none"
+	}
+	t.ext = map[string]string{"none": ".tar", "gzip": ".tar.gz", "zstd": ".tar.zst"}[t.compression] + encryptionExt()
+
+	switch {
+	case isDir:
+		t.dir = filepath.Clean(out)
+		name := p.Name
+		if name == "" {
+			abs, _ := filepath.Abs(p.live())
+			name = filepath.Base(abs)
+		}
+		t.prefix = name + "-"
+		t.path = filepath.Join(t.dir, t.prefix+now.UTC().Format(logDateFormat)+t.ext)
+	case err == nil && !info.Mode().IsRegular():
+		t.stream = true
+	}
+	if t.stream {
+		dir := firstNonEmpty(cfg.Tar.IndexDir, cfg.LogDir)
+		base := filepath.Join(dir, filepath.Base(t.path)+"-"+now.UTC().Format(logDateFormat)+t.ext)
+		t.index, t.sum = base+".index.sha256", base+".sha256"
+	} else {
+		t.index, t.sum = t.path+".index.sha256", t.path+".sha256"
+	}
+	return t, nil
+}
+
+// The folder the archive is written into, which is checked as an out folder.
+func (t tarTarget) folder() string {
+	if t.dir != "" {
+		return t.dir
+	}
+	return filepath.Dir(t.path)
+}
+
+// Writes the in folder as a tar archive, with an index of its files' SHA-256s
+// (as read by sha256sum -c, once extracted) and the archive's own SHA-256.
+type tarBackend struct {
+	t     tarTarget
+	label string // Of the tape, for streams
+}
+
+func openTar(out string, st *state) (backend, error) {
+	return &tarBackend{}, nil
+}
+
+// The archive is named once the pair is known: after its live in folder, if
+// snapshotted.
+func (b *tarBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	t, err := resolveTarTarget(p, time.Now())
+	if err != nil {
+		return p, withExitCode(exitConfig, fmt.Errorf("out: %w", err))
+	}
+	b.t = t
+	if !t.stream {
+		err = withRunTimeout("folder check", func() error { return checkFolder(t.folder()) })
+		if err != nil {
+			return p, withExitCode(exitFolderCheck, fmt.Errorf("out folder: %w", err))
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("%s: OK", p.live()),
+		fmt.Sprintf("%s: OK", t.folder()),
+	}
+	if t.stream {
+		b.label, err = tapeLabel()
+		if err != nil {
+			return p, withExitCode(exitFolderCheck, fmt.Errorf("out: %w", err))
+		}
+		if b.label != "" {
+			lines = append(lines, fmt.Sprintf("tape label: %s", b.label))
+		}
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Folders checked",
+		Detail: `This test tries to write, read, and delete a temporary file
+		in both the input folder and the folder the archive is written to. It
+		also checks for the existence of .backup-helper-check files.`,
+		LogLines: lines,
+	})
+	return p, nil
+}
+
+func (b *tarBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "archived")
+}
+
+func (b *tarBackend) Sync(r *report, rec *historyRecord, p folderPair) (err error) {
+	t := b.t
+	start := time.Now()
+	defer func() {
+		recordStep("archive", nil, start, err)
+	}()
+	if cfg.dryRun {
+		files, bytes, skipped, err := tarFiles(p)
+		if err != nil {
+			return withExitCode(exitRsync, err)
+		}
+		detail := fmt.Sprintf("Would write %d file(s) (%s) to %s, compressed with %s. Skipped %d special file(s).", files, humanBytes(float64(bytes)), t.path, t.compression, skipped)
+		if t.stream && b.label != "" {
+			detail += fmt.Sprintf(" It would be catalogued as on tape %s.", b.label)
+		}
+		r.Sections = append(r.Sections, section{Title: "Archive (dry run)", Detail: detail})
+		return nil
+	}
+
+	res, err := writeTar(p, t)
+	if err != nil {
+		if errors.Is(err, errCshatagMismatch) || errors.Is(err, errDecryptCheck) {
+			return withExitCode(exitCorruption, fmt.Errorf("archive %s failed: %w", t.path, err))
+		}
+		return withExitCode(exitRsync, fmt.Errorf("archive %s failed: %w", t.path, err))
+	}
+	rec.BytesSent += uint64(res.archiveBytes)
+	rec.FilesCreated += res.files
+	if t.dir != "" {
+		for _, suffix := range []string{"", ".sha256", ".index.sha256"} {
+			pruneFiles(filepath.Join(t.dir, t.prefix+"*"+t.ext+suffix), cfg.Tar.Keep)
+		}
+	}
+
+	lines := []string{
+		fmt.Sprintf("archive: %s (%s, compressed with %s)", t.path, humanBytes(float64(res.archiveBytes)), t.compression),
+		fmt.Sprintf("sha256: %s (in %s)", res.sum, t.sum),
+		fmt.Sprintf("index: %s (%d file(s), %s)", t.index, res.files, humanBytes(float64(res.fileBytes))),
+	}
+	if encrypting() {
+		switch {
+		case res.verified:
+			lines = append(lines, fmt.Sprintf("encrypted with %s, and test-decrypted OK", cfg.Encryption.Tool))
+		case cfg.Encryption.Verify:
+			lines = append(lines, fmt.Sprintf("encrypted with %s (not test-decrypted, since it was streamed)", cfg.Encryption.Tool))
+		default:
+			lines = append(lines, fmt.Sprintf("encrypted with %s", cfg.Encryption.Tool))
+		}
+	}
+	if res.skipped > 0 {
+		lines = append(lines, fmt.Sprintf("skipped %d special file(s) (e.g. sockets or devices), which can't be archived", res.skipped))
+	}
+	if res.blocks > 0 {
+		lines = append(lines, fmt.Sprintf("written in %d block(s) of %d KiB, the last padded with %d zero byte(s)", res.blocks, cfg.Tar.BlockSizeKB, res.padding))
+	}
+	if t.stream {
+		e := catalogEntry{
+			Time:        start.UTC(),
+			Label:       b.label,
+			Device:      t.path,
+			Job:         p.Name,
+			In:          p.live(),
+			Files:       res.files,
+			Bytes:       res.archiveBytes,
+			BlockSize:   cfg.Tar.BlockSizeKB << 10,
+			SHA256:      res.sum,
+			Index:       t.index,
+			Compression: t.compression,
+			Tag:         cfg.tag,
+		}
+		if encrypting() {
+			e.Encryption = cfg.Encryption.Tool
+		}
+		err = appendCatalog(e)
+		if err != nil {
+			return withExitCode(exitRsync, fmt.Errorf("archive %s was written, but not catalogued: %w", t.path, err))
+		}
+		label := ""
+		if b.label != "" {
+			label = fmt.Sprintf(" as on tape %s", b.label)
+		}
+		lines = append(lines, fmt.Sprintf("catalogued in %s%s", cfg.Tar.CatalogFile, label))
+	}
+	lines = append(lines, "<end of logs>")
+	detail := fmt.Sprintf("Wrote the input folder as a tar archive. %s", throughput(uint64(res.fileBytes), time.Since(start)))
+	if t.dir != "" {
+		detail += fmt.Sprintf(" Verify it with sha256sum -c %s from within %s.", filepath.Base(t.sum), t.dir)
+	}
+	r.Sections = append(r.Sections, section{Title: "Archive written", Detail: detail, LogLines: lines})
+	logger.Info("folder archived", "in", p.In, "archive", t.path, "sha256", res.sum)
+	return nil
+}
+
+func (b *tarBackend) Cleanup(r *report) error {
+	return nil
+}
+
+// The regular files (and their bytes) which would be archived, and how many
+// special files would be skipped.
+func tarFiles(p folderPair) (int, int64, int, error) {
+	files, skipped := 0, 0
+	var bytes int64
+	err := walkTar(p, func(rel string, fp string, info fs.FileInfo) error {
+		if info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	}, &skipped)
+	return files, bytes, skipped, err
+}
+
+// Calls f for each dir, regular file and symlink in the in folder (minus
+// Excludes), parents first, counting the special files skipped.
+func walkTar(p folderPair, f func(rel string, fp string, info fs.FileInfo) error, skipped *int) error {
+	return filepath.WalkDir(p.In, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.In, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(p, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			*skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return f(rel, fp, info)
+	})
+}
+
+type tarResult struct {
+	files        int
+	fileBytes    int64
+	skipped      int
+	archiveBytes int64 // Without any block padding
+	sum          string
+	verified     bool // Test-decrypted
+	blocks       int64
+	padding      int
+}
+
+// Counts and hashes what is written through it.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (hw *hashWriter) Write(b []byte) (int, error) {
+	n, err := hw.w.Write(b)
+	hw.h.Write(b[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+func writeTar(p folderPair, t tarTarget) (res tarResult, err error) {
+	path := t.path
+	if !t.stream {
+		path = t.path + ".tmp"
+		defer os.Remove(path)
+	}
+	var f io.WriteCloser
+	if t.stream {
+		f, err = openStream(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	}
+	if err != nil {
+		return res, fmt.Errorf("could not open: %w", err)
+	}
+	defer f.Close()
+	var bw interface {
+		io.Writer
+		Flush() error
+	}
+	var blocks *blockWriter
+	if t.stream && cfg.Tar.BlockSizeKB > 0 {
+		blocks = newBlockWriter(f, cfg.Tar.BlockSizeKB<<10)
+		bw = blocks
+	} else {
+		bw = bufio.NewWriterSize(f, 1<<20)
+	}
+	out := &hashWriter{w: bw, h: sha256.New()}
+
+	// The encryption (if any) and then the compressor, between the tar writer
+	// and the file. plain is what is encrypted, for the test decrypt.
+	var enc io.WriteCloser = nopWriteCloser{out}
+	plain := out
+	if encrypting() {
+		pc, err := startPipeCmd(encryptionPath(), encryptArgs(), out)
+		if err != nil {
+			return res, err
+		}
+		defer pc.Close()
+		enc = pc
+		plain = &hashWriter{w: pc, h: sha256.New()}
+	}
+	var comp io.WriteCloser
+	switch t.compression {
+	case "gzip":
+		level := gzip.DefaultCompression
+		if cfg.Tar.Level > 0 {
+			level = cfg.Tar.Level
+		}
+		comp, err = gzip.NewWriterLevel(plain, level)
+		if err != nil {
+			return res, err
+		}
+	case "zstd":
+		args := []string{"-q", "-c", "-T0"}
+		if cfg.Tar.Level > 0 {
+			args = append(args, fmt.Sprintf("-%d", cfg.Tar.Level))
+		}
+		pc, err := startPipeCmd(cfg.Tar.ZstdPath, args, plain)
+		if err != nil {
+			return res, err
+		}
+		defer pc.Close()
+		comp = pc
+	default:
+		comp = nopWriteCloser{plain}
+	}
+
+	var index bytes.Buffer
+	tw := tar.NewWriter(comp)
+	err = walkTar(p, func(rel string, fp string, info fs.FileInfo) error {
+		if err := runCtx.Err(); err != nil {
+			return err
+		}
+		sum, err := addTarEntry(tw, rel, fp, info)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if info.Mode().IsRegular() {
+			res.files++
+			res.fileBytes += info.Size()
+			index.WriteString(manifestLine(sum, rel))
+		}
+		return nil
+	}, &res.skipped)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = comp.Close()
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if _, ok := f.(*pipeCmd); ok && err != nil {
+		// Why the stream command stopped reading, e.g. the tape being full
+		err = errors.Join(err, f.Close())
+	}
+	if err != nil {
+		return res, err
+	}
+	res.archiveBytes = out.n
+	res.sum = hex.EncodeToString(out.h.Sum(nil))
+	if blocks != nil {
+		res.blocks, res.padding = blocks.blocks, blocks.padding
+	}
+	if encrypting() && cfg.Encryption.Verify && !t.stream {
+		err = verifyEncryptedArchive(path, hex.EncodeToString(plain.h.Sum(nil)))
+		if err != nil {
+			return res, err
+		}
+		res.verified = true
+	}
+
+	err = writeFileAtomic(t.index, index.Bytes())
+	if err != nil {
+		return res, fmt.Errorf("could not write index: %w", err)
+	}
+	err = writeFileAtomic(t.sum, []byte(manifestLine(res.sum, filepath.Base(t.path))))
+	if err != nil {
+		return res, fmt.Errorf("could not write checksum: %w", err)
+	}
+	if !t.stream {
+		err = os.Rename(path, t.path)
+		if err != nil {
+			return res, fmt.Errorf("could not move archive into place: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// Adds the entry (with its xattrs, so that cshatag's checksums travel with
+// it), and returns the SHA-256 of a regular file's content - which must match
+// cshatag's, if it stored one for the file's current mtime.
+func addTarEntry(tw *tar.Writer, rel string, fp string, info fs.FileInfo) (string, error) {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(fp)
+		if err != nil {
+			return "", err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return "", err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if info.Mode().IsRegular() || info.IsDir() {
+		names, _ := listXattrs(fp)
+		for _, name := range names {
+			val, err := getXattr(fp, name)
+			if err != nil {
+				return "", fmt.Errorf("could not read xattr %s: %w", name, err)
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(val)
+			hdr.Format = tar.FormatPAX
+		}
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", err
+	}
+
+	file, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(file, info.Size()))
+	if err != nil {
+		return "", err
+	}
+	if n != info.Size() {
+		return "", fmt.Errorf("shrank from %d to %d bytes while archiving", info.Size(), n)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if tagged, ok := cshatagSum(fp, info.ModTime()); ok && tagged != sum {
+		return "", fmt.Errorf("%w (%s, but read %s) - the file may be corrupt, or changed while archiving", errCshatagMismatch, tagged, sum)
+	}
+	return sum, nil
+}
+
+// Test-decrypts the archive, which must give back what was encrypted.
+func verifyEncryptedArchive(path string, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got, err := testDecrypt(f)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errDecryptCheck, err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: decrypted to sha256 %s, not %s", errDecryptCheck, got, want)
+	}
+	logger.Info("archive test-decrypted", "archive", path)
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Writes via a temp file, so that a partial file is never left in place.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
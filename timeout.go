@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// How long each cleanup command gets (see execCleanup), however long the run
+// had left.
+const cleanupTimeout = 5 * time.Minute
+
+// Done once the run's timeout (if any) is up. The mail is not sent under it,
+// so that a timed out run still gets its report.
+var runCtx = context.Background()
+
+// Starts the run's timeout: the -timeout flag, else TimeoutSeconds. The
+// returned func ends it, so that e.g. the disconnect command can still run.
+func startRunTimeout(opts options) (stop func()) {
+	t := opts.Timeout
+	if t == 0 {
+		t = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	if t <= 0 {
+		return func() {}
+	}
+	logger.Debug("run timeout set", "timeout", t.String())
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	runCtx = ctx
+	return func() {
+		cancel()
+		runCtx = context.Background()
+	}
+}
+
+// The context to run the command under: the run's, with the step timeout for
+// cshatag or rsync (if set).
+func commandContext(name string) (context.Context, context.CancelFunc) {
+	secs := 0
+	switch name {
+	case cfg.CshatagPath:
+		secs = cfg.CshatagTimeoutSeconds
+	case cfg.RsyncPath:
+		secs = cfg.RsyncTimeoutSeconds
+	}
+	if secs <= 0 {
+		return context.WithCancel(runCtx)
+	}
+	return context.WithTimeout(runCtx, time.Duration(secs)*time.Second)
+}
+
+// Says which timeout stopped the command.
+func commandTimeoutErr(name string, ctx context.Context) error {
+	if runCtx.Err() != nil {
+		return fmt.Errorf("command %s stopped by the run timeout: %w", name, runCtx.Err())
+	}
+	return fmt.Errorf("command %s stopped by its step timeout: %w", name, ctx.Err())
+}
+
+// Runs f, but gives up once the run times out - e.g. if f is stuck on a hung
+// mount, which can't be interrupted. f is then left running.
+func withRunTimeout(desc string, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-runCtx.Done():
+		return fmt.Errorf("%s stopped by the run timeout: %w", desc, runCtx.Err())
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Renders a compact live status of the running commands, fed by the same
+// output as the log. Only used when stdout is a terminal.
+type tui struct {
+	Out io.Writer
+
+	cmds     map[string]*tuiCmd
+	rendered int // Lines drawn last time, to be redrawn over
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+type tuiCmd struct {
+	start time.Time
+	lines int
+	last  string
+	curr  strings.Builder
+}
+
+func newTUI(out io.Writer) *tui {
+	t := &tui{
+		Out:  out,
+		cmds: map[string]*tuiCmd{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func (t *tui) loop() {
+	defer close(t.done)
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.render()
+		case <-t.stop:
+			t.render()
+			return
+		}
+	}
+}
+
+// Stops rendering, leaving the last status on screen.
+func (t *tui) Stop() {
+	close(t.stop)
+	<-t.done
+}
+
+// Returns a writer for the command's output.
+func (t *tui) Start(desc string) io.Writer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cmds[desc] = &tuiCmd{start: time.Now()}
+	return &tuiCmdWriter{t: t, desc: desc}
+}
+
+func (t *tui) Done(desc string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.cmds, desc)
+}
+
+func (t *tui) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+	// Go back over what was drawn before
+	if t.rendered > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", t.rendered)
+	}
+	descs := make([]string, 0, len(t.cmds))
+	for d := range t.cmds {
+		descs = append(descs, d)
+	}
+	sort.Strings(descs)
+	lines := []string{fmt.Sprintf("backup-helper: %d command(s) running", len(descs))}
+	for _, d := range descs {
+		c := t.cmds[d]
+		lines = append(lines, fmt.Sprintf("  [%s] %s, %d lines: %s",
+			d, time.Since(c.start).Round(time.Second), c.lines, truncate(c.last, 60)))
+	}
+	// Clear any lines left over from a taller render
+	for len(lines) < t.rendered {
+		lines = append(lines, "")
+	}
+	for _, l := range lines {
+		fmt.Fprintf(&b, "\x1b[2K%s\n", l)
+	}
+	t.rendered = len(lines)
+	io.WriteString(t.Out, b.String())
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
+
+type tuiCmdWriter struct {
+	t    *tui
+	desc string
+}
+
+func (w *tuiCmdWriter) Write(p []byte) (n int, err error) {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+	c, ok := w.t.cmds[w.desc]
+	if !ok {
+		return len(p), nil
+	}
+
+	for _, b := range p {
+		// Progress output uses \r to redraw the same line
+		if b == '\n' || b == '\r' {
+			if c.curr.Len() > 0 {
+				c.last = c.curr.String()
+				c.curr.Reset()
+			}
+			if b == '\n' {
+				c.lines++
+			}
+			continue
+		}
+		c.curr.WriteByte(b)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// For out folders given as davs://host/path (or dav://, without TLS), e.g. a
+// Nextcloud or ownCloud folder: davs://cloud.lan/remote.php/dav/files/bob/Backup.
+type webdavConfig struct {
+	// Basic auth. The User defaults to the URL's. The Password (an app
+	// password, for Nextcloud) may be a secret reference, or given as a
+	// command or OS keyring entry instead (as for MailPass).
+	User            string
+	Password        string
+	PasswordCommand []string
+	PasswordKeyring *keyringRef
+}
+
+const (
+	davScheme  = "dav://"
+	davsScheme = "davs://"
+)
+
+type webdavStore struct {
+	url  string
+	base *url.URL // Path ends with /
+	user string
+	pass string
+
+	// From the last list (or put), so that a file changed on the server since
+	// is not overwritten
+	etags map[string]string
+	dirs  map[string]bool // Made (or found) already
+}
+
+// The store for out, if it is a dav:// or davs:// URL.
+func webdavDestination(out string) (*webdavStore, bool, error) {
+	scheme := ""
+	switch {
+	case strings.HasPrefix(out, davScheme):
+		scheme = "http"
+	case strings.HasPrefix(out, davsScheme):
+		scheme = "https"
+	default:
+		return nil, false, nil
+	}
+	u, err := url.Parse(out)
+	if err != nil || u.Host == "" {
+		return nil, true, fmt.Errorf("invalid WebDAV destination %q: expect davs://host/path", out)
+	}
+	u.Scheme = scheme
+	s := &webdavStore{url: out, user: cfg.WebDAV.User, pass: cfg.WebDAV.Password, etags: map[string]string{}, dirs: map[string]bool{}}
+	if u.User != nil && s.user == "" {
+		s.user = u.User.Username()
+	}
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	u.RawPath = ""
+	s.base = u
+	return s, true, nil
+}
+
+func (s *webdavStore) String() string {
+	return s.url
+}
+
+// A non-2xx response.
+type httpStatusError struct {
+	Code   int
+	Status string
+	Method string
+	Path   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+func isHTTPStatus(err error, codes ...int) bool {
+	var sErr *httpStatusError
+	if !errors.As(err, &sErr) {
+		return false
+	}
+	for _, c := range codes {
+		if sErr.Code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the request for the path (relative to the base), failing on a
+// non-2xx status.
+func (s *webdavStore) do(method string, rel string, headers map[string]string, body io.Reader, size int64) (*http.Response, error) {
+	u := s.base.JoinPath(rel)
+	req, err := http.NewRequestWithContext(runCtx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	logger.Debug("webdav request", "method", method, "url", u.Redacted())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &httpStatusError{Code: resp.StatusCode, Status: resp.Status, Method: method, Path: u.Path}
+	}
+	return resp, nil
+}
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><d:resourcetype/><d:getcontentlength/><d:getetag/><oc:checksums/></d:prop>
+</d:propfind>`
+
+type davResource struct {
+	key        string // Relative to the base
+	collection bool
+	size       int64
+	etag       string
+	checksums  []string // E.g. "SHA1:abc... MD5:def...", from ownCloud and Nextcloud
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				ETag          string `xml:"DAV: getetag"`
+				Checksums     struct {
+					Checksum []string `xml:"http://owncloud.org/ns checksum"`
+				} `xml:"http://owncloud.org/ns checksums"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// The resource at rel and (with depth 1) its members.
+func (s *webdavStore) propfind(rel string, depth string) ([]davResource, error) {
+	resp, err := s.do("PROPFIND", rel, map[string]string{"Depth": depth, "Content-Type": "application/xml"},
+		strings.NewReader(davPropfind), int64(len(davPropfind)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms davMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse PROPFIND response for %s: %w", rel, err)
+	}
+	var res []davResource
+	for _, r := range ms.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response: %w", r.Href, err)
+		}
+		key, ok := strings.CutPrefix(u.Path, s.base.Path)
+		if !ok && u.Path+"/" != s.base.Path {
+			continue
+		}
+		d := davResource{key: strings.TrimSuffix(key, "/")}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			d.collection = d.collection || ps.Prop.ResourceType.Collection != nil
+			d.size = max(d.size, ps.Prop.ContentLength)
+			d.etag = firstNonEmpty(d.etag, ps.Prop.ETag)
+			d.checksums = append(d.checksums, ps.Prop.Checksums.Checksum...)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// Every file under the base, walking one collection at a time, since many
+// servers refuse Depth: infinity.
+func (s *webdavStore) list() (map[string]storedObject, error) {
+	objs := map[string]storedObject{}
+	s.etags = map[string]string{}
+	pending := []string{""}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+		rel := dir
+		if rel != "" {
+			rel += "/"
+		}
+		members, err := s.propfind(rel, "1")
+		if err != nil {
+			return nil, err
+		}
+		s.dirs[dir] = true
+		for _, m := range members {
+			if m.key == dir {
+				continue
+			}
+			if m.collection {
+				pending = append(pending, m.key)
+				continue
+			}
+			objs[m.key] = storedObject{Size: m.size}
+			s.etags[m.key] = m.etag
+		}
+	}
+	return objs, nil
+}
+
+// Makes the collection and its parents, as needed.
+func (s *webdavStore) mkcolAll(dir string) error {
+	if dir == "." || dir == "" || s.dirs[dir] {
+		return nil
+	}
+	err := s.mkcolAll(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("MKCOL", dir+"/", nil, nil, 0)
+	// 405 if it exists already
+	if err != nil && !isHTTPStatus(err, http.StatusMethodNotAllowed) {
+		return fmt.Errorf("could not make collection %s: %w", dir, err)
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	s.dirs[dir] = true
+	return nil
+}
+
+var errWebDAVConflict = errors.New("changed on the server since it was listed (is something else writing to it?), so not overwritten")
+
+// Uploads with an OC-Checksum header (which ownCloud and Nextcloud check the
+// content against), only if the file is as listed - then checks the stored
+// size, and checksum where the server gives one.
+func (s *webdavStore) put(key string, r io.ReaderAt, size int64, sum []byte) error {
+	err := s.mkcolAll(path.Dir(key))
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return fmt.Errorf("could not hash: %w", err)
+	}
+	sha1Sum := "SHA1:" + hex.EncodeToString(h.Sum(nil))
+	headers := map[string]string{"OC-Checksum": sha1Sum, "Content-Type": "application/octet-stream"}
+	if etag, ok := s.etags[key]; ok && etag != "" {
+		headers["If-Match"] = etag
+	} else if !ok {
+		headers["If-None-Match"] = "*"
+	}
+	resp, err := s.do(http.MethodPut, key, headers, io.NewSectionReader(r, 0, size), size)
+	if isHTTPStatus(err, http.StatusPreconditionFailed) {
+		return errWebDAVConflict
+	}
+	if isHTTPStatus(err, http.StatusLocked) {
+		return fmt.Errorf("locked on the server (open elsewhere?): %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.etags[key] = resp.Header.Get("ETag")
+
+	res, err := s.propfind(key, "0")
+	if err != nil {
+		return fmt.Errorf("could not check upload: %w", err)
+	}
+	if len(res) != 1 {
+		return fmt.Errorf("could not check upload: %d resources in PROPFIND response", len(res))
+	}
+	if res[0].size != size {
+		return fmt.Errorf("upload check failed: stored as %d bytes, not %d", res[0].size, size)
+	}
+	for _, c := range strings.Fields(strings.Join(res[0].checksums, " ")) {
+		if strings.HasPrefix(strings.ToUpper(c), "SHA1:") && !strings.EqualFold(c, sha1Sum) {
+			return fmt.Errorf("upload check failed: server has checksum %s, not %s", c, sha1Sum)
+		}
+	}
+	if res[0].etag != "" {
+		s.etags[key] = res[0].etag
+	}
+	return nil
+}
+
+func (s *webdavStore) get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Also removes the collections which are left empty, as rsync --delete
+// would.
+func (s *webdavStore) delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0)
+	if err != nil && !isHTTPStatus(err, http.StatusNotFound) {
+		return err
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	delete(s.etags, key)
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		members, err := s.propfind(dir+"/", "1")
+		if err != nil || len(members) > 1 {
+			break
+		}
+		resp, err := s.do(http.MethodDelete, dir+"/", nil, nil, 0)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		delete(s.dirs, dir)
+	}
+	return nil
+}
+
+// Like checkFolder's smoke file check, since the folder may be on a drive
+// which is not mounted (or the URL may be wrong).
+func (s *webdavStore) checkSmokeFile() error {
+	_, err := s.propfind(smokeFilename, "0")
+	if isHTTPStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("smoke file check err (maybe not mounted?): %w", err)
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A daily time range, e.g. 01:00 to 05:00. End may be before Start, in which
+// case the window wraps past midnight.
+type timeWindow struct {
+	Start    string
+	End      string
+	Timezone string // IANA name, e.g. "Africa/Johannesburg". Local if blank.
+
+	start, end int // Minutes since midnight
+	loc        *time.Location
+}
+
+func (w *timeWindow) parse() error {
+	var err error
+	w.start, err = parseClock(w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	w.end, err = parseClock(w.End)
+	if err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	w.loc = time.Local
+	if w.Timezone != "" {
+		w.loc, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	return nil
+}
+
+// Parses HH:MM into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// The next time (after t) that the window opens.
+func (w timeWindow) nextStart(t time.Time) time.Time {
+	t = t.In(w.loc)
+	y, mo, d := t.Date()
+	next := time.Date(y, mo, d, w.start/60, w.start%60, 0, 0, w.loc)
+	if !next.After(t) {
+		next = time.Date(y, mo, d+1, w.start/60, w.start%60, 0, 0, w.loc)
+	}
+	return next
+}
+
+func (w timeWindow) String() string {
+	tz := w.Timezone
+	if tz == "" {
+		tz = "local"
+	}
+	return fmt.Sprintf("%s-%s (%s)", w.Start, w.End, tz)
+}
+
+// True if there are no windows configured, or t is in one of them. Otherwise,
+// gives the soonest time a window opens.
+func inAllowedWindow(windows []timeWindow, t time.Time) (bool, time.Time) {
+	if len(windows) == 0 {
+		return true, t
+	}
+	var soonest time.Time
+	for _, w := range windows {
+		if w.contains(t) {
+			return true, t
+		}
+		next := w.nextStart(t)
+		if soonest.IsZero() || next.Before(soonest) {
+			soonest = next
+		}
+	}
+	return false, soonest
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 )
@@ -83,3 +86,132 @@ func (lw *linesWriter) Lines() []string {
 
 	return lw.lines
 }
+
+var errLogCapExceeded = errors.New("log size cap exceeded - likely a runaway command")
+
+// The log, for commands' output. Once the log file is capped, output only goes
+// to stderr (unless the log isn't mirrored there), so that commands still
+// running - e.g. to clean up - aren't cut off by failing writes.
+type commandLog struct{}
+
+func (commandLog) Write(p []byte) (int, error) {
+	if logCap.IsExceeded() {
+		if logWriter == io.Writer(logCap) {
+			return len(p), nil
+		}
+		return os.Stderr.Write(p)
+	}
+	n, err := logWriter.Write(p)
+	if errors.Is(err, errLogCapExceeded) {
+		// Any stderr copy was written first
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Passes writes to Out until Max bytes (if > 0) have been written, after which
+// every write fails and Exceeded is closed.
+type capWriter struct {
+	Out io.Writer
+	Max int64
+
+	written  int64
+	exceeded chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+}
+
+func newCapWriter(out io.Writer) *capWriter {
+	return &capWriter{
+		Out:      out,
+		exceeded: make(chan struct{}),
+	}
+}
+
+func (cw *capWriter) Write(p []byte) (n int, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.Max > 0 && cw.written+int64(len(p)) > cw.Max {
+		cw.once.Do(func() { close(cw.exceeded) })
+		return 0, errLogCapExceeded
+	}
+	n, err = cw.Out.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *capWriter) SetMax(max int64) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.Max = max
+}
+
+// Closed once the cap is exceeded
+func (cw *capWriter) Exceeded() <-chan struct{} {
+	return cw.exceeded
+}
+
+func (cw *capWriter) IsExceeded() bool {
+	select {
+	case <-cw.exceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// Holds writes in memory until Open is called, since where the log file goes
+// is only known once the config is loaded.
+type pendingFile struct {
+	Path string // Set by Open
+
+	buf bytes.Buffer
+	f   *os.File
+	mu  sync.Mutex
+}
+
+func (pf *pendingFile) Write(p []byte) (n int, err error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f == nil {
+		return pf.buf.Write(p)
+	}
+	return pf.f.Write(p)
+}
+
+// Creates the file (and its dir), writing what was held so far.
+func (pf *pendingFile) Open(path string) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create log dir: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create log file %s: %w", path, err)
+	}
+	_, err = pf.buf.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not write log file %s: %w", path, err)
+	}
+	pf.f, pf.Path = f, path
+	return nil
+}
+
+func (pf *pendingFile) IsOpen() bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return pf.f != nil
+}
+
+func (pf *pendingFile) Close() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f == nil {
+		return nil
+	}
+	return pf.f.Close()
+}
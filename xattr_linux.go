@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	features = append(features, "xattr")
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, name, buf)
+	if err == unix.ERANGE {
+		// Bigger than most, so ask for its size
+		n, err = unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf = make([]byte, n)
+		n, err = unix.Getxattr(path, name, buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// The names of the file's xattrs.
+func listXattrs(path string) ([]string, error) {
+	n, err := unix.Listxattr(path, nil)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	n, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(string(buf[:n]), func(r rune) bool { return r == 0 }), nil
+}
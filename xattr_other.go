@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setXattr(path string, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func listXattrs(path string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
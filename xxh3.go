@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH3-64 (unseeded, with the default secret), as per xxhash.h's scalar code.
+// Not cryptographic, but much faster than the others, and fine for noticing
+// bitrot.
+
+const (
+	xxhPrime32_1 = 0x9E3779B1
+	xxhPrime32_2 = 0x85EBCA77
+	xxhPrime32_3 = 0xC2B2AE3D
+	xxhPrime64_1 = 0x9E3779B185EBCA87
+	xxhPrime64_2 = 0xC2B2AE3D27D4EB4F
+	xxhPrime64_3 = 0x165667B19E3779F9
+	xxhPrime64_4 = 0x85EBCA77C2B2AE63
+	xxhPrime64_5 = 0x27D4EB2F165667C5
+	xxhPrimeMx1  = 0x165667919E3779F9
+	xxhPrimeMx2  = 0x9FB21C651E98DF25
+
+	xxh3StripeLen = 64
+	// Stripes per block, each consuming 8 more bytes of the secret
+	xxh3StripesPerBlock = (len(xxh3Secret) - xxh3StripeLen) / 8
+	xxh3BlockLen        = xxh3StripeLen * xxh3StripesPerBlock
+	xxh3MidSizeMax      = 240
+)
+
+var xxh3Secret = [192]byte{
+	0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c,
+	0xde, 0xd4, 0x6d, 0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f,
+	0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0, 0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21,
+	0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0, 0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c,
+	0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b, 0x1b, 0x53, 0x2e, 0xa3,
+	0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac, 0xd8,
+	0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d,
+	0x8a, 0x51, 0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64,
+	0xea, 0xc5, 0xac, 0x83, 0x34, 0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb,
+	0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49, 0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e,
+	0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8, 0xd1, 0x7a, 0xd0, 0x31, 0xce,
+	0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b, 0x40, 0x7e,
+}
+
+func xxhLE32(b []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(b))
+}
+
+func xxhLE64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func xxhMulFold(a uint64, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func xxh64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxhPrime64_2
+	h ^= h >> 29
+	h *= xxhPrime64_3
+	h ^= h >> 32
+	return h
+}
+
+func xxh3Avalanche(h uint64) uint64 {
+	h ^= h >> 37
+	h *= xxhPrimeMx1
+	h ^= h >> 32
+	return h
+}
+
+func xxh3RRMXMX(h uint64, n uint64) uint64 {
+	h ^= bits.RotateLeft64(h, 49) ^ bits.RotateLeft64(h, 24)
+	h *= xxhPrimeMx2
+	h ^= (h >> 35) + n
+	h *= xxhPrimeMx2
+	return h ^ (h >> 28)
+}
+
+func xxh3Mix16(b []byte, secret []byte) uint64 {
+	return xxhMulFold(xxhLE64(b)^xxhLE64(secret), xxhLE64(b[8:])^xxhLE64(secret[8:]))
+}
+
+// The hash of input of up to 240 bytes, which is hashed whole.
+func xxh3Short(b []byte) uint64 {
+	s := xxh3Secret[:]
+	n := uint64(len(b))
+	switch {
+	case n == 0:
+		return xxh64Avalanche(xxhLE64(s[56:]) ^ xxhLE64(s[64:]))
+	case n <= 3:
+		combined := uint64(b[0])<<16 | uint64(b[n>>1])<<24 | uint64(b[n-1]) | n<<8
+		return xxh64Avalanche(combined ^ (xxhLE32(s) ^ xxhLE32(s[4:])))
+	case n <= 8:
+		input := xxhLE32(b[n-4:]) + xxhLE32(b)<<32
+		return xxh3RRMXMX(input^(xxhLE64(s[8:])^xxhLE64(s[16:])), n)
+	case n <= 16:
+		lo := xxhLE64(b) ^ (xxhLE64(s[24:]) ^ xxhLE64(s[32:]))
+		hi := xxhLE64(b[n-8:]) ^ (xxhLE64(s[40:]) ^ xxhLE64(s[48:]))
+		return xxh3Avalanche(n + bits.ReverseBytes64(lo) + hi + xxhMulFold(lo, hi))
+	case n <= 128:
+		acc := n * xxhPrime64_1
+		for i := (n - 1) / 32; ; i-- {
+			acc += xxh3Mix16(b[16*i:], s[32*i:])
+			acc += xxh3Mix16(b[n-16*(i+1):], s[32*i+16:])
+			if i == 0 {
+				break
+			}
+		}
+		return xxh3Avalanche(acc)
+	}
+	acc := n * xxhPrime64_1
+	for i := 0; i < 8; i++ {
+		acc += xxh3Mix16(b[16*i:], s[16*i:])
+	}
+	acc = xxh3Avalanche(acc)
+	end := xxh3Mix16(b[n-16:], s[136-17:])
+	for i := 8; i < len(b)/16; i++ {
+		end += xxh3Mix16(b[16*i:], s[16*(i-8)+3:])
+	}
+	return xxh3Avalanche(acc + end)
+}
+
+type xxh3Acc [8]uint64
+
+func (acc *xxh3Acc) stripe(b []byte, secret []byte) {
+	for i := 0; i < 8; i++ {
+		v := xxhLE64(b[8*i:])
+		k := v ^ xxhLE64(secret[8*i:])
+		acc[i^1] += v
+		acc[i] += uint64(uint32(k)) * (k >> 32)
+	}
+}
+
+func (acc *xxh3Acc) scramble() {
+	s := xxh3Secret[len(xxh3Secret)-xxh3StripeLen:]
+	for i := 0; i < 8; i++ {
+		a := acc[i]
+		a ^= a >> 47
+		a ^= xxhLE64(s[8*i:])
+		acc[i] = a * xxhPrime32_1
+	}
+}
+
+// A hash.Hash. Blocks are only consumed once more input follows them, since
+// the last stripe of the input is handled apart.
+type xxh3Hasher struct {
+	acc   xxh3Acc
+	buf   [xxh3BlockLen]byte
+	n     int // Bytes in buf
+	total uint64
+	// The end of the last block consumed, for a last stripe overlapping it
+	tail [xxh3StripeLen]byte
+}
+
+func newXXH3() hash.Hash {
+	h := &xxh3Hasher{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh3Hasher) Size() int      { return 8 }
+func (h *xxh3Hasher) BlockSize() int { return xxh3StripeLen }
+
+func (h *xxh3Hasher) Reset() {
+	*h = xxh3Hasher{acc: xxh3Acc{xxhPrime32_3, xxhPrime64_1, xxhPrime64_2, xxhPrime64_3, xxhPrime64_4, xxhPrime32_2, xxhPrime64_5, xxhPrime32_1}}
+}
+
+func (h *xxh3Hasher) block(b []byte) {
+	for i := 0; i < xxh3StripesPerBlock; i++ {
+		h.acc.stripe(b[i*xxh3StripeLen:], xxh3Secret[8*i:])
+	}
+	h.acc.scramble()
+}
+
+func (h *xxh3Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	for len(p) > 0 {
+		if h.n == xxh3BlockLen {
+			h.block(h.buf[:])
+			copy(h.tail[:], h.buf[xxh3BlockLen-xxh3StripeLen:])
+			h.n = 0
+		}
+		// Whole blocks with more input after them are consumed in place
+		if h.n == 0 && len(p) > xxh3BlockLen {
+			h.block(p[:xxh3BlockLen])
+			copy(h.tail[:], p[xxh3BlockLen-xxh3StripeLen:xxh3BlockLen])
+			p = p[xxh3BlockLen:]
+			continue
+		}
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (h *xxh3Hasher) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.sum64())
+}
+
+func (h *xxh3Hasher) sum64() uint64 {
+	if h.total <= xxh3MidSizeMax {
+		return xxh3Short(h.buf[:h.n])
+	}
+	acc := h.acc
+	stripes := (h.n - 1) / xxh3StripeLen
+	for i := 0; i < stripes; i++ {
+		acc.stripe(h.buf[i*xxh3StripeLen:], xxh3Secret[8*i:])
+	}
+	var last [xxh3StripeLen]byte
+	if h.n >= xxh3StripeLen {
+		copy(last[:], h.buf[h.n-xxh3StripeLen:h.n])
+	} else {
+		copy(last[:], h.tail[h.n:])
+		copy(last[xxh3StripeLen-h.n:], h.buf[:h.n])
+	}
+	acc.stripe(last[:], xxh3Secret[len(xxh3Secret)-xxh3StripeLen-7:])
+
+	result := h.total * xxhPrime64_1
+	s := xxh3Secret[11:]
+	for i := 0; i < 4; i++ {
+		result += xxhMulFold(acc[2*i]^xxhLE64(s[16*i:]), acc[2*i+1]^xxhLE64(s[16*i+8:]))
+	}
+	return xxh3Avalanche(result)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Input of the given length, as xxhsum's sanity check generates it (with its
+// own primes, not quite xxhash's).
+func xxh3Input(n int) []byte {
+	b := make([]byte, n)
+	gen := uint64(2654435761)
+	for i := range b {
+		b[i] = byte(gen >> 56)
+		gen *= 11400714785074694797
+	}
+	return b
+}
+
+// From xxhsum's sanity check (where it has the length), else as hashed by
+// the reference xxhash.h, over the short, mid size, block and multi-block
+// paths and their boundaries.
+var xxh3Vectors = []struct {
+	n    int
+	want uint64
+}{
+	{0, 0x2d06800538d394c2},
+	{1, 0xc44bdff4074eecdb},
+	{3, 0x54247382a8d6b94d},
+	{4, 0xe5dc74bc51848a51},
+	{8, 0x24ccc9acaa9f65e4},
+	{9, 0x14d5001c15dd3f2b},
+	{16, 0x981b17d36c7498c9},
+	{17, 0x796f5acd3a60f862},
+	{128, 0xfcff24126754d861},
+	{129, 0x98f1b0a679a2ca29},
+	{240, 0x81c3c2b67f568ccf},
+	{241, 0xc5a639ecd2030e5e},
+	{1024, 0xdd85c9b5c1109c5c},
+	{1025, 0xd870c0fa13211c6a},
+	{2048, 0xdd59e2c3a5f038e0},
+	{2240, 0x6e73a90539cf2948},
+	{2367, 0xcb37aeb9e5d361ed},
+	{4096, 0xe91206429d1f48f9},
+	{8<<20 + 1, 0x78aae7b2ce83311a},
+}
+
+func TestXXH3(t *testing.T) {
+	for _, tc := range xxh3Vectors {
+		in := xxh3Input(tc.n)
+		h := newXXH3()
+		h.Write(in)
+		got := binary.BigEndian.Uint64(h.Sum(nil))
+		if got != tc.want {
+			t.Errorf("XXH3 of %d bytes = %016x, want %016x", tc.n, got, tc.want)
+		}
+
+		// Written in pieces which don't line up with the stripes or blocks
+		h.Reset()
+		for p := in; len(p) > 0; {
+			n := min(len(p), 1000)
+			h.Write(p[:n])
+			p = p[n:]
+		}
+		got = binary.BigEndian.Uint64(h.Sum(nil))
+		if got != tc.want {
+			t.Errorf("XXH3 of %d bytes in pieces = %016x, want %016x", tc.n, got, tc.want)
+		}
+	}
+}
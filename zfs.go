@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// For in folders on ZFS datasets (backed up from a snapshot, if Snapshot is
+// on), and out folders given as zfs:pool/dataset or
+// zfs://[user@]host[:port]/pool/dataset, which the in folder's dataset is
+// sent to with zfs send | zfs recv, rather than synced.
+type zfsConfig struct {
+	// Back up (and verify) in folders on ZFS datasets from a snapshot taken
+	// for the run, which is destroyed after it.
+	Snapshot bool
+
+	// The binary to run (default zfs), on this host and the out host, and
+	// extra args for zfs send and zfs recv (e.g. ["-w"], to send encrypted
+	// datasets raw).
+	Path     string
+	SendArgs []string
+	RecvArgs []string
+	// For zfs: outputs, the newest snapshots kept on the out dataset (0 keeps
+	// all). The in dataset only keeps the newest, as the base for the next
+	// (incremental) send.
+	Keep int
+}
+
+const (
+	zfsScheme = "zfs:"
+	// Snapshots taken to back up from (and destroyed after the run), and those
+	// sent to a zfs: output (kept as the base for the next send)
+	zfsRunPrefix  = "backup-helper-run-"
+	zfsSendPrefix = "backup-helper-send-"
+)
+
+// The prefix of the snapshots sent to d, e.g. backup-helper-send-1a2b3c4d-.
+// Each output has its own, so that pruning for one never destroys the base
+// of another.
+func (d zfsDest) snapPrefix() string {
+	sum := sha256.Sum256([]byte(d.String()))
+	return zfsSendPrefix + hex.EncodeToString(sum[:4]) + "-"
+}
+
+func validateZFS(c *config) error {
+	if c.ZFS.Keep < 0 {
+		return fmt.Errorf("ZFS Keep must not be negative, not %d", c.ZFS.Keep)
+	}
+	return nil
+}
+
+// A dataset to receive into: on this host, or over ssh.
+type zfsDest struct {
+	host    string // [user@]host, or blank for this host
+	port    string
+	dataset string
+}
+
+func (d zfsDest) String() string {
+	if d.host == "" {
+		return d.dataset
+	}
+	return d.host + ":" + d.dataset
+}
+
+// The dataset to receive into, if out is a zfs destination.
+func zfsTarget(out string) (zfsDest, bool, error) {
+	if strings.HasPrefix(out, "zfs://") {
+		u, err := url.Parse(out)
+		if err != nil {
+			return zfsDest{}, true, err
+		}
+		d := zfsDest{host: u.Hostname(), port: u.Port(), dataset: strings.Trim(u.Path, "/")}
+		if u.User != nil {
+			d.host = u.User.Username() + "@" + d.host
+		}
+		if d.host == "" || d.dataset == "" {
+			return zfsDest{}, true, errors.New("zfs:// needs a host and dataset, e.g. zfs://backup@nas/tank/backup")
+		}
+		return d, true, nil
+	}
+	dataset, ok := strings.CutPrefix(out, zfsScheme)
+	if !ok {
+		return zfsDest{}, false, nil
+	}
+	dataset = strings.Trim(dataset, "/")
+	if dataset == "" {
+		return zfsDest{}, true, errors.New("no dataset given after zfs:")
+	}
+	return zfsDest{dataset: dataset}, true, nil
+}
+
+func isZFS(out string) bool {
+	_, ok, _ := zfsTarget(out)
+	return ok
+}
+
+// The command to run zfs with the args: on the host over ssh, if not blank.
+func zfsCommand(d zfsDest, args []string) (string, []string) {
+	if d.host == "" {
+		return cfg.ZFS.Path, args
+	}
+	return remoteCommand(d.host, d.port, cfg.ZFS.Path, args)
+}
+
+// Runs zfs for its output (e.g. of zfs list), as lines.
+func zfsQuery(d zfsDest, args ...string) ([]string, error) {
+	name, argv := zfsCommand(d, args)
+	return commandLines("zfs "+args[0], name, argv...)
+}
+
+// Runs zfs for what it does (e.g. zfs snapshot), adding its output to the
+// report if it fails.
+func zfsRun(r *report, d zfsDest, args ...string) error {
+	name, argv := zfsCommand(d, args)
+	lines, err := execCommand("zfs:"+args[0], name, argv...)
+	if err != nil {
+		addExecSection(r, "zfs "+args[0], lines, name, argv...)
+	}
+	return err
+}
+
+// As zfsRun, but for cleaning up (see execCleanup).
+func zfsCleanup(r *report, d zfsDest, args ...string) error {
+	name, argv := zfsCommand(d, args)
+	lines, err := execCleanup("zfs:"+args[0], name, argv...)
+	if err != nil {
+		addExecSection(r, "zfs "+args[0], lines, name, argv...)
+	}
+	return err
+}
+
+// The dataset dir is on, and its mountpoint.
+func zfsDataset(dir string) (string, string, error) {
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	lines, err := zfsQuery(zfsDest{}, "list", "-H", "-o", "name,mountpoint", abs)
+	if err != nil {
+		return "", "", err
+	}
+	name, mountpoint, ok := strings.Cut(lines[0], "\t")
+	if !ok {
+		return "", "", fmt.Errorf("could not parse zfs list: %q", lines[0])
+	}
+	if !filepath.IsAbs(mountpoint) {
+		return "", "", fmt.Errorf("dataset %s is mounted as %s, so its snapshots can't be read", name, mountpoint)
+	}
+	return name, mountpoint, nil
+}
+
+// A snapshot, as listed by zfs list -o name,guid.
+type zfsSnapshot struct {
+	name string // After the @
+	guid string
+}
+
+// The dataset's snapshots with the prefix, oldest first.
+func zfsSnapshots(d zfsDest, prefix string) ([]zfsSnapshot, error) {
+	lines, err := zfsQuery(d, "list", "-H", "-p", "-o", "name,guid", "-t", "snapshot", "-d", "1", "-s", "createtxg", d.dataset)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []zfsSnapshot
+	for _, l := range lines {
+		full, guid, _ := strings.Cut(l, "\t")
+		_, name, _ := strings.Cut(full, "@")
+		if strings.HasPrefix(name, prefix) {
+			snaps = append(snaps, zfsSnapshot{name: name, guid: guid})
+		}
+	}
+	return snaps, nil
+}
+
+// Fails if there are datasets mounted within dir, which a snapshot of the
+// dataset would show as empty folders - and so delete from the backup.
+func checkChildDatasets(dataset string, dir string) error {
+	lines, err := zfsQuery(zfsDest{}, "list", "-H", "-o", "name,mountpoint", "-r", dataset)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		name, mountpoint, _ := strings.Cut(l, "\t")
+		rel, err := filepath.Rel(dir, mountpoint)
+		if name == dataset || err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		return fmt.Errorf("dataset %s is mounted within it (at %s), and would be missing from the snapshot - back up each dataset on its own (e.g. as a job)", name, mountpoint)
+	}
+	return nil
+}
+
+func snapshotZFS(r *report, p folderPair) (folderPair, func() error, error) {
+	noop := func() error { return nil }
+	dataset, mountpoint, err := zfsDataset(p.In)
+	if err != nil {
+		logger.Info("in folder not on a ZFS dataset, so not snapshotting it", "in", p.In, "err", err.Error())
+		r.Sections = append(r.Sections, section{
+			Title:  "Snapshot skipped",
+			Detail: fmt.Sprintf("%s does not seem to be on a ZFS dataset (%s), so it was backed up as it is.", p.In, err),
+		})
+		return p, noop, nil
+	}
+	abs, _ := filepath.Abs(p.In)
+	abs, _ = filepath.EvalSymlinks(abs)
+	err = checkChildDatasets(dataset, abs)
+	if err != nil {
+		return p, noop, withExitCode(exitConfig, fmt.Errorf("in folder: %w", err))
+	}
+	rel, err := filepath.Rel(mountpoint, abs)
+	if err != nil {
+		return p, noop, err
+	}
+	name := zfsRunPrefix + time.Now().UTC().Format(logDateFormat)
+	dir := filepath.Join(mountpoint, ".zfs", "snapshot", name, rel)
+	if cfg.dryRun {
+		r.Sections = append(r.Sections, section{
+			Title:  "Snapshot (dry run)",
+			Detail: fmt.Sprintf("Would snapshot %s as %s@%s, and back up from %s.", p.In, dataset, name, dir),
+		})
+		return p, noop, nil
+	}
+
+	src := zfsDest{dataset: dataset}
+	err = zfsRun(r, src, "snapshot", dataset+"@"+name)
+	if err != nil {
+		return p, noop, withExitCode(exitFolderCheck, fmt.Errorf("could not snapshot %s: %w", dataset, err))
+	}
+	logger.Info("snapshot taken", "snapshot", dataset+"@"+name, "dir", dir)
+	setSnapshotDir(dir, true)
+	r.Sections = append(r.Sections, section{
+		Title:  "Snapshot taken",
+		Detail: "The in folder was snapshotted, and backed up (and verified) from the snapshot, which is destroyed after the backup.",
+		LogLines: []string{
+			fmt.Sprintf("snapshot: %s@%s", dataset, name),
+			fmt.Sprintf("backed up from: %s", dir),
+		},
+	})
+	p.Live, p.In = p.In, dir
+
+	destroyed := false
+	return p, func() error {
+		if destroyed {
+			return nil
+		}
+		destroyed = true
+		setSnapshotDir(dir, false)
+		err := zfsCleanup(r, src, "destroy", dataset+"@"+name)
+		if err != nil {
+			return fmt.Errorf("could not destroy snapshot %s@%s: %w", dataset, name, err)
+		}
+		logger.Info("snapshot destroyed", "snapshot", dataset+"@"+name)
+		return nil
+	}, nil
+}
+
+// The zfs send and zfs recv args, to send the snapshot (incrementally from
+// base, if not blank) to d.
+func zfsSendArgs(dataset string, snap string, base string, d zfsDest) ([]string, []string) {
+	send := append([]string{"send"}, cfg.ZFS.SendArgs...)
+	recv := []string{"recv", "-u"}
+	if base != "" {
+		// Roll back any changes to the out dataset since base was received
+		send = append(send, "-i", "@"+base)
+		recv = append(recv, "-F")
+	}
+	send = append(send, dataset+"@"+snap)
+	recv = append(append(recv, cfg.ZFS.RecvArgs...), d.dataset)
+	return send, recv
+}
+
+// Sends a new snapshot of the in folder (which must be a dataset's
+// mountpoint) to the out dataset, incrementally from the newest snapshot both
+// have. The snapshot is taken as it is prepared, and backed up (and verified
+// with cshatag, read only) from.
+type zfsBackend struct {
+	d                   zfsDest
+	src                 zfsDest
+	dataset, mountpoint string
+	base                string // Blank to send in full
+	snap                string // Set once taken
+	received            bool
+}
+
+func openZFS(out string, st *state) (backend, error) {
+	d, _, err := zfsTarget(out)
+	if err != nil {
+		return nil, err
+	}
+	return &zfsBackend{d: d}, nil
+}
+
+func (b *zfsBackend) Prepare(r *report, p folderPair) (folderPair, error) {
+	d := b.d
+	dataset, mountpoint, err := zfsDataset(p.In)
+	if err != nil {
+		return p, withExitCode(exitConfig, fmt.Errorf("in folder: %w", err))
+	}
+	abs, _ := filepath.Abs(p.In)
+	abs, _ = filepath.EvalSymlinks(abs)
+	if abs != mountpoint {
+		return p, withExitCode(exitConfig, fmt.Errorf("in folder: zfs: outputs get the whole dataset, so the in folder must be the mountpoint of %s (%s)", dataset, mountpoint))
+	}
+	b.dataset, b.mountpoint, b.src = dataset, mountpoint, zfsDest{dataset: dataset}
+
+	// Find the base: the newest snapshot sent before which the out dataset
+	// still has
+	sent, err := zfsSnapshots(b.src, d.snapPrefix())
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("in folder: %w", err))
+	}
+	received, err := zfsSnapshots(d, d.snapPrefix())
+	exists := err == nil
+	if err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out: %w", err))
+	}
+	for _, s := range sent {
+		if slices.ContainsFunc(received, func(rs zfsSnapshot) bool { return rs.guid == s.guid }) {
+			b.base = s.name
+		}
+	}
+	if exists && b.base == "" {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("out: %s has no snapshot in common with %s, so it can't be sent to incrementally - destroy it (zfs destroy -r) to send it in full", d, dataset))
+	}
+	checked := []string{fmt.Sprintf("%s: OK (dataset %s)", p.In, dataset)}
+	if exists {
+		checked = append(checked, fmt.Sprintf("%s: OK (has %s@%s)", d, d.dataset, b.base))
+	} else {
+		checked = append(checked, fmt.Sprintf("%s: does not exist yet, so the dataset is sent in full", d))
+	}
+	r.Sections = append(r.Sections, section{
+		Title: "Folders checked",
+		Detail: `This test tries to write, read, and delete a temporary file
+		in the input folder, and checks for its .backup-helper-check file. It
+		then lists the snapshots of the output dataset.`,
+		LogLines: checked,
+	})
+	if cfg.dryRun {
+		return p, nil
+	}
+
+	snap := d.snapPrefix() + time.Now().UTC().Format(logDateFormat)
+	err = zfsRun(r, b.src, "snapshot", dataset+"@"+snap)
+	if err != nil {
+		return p, withExitCode(exitFolderCheck, fmt.Errorf("could not snapshot %s: %w", dataset, err))
+	}
+	b.snap = snap
+	snapDir := filepath.Join(mountpoint, ".zfs", "snapshot", snap)
+	setSnapshotDir(snapDir, true)
+	p.Live, p.In = p.In, snapDir
+	return p, nil
+}
+
+func (b *zfsBackend) Verify(r *report, rec *historyRecord, p folderPair) error {
+	return verifyInput(r, rec, p, "sent")
+}
+
+func (b *zfsBackend) Sync(r *report, rec *historyRecord, p folderPair) error {
+	d, dataset, src := b.d, b.dataset, b.src
+	how := "in full"
+	if b.base != "" {
+		how = "incrementally from @" + b.base
+	}
+	if cfg.dryRun {
+		r.Sections = append(r.Sections, section{
+			Title:  "Send (dry run)",
+			Detail: fmt.Sprintf("Would snapshot %s as @%s, and send it %s to %s.", dataset, d.snapPrefix()+time.Now().UTC().Format(logDateFormat), how, d),
+		})
+		return nil
+	}
+
+	snap := b.snap
+	sendArgs, recvArgs := zfsSendArgs(dataset, snap, b.base, d)
+	start := time.Now()
+	name, argv := zfsCommand(d, recvArgs)
+	n, err := sendStream("zfs send", append([]string{cfg.ZFS.Path}, sendArgs...), "zfs recv", append([]string{name}, argv...))
+	recordStep("zfs send", append([]string{cfg.ZFS.Path}, sendArgs...), start, err)
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("zfs send to %s failed: %w", d, err))
+	}
+	rec.BytesSent += uint64(n)
+
+	// The received snapshot must be the one sent
+	received, err := zfsSnapshots(d, d.snapPrefix())
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("could not list %s: %w", d, err))
+	}
+	sent, err := zfsSnapshots(src, d.snapPrefix())
+	if err != nil {
+		return withExitCode(exitRsync, fmt.Errorf("could not list %s: %w", dataset, err))
+	}
+	i := slices.IndexFunc(received, func(s zfsSnapshot) bool { return s.name == snap })
+	j := slices.IndexFunc(sent, func(s zfsSnapshot) bool { return s.name == snap })
+	if i < 0 || j < 0 || received[i].guid != sent[j].guid {
+		return withExitCode(exitRsync, fmt.Errorf("%s@%s was not received as sent", d.dataset, snap))
+	}
+	b.received = true
+
+	// Prune: the in dataset only needs the new snapshot, as the next base
+	lines := []string{
+		fmt.Sprintf("sent %s@%s %s (%s)", dataset, snap, how, humanBytes(float64(n))),
+		fmt.Sprintf("received %s@%s (guid %s, as sent)", d.dataset, snap, sent[j].guid),
+	}
+	var errs []error
+	for _, s := range sent[:j] {
+		err := zfsRun(r, src, "destroy", dataset+"@"+s.name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("destroyed %s@%s", dataset, s.name))
+	}
+	if cfg.ZFS.Keep > 0 && len(received) > cfg.ZFS.Keep {
+		for _, s := range received[:len(received)-cfg.ZFS.Keep] {
+			err := zfsRun(r, d, "destroy", d.dataset+"@"+s.name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("destroyed %s@%s", d, s.name))
+		}
+	}
+	if len(cfg.Excludes) > 0 || len(p.Excludes) > 0 {
+		lines = append(lines, "Excludes are not applied, since the whole dataset is sent")
+	}
+	lines = append(lines, "<end of logs>")
+	r.Sections = append(r.Sections, section{
+		Title:    fmt.Sprintf("zfs send from %s to %s", dataset, d),
+		Detail:   fmt.Sprintf("[%s %s | %s %s]. %s", cfg.ZFS.Path, strings.Join(sendArgs, " "), name, strings.Join(argv, " "), throughput(uint64(n), time.Since(start))),
+		LogLines: lines,
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("could not prune snapshots: %w", errors.Join(errs...))
+	}
+	logger.Info("dataset sent", "in", p.live(), "out", d.String())
+	return nil
+}
+
+// Until it is received, the new snapshot is destroyed.
+func (b *zfsBackend) Cleanup(r *report) error {
+	if b.snap == "" {
+		return nil
+	}
+	setSnapshotDir(filepath.Join(b.mountpoint, ".zfs", "snapshot", b.snap), false)
+	if b.received {
+		return nil
+	}
+	return zfsCleanup(r, b.src, "destroy", b.dataset+"@"+b.snap)
+}